@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	accessLogMu sync.Mutex
+	accessLog   io.Writer
+)
+
+// openAccessLog writes to stdout for "-", otherwise to a file rotated with
+// the same size/age/backup settings as the main log.
+func openAccessLog(path string) error {
+	if path == "-" {
+		accessLog = os.Stdout
+		return nil
+	}
+	c := conf().Log
+	c.File = path
+	w, err := newRotatingWriter(c)
+	if err != nil {
+		return err
+	}
+	accessLog = w
+	return nil
+}
+
+// writeAccessLog emits one line per finished session in a fixed field
+// order, similar in spirit to HAProxy's TCP log:
+//
+//	start src dst backend bytes_in bytes_out duration_ms cause conn_id
+//
+// Empty fields are written as "-" so the column count never changes.
+func writeAccessLog(s *session) {
+	if accessLog == nil {
+		return
+	}
+	end := time.Now()
+	s.mu.Lock()
+	listen, target, _ := strings.Cut(s.route, "->")
+	backend := s.backend
+	if backend == "" {
+		backend = target
+	}
+	line := fmt.Sprintf("%s %s %s %s %d %d %d %s %s\n",
+		s.start.UTC().Format("2006-01-02T15:04:05.000Z07:00"),
+		anonAddr(s.client.RemoteAddr().String()),
+		orDash(listen),
+		orDash(backend),
+		s.bytesIn.Load(),
+		s.bytesOut.Load(),
+		end.Sub(s.start).Milliseconds(),
+		orDash(s.closeReason),
+		s.id,
+	)
+	s.mu.Unlock()
+	accessLogMu.Lock()
+	defer accessLogMu.Unlock()
+	if _, err := io.WriteString(accessLog, line); err != nil {
+		warnf("failed to write access log: %v", err)
+		reportError(err, "failed to write access log")
+	}
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+var (
+	adminMux      = http.NewServeMux()
+	listenerBound atomic.Bool
+)
+
+func init() {
+	adminMux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text") {
+			w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+			writePrometheus(w, true)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writePrometheus(w, false)
+	})
+	adminMux.HandleFunc("/debug/vars", opsAuth(expvar.Handler().ServeHTTP))
+	adminMux.HandleFunc("/loglevel", opsAuth(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost || r.Method == http.MethodPut {
+			l, err := parseLogLevel(r.FormValue("level"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			setLogLevel(l)
+			infof("log level set to %s via admin endpoint", l)
+			auditf("log level set to %s by %s", l, adminActor(r))
+		}
+		fmt.Fprintln(w, getLogLevel())
+	}))
+	adminMux.HandleFunc("/canary", opsAuth(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost || r.Method == http.MethodPut {
+			p, err := strconv.ParseFloat(r.FormValue("percent"), 64)
+			if err != nil || p < 0 || p > 100 {
+				http.Error(w, "percent must be a number from 0 to 100", http.StatusBadRequest)
+				return
+			}
+			setCanaryPercent(p)
+			infof("canary share set to %g%% via admin endpoint", p)
+			auditf("canary share set to %g%% by %s", p, adminActor(r))
+		}
+		fmt.Fprintf(w, "%g\n", getCanaryPercent())
+	}))
+	adminMux.HandleFunc("/hexdump", opsAuth(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost || r.Method == http.MethodPut {
+			list := strings.FieldsFunc(r.FormValue("ips"), func(c rune) bool { return c == ',' || c == ' ' })
+			if err := setHexdumpTargets(list); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			infof("hexdump sources set to %v via admin endpoint", list)
+			auditf("hexdump sources set to %v by %s", list, adminActor(r))
+		}
+		fmt.Fprintln(w, strings.Join(hexdumpTargets(), ","))
+	}))
+	adminMux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	adminMux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !listenerBound.Load() {
+			http.Error(w, "listener not bound", http.StatusServiceUnavailable)
+			return
+		}
+		// ?backends=false only asks about the listener, for the healthcheck
+		if r.URL.Query().Get("backends") != "false" && !anyBackendHealthy() {
+			http.Error(w, "no healthy backend", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ready")
+	})
+
+	expvar.Publish("goroutines", expvar.Func(func() any {
+		return runtime.NumGoroutine()
+	}))
+	expvar.Publish("logged_ips", expvar.Func(func() any {
+		return loggedIPs.len()
+	}))
+	expvar.Publish("notify_queue_depth", expvar.Func(func() any {
+		return notifyQueueDepth()
+	}))
+	expvar.Publish("active_sessions", expvar.Func(func() any {
+		sessionsMu.Lock()
+		defer sessionsMu.Unlock()
+		return len(sessions)
+	}))
+	expvar.Publish("maintenance", expvar.Func(func() any {
+		return inMaintenance()
+	}))
+}
+
+func startAdmin(addr string) {
+	if conf().Admin.Pprof {
+		adminMux.HandleFunc("/debug/pprof/", opsAuth(pprof.Index))
+		adminMux.HandleFunc("/debug/pprof/cmdline", opsAuth(pprof.Cmdline))
+		adminMux.HandleFunc("/debug/pprof/profile", opsAuth(pprof.Profile))
+		adminMux.HandleFunc("/debug/pprof/symbol", opsAuth(pprof.Symbol))
+		adminMux.HandleFunc("/debug/pprof/trace", opsAuth(pprof.Trace))
+		infof("pprof enabled on admin endpoint\n")
+	}
+	l, err := listen("tcp", addr)
+	if err != nil {
+		errorf("admin endpoint failed to listen on %s: %v\n", addr, err)
+		return
+	}
+	infof("admin endpoint listening on %s\n", addr)
+	go func() {
+		if err := http.Serve(l, adminMux); err != nil && !handedOver.Load() {
+			errorf("admin endpoint on %s stopped: %v\n", addr, err)
+		}
+	}()
+}
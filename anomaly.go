@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Spike detection looks at the connection rate as a whole, so a scan
+// spread over many addresses shows up even though no single one does
+// anything unusual. Accepted connections are counted per interval and
+// compared with the mean and standard deviation of the intervals before.
+var (
+	spikeMu       sync.Mutex
+	spikeCount    int
+	spikeSources  = map[string]int{}
+	spikeHistory  []float64
+	spikeAlerting bool
+)
+
+// spikeMaxSources caps how many distinct sources one interval remembers,
+// since a large scan is exactly when this would otherwise grow.
+const spikeMaxSources = 10000
+
+func noteSpikeConnection(ip string) {
+	spikeMu.Lock()
+	defer spikeMu.Unlock()
+	spikeCount++
+	src := anonIP(ip)
+	if _, ok := spikeSources[src]; ok || len(spikeSources) < spikeMaxSources {
+		spikeSources[src]++
+	}
+}
+
+func meanStddev(xs []float64) (float64, float64) {
+	var sum float64
+	for _, x := range xs {
+		sum += x
+	}
+	mean := sum / float64(len(xs))
+	var sq float64
+	for _, x := range xs {
+		sq += (x - mean) * (x - mean)
+	}
+	return mean, math.Sqrt(sq / float64(len(xs)))
+}
+
+// isSpike applies anomaly.factor and anomaly.zscore, either of which is
+// enough; a flat baseline has no spread, so the z-score is skipped then.
+func isSpike(c AnomalyConfig, current, mean, stddev float64) bool {
+	if current < float64(c.MinConnections) {
+		return false
+	}
+	if c.Factor > 0 && current >= c.Factor*math.Max(mean, 1) {
+		return true
+	}
+	return c.ZScore > 0 && stddev > 0 && (current-mean)/stddev >= c.ZScore
+}
+
+func runSpikeDetection(c AnomalyConfig) {
+	window := int(c.Baseline.Duration / c.Interval.Duration)
+	// wait for a usable baseline before judging anything
+	warmup := window / 4
+	if warmup < 3 {
+		warmup = 3
+	}
+	for range time.Tick(c.Interval.Duration) {
+		spikeMu.Lock()
+		current := float64(spikeCount)
+		sources := spikeSources
+		spikeCount = 0
+		spikeSources = map[string]int{}
+		history := spikeHistory
+		alerting := spikeAlerting
+		spikeMu.Unlock()
+
+		if len(history) < warmup {
+			spikeMu.Lock()
+			spikeHistory = append(spikeHistory, current)
+			spikeMu.Unlock()
+			continue
+		}
+		mean, stddev := meanStddev(history)
+		spike := isSpike(c, current, mean, stddev)
+		spikeMu.Lock()
+		spikeAlerting = spike
+		// a spike stays out of the baseline, or a long one would become normal
+		if !spike {
+			spikeHistory = append(spikeHistory, current)
+			if len(spikeHistory) > window {
+				spikeHistory = spikeHistory[len(spikeHistory)-window:]
+			}
+		}
+		spikeMu.Unlock()
+
+		switch {
+		case spike && !alerting:
+			alertSpike(c, current, mean, stddev, sources)
+		case !spike && alerting:
+			infof("connection rate back to normal: %.0f per %s\n", current, c.Interval.Duration)
+			if err := sendAlert(alertVars{"connections": current, "baseline": mean}, "Connection Rate Normal", fmt.Sprintf("%.0f connections in the last %s, baseline %.1f", current, c.Interval.Duration, mean), 0x008000); err != nil {
+				warnf("Failed to send Discord embed: %v", err)
+			}
+		}
+	}
+}
+
+func alertSpike(c AnomalyConfig, current, mean, stddev float64, sources map[string]int) {
+	z := "n/a"
+	if stddev > 0 {
+		z = strconv.FormatFloat((current-mean)/stddev, 'f', 1, 64)
+	}
+	warnf("connection spike: %.0f per %s against a baseline of %.1f (z %s) from %d sources\n", current, c.Interval.Duration, mean, z, len(sources))
+	fields := []*DiscordEmbedField{
+		{Name: "Connections", Value: fmt.Sprintf("%.0f in %s", current, c.Interval.Duration), Inline: true},
+		{Name: "Baseline", Value: fmt.Sprintf("%.1f ± %.1f", mean, stddev), Inline: true},
+		{Name: "Z-Score", Value: z, Inline: true},
+		{Name: "Unique Sources", Value: strconv.Itoa(len(sources)), Inline: true},
+	}
+	if len(sources) > 0 {
+		fields = append(fields, &DiscordEmbedField{Name: "Top Sources", Value: topSources(sources, 5)})
+	}
+	if err := sendAlert(alertVars{"connections": current, "baseline": mean, "stddev": stddev, "sources": len(sources)}, "Connection Spike", fmt.Sprintf("Connection rate is well above its usual level (%.0f vs %.1f per %s)", current, mean, c.Interval.Duration), 0xFFA500, fields...); err != nil {
+		warnf("Failed to send Discord embed: %v", err)
+	}
+}
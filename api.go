@@ -0,0 +1,414 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The REST API lives under /api/v1 on the admin listener. Unlike the
+// older plain-text endpoints it's only served once credentials are
+// configured; see auth.go.
+
+func init() {
+	adminMux.HandleFunc("GET /api/v1/sessions", tenantAPI(apiSessions))
+	adminMux.HandleFunc("GET /api/v1/sessions/{id}", tenantAPI(apiSession))
+	adminMux.HandleFunc("DELETE /api/v1/sessions/{id}", tenantAPI(apiKillSession))
+	adminMux.HandleFunc("POST /api/v1/sessions/{id}/tags", tenantAPI(apiAddTags))
+	adminMux.HandleFunc("DELETE /api/v1/sessions/{id}/tags/{tag}", tenantAPI(apiRemoveTag))
+	adminMux.HandleFunc("GET /api/v1/history", tenantAPI(apiHistory))
+	adminMux.HandleFunc("GET /api/v1/stats", apiAuth(apiStats))
+	adminMux.HandleFunc("GET /api/v1/backends", apiAuth(apiBackends))
+	adminMux.HandleFunc("GET /api/v1/bans", apiAuth(apiListBans))
+	adminMux.HandleFunc("POST /api/v1/bans", apiAuth(apiAddBan))
+	adminMux.HandleFunc("DELETE /api/v1/bans/{ip}", apiAuth(apiRemoveBan))
+	adminMux.HandleFunc("GET /api/v1/config", apiAuth(apiConfig))
+	adminMux.HandleFunc("POST /api/v1/reload", apiAuth(apiReload))
+	adminMux.HandleFunc("GET /api/v1/traffic", apiAuth(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, throughputSamples())
+	}))
+	adminMux.HandleFunc("GET /api/v1/alerts", apiAuth(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, recentAlertList())
+	}))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func apiError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+type sessionInfo struct {
+	ID         string    `json:"id"`
+	Tenant     string    `json:"tenant,omitempty"`
+	Src        string    `json:"src"`
+	Backend    string    `json:"backend,omitempty"`
+	Started    time.Time `json:"started"`
+	AgeSeconds float64   `json:"age_seconds"`
+	BytesIn    int64     `json:"bytes_in"`
+	BytesOut   int64     `json:"bytes_out"`
+	Country    string    `json:"country,omitempty"`
+	Tags       []string  `json:"tags,omitempty"`
+}
+
+func (s *session) info() sessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sessionInfo{
+		ID:         s.id,
+		Tenant:     s.tenant,
+		Src:        anonAddr(s.client.RemoteAddr().String()),
+		Backend:    s.backend,
+		Started:    s.start.UTC(),
+		AgeSeconds: time.Since(s.start).Seconds(),
+		BytesIn:    s.bytesIn.Load(),
+		BytesOut:   s.bytesOut.Load(),
+		Country:    s.geo.Country,
+		Tags:       append([]string(nil), s.tags...),
+	}
+}
+
+// sessionInfos lists open sessions, oldest first.
+func sessionInfos() []sessionInfo {
+	list := activeSessions()
+	out := make([]sessionInfo, 0, len(list))
+	for _, s := range list {
+		out = append(out, s.info())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Started.Before(out[j].Started) })
+	return out
+}
+
+// hasTags is true if tags includes every one of want.
+func hasTags(tags, want []string) bool {
+	for _, t := range want {
+		if !containsString(tags, t) {
+			return false
+		}
+	}
+	return true
+}
+
+// apiSessions takes ?tag=, repeatable, to list only sessions carrying all
+// the given tags.
+func apiSessions(w http.ResponseWriter, r *http.Request) {
+	want := r.URL.Query()["tag"]
+	scope, scoped := requestTenant(r)
+	out := []sessionInfo{}
+	for _, s := range sessionInfos() {
+		if hasTags(s.Tags, want) && (!scoped || s.Tenant == scope) {
+			out = append(out, s)
+		}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// requestSession finds the session named in the path, answering 404 if
+// there's none the caller may see.
+func requestSession(w http.ResponseWriter, r *http.Request) *session {
+	s := findSession(r.PathValue("id"))
+	if scope, scoped := requestTenant(r); s != nil && scoped && s.tenant != scope {
+		s = nil
+	}
+	if s == nil {
+		apiError(w, http.StatusNotFound, "no open session "+r.PathValue("id"))
+	}
+	return s
+}
+
+func apiSession(w http.ResponseWriter, r *http.Request) {
+	if s := requestSession(w, r); s != nil {
+		writeJSON(w, http.StatusOK, s.info())
+	}
+}
+
+func apiKillSession(w http.ResponseWriter, r *http.Request) {
+	s := requestSession(w, r)
+	if s == nil {
+		return
+	}
+	if !killSession(s.id, adminActor(r)) {
+		apiError(w, http.StatusNotFound, "no open session "+s.id)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiAddTags(w http.ResponseWriter, r *http.Request) {
+	s := requestSession(w, r)
+	if s == nil {
+		return
+	}
+	var req struct {
+		Tags []string `json:"tags"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil || len(req.Tags) == 0 {
+		apiError(w, http.StatusBadRequest, "body must be JSON like {\"tags\": [\"suspicious\"]}")
+		return
+	}
+	for _, t := range req.Tags {
+		if err := validTag(t); err != nil {
+			apiError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	for _, t := range req.Tags {
+		if s.addTag(t) {
+			auditf("session %s tagged %s by %s", s.id, t, adminActor(r))
+		}
+	}
+	writeJSON(w, http.StatusOK, s.info())
+}
+
+func apiRemoveTag(w http.ResponseWriter, r *http.Request) {
+	s := requestSession(w, r)
+	if s == nil {
+		return
+	}
+	tag := r.PathValue("tag")
+	if !s.removeTag(tag) {
+		apiError(w, http.StatusNotFound, "session "+s.id+" isn't tagged "+tag)
+		return
+	}
+	auditf("session %s untagged %s by %s", s.id, tag, adminActor(r))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiHistory searches finished sessions: ?since= (default 24h), ?tag=
+// (repeatable, all must match), ?src= and ?limit= (default 500, newest
+// kept).
+func apiHistory(w http.ResponseWriter, r *http.Request) {
+	if conf().History.Path == "" {
+		apiError(w, http.StatusNotFound, "history.path isn't set, so there's no history")
+		return
+	}
+	q := r.URL.Query()
+	since, err := parseSince(cmp.Or(q.Get("since"), "24h"), time.Now())
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	limit := 500
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			apiError(w, http.StatusBadRequest, "limit must be a positive number")
+			return
+		}
+	}
+	tags, src := q["tag"], q.Get("src")
+	scope, scoped := requestTenant(r)
+	out := []historyRecord{}
+	err = readHistory(conf().History.Path, since, func(rec historyRecord) bool {
+		if hasTags(rec.Tags, tags) && (src == "" || historySourceMatches(rec.Src, src)) && (!scoped || rec.Tenant == scope) {
+			out = append(out, rec)
+			if len(out) > limit {
+				out = out[1:]
+			}
+		}
+		return true
+	})
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+type proxyStats struct {
+	Version        string           `json:"version"`
+	Started        time.Time        `json:"started"`
+	UptimeSeconds  float64          `json:"uptime_seconds"`
+	Accepted       int64            `json:"connections_accepted"`
+	Rejected       map[string]int64 `json:"connections_rejected"`
+	ActiveSessions int              `json:"active_sessions"`
+	BytesIn        int64            `json:"bytes_in"`
+	BytesOut       int64            `json:"bytes_out"`
+	Maintenance    bool             `json:"maintenance"`
+	Bans           int              `json:"bans"`
+	NotifyQueue    int              `json:"notify_queue"`
+	LogLevel       string           `json:"log_level"`
+	Lifetime       lifetimeSummary  `json:"lifetime"`
+}
+
+func currentStats() proxyStats {
+	st := proxyStats{
+		Version:        version,
+		Started:        startTime.UTC(),
+		UptimeSeconds:  time.Since(startTime).Seconds(),
+		Accepted:       int64(connectionsAccepted.total()),
+		Rejected:       map[string]int64{},
+		ActiveSessions: len(activeSessions()),
+		BytesIn:        int64(bytesForwarded.value("client->backend")),
+		BytesOut:       int64(bytesForwarded.value("backend->client")),
+		Maintenance:    inMaintenance(),
+		Bans:           len(activeBans()),
+		NotifyQueue:    notifyQueueDepth(),
+		LogLevel:       getLogLevel().String(),
+		Lifetime:       currentLifetimeSummary(),
+	}
+	for _, s := range connectionsRejected.snapshot() {
+		st.Rejected[s.labelValues[0]] = int64(s.value)
+	}
+	return st
+}
+
+func apiStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, currentStats())
+}
+
+type backendInfo struct {
+	Address     string  `json:"address"`
+	Up          bool    `json:"up"`
+	Sessions    int     `json:"active_sessions"`
+	DialP50Secs float64 `json:"dial_p50_seconds"`
+	DialP99Secs float64 `json:"dial_p99_seconds"`
+}
+
+func backendInfos() []backendInfo {
+	counts := map[string]int{}
+	for _, s := range sessionInfos() {
+		counts[s.Backend]++
+	}
+	out := []backendInfo{}
+	for addr, up := range backendHealthSnapshot() {
+		q := dialQuantiles(addr, 0.5, 0.99)
+		out = append(out, backendInfo{Address: addr, Up: up, Sessions: counts[addr], DialP50Secs: q[0].Seconds(), DialP99Secs: q[1].Seconds()})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Address < out[j].Address })
+	return out
+}
+
+func apiBackends(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, backendInfos())
+}
+
+type banInfo struct {
+	IP    string     `json:"ip"`
+	Until *time.Time `json:"until,omitempty"`
+}
+
+func apiListBans(w http.ResponseWriter, r *http.Request) {
+	out := []banInfo{}
+	for ip, until := range activeBans() {
+		b := banInfo{IP: ip}
+		if !until.IsZero() {
+			u := until.UTC()
+			b.Until = &u
+		}
+		out = append(out, b)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].IP < out[j].IP })
+	writeJSON(w, http.StatusOK, out)
+}
+
+func apiAddBan(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		IP       string   `json:"ip"`
+		Duration Duration `json:"duration"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		apiError(w, http.StatusBadRequest, "body must be JSON like {\"ip\": \"203.0.113.7\", \"duration\": \"1h\"}")
+		return
+	}
+	if req.Duration.Duration < 0 {
+		apiError(w, http.StatusBadRequest, "duration can't be negative")
+		return
+	}
+	killed, err := banIP(req.IP, req.Duration.Duration, adminActor(r))
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]any{"ip": req.IP, "closed_sessions": killed})
+}
+
+func apiRemoveBan(w http.ResponseWriter, r *http.Request) {
+	ip := r.PathValue("ip")
+	if !unbanIP(ip, adminActor(r)) {
+		apiError(w, http.StatusNotFound, ip+" isn't banned")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiConfig(w http.ResponseWriter, r *http.Request) {
+	data, err := json.Marshal(conf())
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	var v any
+	json.Unmarshal(data, &v)
+	writeJSON(w, http.StatusOK, redactConfig("", v))
+}
+
+func apiReload(w http.ResponseWriter, r *http.Request) {
+	res, err := reloadConfig(adminActor(r))
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// secretConfigKeys are the config keys whose values are credentials, on
+// top of anything secretConfigKey matches by suffix.
+var secretConfigKeys = map[string]bool{
+	"token": true, "key": true, "dsn": true, "headers": true,
+}
+
+// secretConfigKey goes by suffix as well, so a new credential field like
+// cloudflare.api_token is covered without having to be listed. A public
+// key gets blanked too, which does no harm.
+func secretConfigKey(key string) bool {
+	if secretConfigKeys[key] {
+		return true
+	}
+	for _, suffix := range []string{"_token", "_key", "password", "secret"} {
+		if strings.HasSuffix(key, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactConfig blanks credentials and cuts URLs down to their host, since
+// webhook URLs carry their secret in the path.
+func redactConfig(key string, v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, val := range v {
+			if secretConfigKey(key) {
+				// e.g. headers, where any value may be an Authorization
+				v[k] = "(redacted)"
+				continue
+			}
+			v[k] = redactConfig(k, val)
+		}
+	case []any:
+		for i, val := range v {
+			v[i] = redactConfig(key, val)
+		}
+	case string:
+		if v == "" {
+			return v
+		}
+		if secretConfigKey(key) {
+			return "(redacted)"
+		}
+		if strings.HasPrefix(v, "http://") || strings.HasPrefix(v, "https://") {
+			return redactURL(v)
+		}
+	}
+	return v
+}
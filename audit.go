@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Each audit line is {"hash":H,"record":R} where H is the SHA-256 of the
+// exact bytes of R, and R carries the previous line's hash. Editing,
+// removing or reordering any line breaks every hash after it. Checkpoint
+// records additionally carry an ed25519 signature over the hash they
+// follow, so the chain can't simply be recomputed after an edit.
+type auditRecord struct {
+	Seq     int64         `json:"seq"`
+	Time    time.Time     `json:"time"`
+	Kind    string        `json:"kind"`
+	Event   *sessionEvent `json:"event,omitempty"`
+	Message string        `json:"message,omitempty"`
+	Sig     string        `json:"sig,omitempty"`
+	Prev    string        `json:"prev"`
+}
+
+type auditLine struct {
+	Hash   string          `json:"hash"`
+	Record json.RawMessage `json:"record"`
+}
+
+type auditLog struct {
+	mu     sync.Mutex
+	path   string
+	f      *os.File
+	key    ed25519.PrivateKey
+	seq    int64
+	last   string
+	paused bool
+}
+
+var audit *auditLog
+
+func openAuditLog(c AuditConfig) (*auditLog, error) {
+	for _, p := range []string{c.File, c.KeyFile} {
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return nil, err
+		}
+	}
+	key, err := loadAuditKey(c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	a := &auditLog{path: c.File, key: key}
+	if err := a.catchUp(); err != nil {
+		return nil, err
+	}
+	a.f, err = os.OpenFile(c.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// catchUp picks the chain up where the file leaves it, whoever wrote last.
+func (a *auditLog) catchUp() error {
+	err := scanAudit(a.path, func(line auditLine, rec auditRecord) error {
+		a.seq, a.last = rec.Seq, line.Hash
+		return nil
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("existing audit log %s is unreadable: %v", a.path, err)
+	}
+	return nil
+}
+
+// pause writes a last checkpoint and stops appending, so another process
+// (the new one during an upgrade) can carry the chain on. Records after
+// that are dropped.
+func (a *auditLog) pause(msg string) {
+	a.append(auditRecord{Kind: "checkpoint", Message: msg})
+	a.mu.Lock()
+	a.paused = true
+	a.mu.Unlock()
+}
+
+// resume continues after whatever the other process appended meanwhile.
+func (a *auditLog) resume() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.catchUp(); err != nil {
+		return err
+	}
+	a.paused = false
+	return nil
+}
+
+// loadAuditKey reads a hex ed25519 seed, creating one (and a .pub file
+// next to it for reviewers) on first run.
+func loadAuditKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, []byte(hex.EncodeToString(priv.Seed())+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path+".pub", []byte(hex.EncodeToString(pub)+"\n"), 0644); err != nil {
+			return nil, err
+		}
+		infof("generated audit signing key %s, public key %x\n", path, pub)
+		return priv, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("audit key %s must be a hex encoded %d byte seed", path, ed25519.SeedSize)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+func (a *auditLog) append(rec auditRecord) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.paused {
+		return
+	}
+	a.seq++
+	rec.Seq = a.seq
+	rec.Time = time.Now().UTC()
+	rec.Prev = a.last
+	if rec.Kind == "checkpoint" {
+		rec.Sig = base64.StdEncoding.EncodeToString(ed25519.Sign(a.key, []byte(a.last)))
+	}
+	raw, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	sum := sha256.Sum256(raw)
+	hash := hex.EncodeToString(sum[:])
+	if _, err := fmt.Fprintf(a.f, "{\"hash\":%q,\"record\":%s}\n", hash, raw); err != nil {
+		warnf("failed to write audit record: %v", err)
+		reportError(err, "failed to write audit record")
+		a.seq--
+		return
+	}
+	a.last = hash
+}
+
+// auditf records an operator-visible state change, such as maintenance
+// or log level changes. It's a no-op when the audit log is off.
+func auditf(format string, args ...any) {
+	if audit == nil {
+		return
+	}
+	audit.append(auditRecord{Kind: "admin", Message: fmt.Sprintf(format, args...)})
+}
+
+func startAuditLog(c AuditConfig) error {
+	a, err := openAuditLog(c)
+	if err != nil {
+		return err
+	}
+	audit = a
+	addEventSink(func(ev sessionEvent) {
+		a.append(auditRecord{Kind: "session", Event: &ev})
+	})
+	a.append(auditRecord{Kind: "checkpoint", Message: "startup"})
+	go func() {
+		for range time.Tick(c.CheckpointEvery.Duration) {
+			a.append(auditRecord{Kind: "checkpoint"})
+		}
+	}()
+	return nil
+}
+
+func scanAudit(path string, fn func(auditLine, auditRecord) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	n := 0
+	for sc.Scan() {
+		n++
+		var line auditLine
+		var rec auditRecord
+		if err := json.Unmarshal(sc.Bytes(), &line); err != nil {
+			return fmt.Errorf("line %d: %v", n, err)
+		}
+		if err := json.Unmarshal(line.Record, &rec); err != nil {
+			return fmt.Errorf("line %d: %v", n, err)
+		}
+		if err := fn(line, rec); err != nil {
+			return fmt.Errorf("line %d: %v", n, err)
+		}
+	}
+	return sc.Err()
+}
+
+// verifyAudit walks the whole chain and checks checkpoint signatures when
+// a public key is given. It returns the number of records and checkpoints.
+func verifyAudit(path string, pub ed25519.PublicKey) (records, checkpoints int, err error) {
+	var prev string
+	var seq int64
+	err = scanAudit(path, func(line auditLine, rec auditRecord) error {
+		sum := sha256.Sum256(line.Record)
+		if hex.EncodeToString(sum[:]) != line.Hash {
+			return fmt.Errorf("record %d does not match its hash", rec.Seq)
+		}
+		if rec.Prev != prev {
+			return fmt.Errorf("record %d does not follow the previous record", rec.Seq)
+		}
+		if rec.Seq != seq+1 {
+			return fmt.Errorf("expected record %d, found %d", seq+1, rec.Seq)
+		}
+		if rec.Kind == "checkpoint" {
+			sig, err := base64.StdEncoding.DecodeString(rec.Sig)
+			if err != nil {
+				return fmt.Errorf("checkpoint %d has a malformed signature", rec.Seq)
+			}
+			if pub != nil && !ed25519.Verify(pub, []byte(rec.Prev), sig) {
+				return fmt.Errorf("checkpoint %d has a bad signature", rec.Seq)
+			}
+			checkpoints++
+		}
+		prev, seq = line.Hash, rec.Seq
+		records++
+		return nil
+	})
+	return records, checkpoints, err
+}
+
+func runVerifyAudit(args []string) {
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Println("usage: ./connectproxy verify-audit <audit.log> [public key hex]")
+		os.Exit(2)
+	}
+	var pub ed25519.PublicKey
+	if len(args) == 2 {
+		b, err := hex.DecodeString(args[1])
+		if err != nil || len(b) != ed25519.PublicKeySize {
+			fmt.Println("public key must be hex encoded ed25519")
+			os.Exit(2)
+		}
+		pub = b
+	}
+	records, checkpoints, err := verifyAudit(args[0], pub)
+	if err != nil {
+		fmt.Printf("FAILED after %d good records: %v\n", records, err)
+		os.Exit(1)
+	}
+	signed := "signatures not checked"
+	if pub != nil {
+		signed = "signatures verified"
+	}
+	fmt.Printf("OK: %d records, %d checkpoints, %s\n", records, checkpoints, signed)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Admin access: admin.token (an operator) plus admin.users, each with a
+// bearer token and/or a basic auth password and a role. "read" can look,
+// "operator" can also change things. A user with a tenant only gets the
+// endpoints wrapped in tenantAPI, which show just that tenant's data. The
+// control socket gets full access.
+
+type adminIdentity struct {
+	name   string
+	role   string
+	tenant string
+}
+
+type adminActorKey struct{}
+
+type adminTenantKey struct{}
+
+func adminAuthConfigured() bool {
+	return conf().Admin.Token != "" || len(conf().Admin.Users) > 0
+}
+
+func secretEqual(a, b string) bool {
+	return b != "" && subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// authenticate checks a bearer token or basic auth credentials. A token
+// also works as a basic auth password with any user name, so token users
+// can get through a browser's login prompt.
+func authenticate(r *http.Request) (adminIdentity, bool) {
+	secret, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	name := ""
+	if !ok {
+		if name, secret, ok = r.BasicAuth(); !ok {
+			return adminIdentity{}, false
+		}
+	}
+	if secretEqual(secret, conf().Admin.Token) {
+		return adminIdentity{name: "admin.token", role: "operator"}, true
+	}
+	for _, u := range conf().Admin.Users {
+		if secretEqual(secret, u.Token) || (name == u.Name && secretEqual(secret, u.Password)) {
+			return adminIdentity{name: u.Name, role: u.Role, tenant: u.Tenant}, true
+		}
+	}
+	return adminIdentity{}, false
+}
+
+// adminActor is who made an admin request, for logs and the audit trail.
+func adminActor(r *http.Request) string {
+	if a, ok := r.Context().Value(adminActorKey{}).(string); ok {
+		return a
+	}
+	return "admin endpoint from " + anonAddr(r.RemoteAddr)
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// requestTenant is the tenant a request is limited to, if any.
+func requestTenant(r *http.Request) (string, bool) {
+	t, ok := r.Context().Value(adminTenantKey{}).(string)
+	return t, ok
+}
+
+// apiAuth guards /api/v1, which is off entirely until some credentials
+// are configured.
+func apiAuth(h http.HandlerFunc) http.HandlerFunc {
+	return adminAuth(h, false, false)
+}
+
+// tenantAPI is apiAuth for endpoints that filter by requestTenant, so
+// tenant users may call them.
+func tenantAPI(h http.HandlerFunc) http.HandlerFunc {
+	return adminAuth(h, false, true)
+}
+
+// opsAuth guards the older admin endpoints and the dashboard, which stay
+// open as before when no credentials are configured.
+func opsAuth(h http.HandlerFunc) http.HandlerFunc {
+	return adminAuth(h, true, false)
+}
+
+func adminAuth(h http.HandlerFunc, openWithoutAuth, tenantOK bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mutating := r.Method != http.MethodGet && r.Method != http.MethodHead
+		var actor string
+		switch {
+		case viaControlSocket(r):
+			actor = "control socket"
+		case !adminAuthConfigured():
+			if !openWithoutAuth {
+				apiError(w, http.StatusForbidden, "the API is disabled until admin.token or admin.users is set")
+				return
+			}
+			h(w, r)
+			return
+		default:
+			id, ok := authenticate(r)
+			if !ok {
+				w.Header().Add("WWW-Authenticate", `Basic realm="sshproxy"`)
+				w.Header().Add("WWW-Authenticate", `Bearer realm="sshproxy"`)
+				apiError(w, http.StatusUnauthorized, "missing or wrong credentials")
+				return
+			}
+			actor = fmt.Sprintf("%s from %s", id.name, anonAddr(r.RemoteAddr))
+			if id.tenant != "" && !tenantOK {
+				apiError(w, http.StatusForbidden, "not available to tenant users")
+				return
+			}
+			if mutating && id.role != "operator" {
+				auditf("denied %s %s to %s (role %s)", r.Method, r.URL.Path, actor, id.role)
+				apiError(w, http.StatusForbidden, "role "+id.role+" can't make changes")
+				return
+			}
+			if id.tenant != "" {
+				actor += " (tenant " + id.tenant + ")"
+				r = r.WithContext(context.WithValue(r.Context(), adminTenantKey{}, id.tenant))
+			}
+		}
+		r = r.WithContext(context.WithValue(r.Context(), adminActorKey{}, actor))
+		if !mutating {
+			h(w, r)
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h(rec, r)
+		auditf("%s %s by %s: %d", r.Method, r.URL.Path, actor, rec.status)
+	}
+}
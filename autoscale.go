@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+var autoscaleRuns = newCounter("sshproxy_autoscale_runs_total", "Autoscale commands and webhooks run, by direction and outcome.", "direction", "result")
+
+// scaleLoad is what autoscale judges, from the latest throughput sample.
+type scaleLoad struct {
+	Sessions      int     `json:"sessions"`
+	BandwidthMbps float64 `json:"bandwidth_mbps"`
+}
+
+func (l scaleLoad) String() string {
+	return fmt.Sprintf("%d sessions, %.1f Mbps", l.Sessions, l.BandwidthMbps)
+}
+
+// wantsUp and wantsDown are the thresholds; down only counts when every
+// threshold it has is undershot, so a busy link with few sessions isn't
+// scaled down.
+func wantsUp(h ScaleHookConfig, l scaleLoad) bool {
+	return (h.Connections > 0 && l.Sessions >= h.Connections) ||
+		(h.BandwidthMbps > 0 && l.BandwidthMbps >= h.BandwidthMbps)
+}
+
+func wantsDown(h ScaleHookConfig, l scaleLoad) bool {
+	if h.Connections <= 0 && h.BandwidthMbps <= 0 {
+		return false
+	}
+	return (h.Connections <= 0 || l.Sessions < h.Connections) &&
+		(h.BandwidthMbps <= 0 || l.BandwidthMbps < h.BandwidthMbps)
+}
+
+// scaleSide tracks one direction: since when its threshold has held, and
+// when it last fired.
+type scaleSide struct {
+	name  string
+	since time.Time
+	fired time.Time
+}
+
+// check fires the hook once the threshold has held for autoscale.sustain
+// and the cooldown since the last time has passed.
+func (s *scaleSide) check(h ScaleHookConfig, crossed bool, l scaleLoad, now time.Time) {
+	if !crossed {
+		s.since = time.Time{}
+		return
+	}
+	if s.since.IsZero() {
+		s.since = now
+	}
+	// each sample covers the interval before it
+	held := now.Sub(s.since) + throughputSampleInterval
+	sustain := conf().Autoscale.Sustain.Duration
+	if held < sustain || (!s.fired.IsZero() && now.Sub(s.fired) < h.Cooldown.Duration) {
+		return
+	}
+	s.fired = now
+	infof("autoscale: scaling %s, load has been at %s for %s\n", s.name, l, held.Round(time.Second))
+	if err := sendAlert(alertVars{"direction": s.name, "sessions": l.Sessions, "bandwidth_mbps": l.BandwidthMbps}, "Scale "+strings.ToUpper(s.name[:1])+s.name[1:],
+		fmt.Sprintf("Load has been at %s for %s, asking for scale %s", l, sustain, s.name), 0x3498DB); err != nil {
+		warnf("Failed to send Discord embed: %v", err)
+	}
+	go runScaleHook(s.name, h, l)
+}
+
+// runAutoscale judges the load every throughput sample. It reads
+// conf().Autoscale each time, so a reload takes effect straight away.
+func runAutoscale() {
+	// a restart shouldn't count as quiet enough to scale down
+	up, down := &scaleSide{name: "up"}, &scaleSide{name: "down", fired: time.Now()}
+	for now := range time.Tick(throughputSampleInterval) {
+		samples := throughputSamples()
+		if len(samples) == 0 {
+			continue
+		}
+		last := samples[len(samples)-1]
+		l := scaleLoad{Sessions: last.Sessions, BandwidthMbps: (last.In + last.Out) * 8 / 1e6}
+		c := conf().Autoscale
+		up.check(c.Up, wantsUp(c.Up, l), l, now)
+		down.check(c.Down, wantsDown(c.Down, l), l, now)
+	}
+}
+
+func runScaleHook(direction string, h ScaleHookConfig, l scaleLoad) {
+	// each gets the whole timeout, so a slow command doesn't eat into the
+	// webhook's
+	if len(h.Command) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), h.Timeout.Duration)
+		cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+		cmd.Env = append(os.Environ(),
+			"SSHPROXY_SCALE="+direction,
+			fmt.Sprintf("SSHPROXY_SESSIONS=%d", l.Sessions),
+			fmt.Sprintf("SSHPROXY_BANDWIDTH_MBPS=%.1f", l.BandwidthMbps))
+		out, err := cmd.CombinedOutput()
+		reportScaleRun(ctx, h.Timeout, direction, h.Command[0], err, out)
+		cancel()
+	}
+	if h.Webhook != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), h.Timeout.Duration)
+		reportScaleRun(ctx, h.Timeout, direction, redactURL(h.Webhook), postScaleWebhook(ctx, h.Webhook, direction, l), nil)
+		cancel()
+	}
+}
+
+func postScaleWebhook(ctx context.Context, url, direction string, l scaleLoad) error {
+	body, err := json.Marshal(struct {
+		Direction string    `json:"direction"`
+		Time      time.Time `json:"time"`
+		scaleLoad
+	}{direction, time.Now().UTC(), l})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+func reportScaleRun(ctx context.Context, timeout Duration, direction, what string, err error, out []byte) {
+	if err == nil {
+		autoscaleRuns.inc(direction, "ok")
+		if len(out) > 0 {
+			debugf("autoscale %s: %s: %s", direction, what, strings.TrimSpace(clip(string(out), 500)))
+		}
+		return
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		autoscaleRuns.inc(direction, "timeout")
+		err = fmt.Errorf("timed out after %v", timeout.Duration)
+	} else {
+		autoscaleRuns.inc(direction, "failed")
+	}
+	if msg := strings.TrimSpace(clip(string(out), 500)); msg != "" {
+		err = fmt.Errorf("%v: %s", err, msg)
+	}
+	warnf("autoscale %s: %s failed: %v", direction, what, err)
+	if err := sendAlert(alertVars{"direction": direction, "error": err.Error()}, "Autoscale Failed", fmt.Sprintf("Scale %s through %s failed: %v", direction, what, err), 0xFF0000); err != nil {
+		warnf("Failed to send Discord embed: %v", err)
+	}
+}
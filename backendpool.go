@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With backend_pool.size, the proxy keeps that many connections to each
+// backend dialled ahead of time and hands them to new clients, so a burst
+// of connects doesn't wait on a dial each. SSH servers send their version
+// line as soon as a connection opens, and only give a connection that
+// hasn't logged in so long, so what a pooled connection receives is kept
+// and passed on to its client, and ones older than max_idle are replaced.
+
+var backendPoolTakes = newCounter("sshproxy_backend_pool_total", "New sessions by whether their backend connection came from the pool: hit or miss.", "backend", "result")
+
+const (
+	backendPoolDialTimeout = 10 * time.Second
+	backendPoolBackoffMax  = 30 * time.Second
+	// how much a waiting connection's backend may send before it's left
+	// in the socket buffer
+	pooledReadMax = 16 * 1024
+)
+
+// backendPools is filled in at startup and not changed after, so it's
+// read without a lock.
+var backendPools = map[string]*backendPool{}
+
+type pooledConn struct {
+	conn net.Conn
+	born time.Time
+
+	mu   sync.Mutex
+	buf  []byte
+	err  error
+	done chan struct{}
+}
+
+func newPooledConn(conn net.Conn) *pooledConn {
+	p := &pooledConn{conn: conn, born: time.Now(), done: make(chan struct{})}
+	go p.read()
+	return p
+}
+
+// read keeps what the backend sends while the connection waits, which
+// also tells when the backend hangs up.
+func (p *pooledConn) read() {
+	defer close(p.done)
+	buf := make([]byte, 4096)
+	for {
+		p.mu.Lock()
+		room := pooledReadMax - len(p.buf)
+		p.mu.Unlock()
+		if room <= 0 {
+			return
+		}
+		n, err := p.conn.Read(buf[:min(len(buf), room)])
+		p.mu.Lock()
+		p.buf = append(p.buf, buf[:n]...)
+		p.err = err
+		p.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// dead reports whether the backend has hung up on the connection.
+func (p *pooledConn) dead() bool {
+	select {
+	case <-p.done:
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return p.err != nil && !errors.Is(p.err, os.ErrDeadlineExceeded)
+	default:
+		return false
+	}
+}
+
+// claim stops the reader and returns what it read, or the error the
+// backend hung up with.
+func (p *pooledConn) claim() ([]byte, error) {
+	p.conn.SetReadDeadline(time.Now())
+	<-p.done
+	p.conn.SetReadDeadline(time.Time{})
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil && !errors.Is(p.err, os.ErrDeadlineExceeded) {
+		return nil, p.err
+	}
+	return p.buf, nil
+}
+
+type backendPool struct {
+	addr string
+	opts TCPSocketConfig
+
+	mu    sync.Mutex
+	conns []*pooledConn
+	wake  chan struct{}
+}
+
+// startBackendPools starts a pool for every plain TCP backend. A tenant's
+// backend is dialled with the tenant's socket options, unless it's also
+// the main listener's.
+func startBackendPools() {
+	if conf().BackendPool.Size <= 0 {
+		return
+	}
+	tenantOf := map[string]*tenant{}
+	for _, tc := range conf().Tenants {
+		if _, ok := tenantOf[tc.Backend]; !ok && tc.Backend != primaryBackend {
+			tenantOf[tc.Backend] = tenants[tc.Name]
+		}
+	}
+	for _, addr := range knownBackends(primaryBackend) {
+		if strings.Contains(addr, "://") {
+			continue
+		}
+		bp := &backendPool{addr: addr, opts: backendSocket(tenantOf[addr]), wake: make(chan struct{}, 1)}
+		backendPools[addr] = bp
+		go bp.run()
+	}
+}
+
+// takePooled hands out a waiting connection to addr and what the backend
+// has sent on it so far.
+func takePooled(addr string) (net.Conn, []byte, bool) {
+	bp := backendPools[addr]
+	if bp == nil {
+		return nil, nil, false
+	}
+	conn, prefix, ok := bp.take()
+	if ok {
+		backendPoolTakes.inc(addr, "hit")
+	} else {
+		backendPoolTakes.inc(addr, "miss")
+	}
+	return conn, prefix, ok
+}
+
+// take hands out the newest connection, which has the most of the
+// backend's login grace time left.
+func (bp *backendPool) take() (net.Conn, []byte, bool) {
+	defer bp.refill()
+	for {
+		bp.mu.Lock()
+		if len(bp.conns) == 0 {
+			bp.mu.Unlock()
+			return nil, nil, false
+		}
+		p := bp.conns[len(bp.conns)-1]
+		bp.conns = bp.conns[:len(bp.conns)-1]
+		bp.mu.Unlock()
+		if time.Since(p.born) > conf().BackendPool.MaxIdle.Duration {
+			p.conn.Close()
+			continue
+		}
+		prefix, err := p.claim()
+		if err != nil {
+			p.conn.Close()
+			continue
+		}
+		return p.conn, prefix, true
+	}
+}
+
+func (bp *backendPool) refill() {
+	select {
+	case bp.wake <- struct{}{}:
+	default:
+	}
+}
+
+// prune closes connections the backend hung up on or that waited too
+// long, and returns how many are left.
+func (bp *backendPool) prune() int {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	kept := bp.conns[:0]
+	for _, p := range bp.conns {
+		if p.dead() || time.Since(p.born) > conf().BackendPool.MaxIdle.Duration {
+			p.conn.Close()
+			continue
+		}
+		kept = append(kept, p)
+	}
+	clear(bp.conns[len(kept):])
+	bp.conns = kept
+	return len(kept)
+}
+
+// run keeps the pool topped up, backing off while the backend can't be
+// reached. Health checks and sessions report on the backend; the pool
+// only logs.
+func (bp *backendPool) run() {
+	check := max(conf().BackendPool.MaxIdle.Duration/4, time.Second)
+	tick := time.NewTicker(check)
+	defer tick.Stop()
+	var backoff time.Duration
+	for {
+		for bp.prune() < conf().BackendPool.Size {
+			conn, err := dialBackend(bp.addr, backendPoolDialTimeout, bp.opts)
+			if err != nil {
+				backoff = min(max(2*backoff, time.Second), backendPoolBackoffMax)
+				if loggedIPs.allow("backend-pool:" + bp.addr) {
+					warnf("backend pool for %s: %v, retrying in %s", bp.addr, err, backoff)
+				}
+				break
+			}
+			backoff = 0
+			bp.mu.Lock()
+			bp.conns = append(bp.conns, newPooledConn(conn))
+			bp.mu.Unlock()
+		}
+		if backoff > 0 {
+			time.Sleep(backoff)
+			continue
+		}
+		select {
+		case <-tick.C:
+		case <-bp.wake:
+		}
+	}
+}
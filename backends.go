@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	backendHealthMu sync.Mutex
+	backendHealth   = map[string]bool{}
+	primaryBackend  string
+)
+
+func markBackend(addr string, up bool) {
+	backendHealthMu.Lock()
+	prev, known := backendHealth[addr]
+	backendHealth[addr] = up
+	backendHealthMu.Unlock()
+	if known && prev && !up {
+		warnf("backend %s is down\n", addr)
+	}
+	if known && !prev && up {
+		infof("backend %s is back up\n", addr)
+	}
+}
+
+func backendHealthSnapshot() map[string]bool {
+	backendHealthMu.Lock()
+	defer backendHealthMu.Unlock()
+	out := make(map[string]bool, len(backendHealth))
+	for k, v := range backendHealth {
+		out[k] = v
+	}
+	return out
+}
+
+func knownBackends(primary string) []string {
+	seen := map[string]bool{primary: true}
+	list := []string{primary}
+	for _, w := range conf().Maintenance.Windows {
+		if w.StandbyBackend != "" && !seen[w.StandbyBackend] {
+			seen[w.StandbyBackend] = true
+			list = append(list, w.StandbyBackend)
+		}
+	}
+	if c := conf().Canary.Backend; c != "" && !seen[c] {
+		seen[c] = true
+		list = append(list, c)
+	}
+	for _, t := range conf().Tenants {
+		if !seen[t.Backend] {
+			seen[t.Backend] = true
+			list = append(list, t.Backend)
+		}
+	}
+	return list
+}
+
+// checkBackends dials each backend once and reports whether any answered.
+func checkBackends(backends []string) bool {
+	anyUp := false
+	for _, addr := range backends {
+		conn, err := dialBackend(addr, conf().HealthCheck.Timeout.Duration, conf().TCP.Backend)
+		if err != nil {
+			markBackend(addr, false)
+			continue
+		}
+		conn.Close()
+		markBackend(addr, true)
+		anyUp = true
+	}
+	return anyUp
+}
+
+// runHealthChecks is what drives the all-backends-down incident. Client
+// dials come and go with single refusals, so only a run of failed health
+// check rounds opens it, and a backend has to stay up for recover_after
+// before it's resolved, so a flapping backend doesn't page on every flap.
+func runHealthChecks(backends []string) {
+	var downRounds int
+	var upSince time.Time
+	open := false
+	for {
+		c := conf().HealthCheck
+		if checkBackends(backends) {
+			downRounds = 0
+			if upSince.IsZero() {
+				upSince = time.Now()
+			}
+			if open && time.Since(upSince) >= c.RecoverAfter.Duration {
+				open = false
+				resolveIncident("all-backends-down", "At least one backend is reachable again")
+			}
+		} else {
+			downRounds++
+			upSince = time.Time{}
+			if !open && downRounds >= c.Failures {
+				open = true
+				triggerIncident("all-backends-down", "All backends are down, new connections are failing", "critical")
+			}
+		}
+		time.Sleep(c.Interval.Duration)
+	}
+}
+
+// anyBackendHealthy probes the backends itself when periodic health checks
+// are off, so readiness doesn't go stale between client connections.
+func anyBackendHealthy() bool {
+	if conf().HealthCheck.Interval.Duration <= 0 {
+		checkBackends(knownBackends(primaryBackend))
+	}
+	for _, up := range backendHealthSnapshot() {
+		if up {
+			return true
+		}
+	}
+	return false
+}
+
+const dialWindowSize = 512
+
+type dialStats struct {
+	samples  []time.Duration
+	next     int
+	slowRun  int
+	alerting bool
+}
+
+var (
+	dialStatsMu sync.Mutex
+	dialStatsBy = map[string]*dialStats{}
+)
+
+// recordDialLatency keeps a sliding window of recent dial times per backend
+// and alerts once a backend has been slower than the threshold for the
+// configured number of dials in a row.
+func recordDialLatency(connID, addr string, d time.Duration) {
+	dialLatency.observeExemplar(d.Seconds(), connID, addr)
+	dialStatsMu.Lock()
+	st, ok := dialStatsBy[addr]
+	if !ok {
+		st = &dialStats{}
+		dialStatsBy[addr] = st
+	}
+	if len(st.samples) < dialWindowSize {
+		st.samples = append(st.samples, d)
+	} else {
+		st.samples[st.next] = d
+		st.next = (st.next + 1) % dialWindowSize
+	}
+	threshold := conf().DialLatency.Threshold.Duration
+	var fire, recover bool
+	if threshold > 0 {
+		if d > threshold {
+			st.slowRun++
+			if !st.alerting && st.slowRun >= conf().DialLatency.Consecutive {
+				st.alerting = true
+				fire = true
+			}
+		} else {
+			st.slowRun = 0
+			if st.alerting {
+				st.alerting = false
+				recover = true
+			}
+		}
+	}
+	run := st.slowRun
+	dialStatsMu.Unlock()
+
+	if fire {
+		warnf("[%s] backend %s dial latency above %s for %d dials in a row (last %s)\n", connID, addr, threshold, run, d.Round(time.Millisecond))
+		if err := sendAlert(alertVars{"conn_id": connID, "backend": addr, "duration": d, "threshold": threshold, "count": run}, "Backend Latency High", fmt.Sprintf("Dials to %s took longer than %s %d times in a row (last %s)", addr, threshold, run, d.Round(time.Millisecond)), 0xFFA500, connField(connID)); err != nil {
+			warnf("Failed to send Discord embed: %v", err)
+		}
+	}
+	if recover {
+		infof("backend %s dial latency back under %s (%s)\n", addr, threshold, d.Round(time.Millisecond))
+		if err := sendAlert(alertVars{"backend": addr, "duration": d, "threshold": threshold}, "Backend Latency Recovered", fmt.Sprintf("Dials to %s are back under %s (last %s)", addr, threshold, d.Round(time.Millisecond)), 0x008000); err != nil {
+			warnf("Failed to send Discord embed: %v", err)
+		}
+	}
+}
+
+func dialQuantiles(addr string, qs ...float64) []time.Duration {
+	dialStatsMu.Lock()
+	st, ok := dialStatsBy[addr]
+	var sorted []time.Duration
+	if ok {
+		sorted = append(sorted, st.samples...)
+	}
+	dialStatsMu.Unlock()
+	out := make([]time.Duration, len(qs))
+	if len(sorted) == 0 {
+		return out
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	for i, q := range qs {
+		out[i] = sorted[int(q*float64(len(sorted)-1)+0.5)]
+	}
+	return out
+}
+
+func init() {
+	onCollect(func() {
+		quantiles := []float64{0.5, 0.95, 0.99}
+		for _, addr := range dialStatsBackends() {
+			for i, d := range dialQuantiles(addr, quantiles...) {
+				dialLatencyQuantile.set(d.Seconds(), addr, strconv.FormatFloat(quantiles[i], 'g', -1, 64))
+			}
+		}
+	})
+}
+
+func dialStatsBackends() []string {
+	dialStatsMu.Lock()
+	defer dialStatsMu.Unlock()
+	list := make([]string, 0, len(dialStatsBy))
+	for addr := range dialStatsBy {
+		list = append(list, addr)
+	}
+	return list
+}
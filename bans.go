@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// bans maps a client IP to when its ban runs out; a zero time never
+// expires. These are real addresses, since that's what has to match.
+var (
+	bansMu sync.Mutex
+	bans   = map[string]time.Time{}
+)
+
+func isBanned(ip string) bool {
+	bansMu.Lock()
+	defer bansMu.Unlock()
+	until, ok := bans[ip]
+	if !ok {
+		return false
+	}
+	if !until.IsZero() && time.Now().After(until) {
+		delete(bans, ip)
+		return false
+	}
+	return true
+}
+
+// banIP refuses new connections from ip for d (forever if d is zero) and
+// closes the ones it already has. It returns how many sessions were closed.
+func banIP(ip string, d time.Duration, by string) (int, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return 0, fmt.Errorf("%q is not an IP address", ip)
+	}
+	ip = parsed.String()
+	var until time.Time
+	if d > 0 {
+		until = time.Now().Add(d)
+	}
+	bansMu.Lock()
+	bans[ip] = until
+	bansMu.Unlock()
+
+	killed := 0
+	for _, s := range activeSessions() {
+		if s.ip == ip {
+			s.close("banned")
+			killed++
+		}
+	}
+	length := "permanently"
+	if d > 0 {
+		length = "for " + d.String()
+	}
+	shown := anonIP(ip)
+	noteDigestBan()
+	recordBan("banned", shown, until, by)
+	publishEvent(sessionEvent{Type: "banned", Src: shown, Duration: d.Seconds(), Reason: by})
+	infof("banned %s %s (%s), closed %d sessions\n", shown, length, by, killed)
+	auditf("banned %s %s by %s", shown, length, by)
+	if err := sendAlert(alertVars{"ip": shown, "duration": d, "by": by}, "IP Banned", fmt.Sprintf("%s was banned %s by %s", shown, length, by), 0xFFA500,
+		sourceField(shown),
+		&DiscordEmbedField{Name: "Closed Sessions", Value: fmt.Sprint(killed), Inline: true},
+	); err != nil {
+		warnf("Failed to send Discord embed: %v", err)
+	}
+	return killed, nil
+}
+
+func unbanIP(ip string, by string) bool {
+	if parsed := net.ParseIP(ip); parsed != nil {
+		ip = parsed.String()
+	}
+	bansMu.Lock()
+	_, ok := bans[ip]
+	delete(bans, ip)
+	bansMu.Unlock()
+	if !ok {
+		return false
+	}
+	shown := anonIP(ip)
+	recordBan("unbanned", shown, time.Time{}, by)
+	publishEvent(sessionEvent{Type: "unbanned", Src: shown, Reason: by})
+	infof("unbanned %s (%s)\n", shown, by)
+	auditf("unbanned %s by %s", shown, by)
+	if err := sendAlert(alertVars{"ip": shown, "by": by}, "IP Unbanned", fmt.Sprintf("%s was unbanned by %s", shown, by), 0x008000, sourceField(shown)); err != nil {
+		warnf("Failed to send Discord embed: %v", err)
+	}
+	return true
+}
+
+// activeBans copies the current bans, dropping expired ones.
+func activeBans() map[string]time.Time {
+	bansMu.Lock()
+	defer bansMu.Unlock()
+	now := time.Now()
+	out := make(map[string]time.Time, len(bans))
+	for ip, until := range bans {
+		if !until.IsZero() && now.After(until) {
+			delete(bans, ip)
+			continue
+		}
+		out[ip] = until
+	}
+	return out
+}
+
+func restoreBans(saved map[string]time.Time) {
+	bansMu.Lock()
+	defer bansMu.Unlock()
+	for ip, until := range saved {
+		bans[ip] = until
+	}
+}
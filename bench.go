@@ -0,0 +1,140 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+type benchResult struct {
+	connects []time.Duration
+	rtts     []time.Duration
+	bytes    int64
+	errors   int
+}
+
+func (r *benchResult) merge(o *benchResult) {
+	r.connects = append(r.connects, o.connects...)
+	r.rtts = append(r.rtts, o.rtts...)
+	r.bytes += o.bytes
+	r.errors += o.errors
+}
+
+func percentiles(d []time.Duration) string {
+	if len(d) == 0 {
+		return "n/a"
+	}
+	sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+	at := func(q float64) time.Duration { return d[int(q*float64(len(d)-1))] }
+	return fmt.Sprintf("p50 %s  p90 %s  p99 %s  max %s",
+		at(0.5).Round(time.Microsecond), at(0.9).Round(time.Microsecond), at(0.99).Round(time.Microsecond), d[len(d)-1].Round(time.Microsecond))
+}
+
+// benchWorker keeps one connection busy until the deadline. In echo mode
+// each payload must come back before the next is sent, which gives a
+// round-trip latency per request; in send mode it just writes as fast as
+// the path allows.
+func benchWorker(target, mode string, size int, newConn bool, deadline time.Time) *benchResult {
+	r := &benchResult{}
+	payload := make([]byte, size)
+	for i := range payload {
+		payload[i] = byte('a' + i%26)
+	}
+	reply := make([]byte, size)
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	for time.Now().Before(deadline) {
+		if conn == nil {
+			start := time.Now()
+			c, err := net.DialTimeout("tcp", target, 10*time.Second)
+			if err != nil {
+				r.errors++
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			r.connects = append(r.connects, time.Since(start))
+			conn = c
+		}
+		conn.SetDeadline(deadline.Add(5 * time.Second))
+		start := time.Now()
+		_, err := conn.Write(payload)
+		if err == nil && mode == "echo" {
+			_, err = io.ReadFull(conn, reply)
+		}
+		if err != nil {
+			if time.Now().Before(deadline) {
+				r.errors++
+			}
+			conn.Close()
+			conn = nil
+			continue
+		}
+		r.rtts = append(r.rtts, time.Since(start))
+		r.bytes += int64(size)
+		if newConn {
+			conn.Close()
+			conn = nil
+		}
+	}
+	return r
+}
+
+func runBench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	conns := fs.Int("c", 10, "concurrent connections")
+	duration := fs.Duration("d", 10*time.Second, "how long to run")
+	size := fs.Int("size", 4096, "payload size per request in bytes")
+	mode := fs.String("mode", "echo", "echo waits for each payload to come back (needs an echo backend), send only writes")
+	newConn := fs.Bool("new-conn", false, "open a new connection for every request, to test connection rate")
+	fs.Usage = func() {
+		fmt.Println("usage: ./connectproxy bench [-c 10] [-d 10s] [-size 4096] [-mode echo|send] [-new-conn] <proxy host:port>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 || (*mode != "echo" && *mode != "send") || *size < 1 || *conns < 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	target := fs.Arg(0)
+	fmt.Printf("benchmarking %s with %d connections, %d byte payloads, %s mode for %s\n", target, *conns, *size, *mode, *duration)
+
+	start := time.Now()
+	deadline := start.Add(*duration)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	total := &benchResult{}
+	for i := 0; i < *conns; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := benchWorker(target, *mode, *size, *newConn, deadline)
+			mu.Lock()
+			total.merge(r)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start).Seconds()
+
+	fmt.Printf("requests:    %d (%.0f/s), %d errors\n", len(total.rtts), float64(len(total.rtts))/elapsed, total.errors)
+	fmt.Printf("connections: %d (%.0f/s)\n", len(total.connects), float64(len(total.connects))/elapsed)
+	fmt.Printf("throughput:  %s/s sent\n", formatBytes(int64(float64(total.bytes)/elapsed)))
+	fmt.Printf("connect:     %s\n", percentiles(total.connects))
+	if *mode == "echo" {
+		fmt.Printf("round trip:  %s\n", percentiles(total.rtts))
+	} else {
+		fmt.Printf("write:       %s\n", percentiles(total.rtts))
+	}
+	if len(total.rtts) == 0 {
+		os.Exit(1)
+	}
+}
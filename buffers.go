@@ -0,0 +1,33 @@
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+// Each direction of a session copies through a buffer of
+// forwarding.buffer_size. They come from a pool rather than being made per
+// session, which with thousands of sessions coming and going adds up to a
+// lot of garbage.
+
+// copyBuffers holds *[]byte so putting one back doesn't allocate.
+var copyBuffers = sync.Pool{
+	New: func() any {
+		b := make([]byte, conf().Forwarding.BufferSize)
+		return &b
+	},
+}
+
+func getCopyBuffer() *[]byte {
+	return copyBuffers.Get().(*[]byte)
+}
+
+func putCopyBuffer(b *[]byte) {
+	copyBuffers.Put(b)
+}
+
+// writerOnly hides a destination's ReadFrom, which io.CopyBuffer would
+// otherwise use instead of the buffer it's given.
+type writerOnly struct {
+	io.Writer
+}
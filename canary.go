@@ -0,0 +1,51 @@
+package main
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sync"
+)
+
+var (
+	canaryMu      sync.Mutex
+	canaryPercent float64
+)
+
+func setCanaryPercent(p float64) {
+	canaryMu.Lock()
+	canaryPercent = p
+	canaryMu.Unlock()
+}
+
+func getCanaryPercent() float64 {
+	canaryMu.Lock()
+	defer canaryMu.Unlock()
+	return canaryPercent
+}
+
+// canaryFor sends a share of new sessions bound for the stable backend to
+// the canary instead. With sticky set the split is a hash of the client IP,
+// so a given client keeps landing on the same side while the percentage
+// stays put. A canary known to be down gets nothing.
+func canaryFor(targetAddr, ip string) string {
+	c := conf().Canary
+	p := getCanaryPercent()
+	if c.Backend == "" || p <= 0 || targetAddr != primaryBackend {
+		return targetAddr
+	}
+	if up, known := backendHealthSnapshot()[c.Backend]; known && !up {
+		return targetAddr
+	}
+	var roll float64
+	if c.Sticky {
+		h := fnv.New32a()
+		h.Write([]byte(ip))
+		roll = float64(h.Sum32()%10000) / 100
+	} else {
+		roll = rand.Float64() * 100
+	}
+	if roll < p {
+		return c.Backend
+	}
+	return targetAddr
+}
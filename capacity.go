@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+var (
+	capacityMu       sync.Mutex
+	capacityAlerting bool
+)
+
+// checkCapacity fires once when active sessions reach alert_percent of the
+// cap and only re-arms after they fall back to clear_percent, so a count
+// hovering around the threshold doesn't flap.
+func checkCapacity(active int) {
+	max := conf().Limits.MaxConnections
+	if max <= 0 || conf().Limits.AlertPercent <= 0 {
+		return
+	}
+	pct := float64(active) * 100 / float64(max)
+	capacityMu.Lock()
+	var fire, clear bool
+	if !capacityAlerting && pct >= conf().Limits.AlertPercent {
+		capacityAlerting = true
+		fire = true
+	} else if capacityAlerting && pct <= conf().Limits.clearPercent() {
+		capacityAlerting = false
+		clear = true
+	}
+	capacityMu.Unlock()
+
+	if fire {
+		warnf("active connections at %.0f%% of cap (%d/%d)\n", pct, active, max)
+		triggerIncident("capacity", fmt.Sprintf("Active connections at %.0f%% of cap (%d/%d)", pct, active, max), "warning")
+		if err := sendAlert(alertVars{"active": active, "max": max, "percent": pct}, "Capacity Warning", fmt.Sprintf("Active connections at %.0f%% of cap (%d/%d)", pct, active, max), 0xFFA500); err != nil {
+			warnf("Failed to send Discord embed: %v", err)
+		}
+	}
+	if clear {
+		infof("active connections back to %.0f%% of cap (%d/%d)\n", pct, active, max)
+		resolveIncident("capacity", fmt.Sprintf("Active connections back to %.0f%% of cap (%d/%d)", pct, active, max))
+		if err := sendAlert(alertVars{"active": active, "max": max, "percent": pct}, "Capacity Recovered", fmt.Sprintf("Active connections back to %.0f%% of cap (%d/%d)", pct, active, max), 0x008000); err != nil {
+			warnf("Failed to send Discord embed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Captures are synthesized from the byte streams the proxy copies, not
+// sniffed off the wire: each session gets a pcapng file with a fake
+// handshake, one TCP segment per read and a FIN exchange at the end,
+// addressed client <-> proxy listener so it replays as the client saw it.
+
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+
+	// keep each synthesized IP packet under the 64k length field
+	captureMaxSegment = 65000
+)
+
+type captureFilter struct {
+	kind string
+	net  *net.IPNet
+	port int
+}
+
+// parseCaptureFilter understands a small subset of BPF primitives:
+// "host <ip>", "net <cidr>" and "port <n>".
+func parseCaptureFilter(expr string) (captureFilter, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 2 {
+		return captureFilter{}, fmt.Errorf("bad capture filter %q, want host/net/port <value>", expr)
+	}
+	f := captureFilter{kind: fields[0]}
+	switch f.kind {
+	case "host":
+		ip := net.ParseIP(fields[1])
+		if ip == nil {
+			return f, fmt.Errorf("bad host in capture filter %q", expr)
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		f.net = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	case "net":
+		_, n, err := net.ParseCIDR(fields[1])
+		if err != nil {
+			return f, fmt.Errorf("bad net in capture filter %q: %v", expr, err)
+		}
+		f.net = n
+	case "port":
+		p, err := strconv.Atoi(fields[1])
+		if err != nil || p < 1 || p > 65535 {
+			return f, fmt.Errorf("bad port in capture filter %q", expr)
+		}
+		f.port = p
+	default:
+		return f, fmt.Errorf("unknown capture filter %q, want host/net/port", fields[0])
+	}
+	return f, nil
+}
+
+func (f captureFilter) matches(addrs []*net.TCPAddr) bool {
+	for _, a := range addrs {
+		if a == nil {
+			continue
+		}
+		if f.net != nil && f.net.Contains(a.IP) {
+			return true
+		}
+		if f.port != 0 && f.port == a.Port {
+			return true
+		}
+	}
+	return false
+}
+
+var captureInclude, captureExclude []captureFilter
+
+func loadCaptureFilters(c CaptureConfig) error {
+	for _, list := range []struct {
+		exprs []string
+		out   *[]captureFilter
+	}{{c.Include, &captureInclude}, {c.Exclude, &captureExclude}} {
+		for _, expr := range list.exprs {
+			f, err := parseCaptureFilter(expr)
+			if err != nil {
+				return err
+			}
+			*list.out = append(*list.out, f)
+		}
+	}
+	return os.MkdirAll(c.Dir, 0750)
+}
+
+func shouldCapture(addrs []*net.TCPAddr) bool {
+	for _, f := range captureExclude {
+		if f.matches(addrs) {
+			return false
+		}
+	}
+	if len(captureInclude) == 0 {
+		return true
+	}
+	for _, f := range captureInclude {
+		if f.matches(addrs) {
+			return true
+		}
+	}
+	return false
+}
+
+type sessionCapture struct {
+	mu        sync.Mutex
+	id        string
+	base      string
+	segment   int
+	segStart  time.Time
+	segBytes  int64
+	f         *os.File
+	w         *bufio.Writer
+	client    *net.TCPAddr
+	server    *net.TCPAddr
+	seq       [2]uint32
+	written   int64
+	limit     int64
+	truncated bool
+}
+
+// startCapture opens a capture for the session if capturing is on and the
+// filters select it.
+func startCapture(s *session) {
+	if conf().Capture.Dir == "" {
+		return
+	}
+	client, _ := s.client.RemoteAddr().(*net.TCPAddr)
+	server, _ := s.client.LocalAddr().(*net.TCPAddr)
+	var backend *net.TCPAddr
+	if s.target != nil {
+		backend, _ = s.target.RemoteAddr().(*net.TCPAddr)
+	}
+	if client == nil || server == nil || !shouldCapture([]*net.TCPAddr{client, server, backend}) {
+		return
+	}
+	c := &sessionCapture{
+		id:     s.id,
+		base:   filepath.Join(conf().Capture.Dir, s.start.UTC().Format("20060102T150405Z")+"-"+s.id),
+		client: client,
+		server: server,
+		seq:    [2]uint32{rand.Uint32(), rand.Uint32()},
+		limit:  conf().Capture.MaxSessionBytes,
+	}
+	if err := c.openSegment(); err != nil {
+		warnf("[%s] failed to open capture file: %v", s.id, err)
+		return
+	}
+	// handshake
+	c.packet(0, tcpSYN, nil)
+	c.seq[0]++
+	c.packet(1, tcpSYN|tcpACK, nil)
+	c.seq[1]++
+	c.packet(0, tcpACK, nil)
+	s.capture = c
+}
+
+// openSegment starts the next file for the session. Later segments carry
+// on with the same sequence numbers so mergecap can stitch them back
+// together.
+func (c *sessionCapture) openSegment() error {
+	path := c.base + ".pcapng"
+	if c.segment > 0 {
+		path = fmt.Sprintf("%s.%03d.pcapng", c.base, c.segment)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0640)
+	if err != nil {
+		return err
+	}
+	captureFilesMu.Lock()
+	captureOpen[path] = true
+	captureFilesMu.Unlock()
+	c.f, c.w = f, bufio.NewWriterSize(f, 64*1024)
+	c.segStart, c.segBytes = time.Now(), 0
+	c.writeHeader()
+	debugf("[%s] capturing session to %s", c.id, path)
+	return nil
+}
+
+func (c *sessionCapture) closeSegment() {
+	if err := c.w.Flush(); err != nil {
+		warnf("[%s] failed to write capture: %v", c.id, err)
+	}
+	c.f.Close()
+	captureFilesMu.Lock()
+	delete(captureOpen, c.f.Name())
+	captureFilesMu.Unlock()
+	queueUpload(c.f.Name())
+	enforceCaptureBudget()
+}
+
+func (c *sessionCapture) rotate() {
+	c.closeSegment()
+	c.segment++
+	if err := c.openSegment(); err != nil {
+		warnf("[%s] failed to rotate capture, stopping it: %v", c.id, err)
+		c.truncated = true
+	}
+}
+
+func (c *sessionCapture) writeHeader() {
+	// section header block
+	shb := make([]byte, 28)
+	binary.LittleEndian.PutUint32(shb[0:], 0x0A0D0D0A)
+	binary.LittleEndian.PutUint32(shb[4:], 28)
+	binary.LittleEndian.PutUint32(shb[8:], 0x1A2B3C4D)
+	binary.LittleEndian.PutUint16(shb[12:], 1)
+	binary.LittleEndian.PutUint16(shb[14:], 0)
+	binary.LittleEndian.PutUint64(shb[16:], ^uint64(0))
+	binary.LittleEndian.PutUint32(shb[24:], 28)
+	// interface description block, LINKTYPE_RAW
+	idb := make([]byte, 20)
+	binary.LittleEndian.PutUint32(idb[0:], 1)
+	binary.LittleEndian.PutUint32(idb[4:], 20)
+	binary.LittleEndian.PutUint16(idb[8:], 101)
+	binary.LittleEndian.PutUint32(idb[12:], 0)
+	binary.LittleEndian.PutUint32(idb[16:], 20)
+	c.w.Write(shb)
+	c.w.Write(idb)
+}
+
+// packet writes one synthesized segment; dir 0 is client to proxy, 1 the
+// reverse.
+func (c *sessionCapture) packet(dir int, flags byte, payload []byte) {
+	src, dst := c.client, c.server
+	if dir == 1 {
+		src, dst = dst, src
+	}
+	tcp := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(tcp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint32(tcp[4:], c.seq[dir])
+	if flags&tcpACK != 0 {
+		binary.BigEndian.PutUint32(tcp[8:], c.seq[1-dir])
+	}
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	copy(tcp[20:], payload)
+
+	var pkt []byte
+	src4, dst4 := src.IP.To4(), dst.IP.To4()
+	if src4 != nil && dst4 != nil {
+		pkt = make([]byte, 20+len(tcp))
+		pkt[0] = 0x45
+		binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+		binary.BigEndian.PutUint16(pkt[6:], 0x4000)
+		pkt[8] = 64
+		pkt[9] = 6
+		copy(pkt[12:], src4)
+		copy(pkt[16:], dst4)
+		binary.BigEndian.PutUint16(pkt[10:], checksum(pkt[:20], 0))
+		pseudo := append(append(append([]byte{}, src4...), dst4...), 0, 6, byte(len(tcp)>>8), byte(len(tcp)))
+		binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, sum(pseudo)))
+	} else {
+		src16, dst16 := src.IP.To16(), dst.IP.To16()
+		pkt = make([]byte, 40+len(tcp))
+		pkt[0] = 0x60
+		binary.BigEndian.PutUint16(pkt[4:], uint16(len(tcp)))
+		pkt[6] = 6
+		pkt[7] = 64
+		copy(pkt[8:], src16)
+		copy(pkt[24:], dst16)
+		pseudo := append(append(append([]byte{}, src16...), dst16...), 0, 0, byte(len(tcp)>>8), byte(len(tcp)), 0, 0, 0, 6)
+		binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, sum(pseudo)))
+	}
+	copy(pkt[len(pkt)-len(tcp):], tcp)
+
+	// enhanced packet block
+	padded := (len(pkt) + 3) &^ 3
+	total := 32 + padded
+	ts := uint64(time.Now().UnixMicro())
+	hdr := make([]byte, 28)
+	binary.LittleEndian.PutUint32(hdr[0:], 6)
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(total))
+	binary.LittleEndian.PutUint32(hdr[8:], 0)
+	binary.LittleEndian.PutUint32(hdr[12:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(hdr[16:], uint32(ts))
+	binary.LittleEndian.PutUint32(hdr[20:], uint32(len(pkt)))
+	binary.LittleEndian.PutUint32(hdr[24:], uint32(len(pkt)))
+	c.w.Write(hdr)
+	c.w.Write(pkt)
+	c.w.Write(make([]byte, padded-len(pkt)))
+	var trailer [4]byte
+	binary.LittleEndian.PutUint32(trailer[:], uint32(total))
+	c.w.Write(trailer[:])
+	c.written += int64(total)
+	c.segBytes += int64(total)
+	c.seq[dir] += uint32(len(payload))
+}
+
+func sum(b []byte) uint32 {
+	var s uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	return s
+}
+
+func checksum(b []byte, initial uint32) uint16 {
+	s := initial + sum(b)
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return ^uint16(s)
+}
+
+// write records data read in the given direction. Once the session has
+// used up its byte budget the rest of the stream is left out.
+func (c *sessionCapture) write(direction string, p []byte) {
+	if c == nil {
+		return
+	}
+	dir := 0
+	if direction == "backend->client" {
+		dir = 1
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(p) > 0 && !c.truncated {
+		if c.limit > 0 && c.written >= c.limit {
+			c.truncated = true
+			break
+		}
+		if (conf().Capture.RotateSize > 0 && c.segBytes >= conf().Capture.RotateSize) ||
+			(conf().Capture.RotateEvery.Duration > 0 && time.Since(c.segStart) >= conf().Capture.RotateEvery.Duration) {
+			c.rotate()
+			continue
+		}
+		n := len(p)
+		if n > captureMaxSegment {
+			n = captureMaxSegment
+		}
+		if c.limit > 0 && int64(n) > c.limit-c.written {
+			n = int(c.limit - c.written)
+		}
+		c.packet(dir, tcpPSH|tcpACK, p[:n])
+		p = p[n:]
+	}
+}
+
+func (c *sessionCapture) close(id string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.f == nil {
+		return
+	}
+	c.packet(0, tcpFIN|tcpACK, nil)
+	c.seq[0]++
+	c.packet(1, tcpFIN|tcpACK, nil)
+	c.seq[1]++
+	c.packet(0, tcpACK, nil)
+	c.closeSegment()
+	if c.truncated {
+		infof("[%s] capture truncated at %s\n", id, formatBytes(c.written))
+	}
+}
+
+var (
+	captureFilesMu sync.Mutex
+	captureOpen    = map[string]bool{}
+)
+
+// enforceCaptureBudget deletes the oldest finished capture files until the
+// directory fits in max_total_bytes and nothing is older than max_age.
+// Files still being written are never removed.
+func enforceCaptureBudget() {
+	budget, maxAge := conf().Capture.MaxTotalBytes, conf().Capture.MaxAge.Duration
+	if budget <= 0 && maxAge <= 0 {
+		return
+	}
+	captureFilesMu.Lock()
+	defer captureFilesMu.Unlock()
+	entries, err := os.ReadDir(conf().Capture.Dir)
+	if err != nil {
+		warnf("failed to list capture dir: %v", err)
+		return
+	}
+	type file struct {
+		path string
+		size int64
+		mod  time.Time
+	}
+	var files []file
+	var total int64
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".pcapng") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, file{filepath.Join(conf().Capture.Dir, e.Name()), info.Size(), info.ModTime()})
+		total += info.Size()
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].mod.Before(files[j].mod) })
+	for _, f := range files {
+		old := maxAge > 0 && time.Since(f.mod) > maxAge
+		if !old && (budget <= 0 || total <= budget) {
+			break
+		}
+		if captureOpen[f.path] {
+			continue
+		}
+		if err := os.Remove(f.path); err != nil {
+			warnf("failed to remove capture %s: %v", f.path, err)
+			continue
+		}
+		total -= f.size
+		debugf("removed capture %s to stay within budget", f.path)
+	}
+}
+
+func runCaptureJanitor() {
+	for range time.Tick(time.Minute) {
+		enforceCaptureBudget()
+	}
+}
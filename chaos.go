@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	chaosMu   sync.Mutex
+	chaosNets []*net.IPNet
+)
+
+var errChaosReset = errors.New("connection reset by fault injection")
+
+func setChaosTargets(list []string) error {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		n, err := parseIPOrCIDR(s)
+		if err != nil {
+			return err
+		}
+		nets = append(nets, n)
+	}
+	chaosMu.Lock()
+	chaosNets = nets
+	chaosMu.Unlock()
+	return nil
+}
+
+// chaosSelected reports whether faults apply to a client. With no IPs
+// configured they apply to everyone, so chaos mode should only ever be
+// switched on for test deployments.
+func chaosSelected(ip string) bool {
+	if !conf().Chaos.Enabled {
+		return false
+	}
+	chaosMu.Lock()
+	defer chaosMu.Unlock()
+	if len(chaosNets) == 0 {
+		return true
+	}
+	parsed := net.ParseIP(ip)
+	for _, n := range chaosNets {
+		if parsed != nil && n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// chaosWriter sits in front of the destination of a forward and delays,
+// throttles, fragments or resets what gets written to it.
+type chaosWriter struct {
+	sess *session
+	dst  net.Conn
+	c    ChaosConfig
+}
+
+func (w *chaosWriter) Write(p []byte) (int, error) {
+	c := w.c
+	if c.ResetProbability > 0 && rand.Float64() < c.ResetProbability {
+		w.sess.setCloseReason("chaos_reset")
+		chaosFaults.inc("reset")
+		reset(w.sess.client)
+		if w.sess.target != nil {
+			reset(w.sess.target)
+		}
+		return 0, errChaosReset
+	}
+	if d := c.Latency.Duration + time.Duration(rand.Int63n(int64(c.Jitter.Duration)+1)); d > 0 {
+		chaosFaults.inc("latency")
+		time.Sleep(d)
+	}
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if c.PartialWrites && n > 1 {
+			n = 1 + rand.Intn(n)
+			if n < len(p) {
+				chaosFaults.inc("partial_write")
+			}
+		}
+		m, err := w.dst.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		if c.Bandwidth > 0 {
+			time.Sleep(time.Duration(float64(m) / float64(c.Bandwidth) * float64(time.Second)))
+		}
+		p = p[m:]
+	}
+	return written, nil
+}
+
+// reset closes a TCP connection with an RST instead of a FIN.
+func reset(conn net.Conn) {
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+	conn.Close()
+}
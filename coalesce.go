@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Embed types listed under notify.digest are coalesced: the first one in a
+// window goes out as usual, the rest are only counted and summarised in a
+// single embed when the window closes, so a scan touching hundreds of IPs
+// costs two embeds instead of hundreds.
+type digestBucket struct {
+	title   string
+	color   int
+	count   int
+	sources map[string]int
+	since   time.Time
+}
+
+var (
+	digestBucketsMu sync.Mutex
+	digestBuckets   = map[string]*digestBucket{}
+)
+
+// embedKind turns an embed title into the key used in notify.digest, e.g.
+// "Client Connected" -> "client_connected".
+func embedKind(title string) string {
+	return strings.ReplaceAll(strings.ToLower(title), " ", "_")
+}
+
+func sourceField(addr string) *DiscordEmbedField {
+	return &DiscordEmbedField{Name: "Source", Value: addr, Inline: true}
+}
+
+func digestInterval(kind string) time.Duration {
+	if d, ok := conf().Notify.Digest[kind]; ok {
+		return d.Duration
+	}
+	return conf().Notify.Digest["*"].Duration
+}
+
+// coalesceEmbed reports whether the embed was absorbed into an open window
+// and shouldn't be sent on its own.
+func coalesceEmbed(kind string, embed DiscordEmbed) bool {
+	interval := digestInterval(kind)
+	if interval <= 0 {
+		return false
+	}
+	source := ""
+	for _, f := range embed.Fields {
+		if f.Name == "Source" {
+			source = f.Value
+		}
+	}
+	digestBucketsMu.Lock()
+	defer digestBucketsMu.Unlock()
+	if b, ok := digestBuckets[kind]; ok {
+		b.count++
+		if source != "" {
+			b.sources[source]++
+		}
+		return true
+	}
+	digestBuckets[kind] = &digestBucket{title: embed.Title, color: embed.Color, sources: map[string]int{}, since: time.Now()}
+	time.AfterFunc(interval, func() { flushDigestBucket(kind) })
+	return false
+}
+
+func flushDigestBucket(kind string) {
+	digestBucketsMu.Lock()
+	b := digestBuckets[kind]
+	delete(digestBuckets, kind)
+	digestBucketsMu.Unlock()
+	if b == nil || b.count == 0 {
+		return
+	}
+	period := time.Since(b.since).Round(time.Second)
+	desc := fmt.Sprintf("%d more %q events in the last %s", b.count, b.title, period)
+	var fields []*DiscordEmbedField
+	if len(b.sources) > 0 {
+		desc = fmt.Sprintf("%d more %q events from %d sources in the last %s", b.count, b.title, len(b.sources), period)
+		fields = append(fields, &DiscordEmbedField{Name: "Top Sources", Value: topSources(b.sources, 5)})
+	}
+	embed := DiscordEmbed{
+		Title:       b.title + " (summary)",
+		Description: desc,
+		Color:       b.color,
+		Timestamp:   time.Now().Format(time.RFC3339),
+	}
+	for _, f := range fields {
+		embed.Fields = append(embed.Fields, *f)
+	}
+	if err := dispatchEmbed(kind, embed); err != nil {
+		warnf("Failed to send Discord embed: %v", err)
+	}
+}
+
+// flushDigestBuckets sends whatever summaries are pending, for shutdown.
+func flushDigestBuckets() {
+	digestBucketsMu.Lock()
+	kinds := make([]string, 0, len(digestBuckets))
+	for kind := range digestBuckets {
+		kinds = append(kinds, kind)
+	}
+	digestBucketsMu.Unlock()
+	for _, kind := range kinds {
+		flushDigestBucket(kind)
+	}
+}
+
+func topSources(sources map[string]int, n int) string {
+	list := make([]string, 0, len(sources))
+	for s := range sources {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if sources[list[i]] != sources[list[j]] {
+			return sources[list[i]] > sources[list[j]]
+		}
+		return list[i] < list[j]
+	})
+	if len(list) > n {
+		list = list[:n]
+	}
+	var b strings.Builder
+	for _, s := range list {
+		fmt.Fprintf(&b, "%s (%d)\n", s, sources[s])
+	}
+	return b.String()
+}
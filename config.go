@@ -0,0 +1,1150 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\": %v", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+type MaintenanceConfig struct {
+	Enabled    bool                      `json:"enabled"`
+	Message    string                    `json:"message"`
+	FlagFile   string                    `json:"flag_file"`
+	DrainAfter Duration                  `json:"drain_after"`
+	Windows    []MaintenanceWindowConfig `json:"windows"`
+}
+
+type MaintenanceWindowConfig struct {
+	Schedule       string   `json:"schedule"`
+	Duration       Duration `json:"duration"`
+	Action         string   `json:"action"`
+	StandbyBackend string   `json:"standby_backend"`
+}
+
+// LimitsConfig caps concurrent sessions. ClearPercent left out means 10
+// below AlertPercent; an explicit 0 re-arms only once usage is back to 0.
+type LimitsConfig struct {
+	MaxConnections int      `json:"max_connections"`
+	AlertPercent   float64  `json:"alert_percent"`
+	ClearPercent   *float64 `json:"clear_percent"`
+}
+
+// clearPercent is the usage the capacity alert re-arms at.
+func (l LimitsConfig) clearPercent() float64 {
+	if l.ClearPercent == nil {
+		return max(l.AlertPercent-10, 0)
+	}
+	return *l.ClearPercent
+}
+
+type AdminConfig struct {
+	Listen string `json:"listen"`
+	Pprof  bool   `json:"pprof"`
+	// Token is an operator credential for /api/v1, the dashboard and the
+	// gRPC service; the API is off until Token or Users is set.
+	Token      string      `json:"token"`
+	Users      []AdminUser `json:"users"`
+	GRPCListen string      `json:"grpc_listen"`
+}
+
+// AdminUser signs in with a bearer token, a basic auth password, or both.
+// Role is "read" or "operator". A user with a Tenant only sees that
+// tenant's sessions and history.
+type AdminUser struct {
+	Name     string `json:"name"`
+	Token    string `json:"token"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
+	Tenant   string `json:"tenant"`
+}
+
+// ControlConfig is the local control socket; Mode is its octal file mode.
+type ControlConfig struct {
+	Socket string `json:"socket"`
+	Mode   string `json:"mode"`
+}
+
+// HealthCheckConfig dials every backend each Interval. Failures is how
+// many rounds in a row have to find them all down before the
+// all-backends-down incident opens, and RecoverAfter how long one has to
+// stay reachable before it's resolved.
+type HealthCheckConfig struct {
+	Interval     Duration `json:"interval"`
+	Timeout      Duration `json:"timeout"`
+	Failures     int      `json:"failures"`
+	RecoverAfter Duration `json:"recover_after"`
+}
+
+type StatsDConfig struct {
+	Address  string   `json:"address"`
+	Prefix   string   `json:"prefix"`
+	Interval Duration `json:"interval"`
+	Format   string   `json:"format"`
+	Tags     []string `json:"tags"`
+}
+
+type TracingConfig struct {
+	Endpoint    string            `json:"endpoint"`
+	Headers     map[string]string `json:"headers"`
+	ServiceName string            `json:"service_name"`
+}
+
+// OTLPMetricsConfig pushes the metrics to a collector. Protocol is
+// "http/json" (the default, on the collector's 4318 port) or "grpc" (4317).
+type OTLPMetricsConfig struct {
+	Endpoint string            `json:"endpoint"`
+	Protocol string            `json:"protocol"`
+	Headers  map[string]string `json:"headers"`
+	Interval Duration          `json:"interval"`
+}
+
+type DialLatencyConfig struct {
+	Threshold   Duration `json:"threshold"`
+	Consecutive int      `json:"consecutive"`
+}
+
+type TopTalkersConfig struct {
+	Schedule string `json:"schedule"`
+	Top      int    `json:"top"`
+	Webhook  bool   `json:"webhook"`
+}
+
+type DigestConfig struct {
+	Interval Duration `json:"interval"`
+}
+
+type HeartbeatConfig struct {
+	Interval Duration `json:"interval"`
+}
+
+// AnomalyConfig flags connection spikes: more than Factor times the
+// baseline mean, or ZScore standard deviations above it, per Interval.
+type AnomalyConfig struct {
+	Interval       Duration `json:"interval"`
+	Baseline       Duration `json:"baseline"`
+	Factor         float64  `json:"factor"`
+	ZScore         float64  `json:"zscore"`
+	MinConnections int      `json:"min_connections"`
+}
+
+type InactivityConfig struct {
+	AlertAfter Duration `json:"alert_after"`
+}
+
+type SyslogConfig struct {
+	Enabled            bool   `json:"enabled"`
+	Network            string `json:"network"`
+	Address            string `json:"address"`
+	Facility           string `json:"facility"`
+	Tag                string `json:"tag"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+	Only               bool   `json:"only"`
+}
+
+type LogConfig struct {
+	Level       string       `json:"level"`
+	File        string       `json:"file"`
+	MaxSizeMB   int          `json:"max_size_mb"`
+	RotateEvery Duration     `json:"rotate_every"`
+	MaxBackups  int          `json:"max_backups"`
+	MaxAge      Duration     `json:"max_age"`
+	Compress    bool         `json:"compress"`
+	Syslog      SyslogConfig `json:"syslog"`
+}
+
+type HistoryConfig struct {
+	Path      string   `json:"path"`
+	Retention Duration `json:"retention"`
+}
+
+type AccessLogConfig struct {
+	File string `json:"file"`
+}
+
+type PrivacyConfig struct {
+	Mode string `json:"mode"`
+	Key  string `json:"key"`
+}
+
+type AuditConfig struct {
+	File            string   `json:"file"`
+	KeyFile         string   `json:"key_file"`
+	CheckpointEvery Duration `json:"checkpoint_every"`
+}
+
+type SentryConfig struct {
+	DSN         string `json:"dsn"`
+	Environment string `json:"environment"`
+	Release     string `json:"release"`
+}
+
+type CaptureConfig struct {
+	Dir             string   `json:"dir"`
+	Include         []string `json:"include"`
+	Exclude         []string `json:"exclude"`
+	MaxSessionBytes int64    `json:"max_session_bytes"`
+	RotateSize      int64    `json:"rotate_size"`
+	RotateEvery     Duration `json:"rotate_every"`
+	MaxTotalBytes   int64    `json:"max_total_bytes"`
+	MaxAge          Duration `json:"max_age"`
+	S3              S3Config `json:"s3"`
+}
+
+type S3Config struct {
+	Endpoint          string            `json:"endpoint"`
+	Region            string            `json:"region"`
+	Bucket            string            `json:"bucket"`
+	Prefix            string            `json:"prefix"`
+	AccessKey         string            `json:"access_key"`
+	SecretKey         string            `json:"secret_key"`
+	SessionToken      string            `json:"session_token"`
+	SSE               string            `json:"sse"`
+	KMSKeyID          string            `json:"kms_key_id"`
+	Tags              map[string]string `json:"tags"`
+	DeleteAfterUpload bool              `json:"delete_after_upload"`
+	ScanInterval      Duration          `json:"scan_interval"`
+}
+
+type MirrorConfig struct {
+	Address     string `json:"address"`
+	QueueChunks int    `json:"queue_chunks"`
+}
+
+type CanaryConfig struct {
+	Backend string  `json:"backend"`
+	Percent float64 `json:"percent"`
+	Sticky  bool    `json:"sticky"`
+}
+
+// TagRuleConfig tags sessions matching all of the conditions it sets.
+type TagRuleConfig struct {
+	Tag       string   `json:"tag"`
+	IPs       []string `json:"ips"`
+	Countries []string `json:"countries"`
+	Backends  []string `json:"backends"`
+}
+
+type TaggingConfig struct {
+	Rules []TagRuleConfig `json:"rules"`
+}
+
+// TenantConfig is a customer with its own listener and backend. Allow and
+// Deny are IPs or CIDRs; MaxConnections of 0 means no quota beyond
+// limits.max_connections. Webhook gets a copy of alerts about the tenant's
+// sessions.
+type TenantConfig struct {
+	Name           string           `json:"name"`
+	Listen         string           `json:"listen"`
+	Backend        string           `json:"backend"`
+	Allow          []string         `json:"allow"`
+	Deny           []string         `json:"deny"`
+	MaxConnections int              `json:"max_connections"`
+	Webhook        string           `json:"webhook"`
+	MPTCP          RouteMPTCPConfig `json:"mptcp"`
+}
+
+type ChaosConfig struct {
+	Enabled          bool     `json:"enabled"`
+	IPs              []string `json:"ips"`
+	Latency          Duration `json:"latency"`
+	Jitter           Duration `json:"jitter"`
+	Bandwidth        int64    `json:"bandwidth"`
+	ResetProbability float64  `json:"reset_probability"`
+	PartialWrites    bool     `json:"partial_writes"`
+}
+
+type ExfilConfig struct {
+	Threshold int64 `json:"threshold"`
+}
+
+type SignatureRule struct {
+	Name      string `json:"name"`
+	Direction string `json:"direction"`
+	Regex     string `json:"regex"`
+	Contains  string `json:"contains"`
+	Hex       string `json:"hex"`
+	Action    string `json:"action"`
+}
+
+type SignaturesConfig struct {
+	ScanBytes int             `json:"scan_bytes"`
+	Rules     []SignatureRule `json:"rules"`
+}
+
+type SlackConfig struct {
+	URL         string   `json:"url"`
+	Events      []string `json:"events"`
+	Only        bool     `json:"only"`
+	MinSeverity string   `json:"min_severity"`
+}
+
+type TelegramConfig struct {
+	BotToken    string   `json:"bot_token"`
+	ChatID      string   `json:"chat_id"`
+	APIURL      string   `json:"api_url"`
+	Events      []string `json:"events"`
+	Only        bool     `json:"only"`
+	MinSeverity string   `json:"min_severity"`
+}
+
+type WebhookConfig struct {
+	Name         string            `json:"name"`
+	URL          string            `json:"url"`
+	Headers      map[string]string `json:"headers"`
+	Template     string            `json:"template"`
+	TemplateFile string            `json:"template_file"`
+	Events       []string          `json:"events"`
+	MinSeverity  string            `json:"min_severity"`
+	Secret       string            `json:"secret"`
+}
+
+type SMTPConfig struct {
+	Host               string   `json:"host"`
+	Port               int      `json:"port"`
+	TLS                string   `json:"tls"`
+	Username           string   `json:"username"`
+	Password           string   `json:"password"`
+	From               string   `json:"from"`
+	To                 []string `json:"to"`
+	SubjectPrefix      string   `json:"subject_prefix"`
+	Events             []string `json:"events"`
+	InsecureSkipVerify bool     `json:"insecure_skip_verify"`
+	MinSeverity        string   `json:"min_severity"`
+}
+
+type PagerDutyConfig struct {
+	RoutingKey string `json:"routing_key"`
+	URL        string `json:"url"`
+}
+
+type OpsgenieConfig struct {
+	APIKey string `json:"api_key"`
+	URL    string `json:"url"`
+}
+
+type AlertTemplate struct {
+	Title       string               `json:"title"`
+	Description string               `json:"description"`
+	Fields      []AlertTemplateField `json:"fields"`
+}
+
+type AlertTemplateField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline"`
+}
+
+type NotifyRateLimitConfig struct {
+	PerMinute float64 `json:"per_minute"`
+	Burst     int     `json:"burst"`
+}
+
+type NotifyConfig struct {
+	QueueSize   int                      `json:"queue_size"`
+	DropPolicy  string                   `json:"drop_policy"`
+	MaxAge      Duration                 `json:"max_age"`
+	Cooldown    Duration                 `json:"cooldown"`
+	SpoolFile   string                   `json:"spool_file"`
+	Digest      map[string]Duration      `json:"digest"`
+	Routes      map[string]string        `json:"routes"`
+	Slack       SlackConfig              `json:"slack"`
+	Telegram    TelegramConfig           `json:"telegram"`
+	Webhooks    []WebhookConfig          `json:"webhooks"`
+	SMTP        SMTPConfig               `json:"smtp"`
+	PagerDuty   PagerDutyConfig          `json:"pagerduty"`
+	Opsgenie    OpsgenieConfig           `json:"opsgenie"`
+	Templates   map[string]AlertTemplate `json:"templates"`
+	MinSeverity string                   `json:"min_severity"`
+	RateLimit   NotifyRateLimitConfig    `json:"rate_limit"`
+	Username    string                   `json:"username"`
+	AvatarURL   string                   `json:"avatar_url"`
+	Mention     string                   `json:"mention"`
+	Colors      map[string]string        `json:"colors"`
+}
+
+type GeoIPConfig struct {
+	CityDB     string   `json:"city_db"`
+	ASNDB      string   `json:"asn_db"`
+	ReverseDNS bool     `json:"reverse_dns"`
+	DNSTimeout Duration `json:"dns_timeout"`
+	// NewCountryAlerts raises a critical alert the first time a session
+	// from a country not in KnownCountries (or seen since startup) gets
+	// through to a backend.
+	NewCountryAlerts bool     `json:"new_country_alerts"`
+	KnownCountries   []string `json:"known_countries"`
+}
+
+// DiscordBotConfig enables the /proxy slash command. Listen is where
+// Discord delivers interactions (set the application's Interactions
+// Endpoint URL to https://<host>/interactions in front of it); Token and
+// ApplicationID are only needed to register the command.
+type DiscordBotConfig struct {
+	Listen        string   `json:"listen"`
+	PublicKey     string   `json:"public_key"`
+	ApplicationID string   `json:"application_id"`
+	Token         string   `json:"token"`
+	GuildID       string   `json:"guild_id"`
+	Roles         []string `json:"roles"`
+}
+
+// ListenerConfig tunes the proxy's listening sockets. Acceptors above 1
+// opens that many SO_REUSEPORT sockets per address.
+type ListenerConfig struct {
+	Acceptors int `json:"acceptors"`
+}
+
+// UpgradeConfig is for binary upgrades: how long the new process has to
+// come up, and how long the old one keeps its sessions afterwards (0 waits
+// for them all to end). MoveSessions hands open sessions' sockets to the
+// new process as well, so the old one needn't wait for them.
+type UpgradeConfig struct {
+	ReadyTimeout Duration `json:"ready_timeout"`
+	DrainTimeout Duration `json:"drain_timeout"`
+	MoveSessions bool     `json:"move_sessions"`
+}
+
+// ClientHoldConfig keeps a new client waiting when its backend can't be
+// reached, for up to Timeout, redialling every RetryInterval. Up to
+// MaxBytes of what the client sends meanwhile is buffered and passed on
+// once connected. 0 turns it off.
+type ClientHoldConfig struct {
+	Timeout       Duration `json:"timeout"`
+	RetryInterval Duration `json:"retry_interval"`
+	MaxBytes      int      `json:"max_bytes"`
+}
+
+// AutoscaleConfig calls out to outside automation when load stays past a
+// threshold for Sustain: Up to add capacity, Down to remove it.
+type AutoscaleConfig struct {
+	Sustain Duration        `json:"sustain"`
+	Up      ScaleHookConfig `json:"up"`
+	Down    ScaleHookConfig `json:"down"`
+}
+
+// ScaleHookConfig is one side of autoscale. Up fires with active sessions
+// at or above Connections, or throughput at or above BandwidthMbps; down
+// with both below theirs. 0 leaves a threshold out. Command and/or Webhook
+// run at most once per Cooldown.
+type ScaleHookConfig struct {
+	Connections   int      `json:"connections"`
+	BandwidthMbps float64  `json:"bandwidth_mbps"`
+	Command       []string `json:"command"`
+	Webhook       string   `json:"webhook"`
+	Cooldown      Duration `json:"cooldown"`
+	Timeout       Duration `json:"timeout"`
+}
+
+// FailoverConfig pairs this proxy with another one, usually in another
+// region. Each checks Peer every Interval: a host:port it must be able to
+// connect to, or an http(s) URL that must answer 200, like the peer's
+// /readyz. After Failures misses in a row both sides alert, and the
+// standby points DNS at itself.
+type FailoverConfig struct {
+	Role     string        `json:"role"`
+	Peer     string        `json:"peer"`
+	Interval Duration      `json:"interval"`
+	Timeout  Duration      `json:"timeout"`
+	Failures int           `json:"failures"`
+	DNS      DNSHookConfig `json:"dns"`
+}
+
+// DNSHookConfig moves Record to Value, this proxy's address, through the
+// Cloudflare or Route53 API or a Command. The record type follows Value:
+// A or AAAA for an IP, CNAME otherwise.
+type DNSHookConfig struct {
+	Provider   string              `json:"provider"`
+	Record     string              `json:"record"`
+	Value      string              `json:"value"`
+	TTL        int                 `json:"ttl"`
+	Command    []string            `json:"command"`
+	Timeout    Duration            `json:"timeout"`
+	Cloudflare CloudflareDNSConfig `json:"cloudflare"`
+	Route53    Route53Config       `json:"route53"`
+}
+
+type CloudflareDNSConfig struct {
+	ZoneID   string `json:"zone_id"`
+	APIToken string `json:"api_token"`
+	APIURL   string `json:"api_url"`
+}
+
+type Route53Config struct {
+	HostedZoneID string `json:"hosted_zone_id"`
+	AccessKey    string `json:"access_key"`
+	SecretKey    string `json:"secret_key"`
+	SessionToken string `json:"session_token"`
+	Endpoint     string `json:"endpoint"`
+}
+
+// DaemonConfig is for init scripts: run in the background, record the pid
+// in PIDFile, and serve as User/Group once the sockets are bound. Group
+// defaults to the user's primary group.
+type DaemonConfig struct {
+	Background bool   `json:"background"`
+	PIDFile    string `json:"pid_file"`
+	User       string `json:"user"`
+	Group      string `json:"group"`
+}
+
+// WorkersConfig runs Count worker processes behind one SO_REUSEPORT
+// address each, under a supervisor that restarts the ones that die. 0 or 1
+// serves from a single process as usual.
+type WorkersConfig struct {
+	Count int `json:"count"`
+}
+
+// ForwardingConfig tunes how session bytes are copied. BufferSize is the
+// size of each direction's copy buffer, so the most read or written per
+// call. Splice lets TCP to TCP sessions skip the buffer on Linux.
+type ForwardingConfig struct {
+	BufferSize int  `json:"buffer_size"`
+	Splice     bool `json:"splice"`
+}
+
+// BackendPoolConfig keeps Size connections to each backend dialled ahead
+// of time for new clients. Ones that have waited MaxIdle are replaced.
+type BackendPoolConfig struct {
+	Size    int      `json:"size"`
+	MaxIdle Duration `json:"max_idle"`
+}
+
+// TCPConfig sets socket options on the client and backend sides of each
+// session.
+type TCPConfig struct {
+	Client  TCPSocketConfig `json:"client"`
+	Backend TCPSocketConfig `json:"backend"`
+}
+
+// TCPSocketConfig sizes the kernel's receive and send buffers (SO_RCVBUF
+// and SO_SNDBUF) in bytes. 0 leaves the system default and its
+// autotuning. NoDelay sends small writes straight away (TCP_NODELAY);
+// turning it off lets Nagle's algorithm batch them. FastOpen turns on TCP
+// Fast Open, on the proxy listeners for the client side and on dials for
+// the backend side. MPTCP does the same for Multipath TCP, which falls
+// back to plain TCP for peers that don't speak it; tenants can set it for
+// their own route.
+type TCPSocketConfig struct {
+	RecvBuffer int                `json:"recv_buffer"`
+	SendBuffer int                `json:"send_buffer"`
+	KeepAlive  TCPKeepAliveConfig `json:"keepalive"`
+	NoDelay    bool               `json:"nodelay"`
+	FastOpen   bool               `json:"fast_open"`
+	MPTCP      bool               `json:"mptcp"`
+}
+
+// RouteMPTCPConfig turns Multipath TCP on or off for one tenant's route,
+// on its listener (Client) and its backend dials (Backend). Either left
+// out follows tcp.client.mptcp or tcp.backend.mptcp.
+type RouteMPTCPConfig struct {
+	Client  *bool `json:"client"`
+	Backend *bool `json:"backend"`
+}
+
+// TCPKeepAliveConfig has the kernel probe a connection that has been idle
+// for Idle, every Interval, and drop it after Count probes go unanswered.
+type TCPKeepAliveConfig struct {
+	Enabled  bool     `json:"enabled"`
+	Idle     Duration `json:"idle"`
+	Interval Duration `json:"interval"`
+	Count    int      `json:"count"`
+}
+
+// StateConfig keeps what the proxy has seen (client cooldowns, known
+// countries, bans) in a file so a restart doesn't re-alert for everyone.
+type StateConfig struct {
+	File         string   `json:"file"`
+	SaveInterval Duration `json:"save_interval"`
+}
+
+type HexdumpConfig struct {
+	IPs             []string `json:"ips"`
+	File            string   `json:"file"`
+	MaxSessionBytes int64    `json:"max_session_bytes"`
+}
+
+type HTTPSinkConfig struct {
+	URL      string            `json:"url"`
+	Index    string            `json:"index"`
+	Topic    string            `json:"topic"`
+	Labels   map[string]string `json:"labels"`
+	Headers  map[string]string `json:"headers"`
+	Username string            `json:"username"`
+	Password string            `json:"password"`
+}
+
+type NATSConfig struct {
+	URL                string `json:"url"`
+	SubjectPrefix      string `json:"subject_prefix"`
+	Username           string `json:"username"`
+	Password           string `json:"password"`
+	Token              string `json:"token"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+}
+
+// KafkaConfig produces events to Topic. With Brokers set the proxy speaks
+// the Kafka protocol to the cluster itself, authenticating with SASL when
+// Username is set; with URL it posts to a Kafka REST proxy instead.
+type KafkaConfig struct {
+	Brokers            []string          `json:"brokers"`
+	URL                string            `json:"url"`
+	Topic              string            `json:"topic"`
+	TLS                bool              `json:"tls"`
+	InsecureSkipVerify bool              `json:"insecure_skip_verify"`
+	SASLMechanism      string            `json:"sasl_mechanism"`
+	Username           string            `json:"username"`
+	Password           string            `json:"password"`
+	Headers            map[string]string `json:"headers"`
+}
+
+// ExecHookConfig runs Command (no shell) for each matching event, with the
+// event in SSHPROXY_* environment variables and, if Stdin is set, as JSON
+// on stdin.
+type ExecHookConfig struct {
+	Command []string `json:"command"`
+	Events  []string `json:"events"`
+	Stdin   bool     `json:"stdin"`
+	Timeout Duration `json:"timeout"`
+}
+
+type EventsConfig struct {
+	File          string         `json:"file"`
+	Loki          HTTPSinkConfig `json:"loki"`
+	Elasticsearch HTTPSinkConfig `json:"elasticsearch"`
+	Kafka         KafkaConfig    `json:"kafka"`
+	NATS          NATSConfig     `json:"nats"`
+	BatchSize     int            `json:"batch_size"`
+	BufferSize    int            `json:"buffer_size"`
+	FlushInterval Duration       `json:"flush_interval"`
+	MaxRetries    int            `json:"max_retries"`
+
+	Exec            []ExecHookConfig `json:"exec"`
+	ExecConcurrency int              `json:"exec_concurrency"`
+}
+
+type Config struct {
+	Maintenance MaintenanceConfig `json:"maintenance"`
+	Limits      LimitsConfig      `json:"limits"`
+	Listener    ListenerConfig    `json:"listener"`
+	Admin       AdminConfig       `json:"admin"`
+	Control     ControlConfig     `json:"control"`
+	HealthCheck HealthCheckConfig `json:"health_check"`
+	StatsD      StatsDConfig      `json:"statsd"`
+	Tracing     TracingConfig     `json:"tracing"`
+	OTLPMetrics OTLPMetricsConfig `json:"otlp_metrics"`
+	DialLatency DialLatencyConfig `json:"dial_latency"`
+	TopTalkers  TopTalkersConfig  `json:"top_talkers"`
+	Digest      DigestConfig      `json:"digest"`
+	Heartbeat   HeartbeatConfig   `json:"heartbeat"`
+	Inactivity  InactivityConfig  `json:"inactivity"`
+	Anomaly     AnomalyConfig     `json:"anomaly"`
+	Log         LogConfig         `json:"log"`
+	History     HistoryConfig     `json:"history"`
+	Events      EventsConfig      `json:"events"`
+	AccessLog   AccessLogConfig   `json:"access_log"`
+	Privacy     PrivacyConfig     `json:"privacy"`
+	Audit       AuditConfig       `json:"audit"`
+	Sentry      SentryConfig      `json:"sentry"`
+	Capture     CaptureConfig     `json:"capture"`
+	Hexdump     HexdumpConfig     `json:"hexdump"`
+	Mirror      MirrorConfig      `json:"mirror"`
+	Canary      CanaryConfig      `json:"canary"`
+	Chaos       ChaosConfig       `json:"chaos"`
+	Exfil       ExfilConfig       `json:"exfil"`
+	Signatures  SignaturesConfig  `json:"signatures"`
+	Tagging     TaggingConfig     `json:"tagging"`
+	Tenants     []TenantConfig    `json:"tenants"`
+	Notify      NotifyConfig      `json:"notify"`
+	GeoIP       GeoIPConfig       `json:"geoip"`
+	State       StateConfig       `json:"state"`
+	Upgrade     UpgradeConfig     `json:"upgrade"`
+	ClientHold  ClientHoldConfig  `json:"client_hold"`
+	Autoscale   AutoscaleConfig   `json:"autoscale"`
+	Failover    FailoverConfig    `json:"failover"`
+	Daemon      DaemonConfig      `json:"daemon"`
+	Workers     WorkersConfig     `json:"workers"`
+	Forwarding  ForwardingConfig  `json:"forwarding"`
+	TCP         TCPConfig         `json:"tcp"`
+	BackendPool BackendPoolConfig `json:"backend_pool"`
+	DiscordBot  DiscordBotConfig  `json:"discord_bot"`
+}
+
+// cfg is the running config. Reload and the settings API replace it
+// whole rather than changing it in place; read it through conf().
+var cfg atomic.Pointer[Config]
+
+func init() { cfg.Store(defaultConfig()) }
+
+func conf() *Config { return cfg.Load() }
+
+// defaultKeepAlive gives up on a silent peer after about two minutes.
+var defaultKeepAlive = TCPKeepAliveConfig{
+	Enabled:  true,
+	Idle:     Duration{time.Minute},
+	Interval: Duration{15 * time.Second},
+	Count:    4,
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Maintenance: MaintenanceConfig{
+			Message: "service under maintenance, please try again later\r\n",
+		},
+		Control: ControlConfig{
+			Mode: "0660",
+		},
+		HealthCheck: HealthCheckConfig{
+			Timeout:      Duration{3 * time.Second},
+			Failures:     3,
+			RecoverAfter: Duration{time.Minute},
+		},
+		StatsD: StatsDConfig{
+			Prefix:   "sshproxy.",
+			Interval: Duration{10 * time.Second},
+		},
+		Tracing: TracingConfig{
+			ServiceName: "sshproxy",
+		},
+		OTLPMetrics: OTLPMetricsConfig{
+			Protocol: "http/json",
+			Interval: Duration{30 * time.Second},
+		},
+		DialLatency: DialLatencyConfig{
+			Consecutive: 5,
+		},
+		TopTalkers: TopTalkersConfig{
+			Top: 10,
+		},
+		Events: EventsConfig{
+			Elasticsearch:   HTTPSinkConfig{Index: "sshproxy-events"},
+			Kafka:           KafkaConfig{Topic: "sshproxy-events", SASLMechanism: "PLAIN"},
+			NATS:            NATSConfig{SubjectPrefix: "sshproxy.events"},
+			BatchSize:       100,
+			BufferSize:      10000,
+			FlushInterval:   Duration{5 * time.Second},
+			MaxRetries:      5,
+			ExecConcurrency: 4,
+		},
+		Capture: CaptureConfig{
+			MaxSessionBytes: 100 * 1024 * 1024,
+			S3: S3Config{
+				Region:            "us-east-1",
+				DeleteAfterUpload: true,
+				ScanInterval:      Duration{5 * time.Minute},
+			},
+		},
+		Notify: NotifyConfig{
+			QueueSize:  1000,
+			DropPolicy: "drop_newest",
+			MaxAge:     Duration{time.Hour},
+			Cooldown:   Duration{time.Hour},
+			Username:   "ANYTHING",
+			RateLimit:  NotifyRateLimitConfig{PerMinute: 60, Burst: 20},
+			Telegram:   TelegramConfig{APIURL: "https://api.telegram.org"},
+			PagerDuty:  PagerDutyConfig{URL: "https://events.pagerduty.com/v2/enqueue"},
+			Opsgenie:   OpsgenieConfig{URL: "https://api.opsgenie.com"},
+			SMTP: SMTPConfig{
+				Port:          587,
+				TLS:           "starttls",
+				SubjectPrefix: "[sshproxy]",
+				Events:        []string{"errors", "security", "capacity"},
+			},
+		},
+		GeoIP: GeoIPConfig{
+			DNSTimeout: Duration{time.Second},
+		},
+		Anomaly: AnomalyConfig{
+			Interval:       Duration{time.Minute},
+			Baseline:       Duration{time.Hour},
+			MinConnections: 20,
+		},
+		State: StateConfig{
+			SaveInterval: Duration{time.Minute},
+		},
+		Upgrade: UpgradeConfig{
+			ReadyTimeout: Duration{30 * time.Second},
+		},
+		Failover: FailoverConfig{
+			Interval: Duration{5 * time.Second},
+			Timeout:  Duration{3 * time.Second},
+			Failures: 3,
+			DNS: DNSHookConfig{
+				TTL:        60,
+				Timeout:    Duration{30 * time.Second},
+				Cloudflare: CloudflareDNSConfig{APIURL: "https://api.cloudflare.com/client/v4"},
+				Route53:    Route53Config{Endpoint: "https://route53.amazonaws.com"},
+			},
+		},
+		Autoscale: AutoscaleConfig{
+			Sustain: Duration{2 * time.Minute},
+			Up:      ScaleHookConfig{Cooldown: Duration{10 * time.Minute}, Timeout: Duration{30 * time.Second}},
+			Down:    ScaleHookConfig{Cooldown: Duration{30 * time.Minute}, Timeout: Duration{30 * time.Second}},
+		},
+		BackendPool: BackendPoolConfig{
+			MaxIdle: Duration{30 * time.Second},
+		},
+		TCP: TCPConfig{
+			// Go listens with MPTCP by default
+			Client:  TCPSocketConfig{KeepAlive: defaultKeepAlive, NoDelay: true, MPTCP: true},
+			Backend: TCPSocketConfig{KeepAlive: defaultKeepAlive, NoDelay: true},
+		},
+		Forwarding: ForwardingConfig{
+			BufferSize: 32 * 1024,
+			Splice:     true,
+		},
+		ClientHold: ClientHoldConfig{
+			RetryInterval: Duration{250 * time.Millisecond},
+			MaxBytes:      64 * 1024,
+		},
+		Signatures: SignaturesConfig{
+			ScanBytes: 4096,
+		},
+		Mirror: MirrorConfig{
+			QueueChunks: 256,
+		},
+		Hexdump: HexdumpConfig{
+			MaxSessionBytes: 64 * 1024,
+		},
+		Audit: AuditConfig{
+			CheckpointEvery: Duration{time.Hour},
+		},
+		Log: LogConfig{
+			Level:      "info",
+			MaxSizeMB:  100,
+			MaxBackups: 7,
+			Syslog: SyslogConfig{
+				Facility: "daemon",
+				Tag:      "sshproxy",
+			},
+		},
+	}
+}
+
+func loadConfig(path string) (*Config, error) {
+	c := defaultConfig()
+	if path == "" {
+		return c, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %v", path, err)
+	}
+	if l := c.Limits; l.ClearPercent != nil && (*l.ClearPercent < 0 || *l.ClearPercent >= l.AlertPercent) {
+		return nil, fmt.Errorf("limits.clear_percent must be at least 0 and below alert_percent (%g), got %g", l.AlertPercent, *l.ClearPercent)
+	}
+	if p := c.Notify.DropPolicy; p != "drop_newest" && p != "drop_oldest" {
+		return nil, fmt.Errorf("notify.drop_policy must be drop_newest or drop_oldest, got %q", p)
+	}
+	for key, url := range c.Notify.Routes {
+		if !knownEmbedKey(key) {
+			return nil, fmt.Errorf("notify.routes: unknown category or embed type %q", key)
+		}
+		if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+			return nil, fmt.Errorf("notify.routes.%s: webhook must be an http(s) URL", key)
+		}
+	}
+	if u := c.Notify.Slack.URL; u != "" && !strings.HasPrefix(u, "https://") && !strings.HasPrefix(u, "http://") {
+		return nil, fmt.Errorf("notify.slack.url must be an http(s) URL")
+	}
+	for _, key := range c.Notify.Slack.Events {
+		if !knownEmbedKey(key) {
+			return nil, fmt.Errorf("notify.slack.events: unknown category or embed type %q", key)
+		}
+	}
+	if c.Notify.Telegram.BotToken != "" && c.Notify.Telegram.ChatID == "" {
+		return nil, fmt.Errorf("notify.telegram.chat_id is required with bot_token")
+	}
+	for _, key := range c.Notify.Telegram.Events {
+		if !knownEmbedKey(key) {
+			return nil, fmt.Errorf("notify.telegram.events: unknown category or embed type %q", key)
+		}
+	}
+	if s := c.Notify.SMTP; s.Host != "" {
+		if s.From == "" || len(s.To) == 0 {
+			return nil, fmt.Errorf("notify.smtp needs from and at least one to address")
+		}
+		if s.TLS != "starttls" && s.TLS != "tls" && s.TLS != "none" {
+			return nil, fmt.Errorf("notify.smtp.tls must be starttls, tls or none, got %q", s.TLS)
+		}
+		if s.TLS == "none" && (s.Username != "" || s.Password != "") {
+			return nil, fmt.Errorf("notify.smtp.username and password would be sent in the clear with tls none, use starttls or tls")
+		}
+		for _, key := range s.Events {
+			if !knownEmbedKey(key) {
+				return nil, fmt.Errorf("notify.smtp.events: unknown category or embed type %q", key)
+			}
+		}
+	}
+	for name, sev := range map[string]string{
+		"notify.min_severity":          c.Notify.MinSeverity,
+		"notify.slack.min_severity":    c.Notify.Slack.MinSeverity,
+		"notify.telegram.min_severity": c.Notify.Telegram.MinSeverity,
+		"notify.smtp.min_severity":     c.Notify.SMTP.MinSeverity,
+	} {
+		if !validSeverity(sev) {
+			return nil, fmt.Errorf("%s must be debug, info, warning or critical, got %q", name, sev)
+		}
+	}
+	for sev, color := range c.Notify.Colors {
+		if sev == "" || !validSeverity(sev) {
+			return nil, fmt.Errorf("notify.colors: unknown severity %q", sev)
+		}
+		if _, err := parseColor(color); err != nil {
+			return nil, fmt.Errorf("notify.colors.%s: %v", sev, err)
+		}
+	}
+	if err := loadAlertTemplates(c.Notify.Templates); err != nil {
+		return nil, err
+	}
+	if err := loadWebhooks(c.Notify.Webhooks); err != nil {
+		return nil, err
+	}
+	if c.GeoIP.NewCountryAlerts && c.GeoIP.CityDB == "" {
+		return nil, fmt.Errorf("geoip.new_country_alerts needs geoip.city_db")
+	}
+	if c.HealthCheck.Failures < 1 || c.HealthCheck.RecoverAfter.Duration < 0 {
+		return nil, fmt.Errorf("health_check.failures must be at least 1 and recover_after can't be negative")
+	}
+	if ch := c.Chaos; ch.Latency.Duration < 0 || ch.Jitter.Duration < 0 || ch.Bandwidth < 0 {
+		return nil, fmt.Errorf("chaos.latency, jitter and bandwidth can't be negative")
+	} else if ch.ResetProbability < 0 || ch.ResetProbability > 1 {
+		return nil, fmt.Errorf("chaos.reset_probability must be between 0 and 1")
+	}
+	if p := c.Canary.Percent; p < 0 || p > 100 {
+		return nil, fmt.Errorf("canary.percent must be from 0 to 100, got %g", p)
+	}
+	if a := c.Anomaly; a.Factor < 0 || a.ZScore < 0 {
+		return nil, fmt.Errorf("anomaly.factor and anomaly.zscore can't be negative")
+	} else if (a.Factor > 0 || a.ZScore > 0) && (a.Interval.Duration <= 0 || a.Baseline.Duration < 4*a.Interval.Duration) {
+		return nil, fmt.Errorf("anomaly.baseline must cover at least four intervals")
+	}
+	for i := range c.Events.Exec {
+		h := &c.Events.Exec[i]
+		if len(h.Command) == 0 {
+			return nil, fmt.Errorf("events.exec[%d]: command is empty", i)
+		}
+		for _, typ := range h.Events {
+			if !knownEventType(typ) {
+				return nil, fmt.Errorf("events.exec[%d]: unknown event type %q", i, typ)
+			}
+		}
+		if h.Timeout.Duration <= 0 {
+			h.Timeout.Duration = 10 * time.Second
+		}
+	}
+	if len(c.Events.Exec) > 0 && c.Events.ExecConcurrency < 1 {
+		return nil, fmt.Errorf("events.exec_concurrency must be at least 1")
+	}
+	if k := c.Events.Kafka; len(k.Brokers) > 0 || k.URL != "" {
+		if len(k.Brokers) > 0 && k.URL != "" {
+			return nil, fmt.Errorf("events.kafka takes brokers or a REST proxy url, not both")
+		}
+		if k.Topic == "" {
+			return nil, fmt.Errorf("events.kafka.topic can't be empty")
+		}
+		for _, b := range k.Brokers {
+			if _, _, err := net.SplitHostPort(b); err != nil {
+				return nil, fmt.Errorf("events.kafka.brokers: %q must be host:port", b)
+			}
+		}
+		switch k.SASLMechanism {
+		case "PLAIN", "SCRAM-SHA-256", "SCRAM-SHA-512":
+		default:
+			return nil, fmt.Errorf("events.kafka.sasl_mechanism must be PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512, got %q", k.SASLMechanism)
+		}
+	}
+	if c.DiscordBot.Listen != "" {
+		if key, err := hex.DecodeString(c.DiscordBot.PublicKey); err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("discord_bot.public_key must be the application's hex public key")
+		}
+		if len(c.DiscordBot.Roles) == 0 {
+			return nil, fmt.Errorf("discord_bot.roles must list at least one role ID allowed to run commands")
+		}
+		if c.DiscordBot.Token != "" && c.DiscordBot.ApplicationID == "" {
+			return nil, fmt.Errorf("discord_bot.application_id is needed to register commands")
+		}
+	}
+	tenantNames := map[string]bool{}
+	for i, t := range c.Tenants {
+		if err := validTag(t.Name); err != nil {
+			return nil, fmt.Errorf("tenants[%d]: name: %v", i, err)
+		}
+		if tenantNames[t.Name] {
+			return nil, fmt.Errorf("tenant %s is listed twice", t.Name)
+		}
+		tenantNames[t.Name] = true
+		if _, _, err := net.SplitHostPort(t.Listen); err != nil {
+			return nil, fmt.Errorf("tenant %s: listen must be host:port", t.Name)
+		}
+		if t.Backend == "" {
+			return nil, fmt.Errorf("tenant %s needs a backend", t.Name)
+		}
+		for _, list := range [][]string{t.Allow, t.Deny} {
+			for _, a := range list {
+				if _, err := parseIPOrCIDR(a); err != nil {
+					return nil, fmt.Errorf("tenant %s: %v", t.Name, err)
+				}
+			}
+		}
+		if t.MaxConnections < 0 {
+			return nil, fmt.Errorf("tenant %s: max_connections can't be negative", t.Name)
+		}
+		if u := t.Webhook; u != "" && !strings.HasPrefix(u, "https://") && !strings.HasPrefix(u, "http://") {
+			return nil, fmt.Errorf("tenant %s: webhook must be an http(s) URL", t.Name)
+		}
+	}
+	names := map[string]bool{}
+	for i, u := range c.Admin.Users {
+		if u.Name == "" {
+			return nil, fmt.Errorf("admin.users[%d] needs a name", i)
+		}
+		if names[u.Name] {
+			return nil, fmt.Errorf("admin user %s is listed twice", u.Name)
+		}
+		names[u.Name] = true
+		if u.Token == "" && u.Password == "" {
+			return nil, fmt.Errorf("admin user %s needs a token or a password", u.Name)
+		}
+		if u.Role != "read" && u.Role != "operator" {
+			return nil, fmt.Errorf("admin user %s: role must be read or operator", u.Name)
+		}
+		if u.Tenant != "" && !tenantNames[u.Tenant] {
+			return nil, fmt.Errorf("admin user %s: no tenant named %s", u.Name, u.Tenant)
+		}
+	}
+	if c.Admin.GRPCListen != "" && c.Admin.Token == "" && len(c.Admin.Users) == 0 {
+		return nil, fmt.Errorf("admin.grpc_listen needs admin.token or admin.users")
+	}
+	if _, err := strconv.ParseUint(c.Control.Mode, 8, 32); err != nil {
+		return nil, fmt.Errorf("control.mode must be an octal file mode like 0660")
+	}
+	for _, r := range c.Tagging.Rules {
+		if err := validTag(r.Tag); err != nil {
+			return nil, fmt.Errorf("tagging: %v", err)
+		}
+		for _, ip := range r.IPs {
+			if _, err := parseIPOrCIDR(ip); err != nil {
+				return nil, fmt.Errorf("tagging rule %s: %v", r.Tag, err)
+			}
+		}
+	}
+	if p := c.OTLPMetrics.Protocol; p != "http/json" && p != "grpc" {
+		return nil, fmt.Errorf("otlp_metrics.protocol must be http/json or grpc, got %q", p)
+	}
+	if e := c.OTLPMetrics.Endpoint; e != "" && !strings.HasPrefix(e, "http://") && !strings.HasPrefix(e, "https://") {
+		return nil, fmt.Errorf("otlp_metrics.endpoint must be an http(s) URL")
+	}
+	if c.OTLPMetrics.Endpoint != "" && c.OTLPMetrics.Interval.Duration <= 0 {
+		return nil, fmt.Errorf("otlp_metrics.interval must be positive")
+	}
+	if c.State.File != "" && c.State.SaveInterval.Duration <= 0 {
+		return nil, fmt.Errorf("state.save_interval must be positive")
+	}
+	if c.Listener.Acceptors < 0 {
+		return nil, fmt.Errorf("listener.acceptors can't be negative")
+	}
+	if _, ok := soReusePort(); c.Listener.Acceptors > 1 && !ok {
+		return nil, fmt.Errorf("listener.acceptors above 1 needs SO_REUSEPORT load balancing, which %s doesn't have", runtime.GOOS)
+	}
+	if c.Upgrade.ReadyTimeout.Duration <= 0 || c.Upgrade.DrainTimeout.Duration < 0 {
+		return nil, fmt.Errorf("upgrade.ready_timeout must be positive and upgrade.drain_timeout can't be negative")
+	}
+	if runtime.GOOS == "windows" && (c.Daemon.Background || c.Daemon.User != "") {
+		return nil, fmt.Errorf("daemon.background and daemon.user aren't supported on Windows")
+	}
+	if c.Daemon.Group != "" && c.Daemon.User == "" {
+		return nil, fmt.Errorf("daemon.group needs daemon.user")
+	}
+	if c.Forwarding.BufferSize < 1024 || c.Forwarding.BufferSize > 16*1024*1024 {
+		return nil, fmt.Errorf("forwarding.buffer_size must be between 1024 and 16777216 bytes")
+	}
+	for side, o := range map[string]TCPSocketConfig{"client": c.TCP.Client, "backend": c.TCP.Backend} {
+		if o.RecvBuffer < 0 || o.SendBuffer < 0 {
+			return nil, fmt.Errorf("tcp.%s buffer sizes can't be negative", side)
+		}
+		if o.FastOpen && !fastOpenSupported() {
+			return nil, fmt.Errorf("tcp.%s.fast_open isn't supported on %s", side, runtime.GOOS)
+		}
+		if k := o.KeepAlive; k.Enabled && (k.Idle.Duration < time.Second || k.Interval.Duration < time.Second || k.Count <= 0) {
+			return nil, fmt.Errorf("tcp.%s.keepalive needs an idle and interval of at least 1s and a positive count", side)
+		}
+	}
+	if c.BackendPool.Size < 0 || c.BackendPool.MaxIdle.Duration <= 0 {
+		return nil, fmt.Errorf("backend_pool.size can't be negative and backend_pool.max_idle must be positive")
+	}
+	if c.ClientHold.Timeout.Duration < 0 || c.ClientHold.RetryInterval.Duration <= 0 || c.ClientHold.MaxBytes < 0 {
+		return nil, fmt.Errorf("client_hold.timeout and max_bytes can't be negative and client_hold.retry_interval must be positive")
+	}
+	if c.Autoscale.Sustain.Duration < throughputSampleInterval {
+		return nil, fmt.Errorf("autoscale.sustain must be at least %s", throughputSampleInterval)
+	}
+	for name, h := range map[string]ScaleHookConfig{"up": c.Autoscale.Up, "down": c.Autoscale.Down} {
+		thresholds := h.Connections > 0 || h.BandwidthMbps > 0
+		action := len(h.Command) > 0 || h.Webhook != ""
+		switch {
+		case h.Connections < 0 || h.BandwidthMbps < 0:
+			return nil, fmt.Errorf("autoscale.%s thresholds can't be negative", name)
+		case thresholds != action:
+			return nil, fmt.Errorf("autoscale.%s needs both a threshold and a command or webhook", name)
+		case h.Cooldown.Duration < 0 || h.Timeout.Duration <= 0:
+			return nil, fmt.Errorf("autoscale.%s.cooldown can't be negative and timeout must be positive", name)
+		}
+	}
+	if f := c.Failover; f.Role != "" {
+		if f.Role != "primary" && f.Role != "standby" {
+			return nil, fmt.Errorf("failover.role must be primary or standby")
+		}
+		if f.Peer == "" || f.Interval.Duration <= 0 || f.Timeout.Duration <= 0 || f.Failures < 1 {
+			return nil, fmt.Errorf("failover needs a peer, a positive interval and timeout, and failures of at least 1")
+		}
+		if err := validateDNSHook(f.DNS, f.Role == "standby"); err != nil {
+			return nil, fmt.Errorf("failover.dns: %v", err)
+		}
+	}
+	if c.Workers.Count < 0 {
+		return nil, fmt.Errorf("workers.count can't be negative")
+	}
+	if c.Workers.Count > 1 {
+		if _, ok := soReusePort(); !ok || runtime.GOOS == "windows" {
+			return nil, fmt.Errorf("workers.count above 1 needs SO_REUSEPORT load balancing, which %s doesn't have", runtime.GOOS)
+		}
+		if c.Listener.Acceptors > 1 {
+			return nil, fmt.Errorf("workers.count and listener.acceptors can't both be above 1")
+		}
+	}
+	if c.Audit.File != "" && c.Audit.KeyFile == "" {
+		c.Audit.KeyFile = c.Audit.File + ".key"
+	}
+	return c, nil
+}
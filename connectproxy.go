@@ -3,41 +3,43 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
-	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
 var (
-	loggedIPs    = map[string]bool{}
-	forwardCounts = map[string]int{}
-	loggedForwarding = map[string]bool{}
-	mu            sync.Mutex
-	webhookURL    string = "WEBHOOK_URL" 
+	webhookURL string = "WEBHOOK_URL"
+	startTime         = time.Now()
+	version           = "dev"
 )
 
 type DiscordEmbed struct {
-	Title       string `json:"title"`
-	Description string `json:"description"`
-	Color       int    `json:"color"`
-	Timestamp   string `json:"timestamp"`
-	Fields      []struct {
-		Name  string `json:"name"`
-		Value string `json:"value"`
-	} `json:"fields"`
+	Title       string              `json:"title"`
+	Description string              `json:"description"`
+	Color       int                 `json:"color"`
+	Timestamp   string              `json:"timestamp"`
+	Fields      []DiscordEmbedField `json:"fields,omitempty"`
+
+	// severity isn't sent; it decides whether the message mentions anyone
+	severity string
 }
 
 type DiscordWebhookPayload struct {
-	Username string       `json:"username"`
-	Content  string       `json:"content"`
-	Embeds   []DiscordEmbed `json:"embeds"`
+	Username  string         `json:"username"`
+	AvatarURL string         `json:"avatar_url,omitempty"`
+	Content   string         `json:"content"`
+	Embeds    []DiscordEmbed `json:"embeds"`
 }
 
 type DiscordError struct {
@@ -46,192 +48,734 @@ type DiscordError struct {
 }
 
 type DiscordEmbedField struct {
-	Name  string `json:"name"`
-	Value string `json:"value"`
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline,omitempty"`
 }
 
+// sendDiscordEmbed queues an embed for the notification worker and returns
+// straight away; the error only reports that it couldn't be queued.
 func sendDiscordEmbed(title, description string, color int, fields ...*DiscordEmbedField) error {
-	if webhookURL == "" {
-		return fmt.Errorf("empty or malformed webhookURL")
-	}
+	return sendAlert(nil, title, description, color, fields...)
+}
 
+// sendAlert is sendDiscordEmbed with the event details the alert is about,
+// which notify.templates can use to reword it.
+func sendAlert(vars alertVars, title, description string, color int, fields ...*DiscordEmbedField) error {
 	embed := DiscordEmbed{
 		Title:       title,
 		Description: description,
 		Color:       color,
 		Timestamp:   time.Now().Format(time.RFC3339),
 	}
-	data, err := json.Marshal(embed)
-	if err != nil {
-		log.Printf("Failed to marshal Discord embed: %v", err)
-		return err
+	for _, f := range fields {
+		embed.Fields = append(embed.Fields, *f)
+	}
+	kind := embedKind(title)
+	if c, ok := severityColor(embedSeverity(kind)); ok {
+		embed.Color = c
 	}
+	if id, ok := vars["conn_id"].(string); ok && vars["tenant"] == nil {
+		if s := findSession(id); s != nil && s.tenant != "" {
+			vars["tenant"] = s.tenant
+		}
+	}
+	embed = applyAlertTemplate(kind, vars, embed)
+	recordAlert(kind, embed)
+	if url := tenantWebhook(vars); url != "" {
+		// the tenant's own copy skips the digest and throttle, which are
+		// tuned for the operator's channel
+		if err := enqueueNotification("discord", url, embed); err != nil {
+			warnf("Failed to queue tenant notification: %v", err)
+		}
+	}
+	if coalesceEmbed(kind, embed) || !throttleAllow(kind) {
+		return nil
+	}
+	return dispatchEmbed(kind, embed)
+}
 
+// postDiscordEmbeds sends one webhook message. wait is how long Discord
+// wants us to hold off before the next one, from its rate-limit headers.
+func postDiscordEmbeds(url string, embeds []DiscordEmbed) (wait time.Duration, err error) {
+	defer func() {
+		if err != nil && !isRateLimited(err) {
+			webhookFailures.inc()
+		}
+	}()
 	payload := DiscordWebhookPayload{
-		Username: "ANYTHING",
-		Content:  "",
-		Embeds:   []DiscordEmbed{embed},
+		Username:  conf().Notify.Username,
+		AvatarURL: conf().Notify.AvatarURL,
+		Content:   "",
+		Embeds:    embeds,
+	}
+	for _, e := range embeds {
+		if e.severity == "critical" {
+			// mentions only ping from the message content, not from embeds
+			payload.Content = conf().Notify.Mention
+		}
 	}
-	data, err = json.Marshal(payload)
+	data, err := json.Marshal(payload)
 	if err != nil {
-		log.Printf("Failed to marshal Discord webhook payload: %v", err)
-		return err
+		warnf("Failed to marshal Discord webhook payload: %v", err)
+		return 0, err
 	}
 
-	req, err := http.NewRequest("POST", webhookURL, bytes.NewBuffer(data))
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
 	if err != nil {
-		log.Printf("Failed to create HTTP request: %v", err)
-		return err
+		warnf("Failed to create HTTP request: %v", err)
+		return 0, err
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := webhookClient.Do(req)
 	if err != nil {
-		log.Printf("Failed to send Discord embed: %v", err)
-		return err
+		warnf("Failed to send Discord embed: %v", err)
+		return 0, err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusTooManyRequests {
+		body, _ := ioutil.ReadAll(resp.Body)
+		wait = rateLimitWait(resp.Header, body)
+		warnf("Discord webhook rate limited, pausing sends for %s", wait)
+		return wait, &webhookStatusError{code: resp.StatusCode, status: resp.Status}
+	}
 	if resp.StatusCode != http.StatusNoContent {
-		log.Printf("Failed to send Discord embed: %s", resp.Status)
+		statusErr := &webhookStatusError{code: resp.StatusCode, status: resp.Status}
+		warnf("Failed to send Discord embed: %s", resp.Status)
 		body, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
-			log.Printf("Failed to read response body: %v", err)
-			return err
+			warnf("Failed to read response body: %v", err)
+			return 0, statusErr
 		}
-		log.Printf("Response Body: %s", string(body))
+		warnf("Response Body: %s", string(body))
 		var discordError DiscordError
 		err = json.Unmarshal(body, &discordError)
 		if err != nil {
-			log.Printf("Failed to unmarshal Discord error: %v", err)
-			return err
+			warnf("Failed to unmarshal Discord error: %v", err)
+			return 0, statusErr
 		}
-		log.Printf("Discord Error: %s", discordError.Message)
-		return fmt.Errorf("unexpected response status: %s", resp.Status)
+		warnf("Discord Error: %s", discordError.Message)
+		return 0, statusErr
 	}
 
-	return nil
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		return rateLimitWait(resp.Header, nil), nil
+	}
+	return 0, nil
 }
 
-func forward(src, dest net.Conn, direction string, wg *sync.WaitGroup) {
+func forward(sess *session, src, dest net.Conn, direction string, wg *sync.WaitGroup) {
+	defer reportPanic()
 	defer wg.Done()
-	clientIP := src.RemoteAddr().String()
-	ip := clientIP[:strings.Index(clientIP, ":")]
-	bytesCopied, err := io.Copy(src, dest)
+	defer sess.directionDone()
+	ip := src.RemoteAddr().String()
+	if i := strings.Index(ip, ":"); i >= 0 {
+		// built-in test backends have no port
+		ip = ip[:i]
+	}
+	var w io.Writer = dest
+	if sess.chaos {
+		w = &chaosWriter{sess: sess, dst: dest, c: conf().Chaos}
+	}
+	buf := getCopyBuffer()
+	defer putCopyBuffer(buf)
+	var bytesCopied int64
+	var err error
+	for {
+		var n int64
+		n, err = copyStream(sess, w, src, dest, direction, *buf)
+		bytesCopied += n
+		h := sess.pausedForHandover()
+		if err == nil || h == nil {
+			break
+		}
+		if h.park() {
+			// the new process has the connections now
+			return
+		}
+	}
+	if err == nil {
+		if direction == "client->backend" {
+			sess.setCloseReason("client_closed")
+		} else {
+			sess.setCloseReason("backend_closed")
+		}
+	}
 	if err != nil {
-		mu.Lock()
-		if !loggedIPs[ip] {
-			loggedIPs[ip] = true
-			if err := sendDiscordEmbed("Forwarding Error", fmt.Sprintf("Failed to forward %d bytes (%s)", bytesCopied, direction), 0xFF0000); err != nil {
-				log.Printf("Failed to send Discord embed: %v", err)
+		// the other direction may be waiting on a peer that's still there
+		src.Close()
+		dest.Close()
+		switch {
+		case errors.Is(err, syscall.ETIMEDOUT):
+			// keepalive gave up on the peer
+			backendStreamErrors.inc(sess.backend)
+			sess.setCloseReason("timed_out")
+		case !errors.Is(err, net.ErrClosed) && !errors.Is(err, errChaosReset) && !errors.Is(err, errSignatureKill):
+			backendStreamErrors.inc(sess.backend)
+			sess.setCloseReason("stream_error")
+		}
+		if loggedIPs.allow("forward_error:" + ip) {
+			if err := sendAlert(alertVars{"ip": anonIP(ip), "conn_id": sess.id, "backend": sess.backend, "bytes": bytesCopied, "direction": direction}, "Forwarding Error", fmt.Sprintf("Failed to forward %d bytes (%s)", bytesCopied, direction), 0xFF0000, connField(sess.id)); err != nil {
+				warnf("Failed to send Discord embed: %v", err)
 			}
 		}
-		mu.Unlock()
 		return
 	}
-	mu.Lock()
-	forwardCounts[ip]++
-	if forwardCounts[ip] <= 2 {
-		if !loggedForwarding[ip] {
-			loggedForwarding[ip] = true
-			log.Printf("forwarded %d bytes (%s)\n", bytesCopied, direction)
-			if err := sendDiscordEmbed("Forwarding Success", fmt.Sprintf("Forwarded %d bytes (%s)", bytesCopied, direction), 0x008000); err != nil {
-				log.Printf("Failed to send Discord embed: %v", err)
-			}
+	if loggedIPs.allow("forwarded:" + ip) {
+		infof("[%s] forwarded %d bytes (%s)\n", sess.id, bytesCopied, direction)
+		if err := sendAlert(alertVars{"ip": anonIP(ip), "conn_id": sess.id, "backend": sess.backend, "bytes": bytesCopied, "direction": direction}, "Forwarding Success", fmt.Sprintf("Forwarded %d bytes (%s)", bytesCopied, direction), 0x008000, connField(sess.id)); err != nil {
+			warnf("Failed to send Discord embed: %v", err)
 		}
 	}
-	mu.Unlock()
 	src.Close()
 	dest.Close()
 }
 
-func handleClient(client net.Conn, targetAddr string) {
+func handleClient(client net.Conn, listenAddr, targetAddr string, t *tenant) {
+	defer reportPanic()
 	defer client.Close()
+	tuneClient(client)
 	clientIP := client.RemoteAddr().String()
 	ip := clientIP[:strings.Index(clientIP, ":")]
-	mu.Lock()
-	if !loggedIPs[ip] {
-		loggedIPs[ip] = true
-		log.Printf("client connected from %s\n", clientIP)
-		if err := sendDiscordEmbed("Client Connected", fmt.Sprintf("New client connected from %s", clientIP), 0x008000); err != nil {
-			log.Printf("Failed to send Discord embed: %v", err)
+	if conf().Anomaly.Factor > 0 || conf().Anomaly.ZScore > 0 {
+		noteSpikeConnection(ip)
+	}
+	shown := anonAddr(clientIP)
+	id := newConnID()
+	root := startSpan("session", spanKindServer, nil)
+	root.setAttr("client.address", shown)
+	root.setAttr("sshproxy.conn_id", id)
+	defer root.end()
+	reject := func(reason, backend string) {
+		connectionsRejected.inc(reason)
+		if t != nil {
+			tenantRejected.inc(t.Name, reason)
+		}
+		root.setAttr("sshproxy.rejected", reason)
+		publishEvent(sessionEvent{Type: "rejected", ID: id, Tenant: t.name(), Src: shown, Backend: backend, Reason: reason})
+	}
+	if isBanned(ip) {
+		infof("[%s] rejected client %s: banned\n", id, shown)
+		reject("banned", "")
+		return
+	}
+	if t != nil && !t.permits(ip) {
+		infof("[%s] rejected client %s: not allowed for tenant %s\n", id, shown, t.Name)
+		reject("acl", "")
+		return
+	}
+	if inMaintenance() {
+		infof("[%s] rejected client %s: maintenance mode\n", id, shown)
+		reject("maintenance", "")
+		rejectMaintenance(client)
+		return
+	}
+	if t == nil {
+		// standby and canary routing are for the main listener's backend
+		targetAddr = canaryFor(backendFor(targetAddr), ip)
+	}
+	root.setAttr("sshproxy.backend", targetAddr)
+	if t != nil {
+		if !t.acquire() {
+			infof("[%s] rejected client %s: tenant %s is at its limit of %d connections\n", id, shown, t.Name, t.MaxConnections)
+			reject("tenant_quota", targetAddr)
+			return
 		}
+		defer t.release()
+	}
+	sess, ok := trackSession(id, client, ip)
+	if !ok {
+		infof("[%s] rejected client %s: connection cap of %d reached\n", id, shown, conf().Limits.MaxConnections)
+		reject("capacity", targetAddr)
+		return
+	}
+	sess.tenant = t.name()
+	defer untrackSession(sess)
+	noteDigestIP(ip)
+	sess.span = root
+	sess.geo = lookupGeo(ip)
+	sess.hexdump = newHexdumper(id, ip)
+	sess.chaos = chaosSelected(ip)
+	sess.sigs = newSigScanner()
+	sess.route = listenAddr + "->" + targetAddr
+	tagNewSession(sess, targetAddr)
+	publishEvent(sess.event("open"))
+	// keyed by the anonymised address, since client keys end up in the
+	// state file
+	if loggedIPs.allow("client:" + anonIP(ip)) {
+		infof("[%s] client connected from %s\n", id, shown)
+		// off the connection path, rDNS can take a while
+		go func(geo geoInfo) {
+			rdns := reverseDNS(ip)
+			fields := append([]*DiscordEmbedField{connField(id), sourceField(anonIP(ip))}, geoFields(geo, rdns)...)
+			vars := geo.vars(alertVars{"ip": anonIP(ip), "conn_id": id, "backend": targetAddr}, rdns)
+			if err := sendAlert(vars, "Client Connected", fmt.Sprintf("New client connected from %s", shown), 0x008000, fields...); err != nil {
+				warnf("Failed to send Discord embed: %v", err)
+			}
+		}(sess.geo)
+	}
+	dial := startSpan("backend.dial", spanKindClient, root)
+	dial.setAttr("server.address", targetAddr)
+	dialStart := time.Now()
+	target, prefix, pooled := takePooled(targetAddr)
+	var err error
+	if pooled {
+		dial.setAttr("sshproxy.pooled", "true")
+	} else {
+		target, err = dialBackend(targetAddr, 0, backendSocket(t))
+	}
+	var held []byte
+	if err != nil && conf().ClientHold.Timeout.Duration > 0 {
+		target, held, err = holdClient(sess, client, targetAddr, err)
+	}
+	dial.setError(err)
+	dial.end()
+	if errors.Is(err, errClientLeft) {
+		sess.setCloseReason("client_closed")
+		infof("[%s] %v before %s could be reached\n", id, err, targetAddr)
+		return
 	}
-	mu.Unlock()
-	target, err := net.Dial("tcp", targetAddr)
 	if err != nil {
-		log.Printf("failed to connect to backend server at %s: %v\n", targetAddr, err)
-		if err := sendDiscordEmbed("Backend Connection Error", fmt.Sprintf("Failed to connect to backend server at %s: %v", targetAddr, err), 0xFF0000); err != nil {
-			log.Printf("Failed to send Discord embed: %v", err)
+		root.setError(err)
+		sess.setCloseReason("dial_failed")
+		backendDialErrors.inc(targetAddr)
+		markBackend(targetAddr, false)
+		errorf("[%s] failed to connect to backend server at %s: %v\n", id, targetAddr, err)
+		if err := sendAlert(alertVars{"ip": anonIP(ip), "conn_id": id, "backend": targetAddr, "error": err.Error()}, "Backend Connection Error", fmt.Sprintf("Failed to connect to backend server at %s: %v", targetAddr, err), 0xFF0000, connField(id), sourceField(anonIP(ip))); err != nil {
+			warnf("Failed to send Discord embed: %v", err)
 		}
 		return
 	}
 	defer target.Close()
-	mu.Lock()
-	if !loggedIPs[targetAddr] {
-		loggedIPs[targetAddr] = true
-		log.Printf("connected to backend server at %s\n", targetAddr)
-		if err := sendDiscordEmbed("Backend Connected", fmt.Sprintf("Connected to backend server at %s", targetAddr), 0x008000); err != nil {
-			log.Printf("Failed to send Discord embed: %v", err)
+	markBackend(targetAddr, true)
+	backendDialSuccesses.inc(targetAddr)
+	if !pooled {
+		recordDialLatency(id, targetAddr, time.Since(dialStart))
+	}
+	sess.setTarget(target, targetAddr)
+	startCapture(sess)
+	sess.mirror = startMirror(sess)
+	publishEvent(sess.event("connected"))
+	if firstFromCountry(sess.geo) {
+		warnf("[%s] first connection from %s (%s)\n", id, sess.geo.Country, shown)
+		vars := sess.geo.vars(alertVars{"ip": anonIP(ip), "conn_id": id, "backend": targetAddr}, "")
+		fields := append([]*DiscordEmbedField{connField(id), sourceField(anonIP(ip))}, geoFields(sess.geo, "")...)
+		if err := sendAlert(vars, "New Country", fmt.Sprintf("%s connected from %s, the first session from that country", shown, sess.geo.Country), 0xFF0000, fields...); err != nil {
+			warnf("Failed to send Discord embed: %v", err)
+		}
+	}
+	if loggedIPs.allow("backend:" + targetAddr) {
+		infof("[%s] connected to backend server at %s\n", id, targetAddr)
+		if err := sendAlert(alertVars{"ip": anonIP(ip), "conn_id": id, "backend": targetAddr}, "Backend Connected", fmt.Sprintf("Connected to backend server at %s", targetAddr), 0x008000, connField(id)); err != nil {
+			warnf("Failed to send Discord embed: %v", err)
+		}
+	}
+	if len(held) > 0 {
+		// through the same accounting, capture and scanning as the rest
+		if _, err := io.Copy(target, &countingReader{r: bytes.NewReader(held), sess: sess, direction: "client->backend"}); err != nil {
+			sess.setCloseReason("stream_error")
+			return
+		}
+	}
+	if len(prefix) > 0 {
+		// what the backend sent while the connection was pooled
+		if _, err := io.Copy(client, &countingReader{r: bytes.NewReader(prefix), sess: sess, direction: "backend->client"}); err != nil {
+			sess.setCloseReason("stream_error")
+			return
 		}
 	}
-	mu.Unlock()
+	pipeSession(sess, client, target)
+}
+
+// pipeSession forwards both ways until the session ends.
+func pipeSession(sess *session, client, target net.Conn) {
 	var wg sync.WaitGroup
 	wg.Add(2)
-	go forward(client, target, "client->backend", &wg)
-	go forward(target, client, "backend->client", &wg)
+	go forward(sess, client, target, "client->backend", &wg)
+	go forward(sess, target, client, "backend->client", &wg)
 	wg.Wait()
+	sess.teardown.end()
 }
 
-func startProxy(listenAddr, targetAddr string) {
-	mu.Lock()
-	if !loggedIPs[listenAddr] {
-		loggedIPs[listenAddr] = true
-		log.Printf("Attempting to starting tcp proxy on %s and forwarding to %s\n", listenAddr, targetAddr)
+// bindProxy opens the listening sockets for a proxy address, alerting
+// and returning nil if it can't.
+func bindProxy(listenAddr, targetAddr string) []net.Listener {
+	if loggedIPs.allow("starting:" + listenAddr) {
+		infof("Attempting to starting tcp proxy on %s and forwarding to %s\n", listenAddr, targetAddr)
 		if err := sendDiscordEmbed("Proxy Starting", fmt.Sprintf("Attempting to start TCP proxy on %s and forwarding to %s", listenAddr, targetAddr), 0x008000); err != nil {
-			log.Printf("Failed to send Discord embed: %v", err)
+			warnf("Failed to send Discord embed: %v", err)
 		}
 	}
-	mu.Unlock()
-	listener, err := net.Listen("tcp", listenAddr)
+	acceptors, err := listenAcceptors(listenAddr)
 	if err != nil {
-		log.Printf("failed to start tcp proxy on %s: %v\n", listenAddr, err)
-		if err := sendDiscordEmbed("Proxy Error", fmt.Sprintf("Failed to start TCP proxy on %s: %v", listenAddr, err), 0xFF0000); err != nil {
-			log.Printf("Failed to send Discord embed: %v", err)
+		errorf("failed to start tcp proxy on %s: %v\n", listenAddr, err)
+		reportError(err, "failed to start tcp proxy on "+listenAddr)
+		triggerIncident("listener-"+listenAddr, fmt.Sprintf("Listener failed to bind %s: %v", listenAddr, err), "critical")
+		if err := sendAlert(alertVars{"listen": listenAddr, "error": err.Error()}, "Proxy Error", fmt.Sprintf("Failed to start TCP proxy on %s: %v", listenAddr, err), 0xFF0000); err != nil {
+			warnf("Failed to send Discord embed: %v", err)
 		}
-		return
+		return nil
+	}
+	for _, l := range acceptors {
+		tuneListener(l)
 	}
-	defer listener.Close()
-	mu.Lock()
-	if !loggedIPs[listenAddr] {
-		loggedIPs[listenAddr] = true
-		log.Printf("proxy successfully listening on %s, forwarding to %s\n", listenAddr, targetAddr)
+	resolveIncident("listener-"+listenAddr, "Listener bound "+listenAddr)
+	return acceptors
+}
+
+// serveProxy accepts on the sockets from bindProxy until they're closed.
+func serveProxy(acceptors []net.Listener, listenAddr, targetAddr string, t *tenant) {
+	for _, l := range acceptors {
+		defer l.Close()
+	}
+	if t == nil {
+		listenerBound.Store(true)
+		defer listenerBound.Store(false)
+	}
+	if loggedIPs.allow("online:" + listenAddr) {
+		infof("proxy successfully listening on %s, forwarding to %s\n", listenAddr, targetAddr)
 		if err := sendDiscordEmbed("Proxy Online", fmt.Sprintf("Proxy successfully listening on %s, forwarding to %s", listenAddr, targetAddr), 0x008000); err != nil {
-			log.Printf("Failed to send Discord embed: %v", err)
+			warnf("Failed to send Discord embed: %v", err)
+		}
+	}
+	if len(acceptors) > 1 {
+		infof("accepting on %s with %d SO_REUSEPORT sockets\n", listenAddr, len(acceptors))
+		for i, l := range acceptors[1:] {
+			go acceptLoop(l, strconv.Itoa(i+1), listenAddr, targetAddr, t)
 		}
+		acceptLoop(acceptors[0], "0", listenAddr, targetAddr, t)
+		return
 	}
-	mu.Unlock()
+	acceptLoop(acceptors[0], "", listenAddr, targetAddr, t)
+}
+
+// acceptLoop serves one listening socket; acceptor is its index when the
+// address is split over several.
+func acceptLoop(listener net.Listener, acceptor, listenAddr, targetAddr string, t *tenant) {
+	var delay time.Duration
 	for {
 		client, err := listener.Accept()
 		if err != nil {
+			if handedOver.Load() {
+				return
+			}
+			kind := acceptErrorKind(err)
+			acceptErrors.inc(listenAddr, kind)
+			if kind == "temporary" {
+				delay = min(max(2*delay, 5*time.Millisecond), acceptBackoffMax)
+				if loggedIPs.allow("accept-error:" + listenAddr) {
+					warnf("accept on %s failed: %v, backing off\n", listenAddr, err)
+				}
+				time.Sleep(delay)
+				continue
+			}
+			if listener = relisten(listener, acceptor, listenAddr, t == nil, err); listener == nil {
+				return
+			}
+			delay = 0
 			continue
 		}
-		go handleClient(client, targetAddr)
+		delay = 0
+		connectionsAccepted.inc()
+		if acceptor != "" {
+			acceptorAccepted.inc(listenAddr, acceptor)
+		}
+		if t != nil {
+			tenantAccepted.inc(t.Name)
+		}
+		noteActivity()
+		go handleClient(client, listenAddr, targetAddr, t)
 	}
 }
 
 func main() {
-	if len(os.Args) != 4 {
+	configFile := flag.String("config", "", "path to JSON config file")
+	logLevelFlag := flag.String("log-level", "", "debug, info, warn or error (overrides config)")
+	flag.Parse()
+	args := flag.Args()
+	if len(args) > 0 && args[0] == "verify-audit" {
+		runVerifyAudit(args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "replay" {
+		runReplay(args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "bench" {
+		runBench(args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "status" {
+		runStatus(*configFile, args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "reload" {
+		runReload(*configFile, args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "export" {
+		runExport(*configFile, args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "report" {
+		runReport(*configFile, args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "upgrade" {
+		runUpgrade(*configFile, args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "healthcheck" {
+		runHealthcheck(*configFile, args[1:])
+		return
+	}
+	if len(args) != 3 {
 		fmt.Println("Developed by: ----------> tcp | https://t.me/bulletservices/")
-		fmt.Println("usage: ./connectproxy <cncserverip> <cncscreenport> <proxyport>")
-		fmt.Println("example: ./connectproxy 127.0.0.1 1111 1738") 
+		fmt.Println("usage: ./connectproxy [-config proxy.json] [-log-level info] <cncserverip> <cncscreenport> <proxyport>")
+		fmt.Println("example: ./connectproxy 127.0.0.1 1111 1738")
 		return
 	}
-	serverIP := os.Args[1]
-	backendPort := os.Args[2]
-	forwardPort := os.Args[3]
+	c, err := loadConfig(*configFile)
+	if err != nil {
+		log.Fatalf("failed to load config: %v", err)
+	}
+	cfg.Store(c)
+	configPath = *configFile
+	setupWorker()
+	logLevelOverride = *logLevelFlag
+	if *logLevelFlag != "" {
+		conf().Log.Level = *logLevelFlag
+	}
+	level, err := parseLogLevel(conf().Log.Level)
+	if err != nil {
+		log.Fatalf("invalid log level: %v", err)
+	}
+	setLogLevel(level)
+	if conf().Log.File != "" {
+		w, err := newRotatingWriter(conf().Log)
+		if err != nil {
+			log.Fatalf("failed to open log file: %v", err)
+		}
+		log.SetOutput(w)
+	}
+	if conf().Log.Syslog.Enabled {
+		w, err := newSyslogWriter(conf().Log.Syslog)
+		if err != nil {
+			log.Fatalf("failed to connect to syslog: %v", err)
+		}
+		syslogOut = w
+	}
+	if conf().Sentry.DSN != "" {
+		if err := setupSentry(conf().Sentry.DSN); err != nil {
+			log.Fatalf("invalid sentry dsn: %v", err)
+		}
+		defer reportPanic()
+	}
+	if err := setupPrivacy(conf().Privacy); err != nil {
+		log.Fatalf("invalid privacy config: %v", err)
+	}
+	if err := setupGeoIP(conf().GeoIP); err != nil {
+		log.Fatalf("failed to open geoip database: %v", err)
+	}
+	inheritListeners()
+	activatedListeners()
+	daemonize(conf().Daemon, fmt.Sprintf("0.0.0.0:%s", args[2]))
+	if conf().Workers.Count > 1 && workerIndex == 0 {
+		runSupervisor(fmt.Sprintf("0.0.0.0:%s", args[2]))
+	}
+	go watchShutdownSignal()
+	if conf().State.File != "" {
+		if err := loadState(conf().State.File); err != nil {
+			warnf("failed to load state file, starting fresh: %v", err)
+		}
+		if workerIndex > 1 {
+			// the first worker saves it
+			go followBans(conf().State)
+		} else {
+			onShutdown(func() { saveState(conf().State.File) })
+			go runStateSaver(conf().State)
+		}
+	}
+	if conf().Audit.File != "" {
+		if err := startAuditLog(conf().Audit); err != nil {
+			log.Fatalf("failed to open audit log: %v", err)
+		}
+	}
+	if conf().Maintenance.Enabled {
+		setMaintenance(true, "enabled in config")
+	}
+	if conf().Maintenance.FlagFile != "" {
+		go watchMaintenanceFlag(conf().Maintenance.FlagFile)
+	}
+	windows, err := loadMaintenanceWindows(conf().Maintenance.Windows)
+	if err != nil {
+		log.Fatalf("failed to load maintenance windows: %v", err)
+	}
+	if len(windows) > 0 {
+		go runMaintenanceSchedule(windows)
+	}
+	if conf().Admin.Listen != "" {
+		startAdmin(conf().Admin.Listen)
+	}
+	if conf().Admin.GRPCListen != "" {
+		startGRPC(conf().Admin.GRPCListen)
+	}
+	if conf().Control.Socket != "" {
+		if err := startControlSocket(conf().Control); err != nil {
+			log.Fatalf("failed to open control socket: %v", err)
+		}
+	}
+	go watchReloadSignal()
+	go watchDumpSignal()
+	go watchUpgradeSignal()
+	go runSystemdStatus()
+	go runWatchdog(watchdogCheck)
+	go sampleThroughput()
+	if conf().Events.File != "" {
+		if err := startEventFile(conf().Events.File); err != nil {
+			log.Fatalf("failed to open event file: %v", err)
+		}
+	}
+	if conf().Capture.Dir != "" {
+		if err := loadCaptureFilters(conf().Capture); err != nil {
+			log.Fatalf("invalid capture config: %v", err)
+		}
+		enforceCaptureBudget()
+		go runCaptureJanitor()
+		if conf().Capture.S3.Bucket != "" {
+			startS3Uploader(conf().Capture.S3, conf().Capture.Dir)
+		}
+	}
+	if err := loadSignatures(conf().Signatures); err != nil {
+		log.Fatalf("invalid signatures: %v", err)
+	}
+	if err := setChaosTargets(conf().Chaos.IPs); err != nil {
+		log.Fatalf("invalid chaos ips: %v", err)
+	}
+	if conf().Chaos.Enabled {
+		who := "everyone"
+		if len(conf().Chaos.IPs) > 0 {
+			who = strings.Join(conf().Chaos.IPs, ", ")
+		}
+		warnf("chaos mode is on, injecting faults into sessions from %s\n", who)
+	}
+	if err := setHexdumpTargets(conf().Hexdump.IPs); err != nil {
+		log.Fatalf("invalid hexdump ips: %v", err)
+	}
+	if err := setTagRules(conf().Tagging.Rules); err != nil {
+		log.Fatalf("invalid tagging rules: %v", err)
+	}
+	if conf().Hexdump.File != "" {
+		if err := openHexdumpFile(conf().Hexdump.File); err != nil {
+			log.Fatalf("failed to open hexdump file: %v", err)
+		}
+	}
+	if conf().AccessLog.File != "" {
+		if err := openAccessLog(conf().AccessLog.File); err != nil {
+			log.Fatalf("failed to open access log: %v", err)
+		}
+	}
+	if conf().Events.Loki.URL != "" {
+		startShipper("loki", conf().Events, lokiSender(conf().Events.Loki))
+	}
+	if conf().Events.Elasticsearch.URL != "" {
+		startShipper("elasticsearch", conf().Events, elasticsearchSender(conf().Events.Elasticsearch))
+	}
+	if conf().Events.Kafka.URL != "" || len(conf().Events.Kafka.Brokers) > 0 {
+		startShipper("kafka", conf().Events, kafkaSender(conf().Events.Kafka))
+	}
+	if conf().Events.NATS.URL != "" {
+		send, err := natsSender(conf().Events.NATS)
+		if err != nil {
+			log.Fatalf("invalid nats url %s: %v", conf().Events.NATS.URL, err)
+		}
+		startShipper("nats", conf().Events, send)
+	}
+	if len(conf().Events.Exec) > 0 {
+		startExecHooks(conf().Events)
+	}
+	if conf().History.Path != "" {
+		h, err := openHistory(conf().History.Path)
+		if err != nil {
+			log.Fatalf("failed to open history store: %v", err)
+		}
+		history = h
+		if conf().History.Retention.Duration > 0 {
+			go runHistoryPruning(h, conf().History.Retention.Duration)
+		}
+	}
+	if conf().Digest.Interval.Duration > 0 {
+		go runStatsDigest(conf().Digest.Interval.Duration)
+	}
+	if conf().Heartbeat.Interval.Duration > 0 {
+		go runHeartbeat(conf().Heartbeat.Interval.Duration)
+	}
+	if conf().Inactivity.AlertAfter.Duration > 0 {
+		go runInactivityWatch(conf().Inactivity.AlertAfter.Duration)
+	}
+	if conf().Anomaly.Factor > 0 || conf().Anomaly.ZScore > 0 {
+		go runSpikeDetection(conf().Anomaly)
+	}
+	checkFastOpenSysctl()
+	go runAutoscale()
+	if conf().Failover.Role != "" {
+		go runFailover(conf().Failover)
+	}
+	if conf().TopTalkers.Schedule != "" {
+		spec, err := parseCron(conf().TopTalkers.Schedule)
+		if err != nil {
+			log.Fatalf("failed to parse top_talkers schedule: %v", err)
+		}
+		go runCron(spec, func() { reportTopTalkers(conf().TopTalkers) })
+	}
+	if conf().DiscordBot.Listen != "" {
+		startDiscordBot(conf().DiscordBot)
+	}
+	if conf().StatsD.Address != "" {
+		go startStatsD(conf().StatsD)
+	}
+	if conf().Tracing.Endpoint != "" {
+		startTracing(conf().Tracing)
+	}
+	if conf().OTLPMetrics.Endpoint != "" {
+		go startOTLPMetrics(conf().OTLPMetrics)
+	}
+	serverIP := args[0]
+	backendPort := args[1]
+	forwardPort := args[2]
 	listenAddr := fmt.Sprintf("0.0.0.0:%s", forwardPort)
 	targetAddr := fmt.Sprintf("%s:%s", serverIP, backendPort)
+	if strings.Contains(serverIP, "://") {
+		// built-in test backend, the port is ignored
+		targetAddr = serverIP
+	}
 	fmt.Printf("initializing tcp ssh proxy from %s to %s\n", listenAddr, targetAddr)
-	startProxy(listenAddr, targetAddr)
+	primaryBackend = targetAddr
+	setCanaryPercent(conf().Canary.Percent)
+	if err := setupTenants(conf().Tenants); err != nil {
+		log.Fatalf("invalid tenants: %v", err)
+	}
+	if conf().HealthCheck.Interval.Duration > 0 {
+		go runHealthChecks(knownBackends(targetAddr))
+	}
+	startBackendPools()
+	startTenants()
+	if acceptors := bindProxy(listenAddr, targetAddr); acceptors != nil {
+		// everything is bound by now, whether newly or taken over
+		listenersReady()
+		serveProxy(acceptors, listenAddr, targetAddr, nil)
+	}
+	if handedOver.Load() {
+		finishHandover()
+	} else {
+		sdNotify("STOPPING=1")
+	}
+	if conf().State.File != "" {
+		saveState(conf().State.File)
+	}
+	removePIDFile()
+	flushNotifications()
+	flushSentry()
 }
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// The control socket serves the admin endpoints, API included, on a unix
+// socket. Access is whatever the socket's file mode allows, so the API
+// token isn't needed there.
+
+type controlConnKey struct{}
+
+func viaControlSocket(r *http.Request) bool {
+	return r.Context().Value(controlConnKey{}) != nil
+}
+
+// clearStaleSocket removes a socket file left over from a crash. A live
+// one, or one we're taking over, stays.
+func clearStaleSocket(path string) error {
+	if _, err := os.Stat(path); err == nil && !inheritsListener("unix", path) {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return fmt.Errorf("%s is in use by another process", path)
+		}
+		os.Remove(path)
+	}
+	return nil
+}
+
+func startControlSocket(c ControlConfig) error {
+	if err := clearStaleSocket(c.Socket); err != nil {
+		return err
+	}
+	l, err := listen("unix", c.Socket)
+	if err != nil {
+		return err
+	}
+	mode, _ := strconv.ParseUint(c.Mode, 8, 32)
+	if err := os.Chmod(c.Socket, os.FileMode(mode)); err != nil {
+		l.Close()
+		return err
+	}
+	srv := &http.Server{
+		Handler: adminMux,
+		ConnContext: func(ctx context.Context, _ net.Conn) context.Context {
+			return context.WithValue(ctx, controlConnKey{}, true)
+		},
+	}
+	infof("control socket listening on %s\n", c.Socket)
+	go func() {
+		if err := srv.Serve(l); err != nil && !handedOver.Load() {
+			errorf("control socket on %s stopped: %v\n", c.Socket, err)
+		}
+	}()
+	return nil
+}
+
+// controlEndpoint is where the status and reload subcommands send their
+// requests: the control socket if there is one, otherwise the admin
+// listener with a token.
+type controlEndpoint struct {
+	socket string
+	admin  string
+	token  string
+	// configToken is admin.token from -config. It's only a fallback, kept
+	// out of the flag default so -h doesn't print it.
+	configToken string
+}
+
+// controlFlags sets up -socket, -admin and -token, defaulting to
+// control.socket, admin.listen and admin.token from -config.
+func controlFlags(fs *flag.FlagSet, configFile string) *controlEndpoint {
+	var def Config
+	if c, err := loadConfig(configFile); err == nil {
+		def = *c
+	}
+	e := &controlEndpoint{configToken: def.Admin.Token}
+	fs.StringVar(&e.socket, "socket", def.Control.Socket, "control socket path (default control.socket from -config)")
+	fs.StringVar(&e.admin, "admin", def.Admin.Listen, "admin listener address, used when there's no control socket")
+	fs.StringVar(&e.token, "token", "", "API token for -admin (default $SSHPROXY_TOKEN or admin.token)")
+	return e
+}
+
+func (e *controlEndpoint) configured() bool {
+	return e.socket != "" || e.admin != ""
+}
+
+// request sends an API request to the endpoint, with the token if it
+// goes over the admin listener.
+func (e *controlEndpoint) request(method, path string) (*http.Response, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	base := "http://sshproxy"
+	if e.socket != "" {
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", e.socket)
+			},
+		}
+	} else {
+		host, port, err := net.SplitHostPort(e.admin)
+		if err != nil {
+			return nil, fmt.Errorf("-admin: %v", err)
+		}
+		if host == "" || host == "0.0.0.0" || host == "::" {
+			host = "127.0.0.1"
+		}
+		base = "http://" + net.JoinHostPort(host, port)
+	}
+	req, err := http.NewRequest(method, base+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := cmp.Or(e.token, os.Getenv("SSHPROXY_TOKEN"), e.configToken); e.socket == "" && token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return client.Do(req)
+}
+
+// call makes an API request and decodes the JSON answer into out.
+func (e *controlEndpoint) call(method, path string, out any) error {
+	resp, err := e.request(method, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		if e.Error == "" {
+			e.Error = resp.Status
+		}
+		return errors.New(e.Error)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func runStatus(configFile string, args []string) {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	ep := controlFlags(fs, configFile)
+	asJSON := fs.Bool("json", false, "print stats, backends and sessions as JSON")
+	fs.Usage = func() {
+		fmt.Println("usage: ./connectproxy [-config proxy.json] status [-socket path | -admin host:port -token t] [-json]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if !ep.configured() {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var out struct {
+		Stats    proxyStats    `json:"stats"`
+		Backends []backendInfo `json:"backends"`
+		Sessions []sessionInfo `json:"sessions"`
+	}
+	for _, call := range []struct {
+		path string
+		out  any
+	}{{"/api/v1/stats", &out.Stats}, {"/api/v1/sessions", &out.Sessions}, {"/api/v1/backends", &out.Backends}} {
+		if err := ep.call(http.MethodGet, call.path, call.out); err != nil {
+			fmt.Fprintf(os.Stderr, "status: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(out)
+		return
+	}
+	st, sessions, backends := out.Stats, out.Sessions, out.Backends
+	rejected := int64(0)
+	for _, n := range st.Rejected {
+		rejected += n
+	}
+	fmt.Printf("sshproxy %s, up %s\n", st.Version, (time.Duration(st.UptimeSeconds) * time.Second).String())
+	fmt.Printf("connections: %d active, %d accepted, %d rejected\n", st.ActiveSessions, st.Accepted, rejected)
+	fmt.Printf("traffic:     %s in, %s out\n", formatBytes(st.BytesIn), formatBytes(st.BytesOut))
+	fmt.Printf("maintenance: %t, bans: %d, notify queue: %d, log level: %s\n", st.Maintenance, st.Bans, st.NotifyQueue, st.LogLevel)
+	lt := st.Lifetime
+	fmt.Printf("lifetime:    since %s, %d restarts, %d sessions from %d clients, %s in, %s out\n", lt.Since.Local().Format("2006-01-02 15:04"), lt.Restarts, lt.Sessions, lt.Clients, formatBytes(lt.BytesIn), formatBytes(lt.BytesOut))
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if len(backends) > 0 {
+		fmt.Fprintln(w, "\nBACKEND\tUP\tSESSIONS\tDIAL P50")
+		for _, b := range backends {
+			fmt.Fprintf(w, "%s\t%t\t%d\t%s\n", b.Address, b.Up, b.Sessions, time.Duration(b.DialP50Secs*float64(time.Second)).Round(time.Microsecond))
+		}
+	}
+	if len(sessions) > 0 {
+		fmt.Fprintln(w, "\nID\tSOURCE\tBACKEND\tSTARTED\tAGE\tIN\tOUT\tTAGS")
+		for _, s := range sessions {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", s.ID, s.Src, s.Backend, s.Started.Local().Format("Jan 02 15:04:05"),
+				(time.Duration(s.AgeSeconds) * time.Second).String(), formatBytes(s.BytesIn), formatBytes(s.BytesOut), strings.Join(s.Tags, ","))
+		}
+	} else {
+		fmt.Fprintln(w, "\nno open sessions")
+	}
+	w.Flush()
+}
+
+func runReload(configFile string, args []string) {
+	fs := flag.NewFlagSet("reload", flag.ExitOnError)
+	ep := controlFlags(fs, configFile)
+	fs.Usage = func() {
+		fmt.Println("usage: ./connectproxy [-config proxy.json] reload [-socket path | -admin host:port -token t]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if !ep.configured() {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var res reloadResult
+	if err := ep.call(http.MethodPost, "/api/v1/reload", &res); err != nil {
+		fmt.Fprintf(os.Stderr, "reload failed, the proxy is still running the old config: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("applied: %v\n", res.Applied)
+	if len(res.RestartRequired) > 0 {
+		fmt.Printf("changed but only applied on restart: %v\n", res.RestartRequired)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// alertCooldown remembers which keys have alerted recently, so e.g. a
+// client only triggers "Client Connected" once per notify.cooldown. Entries
+// expire, so returning clients alert again eventually and the map doesn't
+// grow for the life of the process.
+type alertCooldown struct {
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	lastSweep time.Time
+}
+
+var loggedIPs = &alertCooldown{seen: map[string]time.Time{}}
+
+// allow reports whether key may alert now, and if so starts its cooldown.
+// A zero notify.cooldown keeps the old behaviour of alerting only once.
+func (c *alertCooldown) allow(key string) bool {
+	ttl := conf().Notify.Cooldown.Duration
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ttl > 0 && now.Sub(c.lastSweep) > ttl {
+		for k, t := range c.seen {
+			if now.Sub(t) > ttl {
+				delete(c.seen, k)
+			}
+		}
+		c.lastSweep = now
+	}
+	if t, ok := c.seen[key]; ok && (ttl <= 0 || now.Sub(t) < ttl) {
+		return false
+	}
+	c.seen[key] = now
+	return true
+}
+
+func (c *alertCooldown) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.seen)
+}
+
+// snapshot copies the entries whose key starts with prefix and are still
+// cooling down, for the state file.
+func (c *alertCooldown) snapshot(prefix string) map[string]time.Time {
+	ttl := conf().Notify.Cooldown.Duration
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := map[string]time.Time{}
+	for k, t := range c.seen {
+		if strings.HasPrefix(k, prefix) && (ttl <= 0 || now.Sub(t) < ttl) {
+			out[k] = t
+		}
+	}
+	return out
+}
+
+// restore adds entries loaded from the state file, keeping whichever
+// timestamp is newer if a key is already there.
+func (c *alertCooldown) restore(seen map[string]time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, t := range seen {
+		if cur, ok := c.seen[k]; !ok || t.After(cur) {
+			c.seen[k] = t
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Daemon mode for init scripts. Go can't fork, and the syscall package has
+// no setuid on Windows, so both are done the way upgrades work: this
+// process binds every listener, starts the executable again with the
+// sockets passed down, in its own session and/or as daemon.user, and
+// waits for it to come up. In the background it then exits. In the
+// foreground it stays to pass signals on and exit with the child.
+
+const daemonEnv = "SSHPROXY_DAEMON"
+
+// daemonize is called early in main, before anything is started. It only
+// returns in the process that should go on to serve.
+func daemonize(c DaemonConfig, listenAddr string) {
+	if workerIndex > 0 {
+		return
+	}
+	if os.Getenv(daemonEnv) != "" || upgradeReady != nil {
+		// we're the child, or an upgrade
+		if c.PIDFile != "" {
+			if err := writePIDFile(c.PIDFile, os.Getpid()); err != nil {
+				warnf("failed to write pid file: %v", err)
+			}
+		}
+		return
+	}
+	cred, err := daemonCredential(c)
+	if err != nil {
+		daemonFatal("daemon: %v", err)
+	}
+	if c.PIDFile != "" {
+		if pid, ok := runningPID(c.PIDFile); ok {
+			daemonFatal("daemon: already running as pid %d (%s)", pid, c.PIDFile)
+		}
+	}
+	if !c.Background && cred == nil {
+		if c.PIDFile != "" {
+			if err := writePIDFile(c.PIDFile, os.Getpid()); err != nil {
+				daemonFatal("daemon: failed to write pid file: %v", err)
+			}
+		}
+		return
+	}
+
+	preBind(listenAddr, cred)
+	if cred != nil && conf().Log.File != "" {
+		// opened before we got here, so it's root's
+		os.Chown(conf().Log.File, int(cred.uid), int(cred.gid))
+	}
+	cmd, exited, err := spawnWithListeners(func(cmd *exec.Cmd) {
+		cmd.Env = append(cmd.Env, daemonEnv+"=1")
+		if !c.Background {
+			cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		} else if conf().Log.File == "" {
+			fmt.Println("no log.file set, the proxy's output goes nowhere in the background")
+		}
+		cmd.SysProcAttr = daemonProcAttr(c.Background, cred)
+	})
+	if err != nil {
+		daemonFatal("daemon: %v", err)
+	}
+	pid := cmd.Process.Pid
+	if c.PIDFile != "" {
+		if err := writePIDFile(c.PIDFile, pid); err != nil {
+			warnf("failed to write pid file: %v", err)
+		} else if cred != nil {
+			// so the child, and upgrades of it, can rewrite it
+			os.Chown(c.PIDFile, int(cred.uid), int(cred.gid))
+		}
+	}
+	closeListeners()
+	if c.Background {
+		fmt.Printf("started in the background, pid %d\n", pid)
+		os.Exit(0)
+	}
+
+	// the terminal sends ^C to the child too, so only relay the rest
+	signal.Ignore(os.Interrupt)
+	relay := []os.Signal{syscall.SIGTERM, syscall.SIGHUP}
+	for _, sig := range []func() (os.Signal, bool){sigusr1, sigusr2} {
+		if s, ok := sig(); ok {
+			relay = append(relay, s)
+		}
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, relay...)
+	for {
+		select {
+		case s := <-sigs:
+			cmd.Process.Signal(s)
+		case err := <-exited:
+			var exit *exec.ExitError
+			if errors.As(err, &exit) {
+				os.Exit(exit.ExitCode())
+			}
+			os.Exit(0)
+		}
+	}
+}
+
+// daemonFatal also goes to stderr, since log.file may already have taken
+// the log and whoever ran the init script should see why it failed.
+func daemonFatal(format string, args ...any) {
+	if conf().Log.File != "" {
+		fmt.Fprintf(os.Stderr, format+"\n", args...)
+	}
+	log.Fatalf(format, args...)
+}
+
+type daemonCred struct {
+	uid, gid uint32
+}
+
+// daemonCredential resolves daemon.user and daemon.group, or returns nil
+// when there's nothing to change.
+func daemonCredential(c DaemonConfig) (*daemonCred, error) {
+	if c.User == "" {
+		return nil, nil
+	}
+	u, err := user.Lookup(c.User)
+	if err != nil {
+		return nil, err
+	}
+	gidStr := u.Gid
+	if c.Group != "" {
+		g, err := user.LookupGroup(c.Group)
+		if err != nil {
+			return nil, err
+		}
+		gidStr = g.Gid
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("user %s: uid %q isn't numeric", c.User, u.Uid)
+	}
+	gid, err := strconv.ParseUint(gidStr, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("group id %q isn't numeric", gidStr)
+	}
+	if int(uid) == os.Getuid() && int(gid) == os.Getgid() {
+		return nil, nil
+	}
+	if os.Getuid() != 0 {
+		return nil, fmt.Errorf("switching to user %s needs root", c.User)
+	}
+	return &daemonCred{uint32(uid), uint32(gid)}, nil
+}
+
+// daemonProcAttr sets Setsid and Credential by name, since neither field
+// exists in the Windows SysProcAttr.
+func daemonProcAttr(background bool, cred *daemonCred) *syscall.SysProcAttr {
+	attr := &syscall.SysProcAttr{}
+	v := reflect.ValueOf(attr).Elem()
+	if f := v.FieldByName("Setsid"); background && f.IsValid() {
+		f.SetBool(true)
+	}
+	if f := v.FieldByName("Credential"); cred != nil && f.IsValid() {
+		cv := reflect.New(f.Type().Elem())
+		cv.Elem().FieldByName("Uid").SetUint(uint64(cred.uid))
+		cv.Elem().FieldByName("Gid").SetUint(uint64(cred.gid))
+		groups := cv.Elem().FieldByName("Groups")
+		groups.Set(reflect.ValueOf([]uint32{cred.gid}))
+		f.Set(cv)
+	}
+	return attr
+}
+
+// preBind opens every configured listener under the same keys the child
+// will ask for, so it takes them over rather than binding them itself.
+// Only the proxy port is fatal here; the child reports the rest.
+func preBind(listenAddr string, cred *daemonCred) {
+	if _, err := listenAcceptors(listenAddr); err != nil {
+		daemonFatal("daemon: failed to listen on %s: %v", listenAddr, err)
+	}
+	for _, t := range conf().Tenants {
+		if _, err := listenAcceptors(t.Listen); err != nil {
+			warnf("daemon: tenant %s: %v", t.Name, err)
+		}
+	}
+	for _, addr := range []string{conf().Admin.Listen, conf().Admin.GRPCListen, conf().DiscordBot.Listen} {
+		if addr == "" {
+			continue
+		}
+		if _, err := listen("tcp", addr); err != nil {
+			warnf("daemon: %v", err)
+		}
+	}
+	if path := conf().Control.Socket; path != "" {
+		if err := clearStaleSocket(path); err != nil {
+			warnf("daemon: %v", err)
+		} else if _, err := listen("unix", path); err != nil {
+			warnf("daemon: %v", err)
+		} else if cred != nil {
+			// the child sets control.mode on it
+			os.Chown(path, int(cred.uid), int(cred.gid))
+		}
+	}
+}
+
+// writePIDFile writes in place rather than by rename, so a pid file
+// handed to daemon.user stays writable by it.
+func writePIDFile(path string, pid int) error {
+	return os.WriteFile(path, []byte(strconv.Itoa(pid)+"\n"), 0644)
+}
+
+// runningPID reads a pid file and reports whether that process is alive.
+func runningPID(path string) (int, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 || pid == os.Getpid() {
+		return 0, false
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return 0, false
+	}
+	return pid, p.Signal(syscall.Signal(0)) == nil
+}
+
+// removePIDFile removes the pid file on the way out, unless a process
+// that took over from this one has already put its own pid there.
+func removePIDFile() {
+	path := conf().Daemon.PIDFile
+	if path == "" {
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || strings.TrimSpace(string(data)) != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		debugf("failed to remove pid file: %v\n", err)
+	}
+}
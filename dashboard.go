@@ -0,0 +1,24 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// The dashboard is one static page built into the binary that drives
+// everything through /api/v1. Fetching it goes through the browser's basic
+// auth prompt, and the page's API calls reuse those credentials.
+//
+//go:embed dashboard.html
+var dashboardPage []byte
+
+func init() {
+	adminMux.HandleFunc("GET /dashboard", opsAuth(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("Content-Type", "text/html; charset=utf-8")
+		h.Set("Content-Security-Policy", "default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; connect-src 'self'; img-src 'self'")
+		h.Set("X-Frame-Options", "DENY")
+		h.Set("Referrer-Policy", "no-referrer")
+		w.Write(dashboardPage)
+	}))
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	digestMu   sync.Mutex
+	digestIPs  = map[string]struct{}{}
+	digestBans int
+)
+
+func noteDigestIP(ip string) {
+	digestMu.Lock()
+	digestIPs[ip] = struct{}{}
+	digestMu.Unlock()
+}
+
+func noteDigestBan() {
+	digestMu.Lock()
+	digestBans++
+	digestMu.Unlock()
+}
+
+func backendHealthSummary() string {
+	health := backendHealthSnapshot()
+	if len(health) == 0 {
+		return "no dials yet"
+	}
+	addrs := make([]string, 0, len(health))
+	for addr := range health {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	var b strings.Builder
+	for _, addr := range addrs {
+		state := "down"
+		if health[addr] {
+			state = "up"
+		}
+		fmt.Fprintf(&b, "%s: %s\n", addr, state)
+	}
+	return b.String()
+}
+
+func sendStatsDigest() {
+	digestMu.Lock()
+	unique := len(digestIPs)
+	banned := digestBans
+	digestIPs = map[string]struct{}{}
+	digestBans = 0
+	digestMu.Unlock()
+
+	uptime := time.Since(startTime).Round(time.Second)
+	accepted := int64(connectionsAccepted.total())
+	rejected := int64(connectionsRejected.total())
+	active := len(activeSessions())
+	in := int64(bytesForwarded.value("client->backend"))
+	out := int64(bytesForwarded.value("backend->client"))
+	health := backendHealthSummary()
+
+	infof("stats digest: uptime %s, %d accepted, %d rejected, %d active, %d unique IPs and %d bans this period, %s in, %s out\n",
+		uptime, accepted, rejected, active, unique, banned, formatBytes(in), formatBytes(out))
+	if err := sendDiscordEmbed("Stats Digest", fmt.Sprintf("Uptime %s", uptime), 0x3498DB,
+		&DiscordEmbedField{Name: "Connections", Value: fmt.Sprintf("%d accepted, %d rejected, %d active", accepted, rejected, active), Inline: true},
+		&DiscordEmbedField{Name: "Unique IPs", Value: fmt.Sprintf("%d this period", unique), Inline: true},
+		&DiscordEmbedField{Name: "Bans Issued", Value: fmt.Sprintf("%d this period", banned), Inline: true},
+		&DiscordEmbedField{Name: "Traffic", Value: fmt.Sprintf("%s in, %s out", formatBytes(in), formatBytes(out)), Inline: true},
+		&DiscordEmbedField{Name: "Backends", Value: health},
+	); err != nil {
+		warnf("Failed to send Discord embed: %v", err)
+	}
+}
+
+func runStatsDigest(interval time.Duration) {
+	for range time.Tick(interval) {
+		sendStatsDigest()
+	}
+}
+
+func runHeartbeat(interval time.Duration) {
+	for range time.Tick(interval) {
+		active := len(activeSessions())
+		if err := sendDiscordEmbed("Heartbeat", fmt.Sprintf("Proxy alive, %d active sessions, up %s", active, time.Since(startTime).Round(time.Second)), 0x95A5A6); err != nil {
+			warnf("Failed to send Discord embed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Discord bot mode: a /proxy slash command, delivered to an HTTP
+// interactions endpoint, so the proxy can be run from the channel its
+// alerts land in. Only members holding one of discord_bot.roles can use it.
+
+const discordAPI = "https://discord.com/api/v10"
+
+type discordOption struct {
+	Name    string          `json:"name"`
+	Type    int             `json:"type"`
+	Value   any             `json:"value,omitempty"`
+	Options []discordOption `json:"options,omitempty"`
+}
+
+type discordInteraction struct {
+	Type int `json:"type"`
+	Data struct {
+		Name    string          `json:"name"`
+		Options []discordOption `json:"options"`
+	} `json:"data"`
+	Member *struct {
+		Roles []string `json:"roles"`
+		User  struct {
+			ID       string `json:"id"`
+			Username string `json:"username"`
+		} `json:"user"`
+	} `json:"member"`
+}
+
+type discordCommandOption struct {
+	Type        int                    `json:"type"`
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	Required    bool                   `json:"required,omitempty"`
+	Choices     []map[string]string    `json:"choices,omitempty"`
+	Options     []discordCommandOption `json:"options,omitempty"`
+}
+
+// Discord's option types: 1 is a subcommand, 3 a string.
+var proxyCommand = map[string]any{
+	"name":        "proxy",
+	"description": "Operate the SSH proxy",
+	"options": []discordCommandOption{
+		{Type: 1, Name: "status", Description: "Show proxy status"},
+		{Type: 1, Name: "ban", Description: "Ban a client IP and close its sessions", Options: []discordCommandOption{
+			{Type: 3, Name: "ip", Description: "Client IP", Required: true},
+			{Type: 3, Name: "duration", Description: "How long, e.g. 1h (default forever)"},
+		}},
+		{Type: 1, Name: "unban", Description: "Lift a ban", Options: []discordCommandOption{
+			{Type: 3, Name: "ip", Description: "Client IP", Required: true},
+		}},
+		{Type: 1, Name: "kill", Description: "Close a session", Options: []discordCommandOption{
+			{Type: 3, Name: "id", Description: "Connection ID", Required: true},
+		}},
+		{Type: 1, Name: "maintenance", Description: "Turn maintenance mode on or off", Options: []discordCommandOption{
+			{Type: 3, Name: "state", Description: "on or off", Required: true, Choices: []map[string]string{
+				{"name": "on", "value": "on"}, {"name": "off", "value": "off"},
+			}},
+		}},
+	},
+}
+
+func startDiscordBot(c DiscordBotConfig) {
+	l, err := listen("tcp", c.Listen)
+	if err != nil {
+		errorf("Discord interactions endpoint failed to listen on %s: %v\n", c.Listen, err)
+		return
+	}
+	key, _ := hex.DecodeString(c.PublicKey)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/interactions", func(w http.ResponseWriter, r *http.Request) {
+		handleDiscordInteraction(w, r, ed25519.PublicKey(key))
+	})
+	go func() {
+		if c.Token != "" {
+			if err := registerDiscordCommands(c); err != nil {
+				warnf("failed to register Discord slash commands: %v", err)
+			} else {
+				infof("registered Discord slash commands\n")
+			}
+		}
+		infof("Discord interactions endpoint listening on %s\n", c.Listen)
+		if err := http.Serve(l, mux); err != nil && !handedOver.Load() {
+			errorf("Discord interactions endpoint on %s stopped: %v\n", c.Listen, err)
+		}
+	}()
+}
+
+// registerDiscordCommands overwrites the application's commands with
+// /proxy, in one guild if guild_id is set (instant) or globally otherwise.
+func registerDiscordCommands(c DiscordBotConfig) error {
+	url := discordAPI + "/applications/" + c.ApplicationID + "/commands"
+	if c.GuildID != "" {
+		url = discordAPI + "/applications/" + c.ApplicationID + "/guilds/" + c.GuildID + "/commands"
+	}
+	body, err := json.Marshal([]any{proxyCommand})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bot "+c.Token)
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// verifyDiscordRequest checks the Ed25519 signature Discord puts on every
+// interaction, and that it isn't an old one being replayed.
+func verifyDiscordRequest(key ed25519.PublicKey, r *http.Request, body []byte) bool {
+	sig, err := hex.DecodeString(r.Header.Get("X-Signature-Ed25519"))
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return false
+	}
+	ts := r.Header.Get("X-Signature-Timestamp")
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || time.Since(time.Unix(sec, 0)).Abs() > 5*time.Minute {
+		return false
+	}
+	return ed25519.Verify(key, append([]byte(ts), body...), sig)
+}
+
+func handleDiscordInteraction(w http.ResponseWriter, r *http.Request, key ed25519.PublicKey) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if !verifyDiscordRequest(key, r, body) {
+		http.Error(w, "invalid request signature", http.StatusUnauthorized)
+		return
+	}
+	var in discordInteraction
+	if err := json.Unmarshal(body, &in); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	// 1 is Discord's ping when the endpoint URL is saved, 2 a slash command
+	switch in.Type {
+	case 1:
+		json.NewEncoder(w).Encode(map[string]int{"type": 1})
+		return
+	case 2:
+	default:
+		http.Error(w, "unsupported interaction", http.StatusBadRequest)
+		return
+	}
+	var reply map[string]any
+	if in.Member == nil || !hasDiscordRole(in.Member.Roles) {
+		reply = map[string]any{"content": "You don't have a role that can operate this proxy."}
+	} else {
+		by := fmt.Sprintf("discord user %s (%s)", in.Member.User.Username, in.Member.User.ID)
+		reply = runProxyCommand(in.Data.Options, by)
+	}
+	// only the caller sees the reply; actions are announced by their own alerts
+	reply["flags"] = 64
+	json.NewEncoder(w).Encode(map[string]any{"type": 4, "data": reply})
+}
+
+func hasDiscordRole(roles []string) bool {
+	for _, have := range roles {
+		for _, want := range conf().DiscordBot.Roles {
+			if have == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func runProxyCommand(opts []discordOption, by string) map[string]any {
+	if len(opts) != 1 {
+		return map[string]any{"content": "Unknown command."}
+	}
+	sub := opts[0]
+	args := map[string]string{}
+	for _, o := range sub.Options {
+		args[o.Name], _ = o.Value.(string)
+	}
+	switch sub.Name {
+	case "status":
+		return map[string]any{"embeds": []DiscordEmbed{statusEmbed()}}
+	case "ban":
+		var d time.Duration
+		if args["duration"] != "" {
+			var err error
+			if d, err = time.ParseDuration(args["duration"]); err != nil || d < 0 {
+				return map[string]any{"content": fmt.Sprintf("Invalid duration %q, use something like 30m or 24h.", args["duration"])}
+			}
+		}
+		killed, err := banIP(args["ip"], d, by)
+		if err != nil {
+			return map[string]any{"content": err.Error() + "."}
+		}
+		return map[string]any{"content": fmt.Sprintf("Banned %s, closed %d sessions.", anonIP(args["ip"]), killed)}
+	case "unban":
+		if !unbanIP(args["ip"], by) {
+			return map[string]any{"content": fmt.Sprintf("%s isn't banned.", anonIP(args["ip"]))}
+		}
+		return map[string]any{"content": fmt.Sprintf("Unbanned %s.", anonIP(args["ip"]))}
+	case "kill":
+		if !killSession(args["id"], by) {
+			return map[string]any{"content": fmt.Sprintf("No open session %q.", args["id"])}
+		}
+		return map[string]any{"content": fmt.Sprintf("Closed session %s.", args["id"])}
+	case "maintenance":
+		on := args["state"] == "on"
+		setMaintenance(on, "set by "+by)
+		return map[string]any{"content": fmt.Sprintf("Maintenance mode is %s.", map[bool]string{true: "on", false: "off"}[on])}
+	}
+	return map[string]any{"content": "Unknown command."}
+}
+
+func statusEmbed() DiscordEmbed {
+	st := currentStats()
+	return DiscordEmbed{
+		Title:     "Proxy Status",
+		Color:     0x3498DB,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Fields: []DiscordEmbedField{
+			{Name: "Version", Value: st.Version, Inline: true},
+			{Name: "Uptime", Value: time.Since(startTime).Round(time.Second).String(), Inline: true},
+			{Name: "Active Sessions", Value: strconv.Itoa(st.ActiveSessions), Inline: true},
+			{Name: "Maintenance", Value: strconv.FormatBool(st.Maintenance), Inline: true},
+			{Name: "Bans", Value: strconv.Itoa(st.Bans), Inline: true},
+			{Name: "Notify Queue", Value: strconv.Itoa(st.NotifyQueue), Inline: true},
+			{Name: "Backends", Value: backendHealthSummary()},
+		},
+	}
+}
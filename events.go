@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type sessionEvent struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	ID       string    `json:"id"`
+	Tenant   string    `json:"tenant,omitempty"`
+	Src      string    `json:"src"`
+	Backend  string    `json:"backend,omitempty"`
+	BytesIn  int64     `json:"bytes_in,omitempty"`
+	BytesOut int64     `json:"bytes_out,omitempty"`
+	Duration float64   `json:"duration_seconds,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+	Tags     []string  `json:"tags,omitempty"`
+	Country  string    `json:"country,omitempty"`
+	ASN      uint64    `json:"asn,omitempty"`
+}
+
+// eventTypes is every sessionEvent.Type that gets published.
+var eventTypes = []string{"open", "connected", "closed", "rejected", "exfil", "signature", "banned", "unbanned"}
+
+func knownEventType(typ string) bool {
+	return containsString(eventTypes, typ)
+}
+
+var (
+	eventSinksMu sync.Mutex
+	eventSinks   []func(sessionEvent)
+)
+
+// addEventSink registers fn to receive every lifecycle event. Sinks are
+// called inline from the connection path and must not block.
+func addEventSink(fn func(sessionEvent)) {
+	eventSinksMu.Lock()
+	eventSinks = append(eventSinks, fn)
+	eventSinksMu.Unlock()
+}
+
+func publishEvent(ev sessionEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	eventSinksMu.Lock()
+	sinks := eventSinks
+	eventSinksMu.Unlock()
+	for _, fn := range sinks {
+		fn(ev)
+	}
+}
+
+func (s *session) event(typ string) sessionEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ev := sessionEvent{
+		Type:    typ,
+		ID:      s.id,
+		Tenant:  s.tenant,
+		Src:     anonAddr(s.client.RemoteAddr().String()),
+		Backend: s.backend,
+		Country: s.geo.Country,
+		ASN:     s.geo.ASN,
+	}
+	if typ == "closed" {
+		ev.BytesIn = s.bytesIn.Load()
+		ev.BytesOut = s.bytesOut.Load()
+		ev.Duration = time.Since(s.start).Seconds()
+		ev.Reason = s.closeReason
+		ev.Tags = append([]string(nil), s.tags...)
+	}
+	return ev
+}
+
+func startEventFile(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	var mu sync.Mutex
+	addEventSink(func(ev sessionEvent) {
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if _, err := f.Write(append(data, '\n')); err != nil {
+			warnf("failed to write event to %s: %v", path, err)
+			reportError(err, "failed to write event to "+path)
+		}
+	})
+	return nil
+}
+
+var (
+	eventWatchersMu sync.Mutex
+	eventWatchers   = map[chan sessionEvent]string{}
+	eventWatchOnce  sync.Once
+)
+
+// watchEvents subscribes to the live event stream until stop is called,
+// for clients that come and go. A watcher that falls behind loses events
+// rather than slowing down the connection path.
+func watchEvents(sink string) (events <-chan sessionEvent, stop func()) {
+	eventWatchOnce.Do(func() {
+		addEventSink(func(ev sessionEvent) {
+			eventWatchersMu.Lock()
+			defer eventWatchersMu.Unlock()
+			for ch, sink := range eventWatchers {
+				select {
+				case ch <- ev:
+				default:
+					eventsDropped.inc(sink)
+				}
+			}
+		})
+	})
+	ch := make(chan sessionEvent, 256)
+	eventWatchersMu.Lock()
+	eventWatchers[ch] = sink
+	eventWatchersMu.Unlock()
+	return ch, func() {
+		eventWatchersMu.Lock()
+		delete(eventWatchers, ch)
+		eventWatchersMu.Unlock()
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	// maxExecHookOutput is as much of a hook's output as is kept for the
+	// log; the rest is read and thrown away.
+	maxExecHookOutput = 4096
+	// execHookWaitDelay bounds the wait for the output pipes after the
+	// command is killed, in case something it started still holds them.
+	execHookWaitDelay = 5 * time.Second
+)
+
+type execJob struct {
+	hook *ExecHookConfig
+	ev   sessionEvent
+}
+
+// startExecHooks queues matching events for events.exec commands, run by
+// exec_concurrency workers. When they fall behind, events are dropped
+// rather than holding up connections.
+func startExecHooks(c EventsConfig) {
+	jobs := make(chan execJob, c.BufferSize)
+	for i := 0; i < c.ExecConcurrency; i++ {
+		go func() {
+			for j := range jobs {
+				runExecHook(j.hook, j.ev)
+			}
+		}()
+	}
+	addEventSink(func(ev sessionEvent) {
+		for i := range c.Exec {
+			h := &c.Exec[i]
+			if len(h.Events) > 0 && !containsString(h.Events, ev.Type) {
+				continue
+			}
+			select {
+			case jobs <- execJob{hook: h, ev: ev}:
+			default:
+				eventsDropped.inc("exec")
+			}
+		}
+	})
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func runExecHook(h *ExecHookConfig, ev sessionEvent) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout.Duration)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+	cmd.Env = append(os.Environ(), eventEnv(ev)...)
+	if h.Stdin {
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return
+		}
+		cmd.Stdin = bytes.NewReader(append(data, '\n'))
+	}
+	out := &cappedBuffer{max: maxExecHookOutput}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.WaitDelay = execHookWaitDelay
+	err := cmd.Run()
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		execHookRuns.inc("timeout")
+		warnf("exec hook %s timed out after %s on %s event", h.Command[0], h.Timeout.Duration, ev.Type)
+	case err != nil:
+		execHookRuns.inc("failed")
+		if msg := strings.TrimSpace(clip(out.String(), 500)); msg != "" {
+			err = fmt.Errorf("%v: %s", err, msg)
+		}
+		warnf("exec hook %s failed on %s event: %v", h.Command[0], ev.Type, err)
+	default:
+		execHookRuns.inc("ok")
+		if out.Len() > 0 {
+			debugf("exec hook %s: %s", h.Command[0], strings.TrimSpace(clip(out.String(), 500)))
+		}
+	}
+}
+
+// cappedBuffer keeps the first max bytes written to it. Later writes
+// still succeed, so a chatty command isn't killed by a broken pipe. The
+// buffer isn't embedded, or io.Copy would use its ReadFrom and skip the cap.
+type cappedBuffer struct {
+	buf bytes.Buffer
+	max int
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if n := b.max - b.buf.Len(); n > 0 {
+		b.buf.Write(p[:min(n, len(p))])
+	}
+	return len(p), nil
+}
+
+func (b *cappedBuffer) String() string { return b.buf.String() }
+
+func (b *cappedBuffer) Len() int { return b.buf.Len() }
+
+// eventEnv is the event as SSHPROXY_* variables; anything unset in the
+// event is passed as an empty string so scripts can rely on the names.
+func eventEnv(ev sessionEvent) []string {
+	return []string{
+		"SSHPROXY_EVENT=" + ev.Type,
+		"SSHPROXY_TIME=" + ev.Time.UTC().Format("2006-01-02T15:04:05.000Z07:00"),
+		"SSHPROXY_CONN_ID=" + ev.ID,
+		"SSHPROXY_SRC=" + ev.Src,
+		"SSHPROXY_BACKEND=" + ev.Backend,
+		"SSHPROXY_BYTES_IN=" + fmt.Sprint(ev.BytesIn),
+		"SSHPROXY_BYTES_OUT=" + fmt.Sprint(ev.BytesOut),
+		"SSHPROXY_DURATION=" + fmt.Sprint(ev.Duration),
+		"SSHPROXY_REASON=" + ev.Reason,
+		"SSHPROXY_TAGS=" + strings.Join(ev.Tags, ","),
+		"SSHPROXY_COUNTRY=" + ev.Country,
+		"SSHPROXY_TENANT=" + ev.Tenant,
+		"SSHPROXY_ASN=" + fmt.Sprint(ev.ASN),
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// checkExfil fires once per session, at the moment its backend->client
+// byte count crosses the threshold.
+func checkExfil(s *session, total, n int64) {
+	t := conf().Exfil.Threshold
+	if t <= 0 || total < t || total-n >= t {
+		return
+	}
+	go alertExfil(s, total)
+}
+
+func alertExfil(s *session, total int64) {
+	elapsed := time.Since(s.start)
+	rate := float64(total) / elapsed.Seconds()
+	s.mu.Lock()
+	client := anonAddr(s.client.RemoteAddr().String())
+	backend := s.backend
+	s.mu.Unlock()
+	exfilAlerts.inc()
+	warnf("[%s] large transfer: %s sent to %s from %s in %s (%s/s)\n", s.id, formatBytes(total), client, backend, elapsed.Round(time.Second), formatBytes(int64(rate)))
+	publishEvent(sessionEvent{Type: "exfil", ID: s.id, Src: client, Backend: backend, BytesOut: total, Duration: elapsed.Seconds(), Reason: "threshold"})
+	auditf("large transfer alert for %s: %d bytes to %s", s.id, total, client)
+	if err := sendAlert(alertVars{"ip": client, "conn_id": s.id, "backend": backend, "bytes": total, "duration": elapsed, "rate": rate}, "Exfiltration Alert", fmt.Sprintf("A single session has sent more than %s to the client", formatBytes(conf().Exfil.Threshold)), 0xFF0000,
+		connField(s.id),
+		&DiscordEmbedField{Name: "Destination", Value: client, Inline: true},
+		&DiscordEmbedField{Name: "Backend", Value: backend, Inline: true},
+		&DiscordEmbedField{Name: "Transferred", Value: fmt.Sprintf("%s in %s", formatBytes(total), elapsed.Round(time.Second)), Inline: true},
+		&DiscordEmbedField{Name: "Rate", Value: formatBytes(int64(rate)) + "/s", Inline: true},
+	); err != nil {
+		warnf("Failed to send Discord embed: %v", err)
+	}
+}
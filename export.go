@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseSince takes a lookback like "24h" or "7d", or an absolute date or
+// RFC 3339 time.
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return now.AddDate(0, 0, -n), nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is neither a duration like 24h or 7d nor a date like 2006-01-02", s)
+}
+
+// historySourceMatches compares the host part of a recorded source with
+// what was asked for. Anonymized records only match their own anonymized
+// form, e.g. 203.0.113.x.
+func historySourceMatches(src, want string) bool {
+	host, _, err := net.SplitHostPort(src)
+	if err != nil {
+		host = src
+	}
+	return host == want
+}
+
+// stringList is a repeatable string flag.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+var exportCSVHeader = []string{"id", "start", "end", "duration_seconds", "src", "dst", "bytes_in", "bytes_out", "close_reason", "country", "tags"}
+
+func runExport(configFile string, args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	def := ""
+	if c, err := loadConfig(configFile); err == nil {
+		def = c.History.Path
+	}
+	path := fs.String("history", def, "history file (default history.path from -config)")
+	since := fs.String("since", "24h", "how far back, e.g. 24h, 7d or 2006-01-02")
+	until := fs.String("until", "", "stop at sessions ending before this, same forms as -since")
+	format := fs.String("format", "csv", "csv or json")
+	src := fs.String("src", "", "only sessions from this source address")
+	var tags stringList
+	fs.Var(&tags, "tag", "only sessions with this tag (repeatable, all must match)")
+	out := fs.String("o", "", "write to this file instead of stdout")
+	fs.Usage = func() {
+		fmt.Println("usage: ./connectproxy [-config proxy.json] export [-since 24h] [-format csv|json] [-src ip] [-tag t] [-o file]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *path == "" || (*format != "csv" && *format != "json") {
+		fs.Usage()
+		os.Exit(2)
+	}
+	now := time.Now()
+	from, err := parseSince(*since, now)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "export: -since: %v\n", err)
+		os.Exit(2)
+	}
+	to := now
+	if *until != "" {
+		if to, err = parseSince(*until, now); err != nil {
+			fmt.Fprintf(os.Stderr, "export: -until: %v\n", err)
+			os.Exit(2)
+		}
+	}
+	if _, err := os.Stat(*path); err != nil {
+		fmt.Fprintf(os.Stderr, "export: %v\n", err)
+		os.Exit(1)
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "export: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		w = f
+	}
+	n, err := exportHistory(w, *path, *format, from, to, func(rec historyRecord) bool {
+		return (*src == "" || historySourceMatches(rec.Src, *src)) && hasTags(rec.Tags, tags)
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "export: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "exported %d sessions\n", n)
+}
+
+// exportHistory writes the records that ended between from and to and
+// pass keep, streaming so a large history doesn't have to fit in memory.
+func exportHistory(w io.Writer, path, format string, from, to time.Time, keep func(historyRecord) bool) (int, error) {
+	n := 0
+	var werr error
+	var each func(historyRecord)
+	var finish func()
+	switch format {
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write(exportCSVHeader)
+		each = func(rec historyRecord) {
+			werr = cw.Write([]string{rec.ID, rec.Start.UTC().Format(time.RFC3339), rec.End.UTC().Format(time.RFC3339),
+				strconv.FormatFloat(rec.End.Sub(rec.Start).Seconds(), 'f', 3, 64), rec.Src, rec.Dst,
+				strconv.FormatInt(rec.BytesIn, 10), strconv.FormatInt(rec.BytesOut, 10), rec.CloseReason, rec.Country,
+				strings.Join(rec.Tags, ";")})
+		}
+		finish = func() {
+			cw.Flush()
+			if werr == nil {
+				werr = cw.Error()
+			}
+		}
+	default:
+		io.WriteString(w, "[")
+		each = func(rec historyRecord) {
+			data, _ := json.Marshal(rec)
+			sep := ",\n  "
+			if n == 0 {
+				sep = "\n  "
+			}
+			_, werr = fmt.Fprintf(w, "%s%s", sep, data)
+		}
+		finish = func() {
+			end := "\n]\n"
+			if n == 0 {
+				end = "]\n"
+			}
+			if _, err := io.WriteString(w, end); werr == nil {
+				werr = err
+			}
+		}
+	}
+	err := readHistory(path, from, func(rec historyRecord) bool {
+		if rec.End.After(to) || !keep(rec) {
+			return true
+		}
+		each(rec)
+		n++
+		return werr == nil
+	})
+	finish()
+	if err == nil {
+		err = werr
+	}
+	return n, err
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// An active/standby pair of proxies, usually in different regions, with
+// clients finding the active one by a DNS name. Both check each other.
+// When the primary stops answering, the standby points the name at
+// itself. Moving it back is left to the operator, once the primary is
+// known to be healthy again, so a primary that flaps can't flap DNS.
+
+var (
+	failoverPeerUp     = newGauge("sshproxy_failover_peer_up", "Whether the failover peer answered its last check.")
+	failoverDNSUpdates = newCounter("sshproxy_failover_dns_updates_total", "DNS updates made to take over from the primary, by outcome.", "result")
+)
+
+func validateDNSHook(d DNSHookConfig, required bool) error {
+	switch d.Provider {
+	case "":
+		if required {
+			return errors.New("the standby needs a provider: cloudflare, route53 or exec")
+		}
+		return nil
+	case "exec":
+		if len(d.Command) == 0 {
+			return errors.New("the exec provider needs a command")
+		}
+	case "cloudflare":
+		if d.Cloudflare.ZoneID == "" || d.Cloudflare.APIToken == "" {
+			return errors.New("cloudflare needs zone_id and api_token")
+		}
+	case "route53":
+		if d.Route53.HostedZoneID == "" || d.Route53.AccessKey == "" || d.Route53.SecretKey == "" {
+			return errors.New("route53 needs hosted_zone_id, access_key and secret_key")
+		}
+	default:
+		return fmt.Errorf("unknown provider %q", d.Provider)
+	}
+	if d.Provider != "exec" && (d.Record == "" || d.Value == "") {
+		return errors.New("record and value are required")
+	}
+	if d.TTL < 1 || d.Timeout.Duration <= 0 {
+		return errors.New("ttl and timeout must be positive")
+	}
+	return nil
+}
+
+// dnsRecordType is the type a record holding value has to be.
+func dnsRecordType(value string) string {
+	ip := net.ParseIP(value)
+	switch {
+	case ip == nil:
+		return "CNAME"
+	case ip.To4() != nil:
+		return "A"
+	}
+	return "AAAA"
+}
+
+func isPeerURL(peer string) bool {
+	return strings.HasPrefix(peer, "http://") || strings.HasPrefix(peer, "https://")
+}
+
+// peerName is the peer for logs and alerts, without any secret in a URL.
+func peerName(peer string) string {
+	if isPeerURL(peer) {
+		return redactURL(peer)
+	}
+	return peer
+}
+
+// probePeer is one check of the other proxy.
+func probePeer(peer string, timeout time.Duration) error {
+	if !isPeerURL(peer) {
+		conn, err := net.DialTimeout("tcp", peer, timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(peer)
+	if err != nil {
+		return err
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// runFailover checks the peer every failover.interval.
+func runFailover(c FailoverConfig) {
+	infof("failover: %s, checking %s every %s\n", c.Role, peerName(c.Peer), c.Interval.Duration)
+	misses := 0
+	tookOver := false
+	tick := time.NewTicker(c.Interval.Duration)
+	defer tick.Stop()
+	for range tick.C {
+		err := probePeer(c.Peer, c.Timeout.Duration)
+		if err == nil {
+			failoverPeerUp.set(1)
+			if misses >= c.Failures {
+				peerRecovered(c, tookOver)
+			}
+			misses, tookOver = 0, false
+			continue
+		}
+		failoverPeerUp.set(0)
+		misses++
+		debugf("failover: check %d of %s failed: %v\n", misses, peerName(c.Peer), err)
+		if misses == c.Failures {
+			peerDown(c, err)
+		}
+		if misses >= c.Failures && c.Role == "standby" && !tookOver {
+			tookOver = takeOver(c, err)
+		}
+	}
+}
+
+func peerDown(c FailoverConfig, cause error) {
+	errorf("failover: the %s at %s missed %d checks: %v\n", peerRole(c), peerName(c.Peer), c.Failures, cause)
+	desc := fmt.Sprintf("The %s at %s missed %d checks in a row: %v", peerRole(c), peerName(c.Peer), c.Failures, cause)
+	if c.Role == "primary" {
+		desc += ". There's no standby to fail over to until it's back."
+	}
+	triggerIncident("failover-peer", desc, "critical")
+	if err := sendAlert(alertVars{"peer": peerName(c.Peer), "role": c.Role, "error": cause.Error()}, "Failover Peer Down", desc, 0xFF0000); err != nil {
+		warnf("Failed to send Discord embed: %v", err)
+	}
+}
+
+func peerRecovered(c FailoverConfig, tookOver bool) {
+	infof("failover: the %s at %s is answering again\n", peerRole(c), peerName(c.Peer))
+	desc := fmt.Sprintf("The %s at %s is answering again", peerRole(c), peerName(c.Peer))
+	if tookOver {
+		desc += fmt.Sprintf(". %s still points here; move it back once the primary is known to be healthy.", c.DNS.Record)
+	}
+	resolveIncident("failover-peer", desc)
+	if err := sendAlert(alertVars{"peer": peerName(c.Peer), "role": c.Role}, "Failover Peer Recovered", desc, 0x008000); err != nil {
+		warnf("Failed to send Discord embed: %v", err)
+	}
+}
+
+func peerRole(c FailoverConfig) string {
+	if c.Role == "standby" {
+		return "primary"
+	}
+	return "standby"
+}
+
+// takeOver points DNS here, unless this proxy can't serve either, in
+// which case the problem is more likely on this side. It reports whether
+// DNS was moved; if not, the next failed check tries again.
+func takeOver(c FailoverConfig, cause error) bool {
+	if !listenerBound.Load() || !anyBackendHealthy() {
+		warnf("failover: not taking over, this proxy isn't ready to serve either")
+		return false
+	}
+	err := updateDNS(c.DNS, c.Peer)
+	if err != nil {
+		failoverDNSUpdates.inc("failed")
+		errorf("failover: failed to point %s at %s: %v\n", c.DNS.Record, c.DNS.Value, err)
+		reportError(err, "failover DNS update failed")
+		if err := sendAlert(alertVars{"record": c.DNS.Record, "value": c.DNS.Value, "error": err.Error()}, "Failover Failed",
+			fmt.Sprintf("The primary is down but %s couldn't be pointed here: %v. Retrying every %s.", c.DNS.Record, err, c.Interval.Duration), 0xFF0000); err != nil {
+			warnf("Failed to send Discord embed: %v", err)
+		}
+		return false
+	}
+	failoverDNSUpdates.inc("ok")
+	warnf("failover: took over from %s, %s now points at %s\n", peerName(c.Peer), c.DNS.Record, c.DNS.Value)
+	auditf("failover: took over from %s, %s now points at %s", peerName(c.Peer), c.DNS.Record, c.DNS.Value)
+	if err := sendAlert(alertVars{"peer": peerName(c.Peer), "record": c.DNS.Record, "value": c.DNS.Value, "error": cause.Error()}, "Failover",
+		fmt.Sprintf("The primary at %s is down (%v). %s now points at this proxy (%s).", peerName(c.Peer), cause, c.DNS.Record, c.DNS.Value), 0xFFA500); err != nil {
+		warnf("Failed to send Discord embed: %v", err)
+	}
+	return true
+}
+
+func updateDNS(d DNSHookConfig, peer string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), d.Timeout.Duration)
+	defer cancel()
+	switch d.Provider {
+	case "cloudflare":
+		return cloudflareUpsert(ctx, d)
+	case "route53":
+		return route53Upsert(ctx, d)
+	}
+	cmd := exec.CommandContext(ctx, d.Command[0], d.Command[1:]...)
+	cmd.Env = append(os.Environ(),
+		"SSHPROXY_DNS_RECORD="+d.Record,
+		"SSHPROXY_DNS_VALUE="+d.Value,
+		"SSHPROXY_DNS_TYPE="+dnsRecordType(d.Value),
+		fmt.Sprintf("SSHPROXY_DNS_TTL=%d", d.TTL),
+		"SSHPROXY_FAILOVER_PEER="+peerName(peer))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(clip(string(out), 500)); msg != "" {
+			err = fmt.Errorf("%v: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
+
+type cloudflareResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result json.RawMessage `json:"result"`
+}
+
+func cloudflareCall(ctx context.Context, c CloudflareDNSConfig, method, path string, body any) (json.RawMessage, error) {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(c.APIURL, "/")+path, r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.APIToken)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var res cloudflareResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&res); err != nil {
+		return nil, fmt.Errorf("%s: %v", resp.Status, err)
+	}
+	if !res.Success {
+		var msgs []string
+		for _, e := range res.Errors {
+			msgs = append(msgs, e.Message)
+		}
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.Join(msgs, "; "))
+	}
+	return res.Result, nil
+}
+
+// cloudflareUpsert updates the record, or creates it if there's none.
+func cloudflareUpsert(ctx context.Context, d DNSHookConfig) error {
+	c := d.Cloudflare
+	base := "/zones/" + url.PathEscape(c.ZoneID) + "/dns_records"
+	raw, err := cloudflareCall(ctx, c, http.MethodGet, base+"?name="+url.QueryEscape(d.Record), nil)
+	if err != nil {
+		return err
+	}
+	var existing []struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(raw, &existing); err != nil {
+		return err
+	}
+	record := map[string]any{"type": dnsRecordType(d.Value), "name": d.Record, "content": d.Value, "ttl": d.TTL}
+	for _, e := range existing {
+		if e.Type == "A" || e.Type == "AAAA" || e.Type == "CNAME" {
+			_, err := cloudflareCall(ctx, c, http.MethodPut, base+"/"+url.PathEscape(e.ID), record)
+			return err
+		}
+	}
+	_, err = cloudflareCall(ctx, c, http.MethodPost, base, record)
+	return err
+}
+
+type route53Change struct {
+	XMLName xml.Name `xml:"https://route53.amazonaws.com/doc/2013-04-01/ ChangeResourceRecordSetsRequest"`
+	Comment string   `xml:"ChangeBatch>Comment"`
+	Action  string   `xml:"ChangeBatch>Changes>Change>Action"`
+	Name    string   `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>Name"`
+	Type    string   `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>Type"`
+	TTL     int      `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>TTL"`
+	Value   string   `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>ResourceRecords>ResourceRecord>Value"`
+}
+
+// route53Upsert sends an UPSERT through ChangeResourceRecordSets, signed
+// with SigV4 like the S3 uploads. Route53 is global and signs as
+// us-east-1.
+func route53Upsert(ctx context.Context, d DNSHookConfig) error {
+	c := d.Route53
+	body, err := xml.Marshal(route53Change{
+		Comment: "sshproxy failover", Action: "UPSERT",
+		Name: d.Record, Type: dnsRecordType(d.Value), TTL: d.TTL, Value: d.Value,
+	})
+	if err != nil {
+		return err
+	}
+	body = append([]byte(xml.Header), body...)
+	u, err := url.Parse(strings.TrimSuffix(c.Endpoint, "/"))
+	if err != nil {
+		return err
+	}
+	zone := strings.TrimPrefix(c.HostedZoneID, "/hostedzone/")
+	u.Path += "/2013-04-01/hostedzone/" + zone + "/rrset/"
+	hash := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(hash[:])
+	now := time.Now().UTC()
+	headers := map[string]string{
+		"host":                 u.Host,
+		"content-type":         "application/xml",
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           now.Format("20060102T150405Z"),
+	}
+	if c.SessionToken != "" {
+		headers["x-amz-security-token"] = c.SessionToken
+	}
+	auth := sigV4Authorization(http.MethodPost, s3EscapePath(u.Path), headers, payloadHash, "us-east-1", "route53", c.AccessKey, c.SecretKey, now)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range headers {
+		if k != "host" {
+			req.Header.Set(k, v)
+		}
+	}
+	req.Header.Set("Authorization", auth)
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected response status: %s %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
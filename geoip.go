@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// geoInfo is what we know about a client address from the configured
+// databases. Any part can be empty.
+type geoInfo struct {
+	Country     string
+	CountryName string
+	City        string
+	ASN         uint64
+	ASOrg       string
+}
+
+var geoCityDB, geoASNDB *mmdbReader
+
+// seenCountries holds every country that has made it through to a backend,
+// for geoip.new_country_alerts.
+var (
+	seenCountriesMu sync.Mutex
+	seenCountries   = map[string]bool{}
+)
+
+func setupGeoIP(c GeoIPConfig) error {
+	var err error
+	for _, cc := range c.KnownCountries {
+		seenCountries[strings.ToUpper(cc)] = true
+	}
+	if c.CityDB != "" {
+		if geoCityDB, err = openMMDB(c.CityDB); err != nil {
+			return err
+		}
+	}
+	if c.ASNDB != "" {
+		if geoASNDB, err = openMMDB(c.ASNDB); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mmdbPath walks nested maps, e.g. mmdbPath(rec, "country", "names", "en").
+func mmdbPath(v any, keys ...string) any {
+	for _, k := range keys {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		v = m[k]
+	}
+	return v
+}
+
+func lookupGeo(ip string) geoInfo {
+	var g geoInfo
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return g
+	}
+	if geoCityDB != nil {
+		rec, err := geoCityDB.lookup(addr)
+		if err != nil {
+			debugf("geoip lookup for %s failed: %v", anonIP(ip), err)
+		}
+		g.Country, _ = mmdbPath(rec, "country", "iso_code").(string)
+		g.CountryName, _ = mmdbPath(rec, "country", "names", "en").(string)
+		g.City, _ = mmdbPath(rec, "city", "names", "en").(string)
+	}
+	if geoASNDB != nil {
+		rec, err := geoASNDB.lookup(addr)
+		if err != nil {
+			debugf("asn lookup for %s failed: %v", anonIP(ip), err)
+		}
+		g.ASN, _ = mmdbPath(rec, "autonomous_system_number").(uint64)
+		g.ASOrg, _ = mmdbPath(rec, "autonomous_system_organization").(string)
+	}
+	return g
+}
+
+// firstFromCountry records that a session from g's country connected and
+// reports whether that's the first time we've seen it.
+func firstFromCountry(g geoInfo) bool {
+	if !conf().GeoIP.NewCountryAlerts || g.Country == "" {
+		return false
+	}
+	seenCountriesMu.Lock()
+	defer seenCountriesMu.Unlock()
+	if seenCountries[g.Country] {
+		return false
+	}
+	seenCountries[g.Country] = true
+	return true
+}
+
+// reverseDNS returns the first PTR name for ip, or "" if there isn't one
+// within the configured timeout.
+func reverseDNS(ip string) string {
+	if !conf().GeoIP.ReverseDNS {
+		return ""
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), conf().GeoIP.DNSTimeout.Duration)
+	defer cancel()
+	names, err := net.DefaultResolver.LookupAddr(ctx, ip)
+	if err != nil || len(names) == 0 {
+		return ""
+	}
+	return strings.TrimSuffix(names[0], ".")
+}
+
+// geoFields turns what we know about a client into embed fields. With
+// privacy mode on, the city and rDNS name are left out since they can
+// identify someone almost as well as the address.
+func geoFields(g geoInfo, rdns string) []*DiscordEmbedField {
+	var fields []*DiscordEmbedField
+	if g.Country != "" {
+		v := g.Country
+		if g.CountryName != "" {
+			v = g.CountryName + " (" + g.Country + ")"
+		}
+		fields = append(fields, &DiscordEmbedField{Name: "Country", Value: v, Inline: true})
+	}
+	if g.City != "" && conf().Privacy.Mode == "" {
+		fields = append(fields, &DiscordEmbedField{Name: "City", Value: g.City, Inline: true})
+	}
+	if g.ASN != 0 {
+		v := fmt.Sprintf("AS%d", g.ASN)
+		if g.ASOrg != "" {
+			v += " " + g.ASOrg
+		}
+		fields = append(fields, &DiscordEmbedField{Name: "ASN", Value: v, Inline: true})
+	}
+	if rdns != "" && conf().Privacy.Mode == "" {
+		fields = append(fields, &DiscordEmbedField{Name: "rDNS", Value: rdns, Inline: true})
+	}
+	return fields
+}
+
+func (g geoInfo) vars(vars alertVars, rdns string) alertVars {
+	vars["country"] = g.Country
+	vars["country_name"] = g.CountryName
+	vars["city"] = g.City
+	vars["asn"] = g.ASN
+	vars["as_org"] = g.ASOrg
+	vars["rdns"] = rdns
+	return vars
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// A small gRPC server for the Admin service in sshproxy.proto, on plain
+// net/http: gRPC is HTTP/2 with length-prefixed protobuf messages and the
+// status in trailers, which is little enough to do by hand and keeps the
+// proxy free of dependencies.
+
+// gRPC status codes used here.
+const (
+	grpcOK              = 0
+	grpcInvalidArgument = 3
+	grpcUnimplemented   = 12
+	grpcInternal        = 13
+	grpcUnauthenticated = 16
+)
+
+var grpcMethods = map[string]func(w http.ResponseWriter, r *http.Request, req []byte) error{
+	"/sshproxy.v1.Admin/GetStats":     grpcGetStats,
+	"/sshproxy.v1.Admin/ListSessions": grpcListSessions,
+	"/sshproxy.v1.Admin/ListBackends": grpcListBackends,
+	"/sshproxy.v1.Admin/WatchEvents":  grpcWatchEvents,
+}
+
+type grpcStatusError struct {
+	code int
+	msg  string
+}
+
+func (e *grpcStatusError) Error() string { return e.msg }
+
+func startGRPC(addr string) {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	srv := &http.Server{Handler: http.HandlerFunc(serveGRPC), Protocols: &protocols}
+	l, err := listen("tcp", addr)
+	if err != nil {
+		errorf("gRPC admin service failed to listen on %s: %v\n", addr, err)
+		return
+	}
+	infof("gRPC admin service listening on %s\n", addr)
+	go func() {
+		if err := srv.Serve(l); err != nil && !handedOver.Load() {
+			errorf("gRPC admin service on %s stopped: %v\n", addr, err)
+		}
+	}()
+}
+
+func serveGRPC(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC only", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	// every method only reads, so any role will do, but the data isn't
+	// split by tenant
+	if id, ok := authenticate(r); !ok || id.tenant != "" {
+		grpcFinish(w, &grpcStatusError{grpcUnauthenticated, "missing or wrong credentials"})
+		return
+	}
+	method, ok := grpcMethods[r.URL.Path]
+	if !ok {
+		grpcFinish(w, &grpcStatusError{grpcUnimplemented, "unknown method " + r.URL.Path})
+		return
+	}
+	req, err := readGRPCMessage(r.Body)
+	if err != nil {
+		grpcFinish(w, &grpcStatusError{grpcInvalidArgument, err.Error()})
+		return
+	}
+	grpcFinish(w, method(w, r, req))
+}
+
+// readGRPCMessage reads the single request message of a unary or
+// server-streaming call.
+func readGRPCMessage(body io.Reader) ([]byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(body, hdr[:]); err != nil {
+		return nil, errors.New("missing request message")
+	}
+	if hdr[0] != 0 {
+		return nil, errors.New("compressed messages aren't supported")
+	}
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if n > 1<<20 {
+		return nil, errors.New("request message too large")
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(body, msg); err != nil {
+		return nil, errors.New("truncated request message")
+	}
+	return msg, nil
+}
+
+func writeGRPCMessage(w http.ResponseWriter, msg []byte) error {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	if _, err := w.Write(append(frame, msg...)); err != nil {
+		return err
+	}
+	w.(http.Flusher).Flush()
+	return nil
+}
+
+// grpcFinish sends the call's status in the trailers.
+func grpcFinish(w http.ResponseWriter, err error) {
+	code, msg := grpcOK, ""
+	var st *grpcStatusError
+	switch {
+	case errors.As(err, &st):
+		code, msg = st.code, st.msg
+	case err != nil:
+		code, msg = grpcInternal, err.Error()
+	}
+	w.Header().Set("Grpc-Status", fmt.Sprint(code))
+	if msg != "" {
+		w.Header().Set("Grpc-Message", url.PathEscape(msg))
+	}
+}
+
+func grpcGetStats(w http.ResponseWriter, r *http.Request, _ []byte) error {
+	st := currentStats()
+	var m pbWriter
+	m.string(1, st.Version)
+	m.int64(2, st.Started.Unix())
+	m.double(3, st.UptimeSeconds)
+	m.int64(4, st.Accepted)
+	for reason, n := range st.Rejected {
+		m.message(5, func(e *pbWriter) {
+			e.string(1, reason)
+			e.int64(2, n)
+		})
+	}
+	m.int64(6, int64(st.ActiveSessions))
+	m.int64(7, st.BytesIn)
+	m.int64(8, st.BytesOut)
+	m.bool(9, st.Maintenance)
+	m.int64(10, int64(st.Bans))
+	m.int64(11, int64(st.NotifyQueue))
+	m.string(12, st.LogLevel)
+	return writeGRPCMessage(w, m.buf)
+}
+
+func grpcListSessions(w http.ResponseWriter, r *http.Request, _ []byte) error {
+	var m pbWriter
+	for _, s := range sessionInfos() {
+		m.message(1, func(e *pbWriter) {
+			e.string(1, s.ID)
+			e.string(2, s.Src)
+			e.string(3, s.Backend)
+			e.int64(4, s.Started.Unix())
+			e.double(5, s.AgeSeconds)
+			e.int64(6, s.BytesIn)
+			e.int64(7, s.BytesOut)
+			e.string(8, s.Country)
+			for _, t := range s.Tags {
+				e.string(9, t)
+			}
+		})
+	}
+	return writeGRPCMessage(w, m.buf)
+}
+
+func grpcListBackends(w http.ResponseWriter, r *http.Request, _ []byte) error {
+	var m pbWriter
+	for _, b := range backendInfos() {
+		m.message(1, func(e *pbWriter) {
+			e.string(1, b.Address)
+			e.bool(2, b.Up)
+			e.int64(3, int64(b.Sessions))
+			e.double(4, b.DialP50Secs)
+			e.double(5, b.DialP99Secs)
+		})
+	}
+	return writeGRPCMessage(w, m.buf)
+}
+
+func grpcWatchEvents(w http.ResponseWriter, r *http.Request, req []byte) error {
+	var types []string
+	err := pbFields(req, func(field, wireType int, _ uint64, data []byte) error {
+		if field == 1 && wireType == 2 {
+			if !knownEventType(string(data)) {
+				return &grpcStatusError{grpcInvalidArgument, fmt.Sprintf("unknown event type %q", data)}
+			}
+			types = append(types, string(data))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	events, stop := watchEvents("grpc")
+	defer stop()
+	// send the headers now so the client knows the stream is up
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil
+		case ev := <-events:
+			if len(types) > 0 && !containsString(types, ev.Type) {
+				continue
+			}
+			var m pbWriter
+			m.int64(1, ev.Time.UnixNano())
+			m.string(2, ev.Type)
+			m.string(3, ev.ID)
+			m.string(4, ev.Src)
+			m.string(5, ev.Backend)
+			m.int64(6, ev.BytesIn)
+			m.int64(7, ev.BytesOut)
+			m.double(8, ev.Duration)
+			m.string(9, ev.Reason)
+			for _, t := range ev.Tags {
+				m.string(10, t)
+			}
+			m.string(11, ev.Country)
+			m.uint64(12, ev.ASN)
+			if err := writeGRPCMessage(w, m.buf); err != nil {
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// runHealthcheck is for container health checks, which can't count on curl
+// being in the image. With a control socket or admin listener it asks the
+// proxy whether its port is bound (and, with -backends, whether a backend
+// is up), so the check never becomes a session. Without one it falls back
+// to connecting to -listen. Exits 0 when healthy, 1 when not.
+func runHealthcheck(configFile string, args []string) {
+	fs := flag.NewFlagSet("healthcheck", flag.ExitOnError)
+	ep := controlFlags(fs, configFile)
+	listen := fs.String("listen", "", "proxy address to connect to when there's no control socket or admin listener, e.g. 127.0.0.1:2222 (an empty host means 127.0.0.1)")
+	backends := fs.Bool("backends", false, "also fail when no backend is healthy")
+	timeout := fs.Duration("timeout", 3*time.Second, "how long the connect may take")
+	fs.Usage = func() {
+		fmt.Println("usage: ./connectproxy [-config proxy.json] healthcheck [-socket path | -admin host:port -token t | -listen host:port] [-backends] [-timeout 3s]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if !ep.configured() && (*listen == "" || *backends) {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if !ep.configured() {
+		addr, err := probeAddr(*listen)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "healthcheck: -listen: %v\n", err)
+			os.Exit(2)
+		}
+		conn, err := net.DialTimeout("tcp", addr, *timeout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unhealthy: %v\n", err)
+			os.Exit(1)
+		}
+		conn.Close()
+		fmt.Println("healthy")
+		return
+	}
+	// /readyz checks the backends on the spot when health_check is off
+	path := "/readyz?backends=false"
+	if *backends {
+		path = "/readyz"
+	}
+	resp, err := ep.request(http.MethodGet, path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unhealthy: %v\n", err)
+		os.Exit(1)
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "unhealthy: %s\n", strings.TrimSpace(string(body)))
+		os.Exit(1)
+	}
+	fmt.Println("healthy")
+}
+
+// probeAddr points an unspecified or missing host at loopback, so -listen
+// can be given the same way as the proxy's own listen address.
+func probeAddr(listen string) (string, error) {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return "", err
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port), nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	hexdumpMu   sync.Mutex
+	hexdumpNets []*net.IPNet
+	hexdumpOut  io.Writer
+)
+
+type hexdumper struct {
+	mu        sync.Mutex
+	id        string
+	remaining int64
+	offset    [2]int64
+}
+
+func parseIPOrCIDR(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		return n, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("%q is not an IP or CIDR", s)
+	}
+	bits := 128
+	if ip.To4() != nil {
+		ip, bits = ip.To4(), 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+func setHexdumpTargets(list []string) error {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		n, err := parseIPOrCIDR(s)
+		if err != nil {
+			return err
+		}
+		nets = append(nets, n)
+	}
+	hexdumpMu.Lock()
+	hexdumpNets = nets
+	hexdumpMu.Unlock()
+	return nil
+}
+
+func hexdumpTargets() []string {
+	hexdumpMu.Lock()
+	defer hexdumpMu.Unlock()
+	out := make([]string, len(hexdumpNets))
+	for i, n := range hexdumpNets {
+		out[i] = n.String()
+	}
+	return out
+}
+
+// openHexdumpFile sends dumps to their own file instead of the main log,
+// rotated with the main log's settings.
+func openHexdumpFile(path string) error {
+	c := conf().Log
+	c.File = path
+	w, err := newRotatingWriter(c)
+	if err != nil {
+		return err
+	}
+	hexdumpOut = w
+	return nil
+}
+
+// newHexdumper returns a dumper if ip is one of the selected sources, or
+// nil (which dumps nothing) for everyone else.
+func newHexdumper(id, ip string) *hexdumper {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return nil
+	}
+	hexdumpMu.Lock()
+	defer hexdumpMu.Unlock()
+	for _, n := range hexdumpNets {
+		if n.Contains(parsed) {
+			return &hexdumper{id: id, remaining: conf().Hexdump.MaxSessionBytes}
+		}
+	}
+	return nil
+}
+
+func (h *hexdumper) write(direction string, p []byte) {
+	if h == nil {
+		return
+	}
+	dir := 0
+	if direction == "backend->client" {
+		dir = 1
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.remaining <= 0 {
+		return
+	}
+	n := int64(len(p))
+	cut := ""
+	if n > h.remaining {
+		n = h.remaining
+		cut = ", rest of session not dumped"
+	}
+	h.remaining -= n
+	header := fmt.Sprintf("[%s] %s %d bytes at offset %d%s", h.id, direction, len(p), h.offset[dir], cut)
+	h.offset[dir] += int64(len(p))
+	dump := hex.Dump(p[:n])
+	if hexdumpOut == nil {
+		debugf("%s\n%s", header, dump)
+		return
+	}
+	hexdumpMu.Lock()
+	fmt.Fprintf(hexdumpOut, "%s %s\n%s", time.Now().Format("2006/01/02 15:04:05.000"), header, dump)
+	hexdumpMu.Unlock()
+}
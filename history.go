@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type historyRecord struct {
+	ID          string    `json:"id"`
+	Tenant      string    `json:"tenant,omitempty"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	Src         string    `json:"src"`
+	Dst         string    `json:"dst"`
+	BytesIn     int64     `json:"bytes_in"`
+	BytesOut    int64     `json:"bytes_out"`
+	CloseReason string    `json:"close_reason"`
+	Tags        []string  `json:"tags,omitempty"`
+	Country     string    `json:"country,omitempty"`
+}
+
+// historyStore is an append-only file of one JSON record per finished
+// session. Pruning rewrites it without the records past retention.
+type historyStore struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+var history *historyStore
+
+func openHistory(path string) (*historyStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &historyStore{path: path, file: f}, nil
+}
+
+func (h *historyStore) add(rec historyRecord) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		warnf("failed to encode history record: %v", err)
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, err := h.file.Write(append(data, '\n')); err != nil {
+		warnf("failed to write history record: %v", err)
+		reportError(err, "failed to write history record")
+	}
+}
+
+func (h *historyStore) prune(retention time.Duration) error {
+	cutoff := time.Now().Add(-retention)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	tmp := h.path + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	enc := json.NewEncoder(w)
+	kept, dropped := 0, 0
+	err = readHistory(h.path, time.Time{}, func(rec historyRecord) bool {
+		if rec.End.Before(cutoff) {
+			dropped++
+			return true
+		}
+		kept++
+		return enc.Encode(rec) == nil
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	out.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if dropped == 0 {
+		os.Remove(tmp)
+		return nil
+	}
+	if err := os.Rename(tmp, h.path); err != nil {
+		return err
+	}
+	h.file.Close()
+	h.file, err = os.OpenFile(h.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	infof("pruned %d history records older than %s, %d kept\n", dropped, retention, kept)
+	return nil
+}
+
+func runHistoryPruning(h *historyStore, retention time.Duration) {
+	for {
+		if err := h.prune(retention); err != nil {
+			warnf("failed to prune history: %v", err)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+// readHistory calls fn for every record that ended at or after since, in
+// file order, until fn returns false.
+func readHistory(path string, since time.Time, fn func(historyRecord) bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		var rec historyRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			continue
+		}
+		if rec.End.Before(since) {
+			continue
+		}
+		if !fn(rec) {
+			break
+		}
+	}
+	return sc.Err()
+}
+
+func recordHistory(s *session) {
+	if history == nil {
+		return
+	}
+	s.mu.Lock()
+	rec := historyRecord{
+		ID:          s.id,
+		Tenant:      s.tenant,
+		Start:       s.start,
+		End:         time.Now(),
+		Src:         anonAddr(s.client.RemoteAddr().String()),
+		Dst:         s.backend,
+		BytesIn:     s.bytesIn.Load(),
+		BytesOut:    s.bytesOut.Load(),
+		CloseReason: s.closeReason,
+		Tags:        append([]string(nil), s.tags...),
+		Country:     s.geo.Country,
+	}
+	s.mu.Unlock()
+	history.add(rec)
+}
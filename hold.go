@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// With client_hold, a backend restart of a few seconds doesn't cost the
+// clients who connect during it their session: instead of closing on them
+// when the dial fails, the proxy keeps them waiting and redials. SSH
+// clients send their version line straight away, so what they send while
+// held is kept and passed on once the backend answers.
+
+var clientHolds = newCounter("sshproxy_client_holds_total", "Clients held because their backend couldn't be reached, by outcome: connected, timeout or left.", "outcome")
+
+var errClientLeft = errors.New("the client left while held")
+
+// holdClient redials addr until client_hold.timeout, reading what the
+// client sends into a buffer meanwhile. That also tells when the client
+// gives up. It returns the connection and the buffered bytes, or the last
+// dial error.
+func holdClient(sess *session, client net.Conn, addr string, dialErr error) (net.Conn, []byte, error) {
+	c := conf().ClientHold
+	start := time.Now()
+	deadline := start.Add(c.Timeout.Duration)
+	infof("[%s] can't reach %s (%v), holding the client for up to %s\n", sess.id, addr, dialErr, c.Timeout.Duration)
+
+	var (
+		mu      sync.Mutex
+		held    []byte
+		readErr error
+	)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 4096)
+		for {
+			mu.Lock()
+			room := c.MaxBytes - len(held)
+			mu.Unlock()
+			if room <= 0 {
+				// the rest waits in the socket buffer
+				return
+			}
+			n, err := client.Read(buf[:min(len(buf), room)])
+			mu.Lock()
+			held = append(held, buf[:n]...)
+			if err != nil {
+				readErr = err
+			}
+			mu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+	// stopReading ends the read and reports whether the client went away
+	stopReading := func() error {
+		client.SetReadDeadline(time.Now())
+		<-done
+		client.SetReadDeadline(time.Time{})
+		mu.Lock()
+		defer mu.Unlock()
+		if readErr != nil && !errors.Is(readErr, os.ErrDeadlineExceeded) {
+			return fmt.Errorf("%w: %v", errClientLeft, readErr)
+		}
+		return nil
+	}
+
+	tick := time.NewTicker(c.RetryInterval.Duration)
+	defer tick.Stop()
+	for reading := done; time.Now().Before(deadline); {
+		select {
+		case <-reading:
+			reading = nil
+			if err := stopReading(); err != nil {
+				clientHolds.inc("left")
+				return nil, nil, err
+			}
+			continue
+		case <-tick.C:
+		}
+		target, err := dialBackend(addr, max(time.Until(deadline), time.Millisecond), backendSocket(tenants[sess.tenant]))
+		if err != nil {
+			dialErr = err
+			continue
+		}
+		if err := stopReading(); err != nil {
+			target.Close()
+			clientHolds.inc("left")
+			return nil, nil, err
+		}
+		clientHolds.inc("connected")
+		infof("[%s] %s answered after %s, passing on %d held bytes\n", sess.id, addr, time.Since(start).Round(time.Millisecond), len(held))
+		return target, held, nil
+	}
+	if err := stopReading(); err != nil {
+		clientHolds.inc("left")
+		return nil, nil, err
+	}
+	clientHolds.inc("timeout")
+	return nil, nil, fmt.Errorf("still unreachable after holding the client for %s: %v", c.Timeout.Duration, dialErr)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// A dead man's switch for busy listeners: if no client connects for
+// inactivity.alert_after, something upstream (a firewall rule, DNS) has
+// probably stopped traffic reaching us, which otherwise looks exactly like
+// a quiet day.
+var (
+	lastActivity       atomic.Int64
+	inactivityAlerting atomic.Bool
+)
+
+func noteActivity() {
+	lastActivity.Store(time.Now().UnixNano())
+	if inactivityAlerting.CompareAndSwap(true, false) {
+		go func() {
+			infof("client connections resumed\n")
+			resolveIncident("inactivity", "Client connections resumed")
+			if err := sendAlert(nil, "Activity Resumed", "Clients are connecting again", 0x008000); err != nil {
+				warnf("Failed to send Discord embed: %v", err)
+			}
+		}()
+	}
+}
+
+func runInactivityWatch(after time.Duration) {
+	lastActivity.Store(time.Now().UnixNano())
+	every := after / 10
+	if every < time.Second {
+		every = time.Second
+	}
+	if every > time.Minute {
+		every = time.Minute
+	}
+	for range time.Tick(every) {
+		idle := time.Since(time.Unix(0, lastActivity.Load()))
+		if idle < after || !inactivityAlerting.CompareAndSwap(false, true) {
+			continue
+		}
+		summary := fmt.Sprintf("No client connections for %s", idle.Round(time.Second))
+		warnf("%s\n", summary)
+		triggerIncident("inactivity", summary, "warning")
+		if err := sendAlert(alertVars{"idle": idle}, "No Activity", summary+", the listener may no longer be reachable", 0xFFA500); err != nil {
+			warnf("Failed to send Discord embed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Incidents are opened and resolved for conditions that need a human, as
+// opposed to embeds which are just messages. Each condition has a stable
+// dedup key so PagerDuty/Opsgenie fold repeats into one incident, and we
+// only send on state changes so a flapping condition doesn't page again
+// while its incident is open.
+//
+// They ride the notification outbox like everything else, so they get the
+// same retries and spool; the incident is carried in an embed's fields.
+var (
+	incidentsMu sync.Mutex
+	// incidentOpen is true for incidents we opened, false for ones we
+	// resolved; keys we haven't touched yet are unknown, so the first
+	// resolve for them is sent in case a previous run left one open.
+	incidentOpen = map[string]bool{}
+)
+
+func incidentsEnabled() bool {
+	return conf().Notify.PagerDuty.RoutingKey != "" || conf().Notify.Opsgenie.APIKey != ""
+}
+
+// triggerIncident opens an incident; severity is critical, error, warning
+// or info.
+func triggerIncident(key, summary, severity string) {
+	if !incidentsEnabled() {
+		return
+	}
+	incidentsMu.Lock()
+	if incidentOpen[key] {
+		incidentsMu.Unlock()
+		return
+	}
+	incidentOpen[key] = true
+	incidentsMu.Unlock()
+	infof("opening incident %s: %s\n", key, summary)
+	queueIncident("trigger", key, summary, severity)
+}
+
+func resolveIncident(key, summary string) {
+	if !incidentsEnabled() {
+		return
+	}
+	incidentsMu.Lock()
+	if open, known := incidentOpen[key]; known && !open {
+		incidentsMu.Unlock()
+		return
+	}
+	incidentOpen[key] = false
+	incidentsMu.Unlock()
+	infof("resolving incident %s\n", key)
+	queueIncident("resolve", key, summary, "info")
+}
+
+func queueIncident(action, key, summary, severity string) {
+	embed := DiscordEmbed{
+		Title:     summary,
+		Timestamp: time.Now().Format(time.RFC3339),
+		Fields: []DiscordEmbedField{
+			{Name: "Action", Value: action},
+			{Name: "Dedup Key", Value: key},
+			{Name: "Severity", Value: severity},
+		},
+	}
+	if c := conf().Notify.PagerDuty; c.RoutingKey != "" {
+		if err := enqueueNotification("pagerduty", c.URL, embed); err != nil {
+			warnf("failed to queue PagerDuty event: %v", err)
+		}
+	}
+	if c := conf().Notify.Opsgenie; c.APIKey != "" {
+		if err := enqueueNotification("opsgenie", c.URL, embed); err != nil {
+			warnf("failed to queue Opsgenie alert: %v", err)
+		}
+	}
+}
+
+func incidentFields(e DiscordEmbed) (action, key, severity string) {
+	for _, f := range e.Fields {
+		switch f.Name {
+		case "Action":
+			action = f.Value
+		case "Dedup Key":
+			key = f.Value
+		case "Severity":
+			severity = f.Value
+		}
+	}
+	return
+}
+
+func postPagerDuty(url string, embeds []DiscordEmbed) (time.Duration, error) {
+	e := embeds[0]
+	action, key, severity := incidentFields(e)
+	host, _ := os.Hostname()
+	event := map[string]any{
+		"routing_key":  conf().Notify.PagerDuty.RoutingKey,
+		"event_action": action,
+		"dedup_key":    "sshproxy-" + key,
+	}
+	if action == "trigger" {
+		event["payload"] = map[string]any{
+			"summary":   e.Title,
+			"source":    host,
+			"severity":  severity,
+			"component": "sshproxy",
+			"timestamp": e.Timestamp,
+		}
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return 0, err
+	}
+	return postJSON(url, body, nil)
+}
+
+var opsgeniePriority = map[string]string{"critical": "P1", "error": "P2", "warning": "P3", "info": "P5"}
+
+func postOpsgenie(url string, embeds []DiscordEmbed) (time.Duration, error) {
+	e := embeds[0]
+	action, key, severity := incidentFields(e)
+	alias := "sshproxy-" + key
+	header := http.Header{"Authorization": {"GenieKey " + conf().Notify.Opsgenie.APIKey}}
+	base := strings.TrimSuffix(url, "/") + "/v2/alerts"
+	host, _ := os.Hostname()
+	if action == "resolve" {
+		body, _ := json.Marshal(map[string]string{"source": host, "note": e.Title})
+		wait, err := postJSON(base+"/"+neturl.PathEscape(alias)+"/close?identifierType=alias", body, header)
+		// closing an alert that was never opened (or already closed) is fine
+		if isStatus(err, http.StatusNotFound) {
+			return wait, nil
+		}
+		return wait, err
+	}
+	body, err := json.Marshal(map[string]any{
+		"message":  clip(e.Title, 130),
+		"alias":    alias,
+		"priority": opsgeniePriority[severity],
+		"source":   host,
+		"tags":     []string{"sshproxy"},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return postJSON(base, body, header)
+}
+
+func isStatus(err error, code int) bool {
+	var se *webhookStatusError
+	return errors.As(err, &se) && se.code == code
+}
@@ -0,0 +1,554 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Kafka producer on the broker protocol, just enough to append events to
+// one topic: Metadata to find each partition's leader, Produce with
+// acks=all, and SASL PLAIN or SCRAM, optionally over TLS. It sticks to
+// request versions that predate flexible encoding, which every broker from
+// 1.0 to 4.x accepts. Any error drops the connections and the metadata, so
+// the shipper's next attempt starts from the bootstrap brokers again.
+
+// Kafka API keys.
+const (
+	kafkaProduce          = 0
+	kafkaMetadata         = 3
+	kafkaSASLHandshake    = 17
+	kafkaSASLAuthenticate = 36
+)
+
+// kafkaErrors names the error codes a producer is likely to see.
+var kafkaErrors = map[int16]string{
+	2:  "CORRUPT_MESSAGE",
+	3:  "UNKNOWN_TOPIC_OR_PARTITION",
+	5:  "LEADER_NOT_AVAILABLE",
+	6:  "NOT_LEADER_OR_FOLLOWER",
+	7:  "REQUEST_TIMED_OUT",
+	10: "MESSAGE_TOO_LARGE",
+	19: "NOT_ENOUGH_REPLICAS",
+	29: "TOPIC_AUTHORIZATION_FAILED",
+	33: "UNSUPPORTED_SASL_MECHANISM",
+	35: "UNSUPPORTED_VERSION",
+	58: "SASL_AUTHENTICATION_FAILED",
+}
+
+func kafkaError(code int16) error {
+	if name, ok := kafkaErrors[code]; ok {
+		return fmt.Errorf("kafka error %d (%s)", code, name)
+	}
+	return fmt.Errorf("kafka error %d", code)
+}
+
+var errKafkaShort = errors.New("truncated kafka response")
+
+type kafkaWriter struct {
+	buf []byte
+}
+
+func (w *kafkaWriter) int8(v int8)   { w.buf = append(w.buf, byte(v)) }
+func (w *kafkaWriter) int16(v int16) { w.buf = binary.BigEndian.AppendUint16(w.buf, uint16(v)) }
+func (w *kafkaWriter) int32(v int32) { w.buf = binary.BigEndian.AppendUint32(w.buf, uint32(v)) }
+func (w *kafkaWriter) int64(v int64) { w.buf = binary.BigEndian.AppendUint64(w.buf, uint64(v)) }
+
+func (w *kafkaWriter) string(s string) {
+	w.int16(int16(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *kafkaWriter) bytes(b []byte) {
+	w.int32(int32(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+// kafkaReader decodes a response, remembering the first short read so
+// callers can check once at the end.
+type kafkaReader struct {
+	buf []byte
+	err error
+}
+
+func (r *kafkaReader) take(n int) []byte {
+	if r.err != nil || n < 0 || len(r.buf) < n {
+		r.err = errKafkaShort
+		return make([]byte, max(n, 0))
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *kafkaReader) int16() int16 { return int16(binary.BigEndian.Uint16(r.take(2))) }
+func (r *kafkaReader) int32() int32 { return int32(binary.BigEndian.Uint32(r.take(4))) }
+func (r *kafkaReader) int64() int64 { return int64(binary.BigEndian.Uint64(r.take(8))) }
+
+// string reads a string, with a null one coming back empty.
+func (r *kafkaReader) string() string {
+	n := r.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(r.take(int(n)))
+}
+
+func (r *kafkaReader) bytes() []byte {
+	n := r.int32()
+	if n < 0 {
+		return nil
+	}
+	return r.take(int(n))
+}
+
+// count reads an array length, which can't be more than the bytes left.
+func (r *kafkaReader) count() int {
+	n := int(r.int32())
+	if n < 0 {
+		return 0
+	}
+	if n > len(r.buf) {
+		r.err = errKafkaShort
+		return 0
+	}
+	return n
+}
+
+type kafkaConn struct {
+	net.Conn
+	r    *bufio.Reader
+	corr int32
+}
+
+// roundTrip sends one request and reads its response, returning the body
+// after the correlation ID.
+func (k *kafkaConn) roundTrip(apiKey, version int16, body []byte) ([]byte, error) {
+	k.corr++
+	var w kafkaWriter
+	w.int32(0) // size, filled in below
+	w.int16(apiKey)
+	w.int16(version)
+	w.int32(k.corr)
+	w.string("sshproxy")
+	w.buf = append(w.buf, body...)
+	binary.BigEndian.PutUint32(w.buf, uint32(len(w.buf)-4))
+	k.SetDeadline(time.Now().Add(15 * time.Second))
+	if _, err := k.Write(w.buf); err != nil {
+		return nil, err
+	}
+	var hdr [8]byte
+	if _, err := io.ReadFull(k.r, hdr[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(hdr[:4])
+	if size < 4 || size > 16<<20 {
+		return nil, fmt.Errorf("bad kafka response size %d", size)
+	}
+	if corr := int32(binary.BigEndian.Uint32(hdr[4:])); corr != k.corr {
+		return nil, fmt.Errorf("kafka response for request %d, expected %d", corr, k.corr)
+	}
+	resp := make([]byte, size-4)
+	if _, err := io.ReadFull(k.r, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+type kafkaProducer struct {
+	c       KafkaConfig
+	brokers map[int32]string // node ID to host:port
+	leaders []int32          // partition to leader node ID
+	conns   map[int32]*kafkaConn
+}
+
+func kafkaBrokerSender(c KafkaConfig) func([]sessionEvent) error {
+	p := &kafkaProducer{c: c, conns: map[int32]*kafkaConn{}}
+	return func(batch []sessionEvent) error {
+		err := p.send(batch)
+		if err != nil {
+			p.reset()
+		}
+		return err
+	}
+}
+
+func (p *kafkaProducer) reset() {
+	for id, k := range p.conns {
+		k.Close()
+		delete(p.conns, id)
+	}
+	p.leaders = nil
+}
+
+func (p *kafkaProducer) dial(addr string) (*kafkaConn, error) {
+	nc, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if p.c.TLS {
+		host, _, _ := net.SplitHostPort(addr)
+		tc := tls.Client(nc, &tls.Config{ServerName: host, InsecureSkipVerify: p.c.InsecureSkipVerify})
+		tc.SetDeadline(time.Now().Add(10 * time.Second))
+		if err := tc.Handshake(); err != nil {
+			nc.Close()
+			return nil, err
+		}
+		nc = tc
+	}
+	k := &kafkaConn{Conn: nc, r: bufio.NewReader(nc)}
+	if p.c.Username != "" {
+		if err := kafkaAuthenticate(k, p.c); err != nil {
+			k.Close()
+			return nil, fmt.Errorf("sasl: %v", err)
+		}
+	}
+	return k, nil
+}
+
+// refresh asks the bootstrap brokers, in turn, who leads each partition.
+func (p *kafkaProducer) refresh() error {
+	var lastErr error
+	for _, addr := range p.c.Brokers {
+		k, err := p.dial(addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		err = p.metadata(k)
+		k.Close()
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+	}
+	return lastErr
+}
+
+func (p *kafkaProducer) metadata(k *kafkaConn) error {
+	var w kafkaWriter
+	w.int32(1)
+	w.string(p.c.Topic)
+	w.int8(1) // let the broker create the topic if it's set up to
+	resp, err := k.roundTrip(kafkaMetadata, 4, w.buf)
+	if err != nil {
+		return err
+	}
+	r := &kafkaReader{buf: resp}
+	r.int32() // throttle time
+	brokers := map[int32]string{}
+	for n := r.count(); n > 0; n-- {
+		id := r.int32()
+		host := r.string()
+		port := r.int32()
+		r.string() // rack
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	r.string() // cluster ID
+	r.int32()  // controller
+	var leaders []int32
+	for n := r.count(); n > 0; n-- {
+		code := r.int16()
+		name := r.string()
+		r.take(1) // is_internal
+		if name == p.c.Topic && code != 0 {
+			return fmt.Errorf("topic %s: %v", name, kafkaError(code))
+		}
+		for parts := r.count(); parts > 0; parts-- {
+			r.int16() // a partition's own error doesn't matter as long as it has a leader
+			index := r.int32()
+			leader := r.int32()
+			r.take(4 * r.count()) // replicas
+			r.take(4 * r.count()) // in-sync replicas
+			if name != p.c.Topic || index < 0 || index >= 1<<16 {
+				continue
+			}
+			for int(index) >= len(leaders) {
+				leaders = append(leaders, -1)
+			}
+			leaders[index] = leader
+		}
+	}
+	if r.err != nil {
+		return r.err
+	}
+	if len(leaders) == 0 {
+		return fmt.Errorf("topic %s has no partitions", p.c.Topic)
+	}
+	p.brokers, p.leaders = brokers, leaders
+	return nil
+}
+
+func (p *kafkaProducer) send(batch []sessionEvent) error {
+	if p.leaders == nil {
+		if err := p.refresh(); err != nil {
+			return err
+		}
+	}
+	// a session's events share a key, so they land on one partition and
+	// stay in order
+	byLeader := map[int32]map[int32][]sessionEvent{}
+	for _, ev := range batch {
+		part := int32(kafkaMurmur2([]byte(ev.ID))&0x7fffffff) % int32(len(p.leaders))
+		leader := p.leaders[part]
+		if leader < 0 {
+			return fmt.Errorf("partition %d of %s has no leader", part, p.c.Topic)
+		}
+		if byLeader[leader] == nil {
+			byLeader[leader] = map[int32][]sessionEvent{}
+		}
+		byLeader[leader][part] = append(byLeader[leader][part], ev)
+	}
+	for leader, parts := range byLeader {
+		k := p.conns[leader]
+		if k == nil {
+			addr, ok := p.brokers[leader]
+			if !ok {
+				return fmt.Errorf("leader %d isn't in the metadata", leader)
+			}
+			var err error
+			if k, err = p.dial(addr); err != nil {
+				return err
+			}
+			p.conns[leader] = k
+		}
+		if err := p.produce(k, parts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *kafkaProducer) produce(k *kafkaConn, parts map[int32][]sessionEvent) error {
+	var w kafkaWriter
+	w.int16(-1) // no transactional ID
+	w.int16(-1) // acks from every in-sync replica
+	w.int32(10000)
+	w.int32(1)
+	w.string(p.c.Topic)
+	w.int32(int32(len(parts)))
+	for part, events := range parts {
+		w.int32(part)
+		w.bytes(kafkaRecordBatch(events))
+	}
+	resp, err := k.roundTrip(kafkaProduce, 3, w.buf)
+	if err != nil {
+		return err
+	}
+	r := &kafkaReader{buf: resp}
+	for n := r.count(); n > 0; n-- {
+		r.string()
+		for parts := r.count(); parts > 0; parts-- {
+			index := r.int32()
+			code := r.int16()
+			r.int64() // base offset
+			r.int64() // log append time
+			if r.err == nil && code != 0 {
+				return fmt.Errorf("partition %d: %v", index, kafkaError(code))
+			}
+		}
+	}
+	return r.err
+}
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// kafkaRecordBatch encodes events as a v2 record batch, keyed by
+// connection ID with the event as JSON.
+func kafkaRecordBatch(events []sessionEvent) []byte {
+	base := events[0].Time.UnixMilli()
+	maxTS := base
+	var records []byte
+	for i, ev := range events {
+		value, _ := json.Marshal(ev)
+		ts := ev.Time.UnixMilli()
+		maxTS = max(maxTS, ts)
+		var rec []byte
+		rec = append(rec, 0) // attributes
+		rec = binary.AppendVarint(rec, ts-base)
+		rec = binary.AppendVarint(rec, int64(i))
+		rec = binary.AppendVarint(rec, int64(len(ev.ID)))
+		rec = append(rec, ev.ID...)
+		rec = binary.AppendVarint(rec, int64(len(value)))
+		rec = append(rec, value...)
+		rec = binary.AppendVarint(rec, 0) // headers
+		records = binary.AppendVarint(records, int64(len(rec)))
+		records = append(records, rec...)
+	}
+
+	// everything from attributes on is covered by the CRC
+	var tail kafkaWriter
+	tail.int16(0) // attributes: no compression, create time
+	tail.int32(int32(len(events) - 1))
+	tail.int64(base)
+	tail.int64(maxTS)
+	tail.int64(-1) // producer ID
+	tail.int16(-1) // producer epoch
+	tail.int32(-1) // base sequence
+	tail.int32(int32(len(events)))
+	tail.buf = append(tail.buf, records...)
+
+	var w kafkaWriter
+	w.int64(0)                                // base offset
+	w.int32(int32(4 + 1 + 4 + len(tail.buf))) // batch length
+	w.int32(-1)                               // partition leader epoch
+	w.int8(2)                                 // magic
+	w.buf = binary.BigEndian.AppendUint32(w.buf, crc32.Checksum(tail.buf, crc32c))
+	w.buf = append(w.buf, tail.buf...)
+	return w.buf
+}
+
+// kafkaMurmur2 is the hash Kafka's default partitioner uses for keys, so
+// other producers writing the same keys pick the same partitions.
+func kafkaMurmur2(data []byte) int32 {
+	const m = 0x5bd1e995
+	h := uint32(0x9747b28c) ^ uint32(len(data))
+	n := len(data) &^ 3
+	for i := 0; i < n; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> 24
+		k *= m
+		h *= m
+		h ^= k
+	}
+	switch tail := data[n:]; len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
+
+// kafkaAuthenticate runs the SASL exchange for c.SASLMechanism.
+func kafkaAuthenticate(k *kafkaConn, c KafkaConfig) error {
+	var w kafkaWriter
+	w.string(c.SASLMechanism)
+	resp, err := k.roundTrip(kafkaSASLHandshake, 1, w.buf)
+	if err != nil {
+		return err
+	}
+	r := &kafkaReader{buf: resp}
+	if code := r.int16(); code != 0 {
+		return kafkaError(code)
+	}
+	if r.err != nil {
+		return r.err
+	}
+	step := func(msg []byte) ([]byte, error) {
+		var w kafkaWriter
+		w.bytes(msg)
+		resp, err := k.roundTrip(kafkaSASLAuthenticate, 0, w.buf)
+		if err != nil {
+			return nil, err
+		}
+		r := &kafkaReader{buf: resp}
+		code := r.int16()
+		text := r.string()
+		data := r.bytes()
+		if r.err != nil {
+			return nil, r.err
+		}
+		if code != 0 {
+			if text != "" {
+				return nil, fmt.Errorf("%v: %s", kafkaError(code), text)
+			}
+			return nil, kafkaError(code)
+		}
+		return data, nil
+	}
+	switch c.SASLMechanism {
+	case "PLAIN":
+		_, err := step([]byte("\x00" + c.Username + "\x00" + c.Password))
+		return err
+	case "SCRAM-SHA-256":
+		return scramAuthenticate(step, sha256.New, c.Username, c.Password)
+	case "SCRAM-SHA-512":
+		return scramAuthenticate(step, sha512.New, c.Username, c.Password)
+	}
+	return fmt.Errorf("unsupported mechanism %s", c.SASLMechanism)
+}
+
+// scramAuthenticate is the client side of RFC 5802, without channel
+// binding.
+func scramAuthenticate(step func([]byte) ([]byte, error), h func() hash.Hash, user, pass string) error {
+	var raw [18]byte
+	rand.Read(raw[:])
+	nonce := base64.RawStdEncoding.EncodeToString(raw[:])
+	user = strings.NewReplacer("=", "=3D", ",", "=2C").Replace(user)
+	clientFirst := "n=" + user + ",r=" + nonce
+	msg, err := step([]byte("n,," + clientFirst))
+	if err != nil {
+		return err
+	}
+	serverFirst := string(msg)
+	attrs := map[string]string{}
+	for _, kv := range strings.Split(serverFirst, ",") {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			attrs[k] = v
+		}
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil {
+		return fmt.Errorf("bad salt from server")
+	}
+	iter, err := strconv.Atoi(attrs["i"])
+	if err != nil || iter < 1 {
+		return fmt.Errorf("bad iteration count from server")
+	}
+	if !strings.HasPrefix(attrs["r"], nonce) {
+		return fmt.Errorf("server nonce doesn't extend ours")
+	}
+	salted, err := pbkdf2.Key(h, pass, salt, iter, h().Size())
+	if err != nil {
+		return err
+	}
+	mac := func(key []byte, s string) []byte {
+		m := hmac.New(h, key)
+		m.Write([]byte(s))
+		return m.Sum(nil)
+	}
+	clientKey := mac(salted, "Client Key")
+	storedKey := h()
+	storedKey.Write(clientKey)
+	withoutProof := "c=biws,r=" + attrs["r"]
+	authMessage := clientFirst + "," + serverFirst + "," + withoutProof
+	proof := mac(storedKey.Sum(nil), authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	msg, err = step([]byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)))
+	if err != nil {
+		return err
+	}
+	want := base64.StdEncoding.EncodeToString(mac(mac(salted, "Server Key"), authMessage))
+	if string(msg) != "v="+want {
+		return fmt.Errorf("server signature doesn't match")
+	}
+	return nil
+}
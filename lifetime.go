@@ -0,0 +1,246 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Lifetime totals outlive restarts by riding along in state.file. The
+// counters hold what earlier runs counted, and this run's metrics are
+// added on top when they're read. Per-client totals and the ban history
+// are kept here directly. Clients are keyed by their anonIP form.
+
+const (
+	maxLifetimeClients = 10000
+	maxBanHistory      = 500
+)
+
+type clientTotals struct {
+	Sessions int64     `json:"sessions"`
+	BytesIn  int64     `json:"bytes_in"`
+	BytesOut int64     `json:"bytes_out"`
+	First    time.Time `json:"first_seen"`
+	Last     time.Time `json:"last_seen"`
+}
+
+type banRecord struct {
+	At     time.Time  `json:"at"`
+	Action string     `json:"action"`
+	IP     string     `json:"ip"`
+	Until  *time.Time `json:"until,omitempty"`
+	By     string     `json:"by"`
+}
+
+type lifetimeTotals struct {
+	Since    time.Time                `json:"since"`
+	Restarts int64                    `json:"restarts"`
+	Accepted int64                    `json:"connections_accepted"`
+	Rejected map[string]int64         `json:"connections_rejected"`
+	Sessions int64                    `json:"sessions"`
+	BytesIn  int64                    `json:"bytes_in"`
+	BytesOut int64                    `json:"bytes_out"`
+	Clients  map[string]*clientTotals `json:"clients"`
+	Bans     []banRecord              `json:"ban_history"`
+}
+
+var (
+	lifetimeMu sync.Mutex
+	lifetime   = lifetimeTotals{Since: time.Now().UTC(), Rejected: map[string]int64{}, Clients: map[string]*clientTotals{}}
+)
+
+func init() {
+	adminMux.HandleFunc("GET /api/v1/clients", apiAuth(apiClients))
+	adminMux.HandleFunc("GET /api/v1/bans/history", apiAuth(apiBanHistory))
+}
+
+// restoreLifetime takes over the totals saved by the last run. It runs
+// before the listener starts, so there's nothing of this run's to merge.
+func restoreLifetime(saved *lifetimeTotals) {
+	if saved == nil {
+		return
+	}
+	lifetimeMu.Lock()
+	defer lifetimeMu.Unlock()
+	lifetime = *saved
+	lifetime.Restarts++
+	if lifetime.Rejected == nil {
+		lifetime.Rejected = map[string]int64{}
+	}
+	if lifetime.Clients == nil {
+		lifetime.Clients = map[string]*clientTotals{}
+	}
+	for len(lifetime.Clients) > maxLifetimeClients {
+		forgetOldestClient()
+	}
+}
+
+// forgetOldestClient drops the client seen longest ago, making room for a
+// new one once maxLifetimeClients are kept. The caller holds lifetimeMu.
+func forgetOldestClient() {
+	var oldest string
+	var last time.Time
+	for k, c := range lifetime.Clients {
+		if oldest == "" || c.Last.Before(last) {
+			oldest, last = k, c.Last
+		}
+	}
+	delete(lifetime.Clients, oldest)
+}
+
+func recordClientTotals(s *session) {
+	key := anonIP(s.ip)
+	now := time.Now().UTC()
+	lifetimeMu.Lock()
+	defer lifetimeMu.Unlock()
+	c := lifetime.Clients[key]
+	if c == nil {
+		if len(lifetime.Clients) >= maxLifetimeClients {
+			forgetOldestClient()
+		}
+		c = &clientTotals{First: s.start.UTC()}
+		lifetime.Clients[key] = c
+	}
+	c.Sessions++
+	c.BytesIn += s.bytesIn.Load()
+	c.BytesOut += s.bytesOut.Load()
+	c.Last = now
+	lifetime.Sessions++
+}
+
+// recordBan adds to the ban history; shown is already anonymized.
+func recordBan(action, shown string, until time.Time, by string) {
+	rec := banRecord{At: time.Now().UTC(), Action: action, IP: shown, By: by}
+	if !until.IsZero() {
+		u := until.UTC()
+		rec.Until = &u
+	}
+	lifetimeMu.Lock()
+	defer lifetimeMu.Unlock()
+	lifetime.Bans = append(lifetime.Bans, rec)
+	if n := len(lifetime.Bans) - maxBanHistory; n > 0 {
+		lifetime.Bans = append([]banRecord(nil), lifetime.Bans[n:]...)
+	}
+}
+
+// lifetimeSnapshot copies the totals with this run's counters added, for
+// saving or showing.
+func lifetimeSnapshot() lifetimeTotals {
+	lifetimeMu.Lock()
+	defer lifetimeMu.Unlock()
+	out := lifetime
+	out.Accepted += int64(connectionsAccepted.total())
+	out.BytesIn += int64(bytesForwarded.value("client->backend"))
+	out.BytesOut += int64(bytesForwarded.value("backend->client"))
+	out.Rejected = make(map[string]int64, len(lifetime.Rejected))
+	for reason, n := range lifetime.Rejected {
+		out.Rejected[reason] = n
+	}
+	for _, s := range connectionsRejected.snapshot() {
+		out.Rejected[s.labelValues[0]] += int64(s.value)
+	}
+	out.Clients = make(map[string]*clientTotals, len(lifetime.Clients))
+	for k, c := range lifetime.Clients {
+		cp := *c
+		out.Clients[k] = &cp
+	}
+	out.Bans = append([]banRecord(nil), lifetime.Bans...)
+	return out
+}
+
+// lifetimeSummary is the part of the totals that goes in /api/v1/stats.
+type lifetimeSummary struct {
+	Since    time.Time        `json:"since"`
+	Restarts int64            `json:"restarts"`
+	Accepted int64            `json:"connections_accepted"`
+	Rejected map[string]int64 `json:"connections_rejected"`
+	Sessions int64            `json:"sessions"`
+	BytesIn  int64            `json:"bytes_in"`
+	BytesOut int64            `json:"bytes_out"`
+	Clients  int              `json:"unique_clients"`
+	Bans     int              `json:"bans_issued"`
+}
+
+func currentLifetimeSummary() lifetimeSummary {
+	lifetimeMu.Lock()
+	defer lifetimeMu.Unlock()
+	st := lifetimeSummary{
+		Since:    lifetime.Since,
+		Restarts: lifetime.Restarts,
+		Accepted: lifetime.Accepted + int64(connectionsAccepted.total()),
+		Rejected: map[string]int64{},
+		Sessions: lifetime.Sessions,
+		BytesIn:  lifetime.BytesIn + int64(bytesForwarded.value("client->backend")),
+		BytesOut: lifetime.BytesOut + int64(bytesForwarded.value("backend->client")),
+		Clients:  len(lifetime.Clients),
+	}
+	for reason, n := range lifetime.Rejected {
+		st.Rejected[reason] = n
+	}
+	for _, s := range connectionsRejected.snapshot() {
+		st.Rejected[s.labelValues[0]] += int64(s.value)
+	}
+	for _, b := range lifetime.Bans {
+		if b.Action == "banned" {
+			st.Bans++
+		}
+	}
+	return st
+}
+
+type clientInfo struct {
+	IP string `json:"ip"`
+	clientTotals
+}
+
+// apiClients lists per-client totals, busiest first by sort=bytes (the
+// default) or sort=sessions, up to limit (default 50).
+func apiClients(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := 50
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			apiError(w, http.StatusBadRequest, "limit must be a positive number")
+			return
+		}
+		limit = n
+	}
+	bySessions := false
+	switch q.Get("sort") {
+	case "", "bytes":
+	case "sessions":
+		bySessions = true
+	default:
+		apiError(w, http.StatusBadRequest, "sort must be bytes or sessions")
+		return
+	}
+	lt := lifetimeSnapshot()
+	out := make([]clientInfo, 0, len(lt.Clients))
+	for ip, c := range lt.Clients {
+		out = append(out, clientInfo{IP: ip, clientTotals: *c})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		if bySessions && a.Sessions != b.Sessions {
+			return a.Sessions > b.Sessions
+		}
+		if a.BytesIn+a.BytesOut != b.BytesIn+b.BytesOut {
+			return a.BytesIn+a.BytesOut > b.BytesIn+b.BytesOut
+		}
+		return a.IP < b.IP
+	})
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func apiBanHistory(w http.ResponseWriter, r *http.Request) {
+	lifetimeMu.Lock()
+	out := append([]banRecord{}, lifetime.Bans...)
+	lifetimeMu.Unlock()
+	writeJSON(w, http.StatusOK, out)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Proxy listeners can be split over several sockets bound to the same
+// port with SO_REUSEPORT. The kernel spreads new connections across them,
+// and each gets its own accept loop, so a burst of connects isn't
+// funnelled through one goroutine.
+
+var (
+	acceptorAccepted = newCounter("sshproxy_acceptor_connections_total", "Client connections accepted per acceptor socket, with listener.acceptors above 1.", "listen", "acceptor")
+	acceptErrors     = newCounter("sshproxy_accept_errors_total", "Failed accepts on the proxy listeners, by kind: temporary, closed or fatal.", "listen", "kind")
+)
+
+const (
+	acceptBackoffMax   = time.Second
+	relistenBackoffMax = time.Minute
+)
+
+// setsockoptInt takes the fd as RawConn hands it over. The syscall
+// package wants an int on Unix and a Handle on Windows; T covers both.
+func setsockoptInt[T ~int | ~uintptr](set func(T, int, int, int) error, fd uintptr, level, opt, value int) error {
+	return set(T(fd), level, opt, value)
+}
+
+// soReusePort is the option that load-balances connections over sockets
+// sharing a port, by number since the syscall package lacks it. Darwin
+// and most BSDs have SO_REUSEPORT but hand every connection to one socket,
+// so they're left out.
+func soReusePort() (int, bool) {
+	switch runtime.GOOS {
+	case "linux", "android":
+		if strings.HasPrefix(runtime.GOARCH, "mips") {
+			return 0x200, true
+		}
+		return 0xf, true
+	case "freebsd":
+		// SO_REUSEPORT_LB
+		return 0x10000, true
+	}
+	return 0, false
+}
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	opt, ok := soReusePort()
+	if !ok {
+		return fmt.Errorf("SO_REUSEPORT load balancing isn't available on %s", runtime.GOOS)
+	}
+	var serr error
+	if err := c.Control(func(fd uintptr) {
+		serr = setsockoptInt(syscall.SetsockoptInt, fd, syscall.SOL_SOCKET, opt, 1)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+// listenAcceptors opens listener.acceptors sockets on addr, or a single
+// plain one when that's 1. The workers' supervisor opens one per worker.
+func listenAcceptors(addr string) ([]net.Listener, error) {
+	n := conf().Listener.Acceptors
+	if conf().Workers.Count > 1 && workerIndex == 0 {
+		n = conf().Workers.Count
+	}
+	if n <= 1 {
+		l, err := listenAs("tcp:"+addr, func() (net.Listener, error) { return listenProxy(addr, false) })
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	}
+	var out []net.Listener
+	var keys []string
+	for i := range n {
+		key := acceptorKey(addr, strconv.Itoa(i))
+		l, err := listenAs(key, func() (net.Listener, error) { return listenProxy(addr, true) })
+		if err != nil {
+			for _, k := range keys {
+				unlisten(k)
+			}
+			return nil, err
+		}
+		out = append(out, l)
+		keys = append(keys, key)
+	}
+	return out, nil
+}
+
+// listenProxy opens a proxy listener, with MPTCP as the route has it.
+func listenProxy(addr string, reusePort bool) (net.Listener, error) {
+	var lc net.ListenConfig
+	if reusePort {
+		lc.Control = reusePortControl
+	}
+	lc.SetMultipathTCP(listenMPTCP(addr))
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// acceptorKey is the listen key of an acceptor socket; acceptor is its
+// index, or empty when the address has just one.
+func acceptorKey(addr, acceptor string) string {
+	if acceptor == "" || acceptor == "0" {
+		return "tcp:" + addr
+	}
+	return "tcp:" + addr + "#" + acceptor
+}
+
+// acceptErrorKind sorts a failed Accept. "temporary" clears up on its own:
+// out of file descriptors or buffers, or a client that went away while
+// queued. "closed" is the socket closed under the accept loop, and
+// "fatal" anything else wrong with it. Both of those need a new socket.
+func acceptErrorKind(err error) string {
+	if errors.Is(err, net.ErrClosed) {
+		return "closed"
+	}
+	for _, errno := range []syscall.Errno{
+		syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM,
+		syscall.ECONNABORTED, syscall.ECONNRESET, syscall.EINTR, syscall.EAGAIN,
+		syscall.EPROTO, syscall.EPERM,
+	} {
+		if errors.Is(err, errno) {
+			return "temporary"
+		}
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return "temporary"
+	}
+	return "fatal"
+}
+
+// relisten replaces a proxy socket that can't accept any more. It keeps
+// trying, backing off up to a minute, with an alert and an incident while
+// the socket is missing. It returns nil once another process has taken
+// over, since there's nothing left to serve then.
+func relisten(old net.Listener, acceptor, listenAddr string, primary bool, cause error) net.Listener {
+	key := acceptorKey(listenAddr, acceptor)
+	errorf("listener on %s stopped accepting: %v, opening it again\n", listenAddr, cause)
+	old.Close()
+	listenersMu.Lock()
+	if listeners[key] == old {
+		delete(listeners, key)
+	}
+	listenersMu.Unlock()
+	// a single socket is only shared with the other workers' ones
+	reusePort := acceptor != "" || workerIndex > 0
+	delay := time.Second
+	failing := false
+	for {
+		if handedOver.Load() {
+			return nil
+		}
+		l, err := listenAs(key, func() (net.Listener, error) { return listenProxy(listenAddr, reusePort) })
+		if err == nil {
+			tuneListener(l)
+			if primary {
+				listenerBound.Store(true)
+			}
+			infof("listening on %s again\n", listenAddr)
+			if failing {
+				resolveIncident("listener-"+listenAddr, "Listener bound "+listenAddr+" again")
+				if err := sendAlert(alertVars{"listen": listenAddr}, "Listener Restored", fmt.Sprintf("Listening on %s again", listenAddr), 0x008000); err != nil {
+					warnf("Failed to send Discord embed: %v", err)
+				}
+			}
+			return l
+		}
+		if !failing {
+			failing = true
+			if primary {
+				listenerBound.Store(false)
+			}
+			errorf("failed to listen on %s again: %v, retrying\n", listenAddr, err)
+			reportError(err, "failed to rebind "+listenAddr)
+			triggerIncident("listener-"+listenAddr, fmt.Sprintf("Listener on %s stopped (%v) and can't be rebound: %v", listenAddr, cause, err), "critical")
+			if err := sendAlert(alertVars{"listen": listenAddr, "error": err.Error(), "cause": cause.Error()}, "Listener Lost",
+				fmt.Sprintf("The listener on %s stopped accepting (%v) and can't be opened again: %v. Retrying until it can.", listenAddr, cause, err), 0xFF0000); err != nil {
+				warnf("Failed to send Discord embed: %v", err)
+			}
+		}
+		time.Sleep(delay)
+		delay = min(2*delay, relistenBackoffMax)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+type logLevel int32
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+var currentLogLevel atomic.Int32
+
+func init() {
+	currentLogLevel.Store(int32(levelInfo))
+}
+
+func (l logLevel) String() string {
+	return levelNames[l]
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return logLevel(i), nil
+		}
+	}
+	if strings.EqualFold(s, "warning") {
+		return levelWarn, nil
+	}
+	return levelInfo, fmt.Errorf("unknown log level %q (want debug, info, warn or error)", s)
+}
+
+func setLogLevel(l logLevel) {
+	currentLogLevel.Store(int32(l))
+}
+
+func getLogLevel() logLevel {
+	return logLevel(currentLogLevel.Load())
+}
+
+func logEnabled(l logLevel) bool {
+	return l >= getLogLevel()
+}
+
+func logf(l logLevel, format string, args ...any) {
+	if !logEnabled(l) {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if syslogOut != nil {
+		syslogOut.send(l, msg)
+		if conf().Log.Syslog.Only {
+			return
+		}
+	}
+	log.Output(3, strings.ToUpper(l.String())+" "+msg)
+}
+
+func debugf(format string, args ...any) { logf(levelDebug, format, args...) }
+func infof(format string, args ...any)  { logf(levelInfo, format, args...) }
+func warnf(format string, args ...any)  { logf(levelWarn, format, args...) }
+func errorf(format string, args ...any) { logf(levelError, format, args...) }
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// rotatingWriter is a log file that rolls over by size or age and prunes old
+// backups, for hosts without logrotate.
+type rotatingWriter struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	every    time.Duration
+	backups  int
+	maxAge   time.Duration
+	compress bool
+
+	file   *os.File
+	size   int64
+	opened time.Time
+
+	cleanupMu sync.Mutex
+}
+
+func newRotatingWriter(c LogConfig) (*rotatingWriter, error) {
+	w := &rotatingWriter{
+		path:     c.File,
+		maxSize:  int64(c.MaxSizeMB) * 1024 * 1024,
+		every:    c.RotateEvery.Duration,
+		backups:  c.MaxBackups,
+		maxAge:   c.MaxAge.Duration,
+		compress: c.Compress,
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *rotatingWriter) open() error {
+	if err := os.MkdirAll(filepath.Dir(w.path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file = f
+	w.size = info.Size()
+	w.opened = time.Now()
+	return nil
+}
+
+func (w *rotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	due := w.every > 0 && time.Since(w.opened) >= w.every
+	if w.size > 0 && (due || (w.maxSize > 0 && w.size+int64(len(p)) > w.maxSize)) {
+		if err := w.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "log rotation failed: %v\n", err)
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *rotatingWriter) rotate() error {
+	w.file.Close()
+	ext := filepath.Ext(w.path)
+	backup := fmt.Sprintf("%s-%s%s", strings.TrimSuffix(w.path, ext), time.Now().Format(backupTimeFormat), ext)
+	if err := os.Rename(w.path, backup); err != nil {
+		w.open()
+		return err
+	}
+	if err := w.open(); err != nil {
+		return err
+	}
+	go w.cleanup(backup)
+	return nil
+}
+
+func (w *rotatingWriter) cleanup(latest string) {
+	w.cleanupMu.Lock()
+	defer w.cleanupMu.Unlock()
+	if w.compress {
+		if err := gzipFile(latest); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to compress %s: %v\n", latest, err)
+		}
+	}
+	ext := filepath.Ext(w.path)
+	prefix := strings.TrimSuffix(filepath.Base(w.path), ext) + "-"
+	entries, err := os.ReadDir(filepath.Dir(w.path))
+	if err != nil {
+		return
+	}
+	var backups []string
+	for _, e := range entries {
+		if isBackupName(e.Name(), prefix, ext) {
+			backups = append(backups, e.Name())
+		}
+	}
+	// The timestamp format sorts lexically, newest last.
+	sort.Strings(backups)
+	for i, name := range backups {
+		full := filepath.Join(filepath.Dir(w.path), name)
+		tooMany := w.backups > 0 && i < len(backups)-w.backups
+		tooOld := false
+		if w.maxAge > 0 {
+			if info, err := os.Stat(full); err == nil && time.Since(info.ModTime()) > w.maxAge {
+				tooOld = true
+			}
+		}
+		if tooMany || tooOld {
+			os.Remove(full)
+		}
+	}
+}
+
+// isBackupName matches exactly what rotate writes, <base>-<time><ext>
+// with an optional .gz, so other files sharing the prefix (proxy-access.log
+// next to proxy.log, say) are left alone.
+func isBackupName(name, prefix, ext string) bool {
+	rest, ok := strings.CutPrefix(name, prefix)
+	if !ok {
+		return false
+	}
+	rest = strings.TrimSuffix(rest, ".gz")
+	ts, ok := strings.CutSuffix(rest, ext)
+	if !ok {
+		return false
+	}
+	_, err := time.Parse(backupTimeFormat, ts)
+	return err == nil
+}
+
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
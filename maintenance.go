@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	maintenanceMu    sync.Mutex
+	maintenanceOn    bool
+	maintenanceSince time.Time
+	maintenanceDrain *time.Timer
+)
+
+func inMaintenance() bool {
+	maintenanceMu.Lock()
+	defer maintenanceMu.Unlock()
+	return maintenanceOn
+}
+
+func setMaintenance(on bool, reason string) {
+	maintenanceMu.Lock()
+	if maintenanceOn == on {
+		maintenanceMu.Unlock()
+		return
+	}
+	maintenanceOn = on
+	if maintenanceDrain != nil {
+		maintenanceDrain.Stop()
+		maintenanceDrain = nil
+	}
+	since := maintenanceSince
+	if on {
+		maintenanceSince = time.Now()
+		if grace := conf().Maintenance.DrainAfter.Duration; grace > 0 {
+			maintenanceDrain = time.AfterFunc(grace, drainSessions)
+		}
+	}
+	maintenanceMu.Unlock()
+
+	auditf("maintenance %t (%s)", on, reason)
+	if on {
+		infof("entering maintenance mode (%s)\n", reason)
+		if err := sendDiscordEmbed("Maintenance Mode", fmt.Sprintf("Proxy entered maintenance mode (%s), new connections are being refused", reason), 0xFFA500); err != nil {
+			warnf("Failed to send Discord embed: %v", err)
+		}
+		return
+	}
+	infof("leaving maintenance mode (%s)\n", reason)
+	if err := sendDiscordEmbed("Maintenance Ended", fmt.Sprintf("Proxy left maintenance mode (%s) after %s", reason, time.Since(since).Round(time.Second)), 0x008000); err != nil {
+		warnf("Failed to send Discord embed: %v", err)
+	}
+}
+
+func drainSessions() {
+	if !inMaintenance() {
+		return
+	}
+	list := activeSessions()
+	infof("maintenance grace period over, closing %d active sessions\n", len(list))
+	for _, s := range list {
+		s.close("maintenance_drain")
+	}
+}
+
+func rejectMaintenance(client net.Conn) {
+	client.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(client, conf().Maintenance.Message)
+}
+
+// The flag file is edge-triggered so it doesn't fight other callers of
+// setMaintenance: only creating or removing it changes the mode.
+func watchMaintenanceFlag(path string) {
+	exists := fileExists(path)
+	if exists {
+		setMaintenance(true, "flag file "+path+" present")
+	}
+	for range time.Tick(2 * time.Second) {
+		now := fileExists(path)
+		if now == exists {
+			continue
+		}
+		exists = now
+		if now {
+			setMaintenance(true, "flag file "+path+" created")
+		} else {
+			setMaintenance(false, "flag file "+path+" removed")
+		}
+	}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
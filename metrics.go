@@ -0,0 +1,309 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// For histograms value holds the sum of observations and buckets the
+// per-bucket (non-cumulative) counts, with the last entry for +Inf.
+type series struct {
+	labelValues []string
+	value       float64
+	count       uint64
+	buckets     []uint64
+	exemplars   []exemplar
+}
+
+// exemplar ties the latest observation in a histogram bucket to the
+// connection that produced it; only the OpenMetrics format can carry it.
+type exemplar struct {
+	connID string
+	value  float64
+	at     time.Time
+}
+
+type metric struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	bounds []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []*metric
+	collectors []func()
+)
+
+func newMetric(kind, name, help string, labels ...string) *metric {
+	m := &metric{name: name, help: help, kind: kind, labels: labels, series: map[string]*series{}}
+	registryMu.Lock()
+	registry = append(registry, m)
+	registryMu.Unlock()
+	return m
+}
+
+func newCounter(name, help string, labels ...string) *metric {
+	return newMetric("counter", name, help, labels...)
+}
+
+func newGauge(name, help string, labels ...string) *metric {
+	return newMetric("gauge", name, help, labels...)
+}
+
+func newHistogram(name, help string, bounds []float64, labels ...string) *metric {
+	m := newMetric("histogram", name, help, labels...)
+	m.bounds = bounds
+	return m
+}
+
+// onCollect registers a hook run before every export, for gauges that are
+// cheaper to compute on demand than to keep up to date.
+func onCollect(fn func()) {
+	registryMu.Lock()
+	collectors = append(collectors, fn)
+	registryMu.Unlock()
+}
+
+func (m *metric) get(labelValues []string) *series {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		m.series[key] = s
+	}
+	return s
+}
+
+func (m *metric) add(v float64, labelValues ...string) {
+	m.mu.Lock()
+	m.get(labelValues).value += v
+	m.mu.Unlock()
+}
+
+func (m *metric) inc(labelValues ...string) {
+	m.add(1, labelValues...)
+}
+
+func (m *metric) set(v float64, labelValues ...string) {
+	m.mu.Lock()
+	m.get(labelValues).value = v
+	m.mu.Unlock()
+}
+
+func (m *metric) observe(v float64, labelValues ...string) {
+	m.observeExemplar(v, "", labelValues...)
+}
+
+func (m *metric) observeExemplar(v float64, connID string, labelValues ...string) {
+	m.mu.Lock()
+	s := m.get(labelValues)
+	if s.buckets == nil {
+		s.buckets = make([]uint64, len(m.bounds)+1)
+		s.exemplars = make([]exemplar, len(m.bounds)+1)
+	}
+	i := sort.SearchFloat64s(m.bounds, v)
+	s.buckets[i]++
+	if connID != "" {
+		s.exemplars[i] = exemplar{connID: connID, value: v, at: time.Now()}
+	}
+	s.count++
+	s.value += v
+	m.mu.Unlock()
+}
+
+func (m *metric) value(labelValues ...string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.series[strings.Join(labelValues, "\xff")]; ok {
+		return s.value
+	}
+	return 0
+}
+
+func (m *metric) total() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var sum float64
+	for _, s := range m.series {
+		sum += s.value
+	}
+	return sum
+}
+
+func (m *metric) reset() {
+	m.mu.Lock()
+	m.series = map[string]*series{}
+	m.mu.Unlock()
+}
+
+func (m *metric) snapshot() []series {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]series, 0, len(m.series))
+	for _, s := range m.series {
+		c := *s
+		c.buckets = append([]uint64(nil), s.buckets...)
+		c.exemplars = append([]exemplar(nil), s.exemplars...)
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return strings.Join(out[i].labelValues, ",") < strings.Join(out[j].labelValues, ",")
+	})
+	return out
+}
+
+func collectMetrics() []*metric {
+	registryMu.Lock()
+	fns := append([]func(){}, collectors...)
+	list := append([]*metric{}, registry...)
+	registryMu.Unlock()
+	for _, fn := range fns {
+		fn()
+	}
+	return list
+}
+
+// writePrometheus renders the classic text format, or OpenMetrics (which
+// adds histogram exemplars) when openMetrics is set.
+func writePrometheus(w io.Writer, openMetrics bool) {
+	for _, m := range collectMetrics() {
+		family := m.name
+		if openMetrics && m.kind == "counter" {
+			family = strings.TrimSuffix(m.name, "_total")
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", family, m.help, family, m.kind)
+		for _, s := range m.snapshot() {
+			if m.kind != "histogram" {
+				fmt.Fprintf(w, "%s%s %s\n", m.name, promLabels(m.labels, s.labelValues), promValue(s.value))
+				continue
+			}
+			labels := append(append([]string(nil), m.labels...), "le")
+			var cum uint64
+			for i, n := range s.buckets {
+				cum += n
+				le := math.Inf(1)
+				if i < len(m.bounds) {
+					le = m.bounds[i]
+				}
+				values := append(append([]string(nil), s.labelValues...), promValue(le))
+				fmt.Fprintf(w, "%s_bucket%s %d", m.name, promLabels(labels, values), cum)
+				if ex := s.exemplars[i]; openMetrics && ex.connID != "" {
+					fmt.Fprintf(w, " # {conn_id=%s} %s %.3f", strconv.Quote(ex.connID), promValue(ex.value), float64(ex.at.UnixNano())/1e9)
+				}
+				fmt.Fprintln(w)
+			}
+			fmt.Fprintf(w, "%s_sum%s %s\n", m.name, promLabels(m.labels, s.labelValues), promValue(s.value))
+			fmt.Fprintf(w, "%s_count%s %d\n", m.name, promLabels(m.labels, s.labelValues), s.count)
+		}
+	}
+	if openMetrics {
+		fmt.Fprintln(w, "# EOF")
+	}
+}
+
+func promLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, n := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(n)
+		b.WriteString("=")
+		b.WriteString(strconv.Quote(values[i]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func promValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	connectionsAccepted  = newCounter("sshproxy_connections_accepted_total", "Client connections accepted by the listener.")
+	connectionsRejected  = newCounter("sshproxy_connections_rejected_total", "Client connections refused before reaching a backend.", "reason")
+	activeSessionsGauge  = newGauge("sshproxy_active_sessions", "Sessions currently open.")
+	bytesForwarded       = newCounter("sshproxy_bytes_total", "Bytes forwarded between clients and backends, counted as they are copied.", "direction")
+	backendDialErrors    = newCounter("sshproxy_backend_dial_errors_total", "Failed dials to a backend.", "backend")
+	backendDialSuccesses = newCounter("sshproxy_backend_dial_successes_total", "Successful dials to a backend.", "backend")
+	backendStreamErrors  = newCounter("sshproxy_backend_stream_errors_total", "Sessions that ended with a read or write error mid-stream.", "backend")
+	backendSessions      = newGauge("sshproxy_backend_active_sessions", "Sessions currently open per backend.", "backend")
+	webhookFailures      = newCounter("sshproxy_webhook_failures_total", "Webhook deliveries that failed.")
+	backendUp            = newGauge("sshproxy_backend_up", "Whether the backend answered its last dial or health check.", "backend")
+	sessionDuration      = newHistogram("sshproxy_session_duration_seconds", "Lifetime of proxied sessions.",
+		[]float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 1800, 3600, 4 * 3600, 24 * 3600}, "route")
+	dialLatency = newHistogram("sshproxy_backend_dial_seconds", "Time taken to dial a backend.",
+		[]float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}, "backend")
+	mirrorBytes           = newCounter("sshproxy_mirror_bytes_total", "Client bytes copied to the mirror target.")
+	mirrorDropped         = newCounter("sshproxy_mirror_dropped_bytes_total", "Client bytes not mirrored because the mirror fell behind.")
+	mirrorErrors          = newCounter("sshproxy_mirror_errors_total", "Mirror connections that failed to dial or write.")
+	chaosFaults           = newCounter("sshproxy_chaos_faults_total", "Faults injected by chaos mode.", "fault")
+	exfilAlerts           = newCounter("sshproxy_exfil_alerts_total", "Sessions that crossed the large transfer threshold.")
+	signatureMatches      = newCounter("sshproxy_signature_matches_total", "Sessions that matched a payload signature.", "signature", "action")
+	notifyQueueDepthGauge = newGauge("sshproxy_notify_queue_depth", "Webhook notifications waiting to be sent.")
+	notifyDropped         = newCounter("sshproxy_notify_dropped_total", "Webhook notifications dropped because the queue was full.")
+	notifyRetries         = newCounter("sshproxy_notify_retries_total", "Webhook sends that failed and were scheduled for another attempt.")
+	notifySuppressed      = newCounter("sshproxy_notify_suppressed_total", "Notifications suppressed by the global notification rate limit.", "kind")
+	notifyRateLimited     = newCounter("sshproxy_notify_rate_limited_total", "Webhook sends Discord answered with 429.")
+	notifyExpired         = newCounter("sshproxy_notify_expired_total", "Webhook notifications given up on after max_age.")
+	eventsDropped         = newCounter("sshproxy_events_dropped_total", "Session events a sink could not deliver.", "sink")
+	execHookRuns          = newCounter("sshproxy_exec_hook_runs_total", "Exec hook commands run, by outcome.", "result")
+	routeBytes            = newCounter("sshproxy_route_bytes_total", "Bytes forwarded per route, counted as they are copied.", "route", "direction")
+	throughput            = newGauge("sshproxy_throughput_bytes_per_second", "Forwarding rate over the last sample interval.", "direction")
+	throughputRoute       = newGauge("sshproxy_route_throughput_bytes_per_second", "Forwarding rate per route over the last sample interval.", "route", "direction")
+	dialLatencyQuantile   = newGauge("sshproxy_backend_dial_latency_seconds", "Dial latency quantiles over the last 512 dials per backend.", "backend", "quantile")
+)
+
+func init() {
+	onCollect(func() {
+		notifyQueueDepthGauge.set(float64(notifyQueueDepth()))
+	})
+	onCollect(func() {
+		sessionsMu.Lock()
+		n := len(sessions)
+		sessionsMu.Unlock()
+		activeSessionsGauge.set(float64(n))
+	})
+	onCollect(func() {
+		counts := map[string]int{}
+		for _, s := range activeSessions() {
+			s.mu.Lock()
+			if s.backend != "" {
+				counts[s.backend]++
+			}
+			s.mu.Unlock()
+		}
+		backendSessions.reset()
+		for addr, n := range counts {
+			backendSessions.set(float64(n), addr)
+		}
+	})
+	onCollect(func() {
+		for addr, up := range backendHealthSnapshot() {
+			v := 0.0
+			if up {
+				v = 1
+			}
+			backendUp.set(v, addr)
+		}
+	})
+}
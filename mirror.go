@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// sessionMirror copies client->backend bytes to a mirror target. It is
+// strictly best effort: the dial happens off the session's goroutine,
+// chunks are dropped when the mirror can't keep up, and any mirror error
+// just ends mirroring for that session.
+type sessionMirror struct {
+	mu     sync.Mutex
+	ch     chan []byte
+	closed bool
+}
+
+func startMirror(s *session) *sessionMirror {
+	if conf().Mirror.Address == "" {
+		return nil
+	}
+	m := &sessionMirror{ch: make(chan []byte, conf().Mirror.QueueChunks)}
+	go m.run(s.id)
+	return m
+}
+
+func (m *sessionMirror) run(id string) {
+	conn, err := net.DialTimeout("tcp", conf().Mirror.Address, 5*time.Second)
+	if err != nil {
+		debugf("[%s] mirror dial to %s failed: %v", id, conf().Mirror.Address, err)
+		mirrorErrors.inc()
+		m.close()
+		for range m.ch {
+		}
+		return
+	}
+	defer conn.Close()
+	// whatever the mirror sends back is thrown away
+	go io.Copy(io.Discard, conn)
+	failed := false
+	for chunk := range m.ch {
+		if failed {
+			continue
+		}
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if _, err := conn.Write(chunk); err != nil {
+			debugf("[%s] mirror write failed, no longer mirroring: %v", id, err)
+			mirrorErrors.inc()
+			failed = true
+			continue
+		}
+		mirrorBytes.add(float64(len(chunk)))
+	}
+}
+
+func (m *sessionMirror) write(p []byte) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return
+	}
+	select {
+	case m.ch <- append([]byte(nil), p...):
+	default:
+		mirrorDropped.add(float64(len(p)))
+	}
+}
+
+func (m *sessionMirror) close() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.closed {
+		m.closed = true
+		close(m.ch)
+	}
+}
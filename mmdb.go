@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+)
+
+// mmdbReader reads MaxMind DB files (GeoLite2/GeoIP2 City, Country and ASN)
+// without pulling in a dependency: the whole file is read into memory and
+// looked up by walking the binary search tree.
+type mmdbReader struct {
+	buf        []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	dataStart  uint
+	ipv4Start  uint
+}
+
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+func openMMDB(path string) (*mmdbReader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	i := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("%s is not a MaxMind DB file", path)
+	}
+	meta := &mmdbReader{buf: buf[i+len(mmdbMetadataMarker):]}
+	v, _, err := meta.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: bad metadata: %v", path, err)
+	}
+	m, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s: bad metadata", path)
+	}
+	uintOf := func(k string) uint {
+		n, _ := m[k].(uint64)
+		return uint(n)
+	}
+	r := &mmdbReader{
+		buf:        buf,
+		nodeCount:  uintOf("node_count"),
+		recordSize: uintOf("record_size"),
+		ipVersion:  uintOf("ip_version"),
+	}
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, fmt.Errorf("%s: unsupported record size %d", path, r.recordSize)
+	}
+	treeSize := r.nodeCount * r.recordSize / 4
+	r.dataStart = treeSize + 16
+	if r.dataStart > uint(len(buf)) {
+		return nil, fmt.Errorf("%s: truncated search tree", path)
+	}
+	// IPv4 addresses live under ::/96 in an IPv6 tree
+	if r.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < r.nodeCount; i++ {
+			node, err = r.readNode(node, 0)
+			if err != nil {
+				return nil, err
+			}
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+func (r *mmdbReader) readNode(node, bit uint) (uint, error) {
+	off := node * r.recordSize / 4
+	if off+r.recordSize/4 > uint(len(r.buf)) {
+		return 0, errors.New("search tree offset out of range")
+	}
+	b := r.buf[off:]
+	switch r.recordSize {
+	case 24:
+		if bit == 0 {
+			return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]), nil
+		}
+		return uint(b[3])<<16 | uint(b[4])<<8 | uint(b[5]), nil
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]), nil
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6]), nil
+	default:
+		if bit == 0 {
+			return uint(binary.BigEndian.Uint32(b)), nil
+		}
+		return uint(binary.BigEndian.Uint32(b[4:])), nil
+	}
+}
+
+// lookup returns the record for ip, or nil if the database has none.
+func (r *mmdbReader) lookup(ip net.IP) (any, error) {
+	var addr []byte
+	node := uint(0)
+	if v4 := ip.To4(); v4 != nil {
+		addr = v4
+		node = r.ipv4Start
+	} else if r.ipVersion == 6 {
+		addr = ip.To16()
+	} else {
+		return nil, nil
+	}
+	for i := 0; i < len(addr)*8 && node < r.nodeCount; i++ {
+		bit := uint(addr[i/8]>>(7-uint(i%8))) & 1
+		var err error
+		if node, err = r.readNode(node, bit); err != nil {
+			return nil, err
+		}
+	}
+	if node == r.nodeCount {
+		return nil, nil
+	}
+	if node < r.nodeCount {
+		return nil, errors.New("search tree ended on an internal node")
+	}
+	v, _, err := r.decode(r.dataStart + node - r.nodeCount - 16)
+	return v, err
+}
+
+// decode reads one value from the data section at off (absolute), returning
+// it and the offset just past it.
+func (r *mmdbReader) decode(off uint) (any, uint, error) {
+	buf := r.buf
+	next := func(n uint) ([]byte, error) {
+		if off+n > uint(len(buf)) {
+			return nil, errors.New("data section offset out of range")
+		}
+		b := buf[off : off+n]
+		off += n
+		return b, nil
+	}
+	b, err := next(1)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctrl := b[0]
+	typ := uint(ctrl >> 5)
+	if typ == 1 {
+		ss, vvv := uint(ctrl>>3)&3, uint(ctrl&7)
+		pb, err := next(ss + 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		var p uint
+		switch ss {
+		case 0:
+			p = vvv<<8 | uint(pb[0])
+		case 1:
+			p = (vvv<<16 | uint(pb[0])<<8 | uint(pb[1])) + 2048
+		case 2:
+			p = (vvv<<24 | uint(pb[0])<<16 | uint(pb[1])<<8 | uint(pb[2])) + 526336
+		default:
+			p = uint(binary.BigEndian.Uint32(pb))
+		}
+		v, _, err := r.decode(r.dataStart + p)
+		return v, off, err
+	}
+	if typ == 0 {
+		eb, err := next(1)
+		if err != nil {
+			return nil, 0, err
+		}
+		typ = 7 + uint(eb[0])
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		sb, err := next(size - 28)
+		if err != nil {
+			return nil, 0, err
+		}
+		switch size {
+		case 29:
+			size = 29 + uint(sb[0])
+		case 30:
+			size = 285 + (uint(sb[0])<<8 | uint(sb[1]))
+		default:
+			size = 65821 + (uint(sb[0])<<16 | uint(sb[1])<<8 | uint(sb[2]))
+		}
+	}
+	switch typ {
+	case 2, 4:
+		sb, err := next(size)
+		if err != nil {
+			return nil, 0, err
+		}
+		if typ == 2 {
+			return string(sb), off, nil
+		}
+		return append([]byte(nil), sb...), off, nil
+	case 3, 15:
+		fb, err := next(size)
+		if err != nil {
+			return nil, 0, err
+		}
+		if typ == 3 && size == 8 {
+			return math.Float64frombits(binary.BigEndian.Uint64(fb)), off, nil
+		}
+		if typ == 15 && size == 4 {
+			return float64(math.Float32frombits(binary.BigEndian.Uint32(fb))), off, nil
+		}
+		return nil, 0, errors.New("bad float size")
+	case 5, 6, 8, 9, 10:
+		ub, err := next(size)
+		if err != nil {
+			return nil, 0, err
+		}
+		var n uint64
+		for _, c := range ub {
+			// uint128 values are truncated; nothing we read uses them
+			n = n<<8 | uint64(c)
+		}
+		if typ == 8 {
+			return int64(int32(n)), off, nil
+		}
+		return n, off, nil
+	case 7:
+		m := make(map[string]any, size)
+		for i := uint(0); i < size; i++ {
+			k, o, err := r.decode(off)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			v, o, err := r.decode(o)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+			off = o
+		}
+		return m, off, nil
+	case 11:
+		a := make([]any, 0, size)
+		for i := uint(0); i < size; i++ {
+			v, o, err := r.decode(off)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			off = o
+		}
+		return a, off, nil
+	case 14:
+		return size != 0, off, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported data type %d", typ)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// natsSender speaks just enough of the NATS client protocol to publish:
+// CONNECT once per connection, a PUB per event, then a PING whose PONG
+// confirms the server has processed the batch. Any error drops the
+// connection and the next attempt redials.
+func natsSender(c NATSConfig) (func([]sessionEvent) error, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	user, pass := c.Username, c.Password
+	if u.User != nil && user == "" {
+		user = u.User.Username()
+		pass, _ = u.User.Password()
+	}
+
+	var conn net.Conn
+	var r *bufio.Reader
+	connect := func() error {
+		nc, err := net.DialTimeout("tcp", host, 10*time.Second)
+		if err != nil {
+			return err
+		}
+		nc.SetDeadline(time.Now().Add(10 * time.Second))
+		br := bufio.NewReader(nc)
+		line, err := br.ReadString('\n')
+		if err != nil {
+			nc.Close()
+			return err
+		}
+		if !strings.HasPrefix(line, "INFO ") {
+			nc.Close()
+			return fmt.Errorf("unexpected greeting %q", strings.TrimSpace(line))
+		}
+		var info struct {
+			TLSRequired bool `json:"tls_required"`
+		}
+		json.Unmarshal([]byte(line[5:]), &info)
+		useTLS := u.Scheme == "tls" || info.TLSRequired
+		if useTLS {
+			tc := tls.Client(nc, &tls.Config{ServerName: u.Hostname(), InsecureSkipVerify: c.InsecureSkipVerify})
+			if err := tc.Handshake(); err != nil {
+				nc.Close()
+				return err
+			}
+			nc = tc
+			br = bufio.NewReader(nc)
+		}
+		opts, _ := json.Marshal(map[string]any{
+			"verbose":      false,
+			"pedantic":     false,
+			"tls_required": useTLS,
+			"name":         "sshproxy",
+			"lang":         "go",
+			"version":      "1",
+			"user":         user,
+			"pass":         pass,
+			"auth_token":   c.Token,
+		})
+		if _, err := fmt.Fprintf(nc, "CONNECT %s\r\n", opts); err != nil {
+			nc.Close()
+			return err
+		}
+		conn, r = nc, br
+		return nil
+	}
+
+	send := func(batch []sessionEvent) error {
+		if conn == nil {
+			if err := connect(); err != nil {
+				return err
+			}
+		}
+		err := natsPublish(conn, r, c.SubjectPrefix, batch)
+		if err != nil {
+			conn.Close()
+			conn = nil
+		}
+		return err
+	}
+	return send, nil
+}
+
+func natsPublish(conn net.Conn, r *bufio.Reader, prefix string, batch []sessionEvent) error {
+	conn.SetDeadline(time.Now().Add(15 * time.Second))
+	w := bufio.NewWriter(conn)
+	for _, ev := range batch {
+		data, err := json.Marshal(ev)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(w, "PUB %s.%s %d\r\n", prefix, ev.Type, len(data))
+		w.Write(data)
+		w.WriteString("\r\n")
+	}
+	w.WriteString("PING\r\n")
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("server error: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
@@ -0,0 +1,542 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// Webhook sends go through a buffered queue drained by a single worker, so
+// connection handling never waits on Discord. The worker keeps an ordered
+// outbox per destination: embeds are sent oldest first, and when one fails
+// with something worth retrying that outbox waits for its backoff, so
+// embeds still arrive in the order they were raised.
+var (
+	notifyOnce  sync.Once
+	notifyQueue chan *notification
+	notifyMu    sync.Mutex
+	notifyWG    sync.WaitGroup
+	outboxLen   atomic.Int64
+
+	webhookClient = &http.Client{Timeout: 15 * time.Second}
+
+	errNotifyQueueFull = errors.New("notification queue full, embed dropped")
+)
+
+// notifierPosts sends a batch of embeds to one destination, formatted for
+// that service. wait is how long the service wants us to back off.
+var notifierPosts = map[string]func(url string, embeds []DiscordEmbed) (wait time.Duration, err error){
+	"discord":   postDiscordEmbeds,
+	"slack":     postSlack,
+	"telegram":  postTelegram,
+	"email":     postEmail,
+	"pagerduty": postPagerDuty,
+	"opsgenie":  postOpsgenie,
+}
+
+// notifierFor finds the sender for a notification's service; generic
+// webhooks are "webhook:<name>".
+func notifierFor(via string) func(url string, embeds []DiscordEmbed) (time.Duration, error) {
+	if name, ok := strings.CutPrefix(via, "webhook:"); ok {
+		return func(url string, embeds []DiscordEmbed) (time.Duration, error) {
+			return postWebhook(name, url, embeds)
+		}
+	}
+	return notifierPosts[via]
+}
+
+type notification struct {
+	Via      string       `json:"via"`
+	Severity string       `json:"severity,omitempty"`
+	URL      string       `json:"url"`
+	Embed    DiscordEmbed `json:"embed"`
+	Queued   time.Time    `json:"queued"`
+	Attempts int          `json:"attempts"`
+	Next     time.Time    `json:"next"`
+}
+
+type webhookStatusError struct {
+	code   int
+	status string
+}
+
+func (e *webhookStatusError) Error() string {
+	return "unexpected response status: " + e.status
+}
+
+// maxEmbedsPerMessage is Discord's limit on embeds in one webhook message.
+const maxEmbedsPerMessage = 10
+
+// maxEmbedCharsPerMessage is Discord's limit on the combined length of the
+// titles, descriptions and fields of all the embeds in one message; going
+// over it gets the whole message rejected with a 400.
+const maxEmbedCharsPerMessage = 6000
+
+// embedChars counts an embed the way Discord does against
+// maxEmbedCharsPerMessage.
+func embedChars(e DiscordEmbed) int {
+	n := utf8.RuneCountInString(e.Title) + utf8.RuneCountInString(e.Description)
+	for _, f := range e.Fields {
+		n += utf8.RuneCountInString(f.Name) + utf8.RuneCountInString(f.Value)
+	}
+	return n
+}
+
+// notifierBatchLimit overrides maxEmbedsPerMessage for services that can't
+// fit that many in one message.
+var notifierBatchLimit = map[string]int{
+	"telegram":  1,
+	"pagerduty": 1,
+	"opsgenie":  1,
+}
+
+func batchLimit(via string) int {
+	if strings.HasPrefix(via, "webhook:") {
+		return 1
+	}
+	if n, ok := notifierBatchLimit[via]; ok {
+		return n
+	}
+	return maxEmbedsPerMessage
+}
+
+func isRateLimited(err error) bool {
+	var se *webhookStatusError
+	return errors.As(err, &se) && se.code == http.StatusTooManyRequests
+}
+
+// rateLimitWait works out how long Discord wants us to back off, preferring
+// the precise X-RateLimit-Reset-After header, then retry_after in the 429
+// body (Telegram nests it under parameters), then the plain Retry-After
+// header.
+func rateLimitWait(h http.Header, body []byte) time.Duration {
+	secs := func(v string) (time.Duration, bool) {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 {
+			return 0, false
+		}
+		return time.Duration(f * float64(time.Second)), true
+	}
+	wait, ok := secs(h.Get("X-RateLimit-Reset-After"))
+	if !ok && len(body) > 0 {
+		var b struct {
+			RetryAfter *float64 `json:"retry_after"`
+			Parameters struct {
+				RetryAfter *float64 `json:"retry_after"`
+			} `json:"parameters"`
+		}
+		if json.Unmarshal(body, &b) == nil {
+			if b.RetryAfter == nil {
+				b.RetryAfter = b.Parameters.RetryAfter
+			}
+			if b.RetryAfter != nil && *b.RetryAfter >= 0 {
+				wait, ok = time.Duration(*b.RetryAfter*float64(time.Second)), true
+			}
+		}
+	}
+	if !ok {
+		wait, ok = secs(h.Get("Retry-After"))
+	}
+	if !ok {
+		wait = 5 * time.Second
+	}
+	if wait > 10*time.Minute {
+		wait = 10 * time.Minute
+	}
+	return wait
+}
+
+// retryable is true for network errors, 429 and 5xx; any other status
+// means Discord rejected the embed itself and resending won't help.
+func retryable(err error) bool {
+	var se *webhookStatusError
+	if errors.As(err, &se) {
+		return se.code == http.StatusTooManyRequests || se.code >= 500
+	}
+	return !smtpPermanent(err)
+}
+
+func startNotifier() {
+	notifyOnce.Do(func() {
+		notifyQueue = make(chan *notification, conf().Notify.QueueSize)
+		outbox := loadSpool(conf().Notify.SpoolFile)
+		go runNotifier(outbox)
+	})
+}
+
+// outbox holds the pending notifications for one destination. Each
+// destination is retried and rate limited on its own, so Slack being down
+// doesn't hold up Discord.
+type outbox struct {
+	items       []*notification
+	pausedUntil time.Time
+}
+
+func runNotifier(spooled []*notification) {
+	boxes := map[string]*outbox{}
+	add := func(n *notification) {
+		key := n.Via + " " + n.URL
+		b := boxes[key]
+		if b == nil {
+			b = &outbox{}
+			boxes[key] = b
+		}
+		b.items = append(b.items, n)
+	}
+	for _, n := range spooled {
+		add(n)
+	}
+	timer := time.NewTimer(0)
+	for {
+		select {
+		case n := <-notifyQueue:
+			add(n)
+		case <-timer.C:
+		}
+		// pick up anything else already queued before sending
+		for drained := false; !drained; {
+			select {
+			case n := <-notifyQueue:
+				add(n)
+			default:
+				drained = true
+			}
+		}
+		var pending []*notification
+		var next time.Time
+		for key, b := range boxes {
+			b.items = trimOutbox(b.items)
+			flushOutbox(b)
+			if len(b.items) == 0 {
+				if time.Now().After(b.pausedUntil) {
+					delete(boxes, key)
+				}
+				continue
+			}
+			pending = append(pending, b.items...)
+			due := b.items[0].Next
+			if b.pausedUntil.After(due) {
+				due = b.pausedUntil
+			}
+			if next.IsZero() || due.Before(next) {
+				next = due
+			}
+		}
+		outboxLen.Store(int64(len(pending)))
+		saveSpool(conf().Notify.SpoolFile, pending)
+		timer.Stop()
+		if !next.IsZero() {
+			timer.Reset(time.Until(next))
+		}
+	}
+}
+
+// trimOutbox drops notifications that are too old to be worth sending, and
+// the oldest ones if the outbox has grown past the queue size.
+func trimOutbox(items []*notification) []*notification {
+	for len(items) > 0 {
+		n := items[0]
+		tooOld := conf().Notify.MaxAge.Duration > 0 && time.Since(n.Queued) > conf().Notify.MaxAge.Duration
+		if !tooOld && len(items) <= conf().Notify.QueueSize {
+			break
+		}
+		if tooOld {
+			warnf("giving up on %s notification %q after %d attempts, queued %s ago", n.Via, n.Embed.Title, n.Attempts, time.Since(n.Queued).Round(time.Second))
+			notifyExpired.inc()
+		} else {
+			notifyDropped.inc()
+		}
+		items = items[1:]
+		notifyWG.Done()
+	}
+	return items
+}
+
+// flushOutbox sends whatever is due. When several embeds are waiting (a
+// burst, or a backlog after being rate limited) they go out together, up to
+// Discord's per-message limits, rather than one request each.
+func flushOutbox(b *outbox) {
+	for len(b.items) > 0 {
+		now := time.Now()
+		if now.Before(b.pausedUntil) || now.Before(b.items[0].Next) {
+			break
+		}
+		batch := 1
+		chars := embedChars(b.items[0].Embed)
+		for batch < len(b.items) && batch < batchLimit(b.items[0].Via) && !now.Before(b.items[batch].Next) {
+			chars += embedChars(b.items[batch].Embed)
+			if chars > maxEmbedCharsPerMessage {
+				break
+			}
+			batch++
+		}
+		embeds := make([]DiscordEmbed, batch)
+		for i, n := range b.items[:batch] {
+			embeds[i] = n.Embed
+		}
+		head := b.items[0]
+		post := notifierFor(head.Via)
+		if post == nil {
+			warnf("dropping notification for unknown service %q", head.Via)
+			b.items = b.items[1:]
+			notifyWG.Done()
+			continue
+		}
+		wait, err := post(head.URL, embeds)
+		if wait > 0 {
+			b.pausedUntil = time.Now().Add(wait)
+		}
+		if isRateLimited(err) {
+			// not the embed's fault, so it doesn't count as an attempt
+			notifyRateLimited.inc()
+			break
+		}
+		if err != nil && retryable(err) {
+			for _, n := range b.items[:batch] {
+				n.Attempts++
+				n.Next = time.Now().Add(retryBackoff(n.Attempts))
+			}
+			notifyRetries.inc()
+			break
+		}
+		b.items = b.items[batch:]
+		notifyWG.Add(-batch)
+	}
+}
+
+// retryBackoff doubles from 1s up to 5m, with +-20% jitter so a fleet of
+// proxies doesn't retry in lockstep.
+func retryBackoff(attempts int) time.Duration {
+	d := time.Second << min(attempts-1, 9)
+	if d > 5*time.Minute {
+		d = 5 * time.Minute
+	}
+	return time.Duration(float64(d) * (0.8 + 0.4*rand.Float64()))
+}
+
+// enqueueNotification applies the drop policy when the queue is full:
+// drop_newest refuses the new embed, drop_oldest throws away the oldest
+// queued one to make room.
+func enqueueNotification(via, url string, embed DiscordEmbed) error {
+	startNotifier()
+	n := &notification{Via: via, Severity: embed.severity, URL: url, Embed: embed, Queued: time.Now()}
+	notifyMu.Lock()
+	defer notifyMu.Unlock()
+	notifyWG.Add(1)
+	select {
+	case notifyQueue <- n:
+		return nil
+	default:
+	}
+	notifyDropped.inc()
+	if conf().Notify.DropPolicy == "drop_oldest" {
+		select {
+		case <-notifyQueue:
+			notifyWG.Done()
+		default:
+		}
+		select {
+		case notifyQueue <- n:
+			return nil
+		default:
+		}
+	}
+	notifyWG.Done()
+	return errNotifyQueueFull
+}
+
+type notifyTarget struct {
+	via         string
+	url         string
+	events      []string
+	minSeverity string
+}
+
+// notifyTargets lists the notifiers configured next to Discord.
+func notifyTargets() []notifyTarget {
+	var targets []notifyTarget
+	if c := conf().Notify.Slack; c.URL != "" {
+		targets = append(targets, notifyTarget{via: "slack", url: c.URL, events: c.Events, minSeverity: c.MinSeverity})
+	}
+	if c := conf().Notify.Telegram; c.BotToken != "" {
+		url := strings.TrimSuffix(c.APIURL, "/") + "/bot" + c.BotToken + "/sendMessage"
+		targets = append(targets, notifyTarget{via: "telegram", url: url, events: c.Events, minSeverity: c.MinSeverity})
+	}
+	if c := conf().Notify.SMTP; c.Host != "" {
+		targets = append(targets, notifyTarget{via: "email", url: smtpURL(c), events: c.Events, minSeverity: c.MinSeverity})
+	}
+	for _, c := range conf().Notify.Webhooks {
+		targets = append(targets, notifyTarget{via: "webhook:" + c.Name, url: c.URL, events: c.Events, minSeverity: c.MinSeverity})
+	}
+	return targets
+}
+
+// wantsEmbed reports whether an embed type passes a notifier's events
+// filter; the keys are the same as notify.routes and empty means all.
+func wantsEmbed(keys []string, kind string) bool {
+	if len(keys) == 0 {
+		return true
+	}
+	for _, k := range keys {
+		if k == "*" || k == kind || k == embedCategory(kind) {
+			return true
+		}
+	}
+	return false
+}
+
+// dispatchEmbed queues an embed for Discord (unless another notifier has
+// taken over with only) and for every other notifier that wants it.
+func dispatchEmbed(kind string, embed DiscordEmbed) error {
+	embed.severity = embedSeverity(kind)
+	var errs []error
+	if !conf().Notify.Slack.Only && !conf().Notify.Telegram.Only && meetsSeverity(kind, conf().Notify.MinSeverity) {
+		if url := routeWebhook(kind); url == "" {
+			errs = append(errs, errors.New("empty or malformed webhookURL"))
+		} else if err := enqueueNotification("discord", url, embed); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, t := range notifyTargets() {
+		if !wantsEmbed(t.events, kind) || !meetsSeverity(kind, t.minSeverity) {
+			continue
+		}
+		if err := enqueueNotification(t.via, t.url, embed); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", t.via, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// postJSON is the plain HTTP side of the non-Discord notifiers: any 2xx is
+// success, 429 is a rate limit and anything else a webhookStatusError.
+func postJSON(url string, body []byte, header http.Header) (wait time.Duration, err error) {
+	defer func() {
+		if err != nil && !isRateLimited(err) {
+			webhookFailures.inc()
+		}
+	}()
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		warnf("notification post to %s failed: %v", redactURL(url), err)
+		return 0, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode == http.StatusTooManyRequests {
+		wait = rateLimitWait(resp.Header, respBody)
+		warnf("notification endpoint %s rate limited, pausing sends for %s", redactURL(url), wait)
+		return wait, &webhookStatusError{code: resp.StatusCode, status: resp.Status}
+	}
+	if resp.StatusCode/100 != 2 {
+		warnf("notification post to %s failed: %s: %s", redactURL(url), resp.Status, respBody)
+		return 0, &webhookStatusError{code: resp.StatusCode, status: resp.Status}
+	}
+	return 0, nil
+}
+
+// redactURL keeps secrets that live in webhook URLs out of the logs.
+func redactURL(raw string) string {
+	u, err := neturl.Parse(raw)
+	if err != nil {
+		return "(invalid url)"
+	}
+	return u.Scheme + "://" + u.Host + "/..."
+}
+
+func notifyQueueDepth() int {
+	return len(notifyQueue) + int(outboxLen.Load())
+}
+
+// loadSpool restores embeds that were still waiting when the proxy last
+// stopped.
+func loadSpool(path string) []*notification {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			warnf("failed to read notification spool %s: %v", path, err)
+		}
+		return nil
+	}
+	var outbox []*notification
+	if err := json.Unmarshal(data, &outbox); err != nil {
+		warnf("failed to parse notification spool %s: %v", path, err)
+		return nil
+	}
+	for _, n := range outbox {
+		if n.Via == "" {
+			n.Via = "discord"
+		}
+		if n.URL == "" {
+			n.URL = webhookURL
+		}
+		n.Embed.severity = n.Severity
+	}
+	notifyWG.Add(len(outbox))
+	if len(outbox) > 0 {
+		infof("loaded %d unsent notifications from %s\n", len(outbox), path)
+	}
+	return outbox
+}
+
+func saveSpool(path string, outbox []*notification) {
+	if path == "" {
+		return
+	}
+	if len(outbox) == 0 {
+		os.Remove(path)
+		return
+	}
+	data, err := json.Marshal(outbox)
+	if err != nil {
+		return
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		warnf("failed to write notification spool: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		warnf("failed to write notification spool: %v", fmt.Errorf("rename: %v", err))
+	}
+}
+
+// flushNotifications gives queued embeds a few seconds to go out before
+// the process exits.
+func flushNotifications() {
+	flushDigestBuckets()
+	done := make(chan struct{})
+	go func() {
+		notifyWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type otlpDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	AsDouble          float64        `json:"asDouble"`
+}
+
+type otlpHistogramPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	Count             string         `json:"count"`
+	Sum               float64        `json:"sum"`
+	BucketCounts      []string       `json:"bucketCounts"`
+	ExplicitBounds    []float64      `json:"explicitBounds"`
+}
+
+func otlpMetricsBody(serviceName string, start time.Time) map[string]any {
+	now := strconv.FormatInt(time.Now().UnixNano(), 10)
+	startNano := strconv.FormatInt(start.UnixNano(), 10)
+	var out []any
+	for _, m := range collectMetrics() {
+		var points []otlpDataPoint
+		var hpoints []otlpHistogramPoint
+		for _, s := range m.snapshot() {
+			attrs := map[string]string{}
+			for i, l := range m.labels {
+				attrs[l] = s.labelValues[i]
+			}
+			if m.kind == "histogram" {
+				counts := make([]string, len(s.buckets))
+				for i, n := range s.buckets {
+					counts[i] = strconv.FormatUint(n, 10)
+				}
+				hpoints = append(hpoints, otlpHistogramPoint{
+					Attributes:        otlpAttributes(attrs),
+					StartTimeUnixNano: startNano,
+					TimeUnixNano:      now,
+					Count:             strconv.FormatUint(s.count, 10),
+					Sum:               s.value,
+					BucketCounts:      counts,
+					ExplicitBounds:    m.bounds,
+				})
+				continue
+			}
+			p := otlpDataPoint{Attributes: otlpAttributes(attrs), TimeUnixNano: now, AsDouble: s.value}
+			if m.kind == "counter" {
+				p.StartTimeUnixNano = startNano
+			}
+			points = append(points, p)
+		}
+		if len(points) == 0 && len(hpoints) == 0 {
+			continue
+		}
+		om := map[string]any{"name": m.name, "description": m.help}
+		if m.kind == "histogram" {
+			om["histogram"] = map[string]any{"dataPoints": hpoints, "aggregationTemporality": 2}
+		} else if m.kind == "counter" {
+			om["sum"] = map[string]any{"dataPoints": points, "aggregationTemporality": 2, "isMonotonic": true}
+		} else {
+			om["gauge"] = map[string]any{"dataPoints": points}
+		}
+		out = append(out, om)
+	}
+	return map[string]any{
+		"resourceMetrics": []any{map[string]any{
+			"resource": otlpResource{Attributes: otlpAttributes(map[string]string{"service.name": serviceName})},
+			"scopeMetrics": []any{map[string]any{
+				"scope":   otlpScope{Name: "sshproxy"},
+				"metrics": out,
+			}},
+		}},
+	}
+}
+
+// otlpMetricsProto is otlpMetricsBody as a protobuf
+// ExportMetricsServiceRequest, for OTLP/gRPC.
+func otlpMetricsProto(serviceName string, start time.Time) []byte {
+	now := uint64(time.Now().UnixNano())
+	startNano := uint64(start.UnixNano())
+	attributes := func(w *pbWriter, field int, attrs map[string]string) {
+		for k, v := range attrs {
+			w.message(field, func(kv *pbWriter) {
+				kv.string(1, k)
+				kv.message(2, func(av *pbWriter) { av.string(1, v) })
+			})
+		}
+	}
+	var req pbWriter
+	req.message(1, func(rm *pbWriter) {
+		rm.message(1, func(res *pbWriter) {
+			attributes(res, 1, map[string]string{"service.name": serviceName})
+		})
+		rm.message(2, func(sm *pbWriter) {
+			sm.message(1, func(scope *pbWriter) { scope.string(1, "sshproxy") })
+			for _, m := range collectMetrics() {
+				snaps := m.snapshot()
+				if len(snaps) == 0 {
+					continue
+				}
+				sm.message(2, func(om *pbWriter) {
+					om.string(1, m.name)
+					om.string(2, m.help)
+					points := func(data *pbWriter) {
+						for _, s := range snaps {
+							attrs := map[string]string{}
+							for i, l := range m.labels {
+								attrs[l] = s.labelValues[i]
+							}
+							if m.kind == "histogram" {
+								data.message(1, func(p *pbWriter) {
+									p.fixed64(2, startNano)
+									p.fixed64(3, now)
+									p.fixed64(4, s.count)
+									p.explicitDouble(5, s.value)
+									p.packedFixed64(6, s.buckets)
+									bounds := make([]uint64, len(m.bounds))
+									for i, b := range m.bounds {
+										bounds[i] = math.Float64bits(b)
+									}
+									p.packedFixed64(7, bounds)
+									attributes(p, 9, attrs)
+								})
+								continue
+							}
+							data.message(1, func(p *pbWriter) {
+								if m.kind == "counter" {
+									p.fixed64(2, startNano)
+								}
+								p.fixed64(3, now)
+								p.explicitDouble(4, s.value)
+								attributes(p, 7, attrs)
+							})
+						}
+					}
+					switch m.kind {
+					case "histogram":
+						om.message(9, func(h *pbWriter) {
+							points(h)
+							h.int64(2, 2) // cumulative
+						})
+					case "counter":
+						om.message(7, func(sum *pbWriter) {
+							points(sum)
+							sum.int64(2, 2)
+							sum.bool(3, true)
+						})
+					default:
+						om.message(5, points)
+					}
+				})
+			}
+		})
+	})
+	return req.buf
+}
+
+var otlpGRPCClient = sync.OnceValue(func() *http.Client {
+	// h2c with prior knowledge for http:// endpoints, as collectors expect,
+	// and HTTP/2 over TLS for https://
+	var protocols http.Protocols
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{Timeout: 10 * time.Second, Transport: &http.Transport{Protocols: &protocols}}
+})
+
+// otlpExport makes a unary gRPC call to a collector's export method and
+// checks the status it answers with.
+func otlpExport(endpoint, method string, headers map[string]string, msg []byte) error {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	req, err := http.NewRequest("POST", strings.TrimSuffix(endpoint, "/")+method, bytes.NewReader(append(frame, msg...)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := otlpGRPCClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	// the response message only says how much was rejected, which the
+	// status covers well enough
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+	status, msgText := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		// a trailers-only response puts them in the headers
+		status, msgText = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	if status == "" {
+		return fmt.Errorf("response has no gRPC status")
+	}
+	if status != "0" {
+		if m, err := url.PathUnescape(msgText); err == nil {
+			msgText = m
+		}
+		return fmt.Errorf("gRPC status %s: %s", status, msgText)
+	}
+	return nil
+}
+
+func startOTLPMetrics(c OTLPMetricsConfig) {
+	start := time.Now()
+	infof("pushing metrics to %s over %s every %s\n", c.Endpoint, c.Protocol, c.Interval.Duration)
+	for range time.Tick(c.Interval.Duration) {
+		var err error
+		if c.Protocol == "grpc" {
+			err = otlpExport(c.Endpoint, "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export", c.Headers, otlpMetricsProto(conf().Tracing.ServiceName, start))
+		} else {
+			err = otlpPost(c.Endpoint, "/v1/metrics", c.Headers, otlpMetricsBody(conf().Tracing.ServiceName, start))
+		}
+		if err != nil {
+			warnf("failed to push OTLP metrics: %v\n", err)
+		}
+	}
+}
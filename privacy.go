@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+)
+
+var privacyKey []byte
+
+// setupPrivacy validates the privacy mode. With hashing and no key
+// configured a random one is used, so pseudonyms only stay stable until
+// the next restart.
+func setupPrivacy(c PrivacyConfig) error {
+	switch c.Mode {
+	case "", "truncate":
+	case "hash":
+		privacyKey = []byte(c.Key)
+		if len(privacyKey) == 0 {
+			privacyKey = make([]byte, 32)
+			rand.Read(privacyKey)
+			warnf("privacy mode hash has no key set, pseudonyms will change on restart")
+		}
+	default:
+		return fmt.Errorf("unknown privacy mode %q (want hash or truncate)", c.Mode)
+	}
+	return nil
+}
+
+// anonIP is how a client IP appears anywhere it leaves the process: logs,
+// notifications, events, history and reports. Lookups and limits keep
+// using the real address.
+func anonIP(ip string) string {
+	switch conf().Privacy.Mode {
+	case "hash":
+		mac := hmac.New(sha256.New, privacyKey)
+		mac.Write([]byte(ip))
+		return "anon-" + hex.EncodeToString(mac.Sum(nil)[:6])
+	case "truncate":
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			return ip
+		}
+		if v4 := parsed.To4(); v4 != nil {
+			return v4.Mask(net.CIDRMask(24, 32)).String()
+		}
+		return parsed.Mask(net.CIDRMask(48, 128)).String()
+	}
+	return ip
+}
+
+func anonAddr(addr string) string {
+	if conf().Privacy.Mode == "" {
+		return addr
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return anonIP(addr)
+	}
+	return net.JoinHostPort(anonIP(host), port)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Just enough protobuf for the gRPC admin service and the OTLP/gRPC
+// metrics exporter: proto3 encoding of scalars, strings and nested
+// messages, and a decoder that can pick fields out of a request and skip
+// everything else.
+
+type pbWriter struct {
+	buf []byte
+}
+
+func (w *pbWriter) varint(v uint64) {
+	w.buf = binary.AppendUvarint(w.buf, v)
+}
+
+func (w *pbWriter) tag(field, wireType int) {
+	w.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+// proto3 leaves fields at their zero value off the wire.
+
+func (w *pbWriter) int64(field int, v int64) {
+	if v != 0 {
+		w.tag(field, 0)
+		w.varint(uint64(v))
+	}
+}
+
+func (w *pbWriter) uint64(field int, v uint64) {
+	if v != 0 {
+		w.tag(field, 0)
+		w.varint(v)
+	}
+}
+
+func (w *pbWriter) bool(field int, v bool) {
+	if v {
+		w.tag(field, 0)
+		w.varint(1)
+	}
+}
+
+func (w *pbWriter) double(field int, v float64) {
+	if v != 0 {
+		w.tag(field, 1)
+		w.buf = binary.LittleEndian.AppendUint64(w.buf, math.Float64bits(v))
+	}
+}
+
+// fixed64 is for the timestamps and counts OTLP declares as fixed64.
+func (w *pbWriter) fixed64(field int, v uint64) {
+	if v != 0 {
+		w.tag(field, 1)
+		w.buf = binary.LittleEndian.AppendUint64(w.buf, v)
+	}
+}
+
+// explicitDouble writes v even when it's zero, for fields that track
+// presence: a oneof member, or one declared optional.
+func (w *pbWriter) explicitDouble(field int, v float64) {
+	w.tag(field, 1)
+	w.buf = binary.LittleEndian.AppendUint64(w.buf, math.Float64bits(v))
+}
+
+// packedFixed64 writes a repeated fixed64 or double (as its bits) field
+// in the packed form proto3 uses.
+func (w *pbWriter) packedFixed64(field int, vs []uint64) {
+	if len(vs) == 0 {
+		return
+	}
+	w.tag(field, 2)
+	w.varint(uint64(8 * len(vs)))
+	for _, v := range vs {
+		w.buf = binary.LittleEndian.AppendUint64(w.buf, v)
+	}
+}
+
+func (w *pbWriter) string(field int, v string) {
+	if v != "" {
+		w.bytes(field, []byte(v))
+	}
+}
+
+func (w *pbWriter) bytes(field int, v []byte) {
+	w.tag(field, 2)
+	w.varint(uint64(len(v)))
+	w.buf = append(w.buf, v...)
+}
+
+// message writes a nested message, even an empty one, since it may be an
+// element of a repeated field.
+func (w *pbWriter) message(field int, fn func(*pbWriter)) {
+	var m pbWriter
+	fn(&m)
+	w.bytes(field, m.buf)
+}
+
+var errPBTruncated = errors.New("truncated protobuf message")
+
+// pbFields calls fn for every field in msg. Only varint and length
+// delimited values are passed on (as v or data); fixed-width ones are
+// skipped since no request uses them.
+func pbFields(msg []byte, fn func(field, wireType int, v uint64, data []byte) error) error {
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return errPBTruncated
+		}
+		msg = msg[n:]
+		field, wireType := int(key>>3), int(key&7)
+		var v uint64
+		var data []byte
+		switch wireType {
+		case 0:
+			v, n = binary.Uvarint(msg)
+			if n <= 0 {
+				return errPBTruncated
+			}
+			msg = msg[n:]
+		case 1, 5:
+			size := 8
+			if wireType == 5 {
+				size = 4
+			}
+			if len(msg) < size {
+				return errPBTruncated
+			}
+			msg = msg[size:]
+			continue
+		case 2:
+			l, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < l {
+				return errPBTruncated
+			}
+			data = msg[n : n+int(l)]
+			msg = msg[n+int(l):]
+		default:
+			return errors.New("unsupported protobuf wire type")
+		}
+		if err := fn(field, wireType, v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// recentAlerts keeps the last few alerts raised, whether or not they were
+// later folded into a digest or throttled, for the dashboard and API.
+const recentAlertsKept = 100
+
+type recentAlert struct {
+	Time        time.Time `json:"time"`
+	Kind        string    `json:"kind"`
+	Severity    string    `json:"severity"`
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+}
+
+var (
+	recentAlertsMu sync.Mutex
+	recentAlerts   []recentAlert
+)
+
+func recordAlert(kind string, embed DiscordEmbed) {
+	recentAlertsMu.Lock()
+	defer recentAlertsMu.Unlock()
+	recentAlerts = append(recentAlerts, recentAlert{
+		Time:        time.Now().UTC(),
+		Kind:        kind,
+		Severity:    embedSeverity(kind),
+		Title:       embed.Title,
+		Description: embed.Description,
+	})
+	if len(recentAlerts) > recentAlertsKept {
+		recentAlerts = recentAlerts[len(recentAlerts)-recentAlertsKept:]
+	}
+}
+
+// recentAlertList returns the kept alerts, newest first.
+func recentAlertList() []recentAlert {
+	recentAlertsMu.Lock()
+	defer recentAlertsMu.Unlock()
+	out := make([]recentAlert, len(recentAlerts))
+	for i, a := range recentAlerts {
+		out[len(out)-1-i] = a
+	}
+	return out
+}
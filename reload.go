@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// configPath is the -config file, re-read on reload; logLevelOverride is
+// -log-level, which keeps winning over the file.
+var (
+	configPath       string
+	logLevelOverride string
+	reloadMu         sync.Mutex
+)
+
+// reloadableSections are the config sections that are read as they're
+// used, so swapping them in takes effect straight away. Everything else
+// is wired up at startup and only changes with a restart.
+var reloadableSections = map[string]bool{
+	"notify": true, "limits": true, "exfil": true, "chaos": true, "hexdump": true, "canary": true,
+	"tagging": true, "client_hold": true, "autoscale": true, "tcp": true,
+}
+
+type reloadResult struct {
+	Applied         []string `json:"applied"`
+	RestartRequired []string `json:"restart_required"`
+}
+
+// reloadConfig re-reads the config file and applies the sections that can
+// change at runtime, plus log.level. The merged config replaces the
+// running one in a single store, so a reader holding the result of conf()
+// sees all of the old config or all of the new one.
+func reloadConfig(by string) (reloadResult, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	sdNotify("RELOADING=1")
+	defer sdNotify("READY=1")
+	res := reloadResult{Applied: []string{}, RestartRequired: []string{}}
+	if configPath == "" {
+		return res, fmt.Errorf("the proxy was started without -config, there's nothing to reload")
+	}
+	next, err := loadConfig(configPath)
+	if err != nil {
+		return res, err
+	}
+	workerOverrides(next)
+	cur := conf()
+	merged := *cur
+	oldV, newV, mergedV := reflect.ValueOf(cur).Elem(), reflect.ValueOf(next).Elem(), reflect.ValueOf(&merged).Elem()
+	for i := 0; i < oldV.NumField(); i++ {
+		name := strings.Split(oldV.Type().Field(i).Tag.Get("json"), ",")[0]
+		if reflect.DeepEqual(oldV.Field(i).Interface(), newV.Field(i).Interface()) {
+			continue
+		}
+		if reloadableSections[name] {
+			mergedV.Field(i).Set(newV.Field(i))
+			res.Applied = append(res.Applied, name)
+		} else if name != "log" {
+			res.RestartRequired = append(res.RestartRequired, name)
+		}
+	}
+	if next.TCP.Client.FastOpen != cur.TCP.Client.FastOpen {
+		// it's set on the listeners when they're bound
+		merged.TCP.Client.FastOpen = cur.TCP.Client.FastOpen
+		res.RestartRequired = append(res.RestartRequired, "tcp.client.fast_open")
+	}
+	if next.TCP.Client.MPTCP != cur.TCP.Client.MPTCP {
+		merged.TCP.Client.MPTCP = cur.TCP.Client.MPTCP
+		res.RestartRequired = append(res.RestartRequired, "tcp.client.mptcp")
+	}
+	if next.Hexdump.File != cur.Hexdump.File {
+		merged.Hexdump.File = cur.Hexdump.File
+		res.RestartRequired = append(res.RestartRequired, "hexdump.file")
+	}
+	// the queue and spool are set up once when the notifier starts
+	if next.Notify.QueueSize != cur.Notify.QueueSize {
+		merged.Notify.QueueSize = cur.Notify.QueueSize
+		res.RestartRequired = append(res.RestartRequired, "notify.queue_size")
+	}
+	if next.Notify.SpoolFile != cur.Notify.SpoolFile {
+		merged.Notify.SpoolFile = cur.Notify.SpoolFile
+		res.RestartRequired = append(res.RestartRequired, "notify.spool_file")
+	}
+	if logLevelOverride != "" {
+		next.Log.Level = logLevelOverride
+	}
+	rest := next.Log
+	rest.Level = cur.Log.Level
+	if !reflect.DeepEqual(rest, cur.Log) {
+		res.RestartRequired = append(res.RestartRequired, "log")
+	}
+	var level *logLevel
+	if next.Log.Level != cur.Log.Level {
+		l, err := parseLogLevel(next.Log.Level)
+		if err != nil {
+			return res, err
+		}
+		level = &l
+		merged.Log.Level = next.Log.Level
+		res.Applied = append(res.Applied, "log.level")
+	}
+	for _, list := range [][]string{merged.Chaos.IPs, merged.Hexdump.IPs} {
+		for _, s := range list {
+			if _, err := parseIPOrCIDR(s); err != nil {
+				return res, err
+			}
+		}
+	}
+
+	// only touch what changed in the file, so runtime changes made through
+	// the admin endpoints survive reloading something unrelated
+	if containsString(res.Applied, "chaos") {
+		setChaosTargets(merged.Chaos.IPs)
+	}
+	if containsString(res.Applied, "hexdump") {
+		setHexdumpTargets(merged.Hexdump.IPs)
+	}
+	if containsString(res.Applied, "notify") {
+		resetAlertTemplates()
+		resetWebhookTemplates()
+	}
+	if containsString(res.Applied, "canary") {
+		setCanaryPercent(merged.Canary.Percent)
+	}
+	if containsString(res.Applied, "tagging") {
+		// already checked by loadConfig
+		setTagRules(merged.Tagging.Rules)
+	}
+	if level != nil {
+		setLogLevel(*level)
+	}
+	cfg.Store(&merged)
+
+	infof("config reloaded (%s): applied %v, needs restart %v\n", by, res.Applied, res.RestartRequired)
+	auditf("config reloaded by %s: applied %v", by, res.Applied)
+	return res, nil
+}
+
+func watchReloadSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		if _, err := reloadConfig("SIGHUP"); err != nil {
+			errorf("config reload failed, keeping the running config: %v\n", err)
+		}
+	}
+}
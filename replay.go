@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type replayChunk struct {
+	at   time.Duration
+	data []byte
+}
+
+// readCaptureClientStream pulls the client side of a session back out of
+// capture files written by the proxy. Segments can be given in any order;
+// packets are put back in time order and the client is whoever sent the
+// opening SYN.
+func readCaptureClientStream(paths []string) ([]replayChunk, error) {
+	type packet struct {
+		at      time.Time
+		src     string
+		flags   byte
+		payload []byte
+	}
+	var packets []packet
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for off := 0; off+12 <= len(data); {
+			typ := binary.LittleEndian.Uint32(data[off:])
+			size := int(binary.LittleEndian.Uint32(data[off+4:]))
+			if size < 12 || off+size > len(data) {
+				return nil, fmt.Errorf("%s: truncated block at offset %d", path, off)
+			}
+			if typ == 0x0A0D0D0A && binary.LittleEndian.Uint32(data[off+8:]) != 0x1A2B3C4D {
+				return nil, fmt.Errorf("%s: only little-endian pcapng from the proxy is supported", path)
+			}
+			if typ == 6 && size >= 32 {
+				ts := uint64(binary.LittleEndian.Uint32(data[off+12:]))<<32 | uint64(binary.LittleEndian.Uint32(data[off+16:]))
+				capLen := int(binary.LittleEndian.Uint32(data[off+20:]))
+				if 28+capLen > size {
+					return nil, fmt.Errorf("%s: bad packet length at offset %d", path, off)
+				}
+				if src, flags, payload, ok := parseSynthPacket(data[off+28 : off+28+capLen]); ok {
+					packets = append(packets, packet{time.UnixMicro(int64(ts)), src, flags, payload})
+				}
+			}
+			off += size
+		}
+	}
+	sort.SliceStable(packets, func(i, j int) bool { return packets[i].at.Before(packets[j].at) })
+	var chunks []replayChunk
+	var client string
+	var first time.Time
+	for _, p := range packets {
+		if client == "" && p.flags&tcpSYN != 0 && p.flags&tcpACK == 0 {
+			client, first = p.src, p.at
+		}
+		if client != "" && p.src == client && len(p.payload) > 0 {
+			chunks = append(chunks, replayChunk{at: p.at.Sub(first), data: p.payload})
+		}
+	}
+	if client == "" {
+		return nil, errors.New("no handshake found, is this a capture written by the proxy?")
+	}
+	return chunks, nil
+}
+
+// parseSynthPacket reads a raw IPv4/IPv6 + TCP packet and returns the
+// source address, TCP flags and payload.
+func parseSynthPacket(pkt []byte) (src string, flags byte, payload []byte, ok bool) {
+	if len(pkt) < 1 {
+		return
+	}
+	var ip net.IP
+	var tcp []byte
+	switch pkt[0] >> 4 {
+	case 4:
+		ihl := int(pkt[0]&0x0f) * 4
+		if len(pkt) < ihl+20 || pkt[9] != 6 {
+			return
+		}
+		ip, tcp = net.IP(pkt[12:16]), pkt[ihl:]
+	case 6:
+		if len(pkt) < 60 || pkt[6] != 6 {
+			return
+		}
+		ip, tcp = net.IP(pkt[8:24]), pkt[40:]
+	default:
+		return
+	}
+	doff := int(tcp[12]>>4) * 4
+	if doff < 20 || len(tcp) < doff {
+		return
+	}
+	port := binary.BigEndian.Uint16(tcp[0:])
+	return net.JoinHostPort(ip.String(), fmt.Sprint(port)), tcp[13], tcp[doff:], true
+}
+
+func replayOnce(chunks []replayChunk, target string, speed float64) (sent, received int64, err error) {
+	conn, err := net.DialTimeout("tcp", target, 10*time.Second)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+	var recv atomic.Int64
+	done := make(chan struct{})
+	go func() {
+		n, _ := io.Copy(io.Discard, conn)
+		recv.Store(n)
+		close(done)
+	}()
+	start := time.Now()
+	for _, c := range chunks {
+		if speed > 0 {
+			if wait := time.Duration(float64(c.at)/speed) - time.Since(start); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		n, err := conn.Write(c.data)
+		sent += int64(n)
+		if err != nil {
+			return sent, recv.Load(), err
+		}
+	}
+	// give the backend a moment to answer the last request
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.CloseWrite()
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+	}
+	return sent, recv.Load(), nil
+}
+
+func runReplay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	speed := fs.Float64("speed", 1, "timing multiplier, 2 = twice as fast, 0 = no delays")
+	concurrency := fs.Int("concurrency", 1, "number of copies of the session to replay at once")
+	repeat := fs.Int("repeat", 1, "times each copy replays the session")
+	fs.Usage = func() {
+		fmt.Println("usage: ./connectproxy replay [-speed 1] [-concurrency 1] [-repeat 1] <target host:port> <capture.pcapng> [more segments...]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	target := fs.Arg(0)
+	chunks, err := readCaptureClientStream(fs.Args()[1:])
+	if err != nil {
+		fmt.Printf("failed to read capture: %v\n", err)
+		os.Exit(1)
+	}
+	var total int
+	for _, c := range chunks {
+		total += len(c.data)
+	}
+	fmt.Printf("replaying %d client writes (%s) to %s, %d x %d at %gx speed\n", len(chunks), formatBytes(int64(total)), target, *concurrency, *repeat, *speed)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var sent, received int64
+	var runs, failures int
+	start := time.Now()
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < *repeat; j++ {
+				s, r, err := replayOnce(chunks, target, *speed)
+				mu.Lock()
+				sent += s
+				received += r
+				runs++
+				if err != nil {
+					failures++
+					fmt.Printf("replay failed: %v\n", err)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	fmt.Printf("%d runs, %d failed, %s sent, %s received in %s\n", runs, failures, formatBytes(sent), formatBytes(received), time.Since(start).Round(time.Millisecond))
+	if failures > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The capacity report reads history and answers "do we need more?": how
+// many sessions were open at once at worst, what bandwidth looks like
+// outside of spikes, when the load comes and which way it's heading.
+
+type hourLoad struct {
+	Hour           int     `json:"hour"`
+	SessionsPerDay float64 `json:"sessions_per_day"`
+	BytesPerDay    float64 `json:"bytes_per_day"`
+}
+
+type dayLoad struct {
+	Day      string `json:"day"`
+	Sessions int    `json:"sessions"`
+	Bytes    int64  `json:"bytes"`
+	full     bool
+}
+
+type capacityReport struct {
+	From            time.Time  `json:"from"`
+	To              time.Time  `json:"to"`
+	HistoryFrom     time.Time  `json:"history_from"`
+	Sessions        int        `json:"sessions"`
+	BytesIn         int64      `json:"bytes_in"`
+	BytesOut        int64      `json:"bytes_out"`
+	PeakConcurrency int        `json:"peak_concurrency"`
+	PeakAt          time.Time  `json:"peak_at"`
+	MaxConnections  int        `json:"max_connections,omitempty"`
+	BucketSeconds   float64    `json:"bucket_seconds"`
+	P95BytesPerSec  float64    `json:"p95_bytes_per_second"`
+	PeakBytesPerSec float64    `json:"peak_bytes_per_second"`
+	BusiestHours    []hourLoad `json:"busiest_hours"`
+	Daily           []dayLoad  `json:"daily"`
+	// Growth is the linear trend over full days with history, as a
+	// percentage of the average day per week; nil with fewer than two.
+	SessionGrowth *float64 `json:"session_growth_percent_per_week"`
+	ByteGrowth    *float64 `json:"byte_growth_percent_per_week"`
+}
+
+func runReport(configFile string, args []string) {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	def, maxConns := "", 0
+	if c, err := loadConfig(configFile); err == nil {
+		def, maxConns = c.History.Path, c.Limits.MaxConnections
+	}
+	path := fs.String("history", def, "history file (default history.path from -config)")
+	since := fs.String("since", "30d", "how far back, e.g. 7d or 2006-01-02")
+	until := fs.String("until", "", "end of the report, same forms as -since (default now)")
+	bucket := fs.Duration("bucket", 5*time.Minute, "interval bandwidth is averaged over")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	fs.Usage = func() {
+		fmt.Println("usage: ./connectproxy [-config proxy.json] report [-since 30d] [-until date] [-bucket 5m] [-json]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *path == "" || *bucket <= 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	now := time.Now()
+	from, err := parseSince(*since, now)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "report: -since: %v\n", err)
+		os.Exit(2)
+	}
+	to := now
+	if *until != "" {
+		if to, err = parseSince(*until, now); err != nil {
+			fmt.Fprintf(os.Stderr, "report: -until: %v\n", err)
+			os.Exit(2)
+		}
+	}
+	if !to.After(from) {
+		fmt.Fprintln(os.Stderr, "report: -until must be after -since")
+		os.Exit(2)
+	}
+	var recs []historyRecord
+	err = readHistory(*path, from, func(rec historyRecord) bool {
+		if !rec.Start.After(to) {
+			recs = append(recs, rec)
+		}
+		return true
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "report: %v\n", err)
+		os.Exit(1)
+	}
+	rep := buildCapacityReport(recs, from, to, *bucket)
+	rep.MaxConnections = maxConns
+	if *asJSON {
+		data, _ := json.MarshalIndent(rep, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+	printCapacityReport(rep)
+}
+
+func buildCapacityReport(recs []historyRecord, from, to time.Time, bucket time.Duration) capacityReport {
+	rep := capacityReport{From: from.UTC(), To: to.UTC(), Sessions: len(recs), BucketSeconds: bucket.Seconds()}
+
+	// history may not reach back to from, so bandwidth, per-day figures and
+	// the trend start at the first session rather than counting empty time
+	dataFrom := to
+	for _, r := range recs {
+		dataFrom = minTime(dataFrom, r.Start)
+	}
+	dataFrom = maxTime(dataFrom, from)
+	rep.HistoryFrom = dataFrom.UTC()
+
+	// peak concurrency: sweep the starts and ends, ends first on a tie so
+	// back-to-back sessions don't count as overlapping
+	type edge struct {
+		at    time.Time
+		delta int
+	}
+	edges := make([]edge, 0, 2*len(recs))
+	for _, r := range recs {
+		start, end := r.Start, r.End
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(to) {
+			end = to
+		}
+		edges = append(edges, edge{start, 1}, edge{end, -1})
+		rep.BytesIn += r.BytesIn
+		rep.BytesOut += r.BytesOut
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		if !edges[i].at.Equal(edges[j].at) {
+			return edges[i].at.Before(edges[j].at)
+		}
+		return edges[i].delta < edges[j].delta
+	})
+	open := 0
+	for _, e := range edges {
+		open += e.delta
+		if open > rep.PeakConcurrency {
+			rep.PeakConcurrency, rep.PeakAt = open, e.at.UTC()
+		}
+	}
+
+	// bandwidth: spread each session's bytes evenly over its lifetime,
+	// then look at the buckets
+	buckets := make([]float64, int(math.Ceil(float64(to.Sub(dataFrom))/float64(bucket))))
+	for _, r := range recs {
+		total := float64(r.BytesIn + r.BytesOut)
+		span := r.End.Sub(r.Start)
+		if total == 0 {
+			continue
+		}
+		if span <= 0 {
+			if i := int(r.Start.Sub(dataFrom) / bucket); i >= 0 && i < len(buckets) {
+				buckets[i] += total
+			}
+			continue
+		}
+		first := max(0, int(r.Start.Sub(dataFrom)/bucket))
+		for i := first; i < len(buckets); i++ {
+			lo := dataFrom.Add(time.Duration(i) * bucket)
+			hi := lo.Add(bucket)
+			if !r.End.After(lo) {
+				break
+			}
+			overlap := minTime(hi, r.End).Sub(maxTime(lo, r.Start))
+			if overlap > 0 {
+				buckets[i] += total * float64(overlap) / float64(span)
+			}
+		}
+	}
+	if len(buckets) > 0 {
+		rates := make([]float64, len(buckets))
+		for i, b := range buckets {
+			rates[i] = b / bucket.Seconds()
+		}
+		sort.Float64s(rates)
+		rep.P95BytesPerSec = rates[int(math.Ceil(0.95*float64(len(rates))))-1]
+		rep.PeakBytesPerSec = rates[len(rates)-1]
+	}
+
+	// hours of the day and days, in local time since that's how people
+	// think about busy periods
+	days := map[string]*dayLoad{}
+	var hourSessions [24]int
+	var hourBytes [24]int64
+	for _, r := range recs {
+		start := r.Start.Local()
+		hourSessions[start.Hour()]++
+		hourBytes[start.Hour()] += r.BytesIn + r.BytesOut
+		key := start.Format("2006-01-02")
+		d := days[key]
+		if d == nil {
+			d = &dayLoad{Day: key}
+			days[key] = d
+		}
+		d.Sessions++
+		d.Bytes += r.BytesIn + r.BytesOut
+	}
+	lo, hi := from.Local(), to.Local()
+	for day := time.Date(lo.Year(), lo.Month(), lo.Day(), 0, 0, 0, 0, time.Local); day.Before(hi); day = day.AddDate(0, 0, 1) {
+		key := day.Format("2006-01-02")
+		d := days[key]
+		if d == nil {
+			d = &dayLoad{Day: key}
+		}
+		d.full = !day.Before(dataFrom) && !day.AddDate(0, 0, 1).After(hi)
+		rep.Daily = append(rep.Daily, *d)
+	}
+	spanDays := to.Sub(dataFrom).Hours() / 24
+	for h := range 24 {
+		if hourSessions[h] == 0 {
+			continue
+		}
+		rep.BusiestHours = append(rep.BusiestHours, hourLoad{Hour: h, SessionsPerDay: float64(hourSessions[h]) / spanDays, BytesPerDay: float64(hourBytes[h]) / spanDays})
+	}
+	sort.Slice(rep.BusiestHours, func(i, j int) bool {
+		a, b := rep.BusiestHours[i], rep.BusiestHours[j]
+		if a.SessionsPerDay != b.SessionsPerDay {
+			return a.SessionsPerDay > b.SessionsPerDay
+		}
+		return a.Hour < b.Hour
+	})
+	if len(rep.BusiestHours) > 5 {
+		rep.BusiestHours = rep.BusiestHours[:5]
+	}
+
+	var sessions, bytes []float64
+	for _, d := range rep.Daily {
+		if d.full {
+			sessions = append(sessions, float64(d.Sessions))
+			bytes = append(bytes, float64(d.Bytes))
+		}
+	}
+	rep.SessionGrowth = weeklyGrowth(sessions)
+	rep.ByteGrowth = weeklyGrowth(bytes)
+	return rep
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// weeklyGrowth fits a line through daily values and gives its slope over
+// a week as a percentage of the average day.
+func weeklyGrowth(daily []float64) *float64 {
+	n := float64(len(daily))
+	if n < 2 {
+		return nil
+	}
+	var sumX, sumY, sumXY, sumXX float64
+	for i, y := range daily {
+		x := float64(i)
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+	}
+	mean := sumY / n
+	if mean == 0 {
+		return nil
+	}
+	slope := (n*sumXY - sumX*sumY) / (n*sumXX - sumX*sumX)
+	g := slope * 7 / mean * 100
+	return &g
+}
+
+func printCapacityReport(rep capacityReport) {
+	from, to := rep.From.Local(), rep.To.Local()
+	fmt.Printf("capacity report %s to %s (%.1f days)\n", from.Format("2006-01-02 15:04"), to.Format("2006-01-02 15:04"), to.Sub(from).Hours()/24)
+	fmt.Printf("sessions:         %d, %s in, %s out\n", rep.Sessions, formatBytes(rep.BytesIn), formatBytes(rep.BytesOut))
+	if rep.Sessions == 0 {
+		return
+	}
+	if rep.HistoryFrom.After(rep.From) {
+		fmt.Printf("history starts:   %s\n", rep.HistoryFrom.Local().Format("2006-01-02 15:04"))
+	}
+	peak := fmt.Sprintf("%d at %s", rep.PeakConcurrency, rep.PeakAt.Local().Format("2006-01-02 15:04"))
+	if rep.MaxConnections > 0 {
+		peak += fmt.Sprintf(" (%.0f%% of limits.max_connections %d)", float64(rep.PeakConcurrency)*100/float64(rep.MaxConnections), rep.MaxConnections)
+	}
+	fmt.Printf("peak concurrency: %s\n", peak)
+	fmt.Printf("bandwidth:        p95 %s/s, peak %s/s (%s buckets)\n", formatBytes(int64(rep.P95BytesPerSec)), formatBytes(int64(rep.PeakBytesPerSec)), time.Duration(rep.BucketSeconds*float64(time.Second)))
+	hours := make([]string, len(rep.BusiestHours))
+	for i, h := range rep.BusiestHours {
+		hours[i] = fmt.Sprintf("%02d:00 (%.1f sessions/day)", h.Hour, h.SessionsPerDay)
+	}
+	fmt.Printf("busiest hours:    %s\n", strings.Join(hours, ", "))
+	full := 0
+	for _, d := range rep.Daily {
+		if d.full {
+			full++
+		}
+	}
+	if rep.SessionGrowth == nil {
+		fmt.Printf("growth:           not enough full days to tell (%d)\n", full)
+		return
+	}
+	fmt.Printf("growth:           sessions %+.1f%%/week, bytes %s over %d full days\n", *rep.SessionGrowth, formatGrowth(rep.ByteGrowth), full)
+}
+
+func formatGrowth(g *float64) string {
+	if g == nil {
+		return "n/a"
+	}
+	return fmt.Sprintf("%+.1f%%/week", *g)
+}
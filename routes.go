@@ -0,0 +1,49 @@
+package main
+
+// embedCategories groups embed types so notify.routes can send, say, errors
+// to a paging channel and connection chatter somewhere quieter.
+var embedCategories = map[string][]string{
+	"connects": {"client_connected", "backend_connected", "forwarding_success"},
+	"errors": {"forwarding_error", "backend_connection_error", "proxy_error", "backend_latency_high", "backend_latency_recovered",
+		"no_activity", "activity_resumed", "listener_lost", "worker_exited", "autoscale_failed"},
+	"capacity": {"capacity_warning", "capacity_recovered", "scale_up", "scale_down"},
+	"security": {"exfiltration_alert", "signature_match", "new_country", "connection_spike", "connection_rate_normal"},
+	"bans":     {"ip_banned", "ip_unbanned"},
+	"status": {"proxy_starting", "proxy_online", "maintenance_mode", "maintenance_ended", "standby_backend",
+		"primary_backend_restored", "heartbeat", "stats_digest", "top_talkers", "notifications_suppressed", "listener_restored",
+		"failover", "failover_failed", "failover_peer_down", "failover_peer_recovered", "proxy_upgraded"},
+}
+
+func embedCategory(kind string) string {
+	for category, kinds := range embedCategories {
+		for _, k := range kinds {
+			if k == kind {
+				return category
+			}
+		}
+	}
+	return ""
+}
+
+// knownEmbedKey reports whether key can be used in notify.routes or an
+// events filter: a category, an embed type or "*".
+func knownEmbedKey(key string) bool {
+	_, category := embedCategories[key]
+	return category || embedCategory(key) != "" || key == "*"
+}
+
+// routeWebhook picks the webhook for an embed type: an exact type match in
+// notify.routes wins, then its category, then "*", then the built-in URL.
+func routeWebhook(kind string) string {
+	routes := conf().Notify.Routes
+	if url, ok := routes[kind]; ok {
+		return url
+	}
+	if url, ok := routes[embedCategory(kind)]; ok {
+		return url
+	}
+	if url, ok := routes["*"]; ok {
+		return url
+	}
+	return webhookURL
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	s3Queue    chan string
+	s3QueuedMu sync.Mutex
+	s3Queued   = map[string]bool{}
+)
+
+// s3Put uploads a file with a path-style PUT signed with AWS SigV4, which
+// works against AWS as well as MinIO and other S3-compatible stores.
+func s3Put(c S3Config, key, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	payloadHash := hex.EncodeToString(h.Sum(nil))
+
+	u, err := url.Parse(strings.TrimSuffix(c.Endpoint, "/"))
+	if err != nil {
+		return err
+	}
+	u.Path += "/" + c.Bucket + "/" + key
+	canonicalURI := s3EscapePath(u.Path)
+	u.RawPath = canonicalURI
+
+	now := time.Now().UTC()
+	headers := map[string]string{
+		"host":                 u.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           now.Format("20060102T150405Z"),
+		"content-type":         "application/vnd.tcpdump.pcap",
+	}
+	if c.SessionToken != "" {
+		headers["x-amz-security-token"] = c.SessionToken
+	}
+	if c.SSE != "" {
+		headers["x-amz-server-side-encryption"] = c.SSE
+		if c.KMSKeyID != "" {
+			headers["x-amz-server-side-encryption-aws-kms-key-id"] = c.KMSKeyID
+		}
+	}
+	if len(c.Tags) > 0 {
+		tags := url.Values{}
+		for k, v := range c.Tags {
+			tags.Set(k, v)
+		}
+		headers["x-amz-tagging"] = tags.Encode()
+	}
+
+	auth := sigV4Authorization("PUT", canonicalURI, headers, payloadHash, c.Region, "s3", c.AccessKey, c.SecretKey, now)
+	req, err := http.NewRequest("PUT", u.String(), f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	for k, v := range headers {
+		if k != "host" {
+			req.Header.Set(k, v)
+		}
+	}
+	req.Header.Set("Authorization", auth)
+	client := &http.Client{Timeout: 10 * time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected response status: %s %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// sigV4Authorization signs a request without a query string with AWS
+// SigV4. headers are lowercase and include host; all of them are signed.
+func sigV4Authorization(method, canonicalURI string, headers map[string]string, payloadHash, region, service, accessKey, secretKey string, now time.Time) string {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", k, strings.TrimSpace(headers[k]))
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{method, canonicalURI, "", canonicalHeaders.String(), signedHeaders, payloadHash}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	crHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(crHash[:])
+	signingKey := hmacSHA256([]byte("AWS4"+secretKey), date)
+	signingKey = hmacSHA256(signingKey, region)
+	signingKey = hmacSHA256(signingKey, service)
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+	return fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, signedHeaders, signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+// s3EscapePath percent-encodes everything but unreserved characters and
+// the slashes between segments, as SigV4 expects.
+func s3EscapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		ch := p[i]
+		if ch == '/' || ch == '-' || ch == '_' || ch == '.' || ch == '~' ||
+			('a' <= ch && ch <= 'z') || ('A' <= ch && ch <= 'Z') || ('0' <= ch && ch <= '9') {
+			b.WriteByte(ch)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", ch)
+	}
+	return b.String()
+}
+
+// queueUpload hands a finished capture file to the uploader. If the queue
+// is full the file just stays on disk and is picked up by the next scan.
+func queueUpload(path string) {
+	if s3Queue == nil {
+		return
+	}
+	s3QueuedMu.Lock()
+	defer s3QueuedMu.Unlock()
+	if s3Queued[path] {
+		return
+	}
+	select {
+	case s3Queue <- path:
+		s3Queued[path] = true
+	default:
+	}
+}
+
+// startS3Uploader uploads capture files as they are finished. Local copies
+// are removed only after S3 has acknowledged the upload, and in that mode
+// the capture dir is also rescanned every scan interval so files left by
+// failed attempts or a previous run still get shipped.
+func startS3Uploader(c S3Config, dir string) {
+	s3Queue = make(chan string, 1000)
+	go func() {
+		for path := range s3Queue {
+			uploadWithRetry(c, path)
+			s3QueuedMu.Lock()
+			delete(s3Queued, path)
+			s3QueuedMu.Unlock()
+		}
+	}()
+	infof("uploading captures to s3 bucket %s\n", c.Bucket)
+	if !c.DeleteAfterUpload {
+		return
+	}
+	if c.ScanInterval.Duration <= 0 {
+		c.ScanInterval.Duration = 5 * time.Minute
+	}
+	go func() {
+		for {
+			entries, err := os.ReadDir(dir)
+			if err == nil {
+				for _, e := range entries {
+					path := filepath.Join(dir, e.Name())
+					captureFilesMu.Lock()
+					open := captureOpen[path]
+					captureFilesMu.Unlock()
+					if !open && strings.HasSuffix(e.Name(), ".pcapng") {
+						queueUpload(path)
+					}
+				}
+			}
+			time.Sleep(c.ScanInterval.Duration)
+		}
+	}()
+}
+
+func uploadWithRetry(c S3Config, path string) {
+	key := c.Prefix + filepath.Base(path)
+	backoff := time.Second
+	for attempt := 0; attempt <= 5; attempt++ {
+		if _, err := os.Stat(path); err != nil {
+			return
+		}
+		err := s3Put(c, key, path)
+		if err == nil {
+			debugf("uploaded %s to s3://%s/%s", path, c.Bucket, key)
+			if c.DeleteAfterUpload {
+				if err := os.Remove(path); err != nil {
+					warnf("failed to remove uploaded capture %s: %v", path, err)
+				}
+			}
+			return
+		}
+		warnf("failed to upload %s to s3, retrying in %s: %v", path, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
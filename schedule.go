@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cronSpec is a classic 5-field cron expression: minute hour dom month dow.
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	domStar, dowStar              bool
+}
+
+func parseCron(expr string) (*cronSpec, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields", expr)
+	}
+	c := &cronSpec{}
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domStar = fields[2] == "*"
+	c.dowStar = fields[4] == "*"
+	return c, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("bad step in cron field %q", field)
+			}
+			step = n
+			part = part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			if i := strings.Index(part, "-"); i >= 0 {
+				a, err1 := strconv.Atoi(part[:i])
+				b, err2 := strconv.Atoi(part[i+1:])
+				if err1 != nil || err2 != nil {
+					return 0, fmt.Errorf("bad range in cron field %q", field)
+				}
+				lo, hi = a, b
+			} else {
+				n, err := strconv.Atoi(part)
+				if err != nil {
+					return 0, fmt.Errorf("bad value in cron field %q", field)
+				}
+				lo, hi = n, n
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("cron field %q out of range %d-%d", field, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (c *cronSpec) matches(t time.Time) bool {
+	if c.minute&(1<<uint(t.Minute())) == 0 || c.hour&(1<<uint(t.Hour())) == 0 || c.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+type maintenanceWindow struct {
+	cfg   MaintenanceWindowConfig
+	spec  *cronSpec
+	state bool
+}
+
+// active reports whether a window that started within the last duration is
+// still running, so a restart in the middle of a window picks it back up.
+func (w *maintenanceWindow) active(now time.Time) bool {
+	now = now.Truncate(time.Minute)
+	for t := now; now.Sub(t) < w.cfg.Duration.Duration; t = t.Add(-time.Minute) {
+		if w.spec.matches(t) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	standbyMu     sync.Mutex
+	standbyTarget string
+)
+
+func backendFor(targetAddr string) string {
+	standbyMu.Lock()
+	defer standbyMu.Unlock()
+	if standbyTarget != "" {
+		return standbyTarget
+	}
+	return targetAddr
+}
+
+func setStandby(addr, reason string) {
+	standbyMu.Lock()
+	if standbyTarget == addr {
+		standbyMu.Unlock()
+		return
+	}
+	standbyTarget = addr
+	standbyMu.Unlock()
+	auditf("standby backend set to %q (%s)", addr, reason)
+	if addr != "" {
+		infof("routing new connections to standby backend %s (%s)\n", addr, reason)
+		if err := sendDiscordEmbed("Standby Backend", fmt.Sprintf("New connections are routed to standby backend %s (%s)", addr, reason), 0xFFA500); err != nil {
+			warnf("Failed to send Discord embed: %v", err)
+		}
+		return
+	}
+	infof("routing new connections back to primary backend (%s)\n", reason)
+	if err := sendDiscordEmbed("Primary Backend Restored", fmt.Sprintf("New connections are routed to the primary backend again (%s)", reason), 0x008000); err != nil {
+		warnf("Failed to send Discord embed: %v", err)
+	}
+}
+
+func loadMaintenanceWindows(list []MaintenanceWindowConfig) ([]*maintenanceWindow, error) {
+	var windows []*maintenanceWindow
+	for _, wc := range list {
+		spec, err := parseCron(wc.Schedule)
+		if err != nil {
+			return nil, err
+		}
+		if wc.Duration.Duration < time.Minute {
+			return nil, fmt.Errorf("maintenance window %q needs a duration of at least 1m", wc.Schedule)
+		}
+		if wc.Action != "" && wc.Action != "maintenance" && wc.Action != "standby" {
+			return nil, fmt.Errorf("maintenance window %q has unknown action %q", wc.Schedule, wc.Action)
+		}
+		if wc.StandbyBackend == "" && wc.Action == "standby" {
+			return nil, fmt.Errorf("maintenance window %q uses action standby without standby_backend", wc.Schedule)
+		}
+		windows = append(windows, &maintenanceWindow{cfg: wc, spec: spec})
+	}
+	return windows, nil
+}
+
+func runMaintenanceSchedule(windows []*maintenanceWindow) {
+	for {
+		now := time.Now()
+		for _, w := range windows {
+			on := w.active(now)
+			if on == w.state {
+				continue
+			}
+			w.state = on
+			reason := "scheduled window " + w.cfg.Schedule
+			if w.cfg.Action == "standby" {
+				if on {
+					setStandby(w.cfg.StandbyBackend, reason)
+				} else {
+					setStandby("", reason)
+				}
+				continue
+			}
+			setMaintenance(on, reason)
+		}
+		time.Sleep(time.Until(now.Truncate(time.Minute).Add(time.Minute)))
+	}
+}
+
+func runCron(spec *cronSpec, fn func()) {
+	for {
+		now := time.Now()
+		time.Sleep(time.Until(now.Truncate(time.Minute).Add(time.Minute)))
+		if spec.matches(time.Now()) {
+			fn()
+		}
+	}
+}
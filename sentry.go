@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+type sentryFrame struct {
+	Function string `json:"function"`
+	Filename string `json:"filename"`
+	AbsPath  string `json:"abs_path"`
+	Lineno   int    `json:"lineno"`
+	InApp    bool   `json:"in_app"`
+}
+
+type sentryException struct {
+	Type       string `json:"type"`
+	Value      string `json:"value"`
+	Stacktrace struct {
+		Frames []sentryFrame `json:"frames"`
+	} `json:"stacktrace"`
+}
+
+var (
+	sentryMu     sync.Mutex
+	sentryURL    string
+	sentryAuth   string
+	sentryDSN    string
+	sentryRecent = map[string]time.Time{}
+	sentryWG     sync.WaitGroup
+)
+
+// setupSentry turns a DSN (https://key@host/project) into the envelope
+// endpoint and auth header.
+func setupSentry(dsn string) error {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return err
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return fmt.Errorf("dsn has no public key")
+	}
+	project := strings.TrimPrefix(u.Path, "/")
+	if i := strings.LastIndex(project, "/"); i >= 0 {
+		u.Path, project = "/"+project[:i], project[i+1:]
+	} else {
+		u.Path = ""
+	}
+	if project == "" {
+		return fmt.Errorf("dsn has no project id")
+	}
+	key := u.User.Username()
+	u.User = nil
+	sentryURL = fmt.Sprintf("%s/api/%s/envelope/", strings.TrimSuffix(u.String(), "/"), project)
+	sentryAuth = fmt.Sprintf("Sentry sentry_version=7, sentry_client=sshproxy/%s, sentry_key=%s", version, key)
+	sentryDSN = dsn
+	return nil
+}
+
+func sentryStack(skip int) []sentryFrame {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(skip+1, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	var out []sentryFrame
+	for {
+		f, more := frames.Next()
+		out = append(out, sentryFrame{
+			Function: f.Function,
+			Filename: f.File[strings.LastIndex(f.File, "/")+1:],
+			AbsPath:  f.File,
+			Lineno:   f.Line,
+			InApp:    strings.HasPrefix(f.Function, "main."),
+		})
+		if !more {
+			break
+		}
+	}
+	// sentry wants the outermost frame first
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out
+}
+
+func sendSentryEvent(level, typ, value string, frames []sentryFrame) error {
+	id := make([]byte, 16)
+	rand.Read(id)
+	eventID := hex.EncodeToString(id)
+	host, _ := os.Hostname()
+	exc := sentryException{Type: typ, Value: value}
+	exc.Stacktrace.Frames = frames
+	release := conf().Sentry.Release
+	if release == "" {
+		release = "sshproxy@" + version
+	}
+	event := map[string]any{
+		"event_id":    eventID,
+		"timestamp":   time.Now().UTC().Format(time.RFC3339Nano),
+		"platform":    "go",
+		"level":       level,
+		"logger":      "sshproxy",
+		"server_name": host,
+		"release":     release,
+		"environment": conf().Sentry.Environment,
+		"exception":   map[string]any{"values": []sentryException{exc}},
+	}
+	header, _ := json.Marshal(map[string]string{"event_id": eventID, "dsn": sentryDSN, "sent_at": time.Now().UTC().Format(time.RFC3339)})
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	body.Write(header)
+	body.WriteString("\n{\"type\":\"event\"}\n")
+	body.Write(payload)
+	body.WriteByte('\n')
+
+	req, err := http.NewRequest("POST", sentryURL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", sentryAuth)
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	return nil
+}
+
+// reportError sends an unexpected internal failure to Sentry. It is meant
+// for things that shouldn't happen on a healthy box (a listener dying,
+// writes to our own files failing), not for per-connection errors. The
+// same message is sent at most once every 10 minutes.
+func reportError(err error, context string) {
+	if sentryURL == "" || err == nil {
+		return
+	}
+	msg := context + ": " + err.Error()
+	sentryMu.Lock()
+	if last, ok := sentryRecent[msg]; ok && time.Since(last) < 10*time.Minute {
+		sentryMu.Unlock()
+		return
+	}
+	sentryRecent[msg] = time.Now()
+	sentryMu.Unlock()
+	frames := sentryStack(2)
+	sentryWG.Add(1)
+	go func() {
+		defer sentryWG.Done()
+		if err := sendSentryEvent("error", fmt.Sprintf("%T", err), msg, frames); err != nil {
+			warnf("failed to report error to sentry: %v", err)
+		}
+	}()
+}
+
+// flushSentry waits briefly for queued reports before the process exits.
+func flushSentry() {
+	done := make(chan struct{})
+	go func() {
+		sentryWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+	}
+}
+
+// reportPanic is deferred at the top of goroutines. It reports the panic
+// with its stack, waits for the send, then re-panics so the process still
+// crashes the way it would have.
+func reportPanic() {
+	if sentryURL == "" {
+		return
+	}
+	r := recover()
+	if r == nil {
+		return
+	}
+	if err := sendSentryEvent("fatal", "panic", fmt.Sprint(r), sentryStack(3)); err != nil {
+		errorf("failed to report panic to sentry: %v", err)
+	}
+	panic(r)
+}
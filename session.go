@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type session struct {
+	mu      sync.Mutex
+	id      string
+	tenant  string
+	client  net.Conn
+	target  net.Conn
+	ip      string
+	backend string
+	route   string
+	start   time.Time
+
+	closeReason string
+
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+
+	capture *sessionCapture
+	hexdump *hexdumper
+	mirror  *sessionMirror
+	chaos   bool
+	sigs    *sigScanner
+	tags    []string
+	geo     geoInfo
+
+	span     *span
+	teardown *span
+	halfOnce sync.Once
+
+	// set while an upgrade moves the session to the new process, see
+	// warmrestart.go; moved once it has gone
+	handover *sessionHandover
+	moved    atomic.Bool
+}
+
+var (
+	sessions   = map[*session]struct{}{}
+	sessionsMu sync.Mutex
+)
+
+func newConnID() string {
+	var b [6]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func connField(id string) *DiscordEmbedField {
+	return &DiscordEmbedField{Name: "Connection", Value: id, Inline: true}
+}
+
+func trackSession(id string, client net.Conn, ip string) (*session, bool) {
+	s := &session{id: id, client: client, ip: ip, start: time.Now()}
+	sessionsMu.Lock()
+	if max := conf().Limits.MaxConnections; max > 0 && len(sessions) >= max {
+		sessionsMu.Unlock()
+		return nil, false
+	}
+	sessions[s] = struct{}{}
+	n := len(sessions)
+	sessionsMu.Unlock()
+	checkCapacity(n)
+	return s, true
+}
+
+func untrackSession(s *session) {
+	// a session that moved to a new process is recorded when it ends there
+	if !s.moved.Load() {
+		sessionDuration.observeExemplar(time.Since(s.start).Seconds(), s.id, s.route)
+		s.capture.close(s.id)
+		s.mirror.close()
+		recordTalker(s.ip, s.bytesIn.Load()+s.bytesOut.Load())
+		recordClientTotals(s)
+		recordHistory(s)
+		writeAccessLog(s)
+		publishEvent(s.event("closed"))
+	}
+	sessionsMu.Lock()
+	delete(sessions, s)
+	n := len(sessions)
+	sessionsMu.Unlock()
+	checkCapacity(n)
+}
+
+func activeSessions() []*session {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	list := make([]*session, 0, len(sessions))
+	for s := range sessions {
+		list = append(list, s)
+	}
+	return list
+}
+
+// killSession closes the session with the given connection ID, if it's
+// still open, and records who asked.
+func killSession(id, by string) bool {
+	s := findSession(id)
+	if s == nil {
+		return false
+	}
+	s.close("killed")
+	infof("[%s] session closed by %s\n", id, by)
+	auditf("session %s closed by %s", id, by)
+	return true
+}
+
+func (s *session) setTarget(target net.Conn, backend string) {
+	s.mu.Lock()
+	s.target = target
+	s.backend = backend
+	s.mu.Unlock()
+}
+
+func (s *session) addBytes(direction string, n int) {
+	if direction == "client->backend" {
+		s.bytesIn.Add(int64(n))
+	} else {
+		checkExfil(s, s.bytesOut.Add(int64(n)), int64(n))
+	}
+	bytesForwarded.add(float64(n), direction)
+	routeBytes.add(float64(n), s.route, direction)
+	if s.tenant != "" {
+		tenantBytes.add(float64(n), s.tenant, direction)
+	}
+}
+
+// addTag adds a tag unless the session already has it.
+func (s *session) addTag(tag string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if containsString(s.tags, tag) {
+		return false
+	}
+	s.tags = append(s.tags, tag)
+	return true
+}
+
+func (s *session) removeTag(tag string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, t := range s.tags {
+		if t == tag {
+			s.tags = append(s.tags[:i:i], s.tags[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func findSession(id string) *session {
+	for _, s := range activeSessions() {
+		if s.id == id {
+			return s
+		}
+	}
+	return nil
+}
+
+// directionDone is called as each copy loop exits; the first one opens the
+// teardown span, which then covers waiting for the other side to finish.
+func (s *session) directionDone() {
+	s.halfOnce.Do(func() {
+		s.teardown = startSpan("teardown", spanKindInternal, s.span)
+	})
+}
+
+// setCloseReason records why the session ended; the first reason wins since
+// later ones are usually fallout from the first side closing.
+func (s *session) setCloseReason(reason string) {
+	s.mu.Lock()
+	if s.closeReason == "" {
+		s.closeReason = reason
+	}
+	s.mu.Unlock()
+}
+
+func (s *session) close(reason string) {
+	s.setCloseReason(reason)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.client.Close()
+	if s.target != nil {
+		s.target.Close()
+	}
+}
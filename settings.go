@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// runtimeSettings are the knobs that can be turned through the API without
+// touching the config file. They're all read as they're used, so a change
+// applies to the next connection, alert or health check. A reload that
+// changes the same section of the file puts the file's value back.
+type runtimeSettings struct {
+	LogLevel              string   `json:"log_level"`
+	Maintenance           bool     `json:"maintenance"`
+	MaintenanceDrainAfter Duration `json:"maintenance_drain_after"`
+	MaxConnections        int      `json:"max_connections"`
+	NotifyPerMinute       float64  `json:"notify_per_minute"`
+	NotifyBurst           int      `json:"notify_burst"`
+	NotifyCooldown        Duration `json:"notify_cooldown"`
+	HealthCheckTimeout    Duration `json:"health_check_timeout"`
+}
+
+func init() {
+	adminMux.HandleFunc("GET /api/v1/settings", apiAuth(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, currentSettings())
+	}))
+	adminMux.HandleFunc("PATCH /api/v1/settings", apiAuth(apiPatchSettings))
+}
+
+func currentSettings() runtimeSettings {
+	return runtimeSettings{
+		LogLevel:              getLogLevel().String(),
+		Maintenance:           inMaintenance(),
+		MaintenanceDrainAfter: conf().Maintenance.DrainAfter,
+		MaxConnections:        conf().Limits.MaxConnections,
+		NotifyPerMinute:       conf().Notify.RateLimit.PerMinute,
+		NotifyBurst:           conf().Notify.RateLimit.Burst,
+		NotifyCooldown:        conf().Notify.Cooldown,
+		HealthCheckTimeout:    conf().HealthCheck.Timeout,
+	}
+}
+
+func (s runtimeSettings) validate() error {
+	if _, err := parseLogLevel(s.LogLevel); err != nil {
+		return err
+	}
+	switch {
+	case s.MaxConnections < 0:
+		return fmt.Errorf("max_connections can't be negative")
+	case s.NotifyPerMinute < 0 || s.NotifyBurst < 0:
+		return fmt.Errorf("notify_per_minute and notify_burst can't be negative")
+	case s.MaintenanceDrainAfter.Duration < 0 || s.NotifyCooldown.Duration < 0:
+		return fmt.Errorf("durations can't be negative")
+	case s.HealthCheckTimeout.Duration <= 0:
+		return fmt.Errorf("health_check_timeout must be positive")
+	}
+	return nil
+}
+
+// applySettings lays patch over the current settings, validates the result
+// and puts it in place, returning the names of the settings that changed.
+// Nothing changes if any value is invalid. The current settings are read
+// under reloadMu, so concurrent patches can't undo each other.
+func applySettings(patch []byte, by string) ([]string, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	prev := currentSettings()
+	next := prev
+	dec := json.NewDecoder(bytes.NewReader(patch))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&next); err != nil {
+		return nil, fmt.Errorf("bad settings: %v", err)
+	}
+	if err := next.validate(); err != nil {
+		return nil, err
+	}
+	level, _ := parseLogLevel(next.LogLevel)
+
+	merged := *conf()
+	merged.Maintenance.DrainAfter = next.MaintenanceDrainAfter
+	merged.Limits.MaxConnections = next.MaxConnections
+	merged.Notify.RateLimit = NotifyRateLimitConfig{PerMinute: next.NotifyPerMinute, Burst: next.NotifyBurst}
+	merged.Notify.Cooldown = next.NotifyCooldown
+	merged.HealthCheck.Timeout = next.HealthCheckTimeout
+	cfg.Store(&merged)
+	if level != getLogLevel() {
+		setLogLevel(level)
+	}
+	setMaintenance(next.Maintenance, "set by "+by)
+
+	changed := []string{}
+	prevV, nextV := reflect.ValueOf(prev), reflect.ValueOf(next)
+	for i := 0; i < prevV.NumField(); i++ {
+		if reflect.DeepEqual(prevV.Field(i).Interface(), nextV.Field(i).Interface()) {
+			continue
+		}
+		name := prevV.Type().Field(i).Tag.Get("json")
+		changed = append(changed, name)
+		auditf("setting %s changed from %v to %v by %s", name, prevV.Field(i).Interface(), nextV.Field(i).Interface(), by)
+	}
+	if len(changed) > 0 {
+		infof("settings changed by %s: %s\n", by, strings.Join(changed, ", "))
+	}
+	return changed, nil
+}
+
+// apiPatchSettings takes any subset of the settings; the rest keep their
+// current values.
+func apiPatchSettings(w http.ResponseWriter, r *http.Request) {
+	patch, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 4096))
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "bad settings: "+err.Error())
+		return
+	}
+	changed, err := applySettings(patch, adminActor(r))
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"changed": changed, "settings": currentSettings()})
+}
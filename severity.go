@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Every embed type has a severity, and each notifier can be given a
+// min_severity so it only hears about things at that level or above.
+var severityLevels = map[string]int{"debug": 0, "info": 1, "warning": 2, "critical": 3}
+
+var embedSeverities = map[string]string{
+	"forwarding_success": "debug",
+	"heartbeat":          "debug",
+
+	"client_connected":          "info",
+	"backend_connected":         "info",
+	"proxy_starting":            "info",
+	"proxy_online":              "info",
+	"maintenance_ended":         "info",
+	"primary_backend_restored":  "info",
+	"capacity_recovered":        "info",
+	"backend_latency_recovered": "info",
+	"stats_digest":              "info",
+	"top_talkers":               "info",
+	"ip_unbanned":               "info",
+	"activity_resumed":          "info",
+	"connection_rate_normal":    "info",
+	"listener_restored":         "info",
+	"failover_peer_recovered":   "info",
+	"scale_up":                  "info",
+	"scale_down":                "info",
+	"proxy_upgraded":            "info",
+
+	"forwarding_error":         "warning",
+	"backend_latency_high":     "warning",
+	"capacity_warning":         "warning",
+	"maintenance_mode":         "warning",
+	"standby_backend":          "warning",
+	"notifications_suppressed": "warning",
+	"ip_banned":                "warning",
+	"no_activity":              "warning",
+	"connection_spike":         "warning",
+	"failover":                 "warning",
+	"failover_peer_down":       "warning",
+
+	"backend_connection_error": "critical",
+	"proxy_error":              "critical",
+	"exfiltration_alert":       "critical",
+	"signature_match":          "critical",
+	"new_country":              "critical",
+	"listener_lost":            "critical",
+	"failover_failed":          "critical",
+	"worker_exited":            "critical",
+	"autoscale_failed":         "critical",
+}
+
+func embedSeverity(kind string) string {
+	if s, ok := embedSeverities[kind]; ok {
+		return s
+	}
+	return "info"
+}
+
+// meetsSeverity reports whether an embed type is at or above min; an empty
+// min lets everything through.
+func meetsSeverity(kind, min string) bool {
+	if min == "" {
+		return true
+	}
+	return severityLevels[embedSeverity(kind)] >= severityLevels[min]
+}
+
+// severityColor is the notify.colors override for a severity, if any.
+func severityColor(severity string) (int, bool) {
+	s, ok := conf().Notify.Colors[severity]
+	if !ok {
+		return 0, false
+	}
+	c, err := parseColor(s)
+	return c, err == nil
+}
+
+// parseColor accepts "#RRGGBB" or "RRGGBB".
+func parseColor(s string) (int, error) {
+	v, err := strconv.ParseUint(strings.TrimPrefix(s, "#"), 16, 24)
+	if err != nil || len(strings.TrimPrefix(s, "#")) != 6 {
+		return 0, fmt.Errorf("color must look like #RRGGBB, got %q", s)
+	}
+	return int(v), nil
+}
+
+func validSeverity(s string) bool {
+	_, ok := severityLevels[s]
+	return ok || s == ""
+}
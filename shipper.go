@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// shipper batches events for a remote sink and retries failed batches with
+// exponential backoff. Events that arrive while the buffer is full are
+// dropped and counted rather than stalling connection handling.
+type shipper struct {
+	name       string
+	ch         chan sessionEvent
+	batchSize  int
+	interval   time.Duration
+	maxRetries int
+	send       func([]sessionEvent) error
+}
+
+func startShipper(name string, c EventsConfig, send func([]sessionEvent) error) {
+	s := &shipper{
+		name:       name,
+		ch:         make(chan sessionEvent, c.BufferSize),
+		batchSize:  c.BatchSize,
+		interval:   c.FlushInterval.Duration,
+		maxRetries: c.MaxRetries,
+		send:       send,
+	}
+	addEventSink(func(ev sessionEvent) {
+		select {
+		case s.ch <- ev:
+		default:
+			eventsDropped.inc(name)
+		}
+	})
+	if s.interval <= 0 {
+		s.interval = 5 * time.Second
+	}
+	go s.run()
+	infof("shipping events to %s\n", name)
+}
+
+func (s *shipper) run() {
+	ticker := time.NewTicker(s.interval)
+	var batch []sessionEvent
+	for {
+		select {
+		case ev := <-s.ch:
+			batch = append(batch, ev)
+			if len(batch) < s.batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		s.deliver(batch)
+		batch = nil
+	}
+}
+
+func (s *shipper) deliver(batch []sessionEvent) {
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		err := s.send(batch)
+		if err == nil {
+			return
+		}
+		if attempt >= s.maxRetries {
+			warnf("giving up on %d events for %s: %v", len(batch), s.name, err)
+			eventsDropped.add(float64(len(batch)), s.name)
+			return
+		}
+		warnf("failed to ship %d events to %s, retrying in %s: %v", len(batch), s.name, backoff, err)
+		time.Sleep(backoff)
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+func postBatch(url, contentType string, body []byte, c HTTPSinkConfig) ([]byte, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range c.Headers {
+		req.Header.Set(k, v)
+	}
+	if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+	client := &http.Client{Timeout: 15 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode/100 != 2 {
+		return data, fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	return data, nil
+}
+
+func lokiSender(c HTTPSinkConfig) func([]sessionEvent) error {
+	url := strings.TrimSuffix(c.URL, "/") + "/loki/api/v1/push"
+	return func(batch []sessionEvent) error {
+		type stream struct {
+			Stream map[string]string `json:"stream"`
+			Values [][2]string       `json:"values"`
+		}
+		byType := map[string]*stream{}
+		var streams []*stream
+		for _, ev := range batch {
+			st, ok := byType[ev.Type]
+			if !ok {
+				labels := map[string]string{"job": "sshproxy", "type": ev.Type}
+				for k, v := range c.Labels {
+					labels[k] = v
+				}
+				st = &stream{Stream: labels}
+				byType[ev.Type] = st
+				streams = append(streams, st)
+			}
+			line, _ := json.Marshal(ev)
+			st.Values = append(st.Values, [2]string{strconv.FormatInt(ev.Time.UnixNano(), 10), string(line)})
+		}
+		body, err := json.Marshal(map[string]any{"streams": streams})
+		if err != nil {
+			return err
+		}
+		_, err = postBatch(url, "application/json", body, c)
+		return err
+	}
+}
+
+func elasticsearchSender(c HTTPSinkConfig) func([]sessionEvent) error {
+	url := strings.TrimSuffix(c.URL, "/") + "/_bulk"
+	return func(batch []sessionEvent) error {
+		var buf bytes.Buffer
+		action, _ := json.Marshal(map[string]any{"index": map[string]string{"_index": c.Index}})
+		for _, ev := range batch {
+			doc, _ := json.Marshal(ev)
+			buf.Write(action)
+			buf.WriteByte('\n')
+			buf.Write(doc)
+			buf.WriteByte('\n')
+		}
+		data, err := postBatch(url, "application/x-ndjson", buf.Bytes(), c)
+		if err != nil {
+			return err
+		}
+		var resp struct {
+			Errors bool `json:"errors"`
+		}
+		if json.Unmarshal(data, &resp) == nil && resp.Errors {
+			return fmt.Errorf("bulk request reported item errors")
+		}
+		return nil
+	}
+}
+
+// kafkaSender produces to the brokers directly, or through a Kafka REST
+// proxy when that's what's configured. Either way records are keyed by
+// connection ID so a session's events stay on one partition and in order.
+func kafkaSender(c KafkaConfig) func([]sessionEvent) error {
+	if len(c.Brokers) > 0 {
+		return kafkaBrokerSender(c)
+	}
+	url := strings.TrimSuffix(c.URL, "/") + "/topics/" + c.Topic
+	sink := HTTPSinkConfig{Headers: c.Headers, Username: c.Username, Password: c.Password}
+	return func(batch []sessionEvent) error {
+		type record struct {
+			Key   string       `json:"key"`
+			Value sessionEvent `json:"value"`
+		}
+		records := make([]record, len(batch))
+		for i, ev := range batch {
+			records[i] = record{Key: ev.ID, Value: ev}
+		}
+		body, err := json.Marshal(map[string]any{"records": records})
+		if err != nil {
+			return err
+		}
+		_, err = postBatch(url, "application/vnd.kafka.json.v2+json", body, sink)
+		return err
+	}
+}
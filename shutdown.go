@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+var (
+	shutdownMu    sync.Mutex
+	shutdownHooks []func()
+)
+
+// onShutdown registers f to run when the proxy is told to stop, before the
+// pid file is removed and the queued notifications are flushed.
+func onShutdown(f func()) {
+	shutdownMu.Lock()
+	shutdownHooks = append(shutdownHooks, f)
+	shutdownMu.Unlock()
+}
+
+// watchShutdownSignal exits cleanly on SIGTERM or an interrupt, so the pid
+// file goes, systemd hears STOPPING=1 and queued notifications and Sentry
+// reports get their chance to go out.
+func watchShutdownSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, os.Interrupt)
+	sig := <-ch
+	infof("received %v, exiting\n", sig)
+	sdNotify("STOPPING=1")
+	shutdownMu.Lock()
+	hooks := shutdownHooks
+	shutdownMu.Unlock()
+	for _, f := range hooks {
+		f()
+	}
+	removePIDFile()
+	flushNotifications()
+	flushSentry()
+	os.Exit(0)
+}
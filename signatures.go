@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+type signature struct {
+	name      string
+	direction string
+	re        *regexp.Regexp
+	literal   []byte
+	action    string
+}
+
+var (
+	signatures       []signature
+	errSignatureKill = errors.New("session killed by signature match")
+)
+
+func loadSignatures(c SignaturesConfig) error {
+	for _, r := range c.Rules {
+		sig := signature{name: r.Name, direction: r.Direction, action: r.Action}
+		if sig.name == "" {
+			return errors.New("signature without a name")
+		}
+		switch sig.direction {
+		case "", "client->backend", "backend->client":
+		default:
+			return fmt.Errorf("signature %s: direction must be client->backend or backend->client", r.Name)
+		}
+		switch sig.action {
+		case "":
+			sig.action = "alert"
+		case "alert", "tag", "kill":
+		default:
+			return fmt.Errorf("signature %s: action must be alert, tag or kill", r.Name)
+		}
+		switch {
+		case r.Regex != "":
+			re, err := regexp.Compile(r.Regex)
+			if err != nil {
+				return fmt.Errorf("signature %s: %v", r.Name, err)
+			}
+			sig.re = re
+		case r.Contains != "":
+			sig.literal = []byte(r.Contains)
+		case r.Hex != "":
+			b, err := hex.DecodeString(strings.ReplaceAll(r.Hex, " ", ""))
+			if err != nil {
+				return fmt.Errorf("signature %s: %v", r.Name, err)
+			}
+			sig.literal = b
+		default:
+			return fmt.Errorf("signature %s needs regex, contains or hex", r.Name)
+		}
+		signatures = append(signatures, sig)
+	}
+	return nil
+}
+
+// sigScanner keeps the first scan_bytes of each direction of a session and
+// re-runs the signatures as data arrives. Each signature fires at most once
+// per session.
+type sigScanner struct {
+	mu    sync.Mutex
+	buf   [2][]byte
+	fired map[string]bool
+}
+
+func newSigScanner() *sigScanner {
+	if len(signatures) == 0 {
+		return nil
+	}
+	return &sigScanner{fired: map[string]bool{}}
+}
+
+// pending is how many more bytes of the direction scan wants to see.
+func (sc *sigScanner) pending(direction string) int {
+	if sc == nil {
+		return 0
+	}
+	dir := 0
+	if direction == "backend->client" {
+		dir = 1
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return max(conf().Signatures.ScanBytes-len(sc.buf[dir]), 0)
+}
+
+// scan returns errSignatureKill if a kill signature matched, in which case
+// the data must not be forwarded.
+func (sc *sigScanner) scan(s *session, direction string, p []byte) error {
+	if sc == nil {
+		return nil
+	}
+	dir := 0
+	if direction == "backend->client" {
+		dir = 1
+	}
+	sc.mu.Lock()
+	limit := conf().Signatures.ScanBytes
+	if len(sc.buf[dir]) >= limit {
+		sc.mu.Unlock()
+		return nil
+	}
+	room := limit - len(sc.buf[dir])
+	if len(p) > room {
+		p = p[:room]
+	}
+	sc.buf[dir] = append(sc.buf[dir], p...)
+	data := sc.buf[dir]
+	var hits []signature
+	for _, sig := range signatures {
+		if sc.fired[sig.name] || (sig.direction != "" && sig.direction != direction) {
+			continue
+		}
+		if (sig.re != nil && sig.re.Match(data)) || (sig.literal != nil && bytes.Contains(data, sig.literal)) {
+			sc.fired[sig.name] = true
+			hits = append(hits, sig)
+		}
+	}
+	sc.mu.Unlock()
+
+	kill := false
+	for _, sig := range hits {
+		signatureMatches.inc(sig.name, sig.action)
+		s.addTag("signature:" + sig.name)
+		client := anonAddr(s.client.RemoteAddr().String())
+		s.mu.Lock()
+		backend := s.backend
+		s.mu.Unlock()
+		switch sig.action {
+		case "tag":
+			infof("[%s] matched signature %s (%s), tagged\n", s.id, sig.name, direction)
+			continue
+		case "kill":
+			kill = true
+		}
+		warnf("[%s] matched signature %s (%s) from %s, action %s\n", s.id, sig.name, direction, client, sig.action)
+		publishEvent(sessionEvent{Type: "signature", ID: s.id, Src: client, Backend: backend, Reason: sig.name})
+		go func(sig signature) {
+			if err := sendAlert(alertVars{"ip": client, "conn_id": s.id, "backend": backend, "signature": sig.name, "action": sig.action, "direction": direction}, "Signature Match", fmt.Sprintf("Session matched signature %s (%s)", sig.name, direction), 0xFF0000,
+				connField(s.id),
+				&DiscordEmbedField{Name: "Client", Value: client, Inline: true},
+				&DiscordEmbedField{Name: "Action", Value: sig.action, Inline: true},
+			); err != nil {
+				warnf("Failed to send Discord embed: %v", err)
+			}
+		}(sig)
+	}
+	if kill {
+		s.close("signature_kill")
+		return errSignatureKill
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type slackBlock struct {
+	Type     string       `json:"type"`
+	Text     *slackText   `json:"text,omitempty"`
+	Fields   []*slackText `json:"fields,omitempty"`
+	Elements []*slackText `json:"elements,omitempty"`
+}
+
+type slackAttachment struct {
+	Color  string       `json:"color"`
+	Blocks []slackBlock `json:"blocks"`
+}
+
+type slackMessage struct {
+	Text        string            `json:"text"`
+	Attachments []slackAttachment `json:"attachments"`
+}
+
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// slackAttachmentFor renders an embed as Block Kit inside a coloured
+// attachment, which is the only way Slack keeps the side colour bar.
+func slackAttachmentFor(e DiscordEmbed) slackAttachment {
+	blocks := []slackBlock{{Type: "header", Text: &slackText{Type: "plain_text", Text: e.Title}}}
+	if e.Description != "" {
+		blocks = append(blocks, slackBlock{Type: "section", Text: &slackText{Type: "mrkdwn", Text: slackEscaper.Replace(e.Description)}})
+	}
+	var fields []*slackText
+	for _, f := range e.Fields {
+		fields = append(fields, &slackText{Type: "mrkdwn", Text: fmt.Sprintf("*%s*\n%s", slackEscaper.Replace(f.Name), slackEscaper.Replace(f.Value))})
+	}
+	// a section takes at most 10 fields
+	for len(fields) > 0 {
+		n := min(len(fields), 10)
+		blocks = append(blocks, slackBlock{Type: "section", Fields: fields[:n]})
+		fields = fields[n:]
+	}
+	if e.Timestamp != "" {
+		blocks = append(blocks, slackBlock{Type: "context", Elements: []*slackText{{Type: "mrkdwn", Text: e.Timestamp}}})
+	}
+	return slackAttachment{Color: fmt.Sprintf("#%06X", e.Color), Blocks: blocks}
+}
+
+func postSlack(url string, embeds []DiscordEmbed) (time.Duration, error) {
+	msg := slackMessage{Text: embeds[0].Title}
+	for _, e := range embeds {
+		msg.Attachments = append(msg.Attachments, slackAttachmentFor(e))
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return 0, err
+	}
+	return postJSON(url, body, nil)
+}
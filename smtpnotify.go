@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// smtpURL is only used to key the outbox; the connection details come from
+// conf().Notify.SMTP.
+func smtpURL(c SMTPConfig) string {
+	return "smtp://" + net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+}
+
+// emailBody renders embeds as a plain-text mail; several queued at once go
+// out as one mail.
+func emailBody(embeds []DiscordEmbed) string {
+	var b strings.Builder
+	for i, e := range embeds {
+		if i > 0 {
+			b.WriteString("\r\n----\r\n\r\n")
+		}
+		b.WriteString(e.Title + "\r\n\r\n")
+		if e.Description != "" {
+			b.WriteString(e.Description + "\r\n\r\n")
+		}
+		for _, f := range e.Fields {
+			b.WriteString(f.Name + ": " + strings.ReplaceAll(f.Value, "\n", "\r\n  ") + "\r\n")
+		}
+		if e.Timestamp != "" {
+			b.WriteString("Time: " + e.Timestamp + "\r\n")
+		}
+	}
+	return b.String()
+}
+
+// headerSafe keeps embed text from injecting extra mail headers.
+func headerSafe(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
+
+func postEmail(_ string, embeds []DiscordEmbed) (time.Duration, error) {
+	c := conf().Notify.SMTP
+	subject := embeds[0].Title
+	if len(embeds) > 1 {
+		subject = fmt.Sprintf("%s (+%d more)", subject, len(embeds)-1)
+	}
+	if c.SubjectPrefix != "" {
+		subject = c.SubjectPrefix + " " + subject
+	}
+	host, _ := os.Hostname()
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", c.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(c.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", headerSafe(subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%s@%s>\r\n", newConnID(), headerSafe(host))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(emailBody(embeds))
+
+	if err := sendMail(c, []byte(msg.String())); err != nil {
+		webhookFailures.inc()
+		warnf("failed to send alert email via %s: %v", c.Host, err)
+		return 0, err
+	}
+	return 0, nil
+}
+
+func sendMail(c SMTPConfig, msg []byte) error {
+	addr := net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+	tlsConfig := &tls.Config{ServerName: c.Host, InsecureSkipVerify: c.InsecureSkipVerify}
+	dialer := &net.Dialer{Timeout: 15 * time.Second}
+	var conn net.Conn
+	var err error
+	if c.TLS == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(time.Minute))
+	client, err := smtp.NewClient(conn, c.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if c.TLS == "starttls" {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return errors.New("server does not support STARTTLS")
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if c.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", c.Username, c.Password, c.Host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(c.From); err != nil {
+		return err
+	}
+	for _, to := range c.To {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// smtpPermanent reports a 5xx reply, which resending won't fix.
+func smtpPermanent(err error) bool {
+	var te *textproto.Error
+	return errors.As(err, &te) && te.Code >= 500
+}
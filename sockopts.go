@@ -0,0 +1,186 @@
+package main
+
+import (
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// tcp.client applies to accepted client connections and tcp.backend to
+// connections dialled to backends. Backend options are set before the
+// connect, so the handshake already advertises them. Client sockets are
+// set up right after the accept.
+
+// TCP Fast Open lets a client that has connected before send its first
+// bytes with the SYN, saving a round trip. Only Linux is covered; the
+// option numbers aren't in the syscall package.
+const (
+	tcpFastOpen        = 0x17
+	tcpFastOpenConnect = 0x1e
+	// how many Fast Open connections may wait for accept
+	fastOpenQueue = 256
+)
+
+func fastOpenSupported() bool {
+	return runtime.GOOS == "linux" || runtime.GOOS == "android"
+}
+
+// checkFastOpenSysctl warns when the kernel won't do what tcp.*.fast_open
+// asks for; net.ipv4.tcp_fastopen has bit 1 for dials and bit 2 for
+// listeners.
+func checkFastOpenSysctl() {
+	c := conf().TCP
+	if !c.Client.FastOpen && !c.Backend.FastOpen {
+		return
+	}
+	data, err := os.ReadFile("/proc/sys/net/ipv4/tcp_fastopen")
+	if err != nil {
+		return
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return
+	}
+	if c.Client.FastOpen && v&2 == 0 {
+		warnf("tcp.client.fast_open is on but net.ipv4.tcp_fastopen is %d, set it to 3 for listeners to use it", v)
+	}
+	if c.Backend.FastOpen && v&1 == 0 {
+		warnf("tcp.backend.fast_open is on but net.ipv4.tcp_fastopen is %d, set it to 3 for dials to use it", v)
+	}
+}
+
+// setsockopt sets an int option through a RawConn.
+func setsockopt(c syscall.RawConn, level, opt, value int) error {
+	var serr error
+	if err := c.Control(func(fd uintptr) {
+		serr = setsockoptInt(syscall.SetsockoptInt, fd, level, opt, value)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+// tuneListener turns on Fast Open for a proxy listener. Linux takes it on
+// a socket that's already listening, so inherited ones are covered too.
+func tuneListener(l net.Listener) {
+	tl, ok := l.(*net.TCPListener)
+	if !ok || !conf().TCP.Client.FastOpen {
+		return
+	}
+	rc, err := tl.SyscallConn()
+	if err == nil {
+		err = setsockopt(rc, syscall.IPPROTO_TCP, tcpFastOpen, fastOpenQueue)
+	}
+	if err != nil {
+		warnf("failed to turn on fast open on %s: %v", l.Addr(), err)
+	}
+}
+
+// apply sets the buffer sizes on a socket.
+func (o TCPSocketConfig) apply(c syscall.RawConn) error {
+	if o.RecvBuffer > 0 {
+		if err := setsockopt(c, syscall.SOL_SOCKET, syscall.SO_RCVBUF, o.RecvBuffer); err != nil {
+			return err
+		}
+	}
+	if o.SendBuffer > 0 {
+		return setsockopt(c, syscall.SOL_SOCKET, syscall.SO_SNDBUF, o.SendBuffer)
+	}
+	return nil
+}
+
+// config turns keepalive off when it isn't enabled, rather than leaving
+// Go's default of probing every 15s.
+func (k TCPKeepAliveConfig) config() net.KeepAliveConfig {
+	if !k.Enabled {
+		return net.KeepAliveConfig{}
+	}
+	return net.KeepAliveConfig{Enable: true, Idle: k.Idle.Duration, Interval: k.Interval.Duration, Count: k.Count}
+}
+
+// dialer is a net.Dialer that sets the options before connecting.
+func (o TCPSocketConfig) dialer(timeout time.Duration) *net.Dialer {
+	d := &net.Dialer{
+		Timeout:         timeout,
+		KeepAliveConfig: o.KeepAlive.config(),
+		Control: func(network, address string, c syscall.RawConn) error {
+			if err := o.apply(c); err != nil {
+				return err
+			}
+			if o.FastOpen {
+				// connect returns straight away when there's a cookie
+				// for the backend, and the SYN goes with the first write
+				return setsockopt(c, syscall.IPPROTO_TCP, tcpFastOpenConnect, 1)
+			}
+			return nil
+		},
+	}
+	if !o.KeepAlive.Enabled {
+		d.KeepAlive = -1
+	}
+	d.SetMultipathTCP(o.MPTCP)
+	return d
+}
+
+// dial connects to a backend with the options set. Go turns on
+// TCP_NODELAY once the connection is up, so that one comes after.
+func (o TCPSocketConfig) dial(addr string, timeout time.Duration) (net.Conn, error) {
+	conn, err := o.dialer(timeout).Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if !o.NoDelay {
+		if err := conn.(*net.TCPConn).SetNoDelay(false); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// tuneClient applies tcp.client to an accepted connection. Failing to is
+// logged but the client is still served.
+func tuneClient(conn net.Conn) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	o := conf().TCP.Client
+	rc, err := tc.SyscallConn()
+	if err == nil {
+		err = o.apply(rc)
+	}
+	if err == nil {
+		err = tc.SetKeepAliveConfig(o.KeepAlive.config())
+	}
+	if err == nil {
+		err = tc.SetNoDelay(o.NoDelay)
+	}
+	if err != nil && loggedIPs.allow("tune-client") {
+		warnf("failed to set tcp.client options: %v", err)
+	}
+}
+
+// listenMPTCP reports whether the proxy listener on addr uses MPTCP.
+func listenMPTCP(addr string) bool {
+	for _, t := range conf().Tenants {
+		if t.Listen == addr && t.MPTCP.Client != nil {
+			return *t.MPTCP.Client
+		}
+	}
+	return conf().TCP.Client.MPTCP
+}
+
+// backendSocket is tcp.backend with the route's MPTCP setting; t is nil
+// for the main listener.
+func backendSocket(t *tenant) TCPSocketConfig {
+	o := conf().TCP.Backend
+	if t != nil && t.MPTCP.Backend != nil {
+		o.MPTCP = *t.MPTCP.Backend
+	}
+	return o
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io"
+	"net"
+	"runtime"
+)
+
+// On Linux, net.TCPConn.ReadFrom moves bytes from one TCP socket to another
+// with splice(2), through a kernel pipe, without copying them into the
+// process. That only happens when it's handed the socket itself, so
+// sessions whose bytes nothing here needs to see are forwarded that way.
+// Capture, hexdump, mirroring and chaos look at every byte, so their
+// sessions are copied through the buffer as before. Signatures only look at
+// the first scan_bytes of each direction, which are copied, and the rest is
+// spliced.
+//
+// Splicing happens forwarding.buffer_size at a time, so the byte counters
+// (and so exfil and throughput) trail what has actually been forwarded by
+// at most that much.
+
+var splicedBytes = newCounter("sshproxy_spliced_bytes_total", "Bytes forwarded with splice, without passing through the proxy, by direction.", "direction")
+
+// canSplice reports whether direction can skip the copy buffer.
+func canSplice(sess *session, src, dest net.Conn, direction string) bool {
+	if runtime.GOOS != "linux" || !conf().Forwarding.Splice {
+		return false
+	}
+	if sess.chaos || sess.capture != nil || sess.hexdump != nil || (direction == "client->backend" && sess.mirror != nil) {
+		return false
+	}
+	_, srcTCP := src.(*net.TCPConn)
+	_, destTCP := dest.(*net.TCPConn)
+	return srcTCP && destTCP
+}
+
+// copyStream forwards src to w, which writes to dest, until EOF or an
+// error, splicing if it can.
+func copyStream(sess *session, w io.Writer, src, dest net.Conn, direction string, buf []byte) (int64, error) {
+	if !canSplice(sess, src, dest, direction) {
+		return io.CopyBuffer(writerOnly{w}, &countingReader{r: src, sess: sess, direction: direction}, buf)
+	}
+	var written int64
+	if pending := sess.sigs.pending(direction); pending > 0 {
+		lr := &io.LimitedReader{R: src, N: int64(pending)}
+		n, err := io.CopyBuffer(writerOnly{w}, &countingReader{r: lr, sess: sess, direction: direction}, buf)
+		written += n
+		if err != nil || lr.N > 0 {
+			// lr.N left over means src hit EOF first
+			return written, err
+		}
+	}
+	to := dest.(*net.TCPConn)
+	chunk := int64(len(buf))
+	for {
+		n, err := to.ReadFrom(&io.LimitedReader{R: src, N: chunk})
+		written += n
+		if n > 0 {
+			sess.addBytes(direction, int(n))
+			splicedBytes.add(float64(n), direction)
+		}
+		if err != nil || n < chunk {
+			return written, err
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// savedState is the on-disk form of state.file. Client addresses in Seen
+// have already been through anonIP; Bans has to keep the real ones.
+type savedState struct {
+	Saved     time.Time            `json:"saved"`
+	Seen      map[string]time.Time `json:"seen"`
+	Countries []string             `json:"countries,omitempty"`
+	Bans      map[string]time.Time `json:"bans,omitempty"`
+	Lifetime  *lifetimeTotals      `json:"lifetime,omitempty"`
+}
+
+var stateMu sync.Mutex
+
+// loadState restores client cooldowns, known countries, bans and lifetime
+// totals from the last run. A missing file just means a fresh start.
+func loadState(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	var st savedState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return fmt.Errorf("parse %s: %v", path, err)
+	}
+	loggedIPs.restore(st.Seen)
+	restoreBans(st.Bans)
+	restoreLifetime(st.Lifetime)
+	seenCountriesMu.Lock()
+	for _, cc := range st.Countries {
+		seenCountries[cc] = true
+	}
+	seenCountriesMu.Unlock()
+	infof("loaded %d known clients and %d countries from %s\n", len(st.Seen), len(st.Countries), path)
+	return nil
+}
+
+func saveState(path string) {
+	if handedOver.Load() {
+		// the new process owns the file now
+		return
+	}
+	lt := lifetimeSnapshot()
+	st := savedState{Saved: time.Now().UTC(), Seen: loggedIPs.snapshot("client:"), Bans: activeBans(), Lifetime: &lt}
+	seenCountriesMu.Lock()
+	for cc := range seenCountries {
+		st.Countries = append(st.Countries, cc)
+	}
+	seenCountriesMu.Unlock()
+	sort.Strings(st.Countries)
+	data, err := json.Marshal(st)
+	if err != nil {
+		return
+	}
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		warnf("failed to write state file: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		warnf("failed to write state file: %v", fmt.Errorf("rename: %v", err))
+	}
+}
+
+// runStateSaver saves every save_interval. main also saves from a shutdown
+// hook, so the totals since the last tick aren't lost.
+func runStateSaver(c StateConfig) {
+	tick := time.NewTicker(c.SaveInterval.Duration)
+	for range tick.C {
+		saveState(c.File)
+	}
+}
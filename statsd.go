@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const statsdMaxPacket = 1432
+
+type statsdEmitter struct {
+	conn net.Conn
+	last map[string]float64
+	buf  []byte
+}
+
+func startStatsD(c StatsDConfig) {
+	conn, err := net.Dial("udp", c.Address)
+	if err != nil {
+		errorf("failed to set up statsd emitter to %s: %v\n", c.Address, err)
+		return
+	}
+	e := &statsdEmitter{conn: conn, last: map[string]float64{}}
+	infof("sending statsd metrics to %s every %s\n", c.Address, c.Interval.Duration)
+	for range time.Tick(c.Interval.Duration) {
+		e.flush(c)
+	}
+}
+
+func (e *statsdEmitter) flush(c StatsDConfig) {
+	for _, m := range collectMetrics() {
+		name := c.Prefix + strings.TrimPrefix(m.name, "sshproxy_")
+		for _, s := range m.snapshot() {
+			key := m.name + "\xff" + strings.Join(s.labelValues, "\xff")
+			if m.kind == "histogram" {
+				e.writeDelta(c, key+"\xffcount", name+"_count", m.labels, s.labelValues, float64(s.count))
+				e.writeDelta(c, key+"\xffsum", name+"_sum", m.labels, s.labelValues, s.value)
+				continue
+			}
+			v := s.value
+			typ := "g"
+			if m.kind == "counter" {
+				typ = "c"
+				v -= e.last[key]
+				e.last[key] = s.value
+				if v == 0 {
+					continue
+				}
+			}
+			e.write(statsdLine(c, name, m.labels, s.labelValues, v, typ))
+		}
+	}
+	e.send()
+}
+
+func (e *statsdEmitter) writeDelta(c StatsDConfig, key, name string, labels, values []string, total float64) {
+	v := total - e.last[key]
+	e.last[key] = total
+	if v != 0 {
+		e.write(statsdLine(c, name, labels, values, v, "c"))
+	}
+}
+
+func statsdLine(c StatsDConfig, name string, labels, values []string, v float64, typ string) string {
+	if c.Format == "plain" {
+		for _, lv := range values {
+			name += "." + statsdSanitize(lv)
+		}
+		return fmt.Sprintf("%s:%s|%s", name, promValue(v), typ)
+	}
+	tags := append([]string(nil), c.Tags...)
+	for i, l := range labels {
+		tags = append(tags, l+":"+statsdSanitize(values[i]))
+	}
+	line := fmt.Sprintf("%s:%s|%s", name, promValue(v), typ)
+	if len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	return line
+}
+
+func statsdSanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', ',', '#', '@', ' ':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+func (e *statsdEmitter) write(line string) {
+	if len(e.buf) > 0 && len(e.buf)+1+len(line) > statsdMaxPacket {
+		e.send()
+	}
+	if len(e.buf) > 0 {
+		e.buf = append(e.buf, '\n')
+	}
+	e.buf = append(e.buf, line...)
+}
+
+func (e *statsdEmitter) send() {
+	if len(e.buf) == 0 {
+		return
+	}
+	if _, err := e.conn.Write(e.buf); err != nil {
+		warnf("failed to send statsd packet: %v\n", err)
+	}
+	e.buf = e.buf[:0]
+}
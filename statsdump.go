@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// sigusr1 is SIGUSR1 by number, since syscall.SIGUSR1 doesn't exist on
+// Windows and the same set of files has to build everywhere.
+func sigusr1() (os.Signal, bool) {
+	switch runtime.GOOS {
+	case "windows", "plan9", "js", "wasip1":
+		return nil, false
+	case "linux":
+		if strings.HasPrefix(runtime.GOARCH, "mips") {
+			return syscall.Signal(16), true
+		}
+		return syscall.Signal(10), true
+	case "solaris", "illumos":
+		return syscall.Signal(16), true
+	}
+	// darwin, the BSDs and aix
+	return syscall.Signal(30), true
+}
+
+func watchDumpSignal() {
+	sig, ok := sigusr1()
+	if !ok {
+		return
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sig)
+	for range ch {
+		logStatsDump("SIGUSR1")
+	}
+}
+
+// logStatsDump writes stats, backends and every open session to the log
+// as a block of logfmt lines, for hosts where nobody can reach the admin
+// listener. It ignores the log level, since someone asked for it.
+func logStatsDump(reason string) {
+	st := currentStats()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	sessions := sessionInfos()
+	backends := backendInfos()
+
+	dumpLine("begin", "reason", reason, "time", time.Now().UTC().Format(time.RFC3339))
+	rejected := make([]any, 0, 2*len(st.Rejected))
+	reasons := make([]string, 0, len(st.Rejected))
+	for r := range st.Rejected {
+		reasons = append(reasons, r)
+	}
+	sort.Strings(reasons)
+	for _, r := range reasons {
+		rejected = append(rejected, "rejected_"+r, st.Rejected[r])
+	}
+	dumpLine("stats", append([]any{"version", st.Version, "uptime", time.Since(startTime).Round(time.Second),
+		"accepted", st.Accepted, "active", st.ActiveSessions, "bytes_in", st.BytesIn, "bytes_out", st.BytesOut,
+		"maintenance", st.Maintenance, "bans", st.Bans, "notify_queue", st.NotifyQueue, "log_level", st.LogLevel}, rejected...)...)
+	dumpLine("runtime", "goroutines", runtime.NumGoroutine(), "heap_bytes", mem.HeapAlloc, "gc_runs", mem.NumGC)
+	for _, b := range backends {
+		dumpLine("backend", "address", b.Address, "up", b.Up, "sessions", b.Sessions,
+			"dial_p50", secondsDuration(b.DialP50Secs), "dial_p99", secondsDuration(b.DialP99Secs))
+	}
+	for _, s := range sessions {
+		dumpLine("session", "id", s.ID, "src", s.Src, "backend", s.Backend, "started", s.Started.Format(time.RFC3339),
+			"age", secondsDuration(s.AgeSeconds).Round(time.Second), "bytes_in", s.BytesIn, "bytes_out", s.BytesOut,
+			"country", s.Country, "tags", strings.Join(s.Tags, ","))
+	}
+	dumpLine("end", "sessions", len(sessions), "backends", len(backends))
+}
+
+func secondsDuration(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second)).Round(time.Microsecond)
+}
+
+// dumpLine logs one "DUMP <kind> key=value ..." line, quoting values that
+// need it so the block can be picked apart with any logfmt parser.
+func dumpLine(kind string, kv ...any) {
+	var b strings.Builder
+	b.WriteString(kind)
+	for i := 0; i+1 < len(kv); i += 2 {
+		v := fmt.Sprint(kv[i+1])
+		if v == "" || strings.ContainsAny(v, " =\"") {
+			v = strconv.Quote(v)
+		}
+		fmt.Fprintf(&b, " %s=%s", kv[i], v)
+	}
+	msg := b.String()
+	if syslogOut != nil {
+		syslogOut.send(levelInfo, "DUMP "+msg)
+		if conf().Log.Syslog.Only {
+			return
+		}
+	}
+	log.Output(2, "DUMP "+msg)
+}
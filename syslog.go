@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+var syslogSeverities = map[logLevel]int{
+	levelDebug: 7,
+	levelInfo:  6,
+	levelWarn:  4,
+	levelError: 3,
+}
+
+// syslogWriter sends RFC 5424 messages to a local or remote syslog daemon.
+// Stream transports use octet-counting framing (RFC 6587/5425). Messages
+// go through a queue to one sender, so a slow or dead syslog server never
+// holds up whoever is logging; what doesn't fit in the queue is dropped.
+type syslogWriter struct {
+	c        SyslogConfig
+	facility int
+	hostname string
+	// conn is only touched by run once it has started
+	conn  net.Conn
+	queue chan syslogLine
+}
+
+type syslogLine struct {
+	line, msg string
+}
+
+const (
+	syslogQueueSize    = 1024
+	syslogWriteTimeout = 5 * time.Second
+)
+
+var syslogDropped = newCounter("sshproxy_syslog_dropped_total", "Log lines not sent to syslog because its queue was full.")
+
+var syslogOut *syslogWriter
+
+func newSyslogWriter(c SyslogConfig) (*syslogWriter, error) {
+	facility, ok := syslogFacilities[strings.ToLower(c.Facility)]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q", c.Facility)
+	}
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+	w := &syslogWriter{c: c, facility: facility, hostname: hostname, queue: make(chan syslogLine, syslogQueueSize)}
+	if err := w.connect(); err != nil {
+		return nil, err
+	}
+	go w.run()
+	return w, nil
+}
+
+func (w *syslogWriter) connect() error {
+	var err error
+	switch w.c.Network {
+	case "", "unix", "local":
+		for _, path := range []string{"/dev/log", "/var/run/syslog", "/var/run/log"} {
+			for _, network := range []string{"unixgram", "unix"} {
+				if w.conn, err = net.Dial(network, path); err == nil {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("no local syslog socket found: %v", err)
+	case "udp", "tcp":
+		w.conn, err = net.DialTimeout(w.c.Network, w.c.Address, 10*time.Second)
+	case "tls":
+		w.conn, err = tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", w.c.Address, &tls.Config{
+			InsecureSkipVerify: w.c.InsecureSkipVerify,
+		})
+	default:
+		return fmt.Errorf("unknown syslog network %q (want unix, udp, tcp or tls)", w.c.Network)
+	}
+	return err
+}
+
+func (w *syslogWriter) stream() bool {
+	return w.c.Network == "tcp" || w.c.Network == "tls"
+}
+
+func (w *syslogWriter) send(l logLevel, msg string) {
+	pri := w.facility*8 + syslogSeverities[l]
+	line := fmt.Sprintf("<%d>1 %s %s %s %d - - %s", pri, time.Now().Format(time.RFC3339Nano), w.hostname, w.c.Tag, os.Getpid(), strings.TrimRight(msg, "\n"))
+	if w.stream() {
+		line = fmt.Sprintf("%d %s", len(line), line)
+	}
+	select {
+	case w.queue <- syslogLine{line, msg}:
+	default:
+		syslogDropped.inc()
+	}
+}
+
+// run writes queued lines, reconnecting after a failed write.
+func (w *syslogWriter) run() {
+	for l := range w.queue {
+		w.write(l)
+	}
+}
+
+func (w *syslogWriter) write(l syslogLine) {
+	for attempt := 0; attempt < 2; attempt++ {
+		if w.conn == nil {
+			if err := w.connect(); err != nil {
+				continue
+			}
+		}
+		w.conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout))
+		if _, err := w.conn.Write([]byte(l.line)); err == nil {
+			return
+		}
+		w.conn.Close()
+		w.conn = nil
+	}
+	fmt.Fprintf(os.Stderr, "failed to write to syslog: %s\n", l.msg)
+}
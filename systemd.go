@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// systemd integration. With socket activation, systemd binds the sockets
+// (low ports included) and passes them in from fd 3 as LISTEN_FDS says;
+// listenAs takes them over for whichever configured address they match.
+// With Type=notify the proxy reports readiness and a status line over
+// NOTIFY_SOCKET, and with WatchdogSec= it pings systemd for as long as it
+// can still serve.
+
+// activated holds sockets systemd passed in that haven't been claimed.
+var activated []net.Listener
+
+func activatedListeners() {
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if pid != os.Getpid() || n <= 0 {
+		return
+	}
+	for i := range n {
+		f := os.NewFile(uintptr(3+i), "systemd-socket")
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			warnf("ignoring socket %d from systemd: %v", 3+i, err)
+			continue
+		}
+		activated = append(activated, l)
+	}
+	infof("got %d sockets from systemd\n", len(activated))
+}
+
+// takeActivated hands over a systemd socket for network:addr. Call with
+// listenersMu held.
+func takeActivated(network, addr string) net.Listener {
+	for i, l := range activated {
+		if l.Addr().Network() == network && sameListenAddr(addr, l.Addr().String()) {
+			activated = append(activated[:i], activated[i+1:]...)
+			infof("using the socket systemd passed for %s\n", addr)
+			return l
+		}
+	}
+	return nil
+}
+
+// sameListenAddr compares a configured listen address with a bound one.
+// An unspecified host on either side matches any, since ListenStream=22
+// binds [::]:22 while the config may well say 0.0.0.0:22.
+func sameListenAddr(configured, bound string) bool {
+	if !strings.Contains(configured, ":") || strings.HasPrefix(configured, "/") {
+		// unix socket path
+		return configured == bound
+	}
+	ch, cp, err := net.SplitHostPort(configured)
+	if err != nil {
+		return false
+	}
+	bh, bp, err := net.SplitHostPort(bound)
+	if err != nil || cp != bp {
+		return false
+	}
+	unspecified := func(h string) bool {
+		ip := net.ParseIP(h)
+		return h == "" || (ip != nil && ip.IsUnspecified())
+	}
+	if unspecified(ch) || unspecified(bh) {
+		return true
+	}
+	cip, bip := net.ParseIP(ch), net.ParseIP(bh)
+	return cip != nil && bip != nil && cip.Equal(bip)
+}
+
+// sdNotify sends state lines to systemd, e.g. "READY=1". Outside of a
+// Type=notify unit there's no NOTIFY_SOCKET and it does nothing. The
+// variable is left set so a process started for an upgrade can notify
+// too.
+func sdNotify(state string) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return
+	}
+	// a leading @ is an abstract socket, which net handles the same way
+	conn, err := net.Dial("unixgram", addr)
+	if err != nil {
+		debugf("systemd notify: %v\n", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		debugf("systemd notify: %v\n", err)
+	}
+}
+
+// notifyReady tells systemd the proxy is serving. After an upgrade the
+// new process also claims to be the main one, so systemd follows it once
+// the old process exits; that needs NotifyAccess=all in the unit.
+func notifyReady(upgraded bool) {
+	state := "READY=1\nSTATUS=" + systemdStatus()
+	if upgraded {
+		state = fmt.Sprintf("MAINPID=%d\n%s", os.Getpid(), state)
+	}
+	sdNotify(state)
+}
+
+func systemdStatus() string {
+	status := fmt.Sprintf("%d active sessions, %d accepted since start", len(activeSessions()), int64(connectionsAccepted.total()))
+	if inMaintenance() {
+		status += ", in maintenance"
+	}
+	return status
+}
+
+// runSystemdStatus keeps the status line systemctl shows current. It stops
+// once another process has taken over, since that one reports from then on.
+func runSystemdStatus() {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+	tick := time.NewTicker(10 * time.Second)
+	defer tick.Stop()
+	for range tick.C {
+		if handedOver.Load() {
+			return
+		}
+		sdNotify("STATUS=" + systemdStatus())
+	}
+}
+
+// runWatchdog pings systemd at half of WatchdogSec= while check passes.
+// When it doesn't, the pings stop and systemd restarts the unit.
+func runWatchdog(check func(timeout time.Duration) error) {
+	usec, _ := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	pid := os.Getenv("WATCHDOG_PID")
+	if usec <= 0 || (pid != "" && pid != strconv.Itoa(os.Getpid())) {
+		return
+	}
+	interval := time.Duration(usec) * time.Microsecond
+	infof("systemd watchdog enabled, pinging every %s\n", interval/2)
+	tick := time.NewTicker(interval / 2)
+	defer tick.Stop()
+	for range tick.C {
+		if handedOver.Load() {
+			return
+		}
+		if err := check(interval / 4); err != nil {
+			warnf("not pinging the systemd watchdog: %v", err)
+			continue
+		}
+		sdNotify("WATCHDOG=1")
+	}
+}
+
+// watchdogCheck is what keeps the pings coming: the main listener is
+// accepting and the session table isn't stuck behind a lock, which every
+// new connection needs.
+func watchdogCheck(timeout time.Duration) error {
+	if !listenerBound.Load() {
+		return fmt.Errorf("the proxy listener isn't bound")
+	}
+	done := make(chan struct{})
+	go func() {
+		activeSessions()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("the session table didn't respond within %s", timeout)
+	}
+}
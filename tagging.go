@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Tags label sessions for later filtering. They come from tagging rules
+// when a session opens, from features like signatures and the canary, and
+// from operators through the API. They follow the session into events and
+// history.
+
+var tagPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9:._-]{0,63}$`)
+
+func validTag(t string) error {
+	if !tagPattern.MatchString(t) {
+		return fmt.Errorf("tag %q must be lowercase letters, digits, ':', '.', '_' or '-', up to 64 long", t)
+	}
+	return nil
+}
+
+type tagRule struct {
+	tag       string
+	nets      []*net.IPNet
+	countries []string
+	backends  []string
+}
+
+var (
+	tagRulesMu sync.Mutex
+	tagRules   []tagRule
+)
+
+func setTagRules(list []TagRuleConfig) error {
+	rules := make([]tagRule, 0, len(list))
+	for _, c := range list {
+		if err := validTag(c.Tag); err != nil {
+			return err
+		}
+		r := tagRule{tag: c.Tag, backends: c.Backends}
+		for _, s := range c.IPs {
+			n, err := parseIPOrCIDR(s)
+			if err != nil {
+				return fmt.Errorf("tag %s: %v", c.Tag, err)
+			}
+			r.nets = append(r.nets, n)
+		}
+		for _, cc := range c.Countries {
+			r.countries = append(r.countries, strings.ToUpper(cc))
+		}
+		rules = append(rules, r)
+	}
+	tagRulesMu.Lock()
+	tagRules = rules
+	tagRulesMu.Unlock()
+	return nil
+}
+
+// matches is true when every condition the rule sets holds; within one
+// condition any entry will do.
+func (r tagRule) matches(ip net.IP, country, backend string) bool {
+	if len(r.nets) > 0 {
+		hit := false
+		for _, n := range r.nets {
+			if n.Contains(ip) {
+				hit = true
+				break
+			}
+		}
+		if !hit {
+			return false
+		}
+	}
+	if len(r.countries) > 0 && !containsString(r.countries, country) {
+		return false
+	}
+	if len(r.backends) > 0 && !containsString(r.backends, backend) {
+		return false
+	}
+	return true
+}
+
+func ruleTags(ip, country, backend string) []string {
+	parsed := net.ParseIP(ip)
+	tagRulesMu.Lock()
+	defer tagRulesMu.Unlock()
+	var out []string
+	for _, r := range tagRules {
+		if r.matches(parsed, country, backend) {
+			out = append(out, r.tag)
+		}
+	}
+	return out
+}
+
+// tagNewSession applies the tagging rules and the built-in tags once the
+// session's country and backend are known, before it's dialed.
+func tagNewSession(s *session, backend string) {
+	for _, t := range ruleTags(s.ip, s.geo.Country, backend) {
+		s.addTag(t)
+	}
+	if conf().Canary.Backend != "" && backend == conf().Canary.Backend {
+		s.addTag("canary")
+	}
+	if s.chaos {
+		s.addTag("chaos")
+	}
+}
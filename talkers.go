@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type talker struct {
+	ip       string
+	sessions int
+	bytes    int64
+}
+
+var (
+	talkersMu    sync.Mutex
+	talkers      = map[string]*talker{}
+	talkersSince = time.Now()
+)
+
+func recordTalker(ip string, bytes int64) {
+	talkersMu.Lock()
+	t, ok := talkers[ip]
+	if !ok {
+		t = &talker{ip: ip}
+		talkers[ip] = t
+	}
+	t.sessions++
+	t.bytes += bytes
+	talkersMu.Unlock()
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func topTalkers(list []*talker, n int, less func(a, b *talker) bool) string {
+	sorted := append([]*talker(nil), list...)
+	sort.Slice(sorted, func(i, j int) bool { return less(sorted[i], sorted[j]) })
+	if len(sorted) > n {
+		sorted = sorted[:n]
+	}
+	var b strings.Builder
+	for i, t := range sorted {
+		fmt.Fprintf(&b, "%d. %s - %d sessions, %s\n", i+1, anonIP(t.ip), t.sessions, formatBytes(t.bytes))
+	}
+	if b.Len() == 0 {
+		return "none\n"
+	}
+	return b.String()
+}
+
+func reportTopTalkers(c TopTalkersConfig) {
+	talkersMu.Lock()
+	list := make([]*talker, 0, len(talkers))
+	for _, t := range talkers {
+		list = append(list, t)
+	}
+	since := talkersSince
+	talkers = map[string]*talker{}
+	talkersSince = time.Now()
+	talkersMu.Unlock()
+
+	bySessions := topTalkers(list, c.Top, func(a, b *talker) bool {
+		if a.sessions != b.sessions {
+			return a.sessions > b.sessions
+		}
+		return a.bytes > b.bytes
+	})
+	byBytes := topTalkers(list, c.Top, func(a, b *talker) bool { return a.bytes > b.bytes })
+	period := time.Since(since).Round(time.Second)
+	infof("top talkers over the last %s (%d unique IPs)\nby sessions:\n%sby bytes:\n%s", period, len(list), bySessions, byBytes)
+	if !c.Webhook {
+		return
+	}
+	if err := sendDiscordEmbed("Top Talkers", fmt.Sprintf("Top %d source IPs over the last %s (%d unique IPs)", c.Top, period, len(list)), 0x3498DB,
+		&DiscordEmbedField{Name: "By sessions", Value: bySessions},
+		&DiscordEmbedField{Name: "By bytes", Value: byBytes},
+	); err != nil {
+		warnf("Failed to send Discord embed: %v", err)
+	}
+}
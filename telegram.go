@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// telegramMaxText is Telegram's limit on a message's text, in characters.
+const telegramMaxText = 4096
+
+var telegramEscaper = strings.NewReplacer(
+	`\`, `\\`, "_", `\_`, "*", `\*`, "[", `\[`, "]", `\]`, "(", `\(`, ")", `\)`,
+	"~", `\~`, "`", "\\`", ">", `\>`, "#", `\#`, "+", `\+`, "-", `\-`, "=", `\=`,
+	"|", `\|`, "{", `\{`, "}", `\}`, ".", `\.`, "!", `\!`,
+)
+
+// telegramMarker stands in for the embed's colour bar.
+func telegramMarker(color int) string {
+	switch color {
+	case 0xFF0000:
+		return "🔴"
+	case 0xFFA500:
+		return "🟠"
+	case 0x008000:
+		return "🟢"
+	case 0x3498DB:
+		return "🔵"
+	}
+	return "⚪"
+}
+
+func clip(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	r := []rune(s)
+	return string(r[:n-1]) + "…"
+}
+
+// telegramText renders an embed as MarkdownV2. Everything user-supplied is
+// clipped before escaping so the message stays under Telegram's limit and
+// never ends in half an escape sequence.
+func telegramText(e DiscordEmbed, withFields bool) string {
+	var b strings.Builder
+	b.WriteString(telegramMarker(e.Color) + " *" + telegramEscaper.Replace(clip(e.Title, 200)) + "*\n")
+	if e.Description != "" {
+		b.WriteString(telegramEscaper.Replace(clip(e.Description, 1000)) + "\n")
+	}
+	for _, f := range e.Fields {
+		if !withFields {
+			break
+		}
+		b.WriteString("*" + telegramEscaper.Replace(clip(f.Name, 50)) + ":* " + telegramEscaper.Replace(clip(f.Value, 100)) + "\n")
+	}
+	if e.Timestamp != "" {
+		b.WriteString("_" + telegramEscaper.Replace(e.Timestamp) + "_")
+	}
+	return b.String()
+}
+
+func postTelegram(url string, embeds []DiscordEmbed) (time.Duration, error) {
+	render := func(withFields bool) string {
+		texts := make([]string, len(embeds))
+		for i, e := range embeds {
+			texts[i] = telegramText(e, withFields)
+		}
+		return strings.Join(texts, "\n\n")
+	}
+	text := render(true)
+	if utf8.RuneCountInString(text) > telegramMaxText {
+		// too many fields to fit; drop them rather than the alert
+		text = render(false)
+	}
+	body, err := json.Marshal(map[string]any{
+		"chat_id":                  conf().Notify.Telegram.ChatID,
+		"text":                     text,
+		"parse_mode":               "MarkdownV2",
+		"disable_web_page_preview": true,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return postJSON(url, body, nil)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// alertVars are the event details an alert was raised with (ip, backend,
+// bytes, ...), exposed to notify.templates alongside the default text.
+type alertVars map[string]any
+
+var (
+	alertTemplatesMu sync.Mutex
+	alertTemplates   = map[string]*template.Template{}
+)
+
+func parseAlertTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(webhookFuncs).Parse(text)
+}
+
+// alertTemplate returns the parsed template for one part of an alert,
+// caching it; the text has already been checked by loadAlertTemplates.
+func alertTemplate(name, text string) *template.Template {
+	alertTemplatesMu.Lock()
+	defer alertTemplatesMu.Unlock()
+	if t, ok := alertTemplates[name]; ok {
+		return t
+	}
+	t, err := parseAlertTemplate(name, text)
+	if err != nil {
+		return nil
+	}
+	alertTemplates[name] = t
+	return t
+}
+
+// resetAlertTemplates drops the cached templates, so a reloaded
+// notify.templates is parsed afresh on the next alert.
+func resetAlertTemplates() {
+	alertTemplatesMu.Lock()
+	alertTemplates = map[string]*template.Template{}
+	alertTemplatesMu.Unlock()
+}
+
+func renderAlertPart(name, text string, data map[string]any, fallback string) string {
+	if text == "" {
+		return fallback
+	}
+	t := alertTemplate(name, text)
+	if t == nil {
+		return fallback
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		warnf("failed to render notify template %s: %v", name, err)
+		return fallback
+	}
+	// not every alert has every variable; a missing one renders as nothing
+	return strings.ReplaceAll(b.String(), "<no value>", "")
+}
+
+// applyAlertTemplate rewrites an embed with the operator's template for its
+// type, if there is one. Anything a template doesn't set keeps the built-in
+// wording, and a template that fails to render falls back to it too.
+func applyAlertTemplate(kind string, vars alertVars, embed DiscordEmbed) DiscordEmbed {
+	tmpl, ok := conf().Notify.Templates[kind]
+	if !ok {
+		return embed
+	}
+	fields := map[string]string{}
+	for _, f := range embed.Fields {
+		fields[f.Name] = f.Value
+	}
+	data := map[string]any{
+		"Kind":        kind,
+		"Category":    embedCategory(kind),
+		"Severity":    embedSeverity(kind),
+		"Title":       embed.Title,
+		"Description": embed.Description,
+		"Fields":      fields,
+	}
+	for k, v := range vars {
+		data[k] = v
+	}
+	embed.Title = renderAlertPart(kind+".title", tmpl.Title, data, embed.Title)
+	embed.Description = renderAlertPart(kind+".description", tmpl.Description, data, embed.Description)
+	if len(tmpl.Fields) > 0 {
+		embed.Fields = nil
+		for i, f := range tmpl.Fields {
+			value := renderAlertPart(fmt.Sprintf("%s.fields.%d", kind, i), f.Value, data, "")
+			if value == "" {
+				// Discord rejects empty field values
+				continue
+			}
+			embed.Fields = append(embed.Fields, DiscordEmbedField{Name: f.Name, Value: value, Inline: f.Inline})
+		}
+	}
+	return embed
+}
+
+func loadAlertTemplates(templates map[string]AlertTemplate) error {
+	for kind, t := range templates {
+		if embedCategory(kind) == "" {
+			return fmt.Errorf("notify.templates: unknown embed type %q", kind)
+		}
+		parts := map[string]string{"title": t.Title, "description": t.Description}
+		for i, f := range t.Fields {
+			parts[fmt.Sprintf("fields.%d", i)] = f.Value
+		}
+		for part, text := range parts {
+			if _, err := parseAlertTemplate(kind+"."+part, text); err != nil {
+				return fmt.Errorf("notify.templates.%s: %v", kind, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"sync/atomic"
+)
+
+// A tenant is a customer sharing the box: its own listener and backend,
+// source ACL, connection quota, alert webhook and metrics, and API users
+// that only see its sessions. The listener from the command line belongs
+// to no tenant and is the operator's own.
+
+type tenant struct {
+	TenantConfig
+	allow, deny []*net.IPNet
+	active      atomic.Int64
+}
+
+// tenants is filled in at startup and not changed after, so it's read
+// without a lock.
+var tenants = map[string]*tenant{}
+
+var (
+	tenantAccepted = newCounter("sshproxy_tenant_connections_accepted_total", "Client connections accepted per tenant.", "tenant")
+	tenantRejected = newCounter("sshproxy_tenant_connections_rejected_total", "Client connections refused per tenant.", "tenant", "reason")
+	tenantActive   = newGauge("sshproxy_tenant_active_sessions", "Sessions currently open per tenant.", "tenant")
+	tenantBytes    = newCounter("sshproxy_tenant_bytes_total", "Bytes forwarded per tenant.", "tenant", "direction")
+)
+
+func init() {
+	onCollect(func() {
+		for name, t := range tenants {
+			tenantActive.set(float64(t.active.Load()), name)
+		}
+	})
+	adminMux.HandleFunc("GET /api/v1/tenants", tenantAPI(apiTenants))
+}
+
+func setupTenants(list []TenantConfig) error {
+	for _, c := range list {
+		t := &tenant{TenantConfig: c}
+		for _, s := range c.Allow {
+			n, err := parseIPOrCIDR(s)
+			if err != nil {
+				return err
+			}
+			t.allow = append(t.allow, n)
+		}
+		for _, s := range c.Deny {
+			n, err := parseIPOrCIDR(s)
+			if err != nil {
+				return err
+			}
+			t.deny = append(t.deny, n)
+		}
+		tenants[c.Name] = t
+	}
+	return nil
+}
+
+func startTenants() {
+	for _, t := range tenants {
+		infof("tenant %s: listening on %s, forwarding to %s\n", t.Name, t.Listen, t.Backend)
+		if acceptors := bindProxy(t.Listen, t.Backend); acceptors != nil {
+			go serveProxy(acceptors, t.Listen, t.Backend, t)
+		}
+	}
+}
+
+// permits applies the tenant's ACL: deny wins, and with an allow list only
+// sources on it get in.
+func (t *tenant) permits(ip string) bool {
+	parsed := net.ParseIP(ip)
+	for _, n := range t.deny {
+		if n.Contains(parsed) {
+			return false
+		}
+	}
+	if len(t.allow) == 0 {
+		return true
+	}
+	for _, n := range t.allow {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// acquire takes a slot from the tenant's connection quota.
+func (t *tenant) acquire() bool {
+	if n := t.active.Add(1); t.MaxConnections > 0 && n > int64(t.MaxConnections) {
+		t.active.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (t *tenant) release() {
+	t.active.Add(-1)
+}
+
+// name is "" for sessions on the main listener.
+func (t *tenant) name() string {
+	if t == nil {
+		return ""
+	}
+	return t.Name
+}
+
+// tenantWebhook is the tenant's own Discord webhook for an alert about one
+// of its sessions, if it has one.
+func tenantWebhook(vars alertVars) string {
+	name, _ := vars["tenant"].(string)
+	if t := tenants[name]; t != nil {
+		return t.Webhook
+	}
+	return ""
+}
+
+type tenantInfo struct {
+	Name           string  `json:"name"`
+	Listen         string  `json:"listen"`
+	Backend        string  `json:"backend"`
+	ActiveSessions int64   `json:"active_sessions"`
+	MaxConnections int     `json:"max_connections"`
+	Accepted       float64 `json:"connections_accepted"`
+	BytesIn        float64 `json:"bytes_in"`
+	BytesOut       float64 `json:"bytes_out"`
+}
+
+func apiTenants(w http.ResponseWriter, r *http.Request) {
+	scope, scoped := requestTenant(r)
+	out := []tenantInfo{}
+	for name, t := range tenants {
+		if scoped && name != scope {
+			continue
+		}
+		out = append(out, tenantInfo{
+			Name:           name,
+			Listen:         t.Listen,
+			Backend:        t.Backend,
+			ActiveSessions: t.active.Load(),
+			MaxConnections: t.MaxConnections,
+			Accepted:       tenantAccepted.value(name),
+			BytesIn:        tenantBytes.value(name, "client->backend"),
+			BytesOut:       tenantBytes.value(name, "backend->client"),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	writeJSON(w, http.StatusOK, out)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// dialBackend dials a real backend over TCP with the socket options in o,
+// or serves one of the built-in pseudo-backends in-process for smoke
+// testing without an upstream:
+//
+//	echo://                sends every byte straight back
+//	echo://?delay=50ms     same, after a fixed delay per read
+//	discard://             swallows everything and never answers
+func dialBackend(addr string, timeout time.Duration, o TCPSocketConfig) (net.Conn, error) {
+	if !strings.Contains(addr, "://") {
+		return o.dial(addr, timeout)
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	var delay time.Duration
+	if d := u.Query().Get("delay"); d != "" {
+		if delay, err = time.ParseDuration(d); err != nil {
+			return nil, fmt.Errorf("bad delay in %s: %v", addr, err)
+		}
+	}
+	switch u.Scheme {
+	case "echo":
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			buf := make([]byte, 32*1024)
+			for {
+				n, err := server.Read(buf)
+				if n > 0 {
+					time.Sleep(delay)
+					if _, err := server.Write(buf[:n]); err != nil {
+						return
+					}
+				}
+				if err != nil {
+					return
+				}
+			}
+		}()
+		return client, nil
+	case "discard":
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			io.Copy(io.Discard, server)
+		}()
+		return client, nil
+	}
+	return nil, fmt.Errorf("unknown backend scheme %q (want echo:// or discard://)", u.Scheme)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// notifyThrottle is a token bucket over everything the notifier sends, after
+// digests have had their go. Whatever doesn't fit is counted and reported in
+// one "Notifications Suppressed" embed a minute later, so a scan or an
+// error storm can't turn into thousands of webhook posts.
+var notifyThrottle struct {
+	mu         sync.Mutex
+	tokens     float64
+	last       time.Time
+	suppressed map[string]int
+}
+
+const suppressedRollupDelay = time.Minute
+
+// throttleAllow takes a token for an embed of the given type, or records it
+// as suppressed.
+func throttleAllow(kind string) bool {
+	c := conf().Notify.RateLimit
+	if c.PerMinute <= 0 {
+		return true
+	}
+	burst := float64(c.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	t := &notifyThrottle
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if t.last.IsZero() {
+		t.tokens = burst
+	} else {
+		t.tokens = min(burst, t.tokens+now.Sub(t.last).Minutes()*c.PerMinute)
+	}
+	t.last = now
+	if t.tokens >= 1 {
+		t.tokens--
+		return true
+	}
+	if t.suppressed == nil {
+		t.suppressed = map[string]int{}
+		time.AfterFunc(suppressedRollupDelay, sendSuppressedRollup)
+	}
+	t.suppressed[kind]++
+	notifySuppressed.inc(kind)
+	return false
+}
+
+func sendSuppressedRollup() {
+	t := &notifyThrottle
+	t.mu.Lock()
+	counts := t.suppressed
+	t.suppressed = nil
+	t.mu.Unlock()
+	total := 0
+	kinds := make([]string, 0, len(counts))
+	for kind, n := range counts {
+		total += n
+		kinds = append(kinds, kind)
+	}
+	if total == 0 {
+		return
+	}
+	sort.Slice(kinds, func(i, j int) bool { return counts[kinds[i]] > counts[kinds[j]] })
+	var b strings.Builder
+	for _, kind := range kinds {
+		fmt.Fprintf(&b, "%s: %d\n", kind, counts[kind])
+	}
+	warnf("notification rate limit suppressed %d embeds\n", total)
+	embed := DiscordEmbed{
+		Title:       "Notifications Suppressed",
+		Description: fmt.Sprintf("%d notifications were suppressed by the rate limit in the last %s", total, suppressedRollupDelay),
+		Color:       0xFFA500,
+		Timestamp:   time.Now().Format(time.RFC3339),
+		Fields:      []DiscordEmbedField{{Name: "By type", Value: b.String()}},
+	}
+	// the rollup itself is never throttled, or it could be suppressed too
+	if err := dispatchEmbed("notifications_suppressed", embed); err != nil {
+		warnf("Failed to send Discord embed: %v", err)
+	}
+}
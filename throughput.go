@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	throughputSampleInterval = 5 * time.Second
+	// half an hour of samples for the dashboard graphs
+	throughputHistoryKept = 360
+)
+
+type throughputSample struct {
+	Time     time.Time `json:"time"`
+	In       float64   `json:"bytes_in_per_second"`
+	Out      float64   `json:"bytes_out_per_second"`
+	Sessions int       `json:"active_sessions"`
+}
+
+var (
+	throughputHistoryMu sync.Mutex
+	throughputHistory   []throughputSample
+)
+
+type countingReader struct {
+	r         io.Reader
+	sess      *session
+	direction string
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if n > 0 {
+		if err := c.sess.sigs.scan(c.sess, c.direction, p[:n]); err != nil {
+			return 0, err
+		}
+		c.sess.addBytes(c.direction, n)
+		c.sess.capture.write(c.direction, p[:n])
+		c.sess.hexdump.write(c.direction, p[:n])
+		if c.direction == "client->backend" {
+			c.sess.mirror.write(p[:n])
+		}
+		if logEnabled(levelDebug) {
+			debugf("[%s] %s read %d bytes (%s)", c.sess.id, anonIP(c.sess.ip), n, c.direction)
+		}
+	}
+	return n, err
+}
+
+// sampleThroughput turns the live byte counters into bytes/sec gauges by
+// diffing them every sample interval.
+func sampleThroughput() {
+	last := map[string]float64{}
+	for range time.Tick(throughputSampleInterval) {
+		secs := throughputSampleInterval.Seconds()
+		totals := map[string]float64{}
+		throughputRoute.reset()
+		for _, s := range routeBytes.snapshot() {
+			key := strings.Join(s.labelValues, "\xff")
+			delta := s.value - last[key]
+			last[key] = s.value
+			route, direction := s.labelValues[0], s.labelValues[1]
+			throughputRoute.set(delta/secs, route, direction)
+			totals[direction] += delta
+		}
+		for _, direction := range []string{"client->backend", "backend->client"} {
+			throughput.set(totals[direction]/secs, direction)
+		}
+		throughputHistoryMu.Lock()
+		throughputHistory = append(throughputHistory, throughputSample{
+			Time:     time.Now().UTC(),
+			In:       totals["client->backend"] / secs,
+			Out:      totals["backend->client"] / secs,
+			Sessions: len(activeSessions()),
+		})
+		if len(throughputHistory) > throughputHistoryKept {
+			throughputHistory = throughputHistory[len(throughputHistory)-throughputHistoryKept:]
+		}
+		throughputHistoryMu.Unlock()
+	}
+}
+
+func throughputSamples() []throughputSample {
+	throughputHistoryMu.Lock()
+	defer throughputHistoryMu.Unlock()
+	return append([]throughputSample{}, throughputHistory...)
+}
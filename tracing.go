@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+type span struct {
+	traceID [16]byte
+	spanID  [8]byte
+	parent  [8]byte
+	name    string
+	kind    int
+	start   time.Time
+
+	mu    sync.Mutex
+	attrs map[string]string
+	err   error
+}
+
+var tracingEnabled bool
+
+func startSpan(name string, kind int, parent *span) *span {
+	if !tracingEnabled {
+		return nil
+	}
+	s := &span{name: name, kind: kind, start: time.Now(), attrs: map[string]string{}}
+	if parent != nil {
+		s.traceID = parent.traceID
+		s.parent = parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return s
+}
+
+func (s *span) setAttr(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs[key] = value
+	s.mu.Unlock()
+}
+
+func (s *span) setError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+}
+
+func (s *span) end() {
+	if s == nil {
+		return
+	}
+	end := time.Now()
+	s.mu.Lock()
+	rec := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+		Attributes:        otlpAttributes(s.attrs),
+		Status:            otlpStatus{Code: 1},
+	}
+	if s.parent != [8]byte{} {
+		rec.ParentSpanID = hex.EncodeToString(s.parent[:])
+	}
+	if s.err != nil {
+		rec.Status = otlpStatus{Code: 2, Message: s.err.Error()}
+	}
+	s.mu.Unlock()
+	select {
+	case spanExport <- rec:
+	default:
+	}
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+var spanExport = make(chan otlpSpan, 1024)
+
+func otlpAttributes(m map[string]string) []otlpKeyValue {
+	out := make([]otlpKeyValue, 0, len(m))
+	for k, v := range m {
+		out = append(out, otlpKeyValue{Key: k, Value: otlpAnyValue{StringValue: v}})
+	}
+	return out
+}
+
+// otlpPost sends an OTLP/HTTP request with the JSON encoding, which every
+// collector accepts on :4318 and needs nothing outside the standard library.
+func otlpPost(endpoint, path string, headers map[string]string, body any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", strings.TrimSuffix(endpoint, "/")+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	return nil
+}
+
+func startTracing(c TracingConfig) {
+	tracingEnabled = true
+	resource := otlpResource{Attributes: otlpAttributes(map[string]string{"service.name": c.ServiceName})}
+	flush := func(batch []otlpSpan) {
+		body := map[string]any{
+			"resourceSpans": []any{map[string]any{
+				"resource": resource,
+				"scopeSpans": []any{map[string]any{
+					"scope": otlpScope{Name: "sshproxy"},
+					"spans": batch,
+				}},
+			}},
+		}
+		if err := otlpPost(c.Endpoint, "/v1/traces", c.Headers, body); err != nil {
+			warnf("failed to export %d spans: %v\n", len(batch), err)
+		}
+	}
+	infof("exporting traces to %s\n", c.Endpoint)
+	go func() {
+		var batch []otlpSpan
+		ticker := time.NewTicker(5 * time.Second)
+		for {
+			select {
+			case s := <-spanExport:
+				batch = append(batch, s)
+				if len(batch) < 512 {
+					continue
+				}
+			case <-ticker.C:
+				if len(batch) == 0 {
+					continue
+				}
+			}
+			flush(batch)
+			batch = nil
+		}
+	}()
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// A binary upgrade starts the proxy's executable again with every
+// listening socket passed down to it, tableflip-style. The sockets stay
+// open throughout, so no connection is refused during the switch. Once the
+// new process says it's up, the old one stops accepting and keeps serving
+// the sessions it has until they end (or upgrade.drain_timeout), then
+// exits.
+
+const (
+	upgradeListenersEnv = "SSHPROXY_UPGRADE_LISTENERS"
+	upgradeReadyEnv     = "SSHPROXY_UPGRADE_READY"
+)
+
+var (
+	listenersMu sync.Mutex
+	// listeners is everything opened through listen, by network:address;
+	// inherited is what the previous process handed down and listen
+	// hasn't claimed yet.
+	listeners = map[string]net.Listener{}
+	inherited = map[string]net.Listener{}
+
+	upgradeReady *os.File
+	upgrading    atomic.Bool
+	handedOver   atomic.Bool
+)
+
+func init() {
+	adminMux.HandleFunc("POST /api/v1/upgrade", apiAuth(apiUpgrade))
+}
+
+// inheritListeners picks up the sockets from the process that started us
+// for an upgrade. They're at fd 3 onwards in the order the variable
+// lists them, followed by the pipe to report readiness on.
+func inheritListeners() {
+	list := os.Getenv(upgradeListenersEnv)
+	ready := os.Getenv(upgradeReadyEnv)
+	os.Unsetenv(upgradeListenersEnv)
+	os.Unsetenv(upgradeReadyEnv)
+	if list == "" {
+		return
+	}
+	for i, key := range strings.Split(list, ",") {
+		f := os.NewFile(uintptr(3+i), key)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			warnf("failed to take over %s from the previous process: %v", key, err)
+			continue
+		}
+		inherited[key] = l
+	}
+	if fd, err := strconv.Atoi(ready); err == nil {
+		upgradeReady = os.NewFile(uintptr(fd), "upgrade-ready")
+	}
+	inheritSessions()
+	infof("took over %d listeners from the previous process\n", len(inherited))
+}
+
+// inheritsListener reports whether the previous process or systemd
+// handed us a socket for this address.
+func inheritsListener(network, addr string) bool {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	if inherited[network+":"+addr] != nil {
+		return true
+	}
+	for _, l := range activated {
+		if l.Addr().Network() == network && sameListenAddr(addr, l.Addr().String()) {
+			return true
+		}
+	}
+	return false
+}
+
+// listen opens a listener, or takes over the one the previous process
+// had for the same address, and keeps it for the next upgrade.
+func listen(network, addr string) (net.Listener, error) {
+	return listenAs(network+":"+addr, func() (net.Listener, error) { return net.Listen(network, addr) })
+}
+
+// listenAs is listen for sockets that need opening some other way; key
+// has to name the same socket from one process to the next.
+func listenAs(key string, open func() (net.Listener, error)) (net.Listener, error) {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	l := inherited[key]
+	delete(inherited, key)
+	if l == nil {
+		network, addr, _ := strings.Cut(key, ":")
+		addr, _, _ = strings.Cut(addr, "#")
+		l = takeActivated(network, addr)
+	}
+	if l == nil {
+		var err error
+		if l, err = open(); err != nil {
+			return nil, err
+		}
+	}
+	listeners[key] = l
+	return l, nil
+}
+
+// unlisten closes a listener and forgets it.
+func unlisten(key string) {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	if l := listeners[key]; l != nil {
+		l.Close()
+		delete(listeners, key)
+	}
+}
+
+// listenersReady is called once the main listener is up. It tells the
+// process that started us for an upgrade, so it can stop accepting, and
+// closes handed-down sockets nothing claimed, e.g. for an address dropped
+// from the config.
+func listenersReady() {
+	listenersMu.Lock()
+	for key, l := range inherited {
+		infof("closing %s, which the new config doesn't use\n", key)
+		l.Close()
+	}
+	inherited = map[string]net.Listener{}
+	for _, l := range activated {
+		warnf("closing the socket systemd passed for %s, which matches no configured address", l.Addr())
+		l.Close()
+	}
+	activated = nil
+	listenersMu.Unlock()
+	upgraded := upgradeReady != nil
+	if upgraded {
+		upgradeReady.Write([]byte("ready\n"))
+		upgradeReady.Close()
+		upgradeReady = nil
+		go adoptSessions()
+	}
+	notifyReady(upgraded)
+}
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+// upgradeBinary starts the new process and waits for it to come up. On
+// success this process stops accepting and the caller's accept loops end.
+func upgradeBinary(by string) (int, error) {
+	if runtime.GOOS == "windows" {
+		return 0, errors.New("upgrades by socket handover aren't supported on Windows")
+	}
+	if workerIndex > 0 {
+		return 0, errors.New("upgrades aren't supported with workers, restart the supervisor instead")
+	}
+	if !upgrading.CompareAndSwap(false, true) {
+		return 0, errors.New("an upgrade is already in progress")
+	}
+	pid, err := startUpgrade(by)
+	if err != nil {
+		upgrading.Store(false)
+		return 0, err
+	}
+	return pid, nil
+}
+
+func startUpgrade(by string) (int, error) {
+	// the new process loads state and continues the audit chain, so both
+	// have to be up to date on disk before it starts
+	if conf().State.File != "" {
+		saveState(conf().State.File)
+	}
+	if audit != nil {
+		audit.pause(fmt.Sprintf("upgrade by %s, handing over", by))
+	}
+	infof("upgrade by %s: starting the new binary\n", by)
+	var move *sessionMove
+	cmd, _, err := spawnWithListeners(func(cmd *exec.Cmd) {
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		// the new process takes over the systemd watchdog along with MAINPID
+		cmd.Env = append(cmd.Env, "WATCHDOG_PID=")
+		if conf().Upgrade.MoveSessions {
+			move = prepareSessionMove(cmd)
+		}
+	})
+	move.closeFiles()
+	if err != nil {
+		move.abort()
+		resumeAudit()
+		errorf("upgrade failed, carrying on: %v\n", err)
+		return 0, err
+	}
+
+	pid := cmd.Process.Pid
+	handedOver.Store(true)
+	closeListeners()
+	moved := move.commit()
+	n := len(activeSessions()) - moved
+	sdNotify(fmt.Sprintf("STATUS=pid %d took over, finishing %d sessions", pid, n))
+	infof("upgrade by %s: pid %d took over with %d sessions, finishing %d open sessions here\n", by, pid, moved, n)
+	desc := fmt.Sprintf("Pid %d took over the listeners (upgrade by %s); %d sessions stay on the old process until they end", pid, by, n)
+	if conf().Upgrade.MoveSessions {
+		desc = fmt.Sprintf("Pid %d took over the listeners and %d sessions (upgrade by %s); %d sessions stay on the old process until they end", pid, moved, by, n)
+	}
+	if err := sendAlert(alertVars{"pid": pid, "by": by, "sessions": n, "moved": moved}, "Proxy Upgraded", desc, 0x3498DB); err != nil {
+		warnf("Failed to send Discord embed: %v", err)
+	}
+	return pid, nil
+}
+
+// spawnWithListeners starts the executable again with the same arguments
+// and every listener passed down, and waits up to upgrade.ready_timeout
+// for it to say it's up. setup adjusts the command before it starts. If
+// the new process doesn't make it, it's killed. exited gets the result of
+// waiting for it.
+func spawnWithListeners(setup func(*exec.Cmd)) (cmd *exec.Cmd, exited <-chan error, err error) {
+	return spawnWith(nil, setup)
+}
+
+// spawnWith is spawnWithListeners passing only set, under the keys it
+// maps them by; nil passes every listener.
+func spawnWith(set map[string]net.Listener, setup func(*exec.Cmd)) (cmd *exec.Cmd, exited <-chan error, err error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, nil, err
+	}
+	listenersMu.Lock()
+	if set == nil {
+		set = listeners
+	}
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, key := range keys {
+		f, err := set[key].(filer).File()
+		if err != nil {
+			listenersMu.Unlock()
+			return nil, nil, fmt.Errorf("%s: %v", key, err)
+		}
+		files = append(files, f)
+	}
+	listenersMu.Unlock()
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer readyR.Close()
+	files = append(files, readyW)
+
+	cmd = exec.Command(exe, os.Args[1:]...)
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		upgradeListenersEnv+"="+strings.Join(keys, ","),
+		upgradeReadyEnv+"="+strconv.Itoa(3+len(keys)))
+	setup(cmd)
+	infof("starting %s with %d listeners\n", exe, len(keys))
+	if err := cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+	readyW.Close()
+	files = files[:len(files)-1]
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	ready := make(chan bool, 1)
+	go func() {
+		buf := make([]byte, 6)
+		n, _ := readyR.Read(buf)
+		ready <- string(buf[:n]) == "ready\n"
+	}()
+	fail := func(err error) (*exec.Cmd, <-chan error, error) {
+		cmd.Process.Kill()
+		return nil, nil, err
+	}
+	select {
+	case ok := <-ready:
+		if !ok {
+			return fail(errors.New("the new process exited before it was ready"))
+		}
+	case err := <-done:
+		return fail(fmt.Errorf("the new process exited before it was ready: %v", err))
+	case <-time.After(conf().Upgrade.ReadyTimeout.Duration):
+		return fail(fmt.Errorf("the new process wasn't ready within %s", conf().Upgrade.ReadyTimeout.Duration))
+	}
+	return cmd, done, nil
+}
+
+// closeListeners stops this process accepting once another has taken the
+// sockets over.
+func closeListeners() {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	for _, l := range listeners {
+		if ul, ok := l.(*net.UnixListener); ok {
+			// the socket file belongs to the new process now
+			ul.SetUnlinkOnClose(false)
+		}
+		l.Close()
+	}
+}
+
+func resumeAudit() {
+	if audit == nil {
+		return
+	}
+	if err := audit.resume(); err != nil {
+		errorf("audit log: %v\n", err)
+	}
+}
+
+// finishHandover waits for the sessions left on this process once a new
+// one has taken over, closing them at upgrade.drain_timeout if set.
+func finishHandover() {
+	var deadline <-chan time.Time
+	if d := conf().Upgrade.DrainTimeout.Duration; d > 0 {
+		deadline = time.After(d)
+	}
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for len(activeSessions()) > 0 {
+		select {
+		case <-tick.C:
+		case <-deadline:
+			for _, s := range activeSessions() {
+				s.close("upgrade")
+			}
+			deadline = nil
+		}
+	}
+	infof("all sessions finished, old process exiting\n")
+}
+
+// sigusr2 is SIGUSR2 by number; see sigusr1.
+func sigusr2() (os.Signal, bool) {
+	switch runtime.GOOS {
+	case "windows", "plan9", "js", "wasip1":
+		return nil, false
+	case "linux":
+		if strings.HasPrefix(runtime.GOARCH, "mips") {
+			return syscall.Signal(17), true
+		}
+		return syscall.Signal(12), true
+	case "solaris", "illumos":
+		return syscall.Signal(17), true
+	}
+	return syscall.Signal(31), true
+}
+
+func watchUpgradeSignal() {
+	sig, ok := sigusr2()
+	if !ok {
+		return
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sig)
+	for range ch {
+		upgradeBinary("SIGUSR2")
+	}
+}
+
+func apiUpgrade(w http.ResponseWriter, r *http.Request) {
+	pid, err := upgradeBinary(adminActor(r))
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"pid": pid})
+}
+
+func runUpgrade(configFile string, args []string) {
+	fs := flag.NewFlagSet("upgrade", flag.ExitOnError)
+	ep := controlFlags(fs, configFile)
+	fs.Usage = func() {
+		fmt.Println("usage: ./connectproxy [-config proxy.json] upgrade [-socket path | -admin host:port -token t]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if !ep.configured() {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var res struct {
+		PID int `json:"pid"`
+	}
+	if err := ep.call(http.MethodPost, "/api/v1/upgrade", &res); err != nil {
+		fmt.Fprintf(os.Stderr, "upgrade failed, the old process is still serving: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("upgraded, pid %d is now accepting connections\n", res.PID)
+}
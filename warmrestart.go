@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With upgrade.move_sessions, open sessions go to the new process along
+// with the listeners. Their sockets are passed down when it starts, while
+// this process keeps forwarding. Once it's up, both copy loops of each
+// session are stopped between reads, so every byte read here has been
+// written, and the new process is told which sessions to carry on with
+// and where their counters stand. The rest of the stream is still in the
+// kernel's socket buffers.
+//
+// Sessions being captured, mirrored or under chaos, and backends that
+// aren't plain TCP, stay on this process as before.
+
+const (
+	upgradeSessionsEnv = "SSHPROXY_UPGRADE_SESSIONS"
+
+	// how long a copy loop may take to stop, e.g. while its write waits on
+	// a slow peer; sessions that don't stop in time stay
+	sessionParkTimeout = 5 * time.Second
+)
+
+// movedSession is what the new process needs to carry on with a session.
+// It goes over a pipe between the two processes, so the address is the
+// real one.
+type movedSession struct {
+	Index    int       `json:"index"`
+	ID       string    `json:"id"`
+	Tenant   string    `json:"tenant,omitempty"`
+	IP       string    `json:"ip"`
+	Backend  string    `json:"backend"`
+	Route    string    `json:"route"`
+	Start    time.Time `json:"start"`
+	BytesIn  int64     `json:"bytes_in"`
+	BytesOut int64     `json:"bytes_out"`
+	Tags     []string  `json:"tags,omitempty"`
+}
+
+type sessionHandover struct {
+	parked chan struct{}
+	done   chan struct{}
+	moved  bool
+}
+
+func (s *session) pausedForHandover() *sessionHandover {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.handover
+}
+
+// park is called by a copy loop that stopped for the handover. It waits
+// for the outcome and reports whether the session moved.
+func (h *sessionHandover) park() bool {
+	h.parked <- struct{}{}
+	<-h.done
+	return h.moved
+}
+
+// waitParked waits for both copy loops to stop, until the deadline.
+func (h *sessionHandover) waitParked(deadline time.Time) bool {
+	t := time.NewTimer(time.Until(deadline))
+	defer t.Stop()
+	for range 2 {
+		select {
+		case <-h.parked:
+			continue
+		default:
+		}
+		select {
+		case <-h.parked:
+		case <-t.C:
+			return false
+		}
+	}
+	return true
+}
+
+// movable reports whether the session's sockets can be passed on.
+func (s *session) movable() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, clientTCP := s.client.(*net.TCPConn)
+	_, targetTCP := s.target.(*net.TCPConn)
+	return clientTCP && targetTCP && s.capture == nil && s.mirror == nil && !s.chaos
+}
+
+type sessionCandidate struct {
+	sess           *session
+	client, target *os.File
+}
+
+// sessionMove is one upgrade's attempt at moving sessions.
+type sessionMove struct {
+	list  []sessionCandidate
+	meta  *os.File
+	files []*os.File
+}
+
+// prepareSessionMove adds the sockets of every movable session to the new
+// process's files. The sessions carry on here until commit.
+func prepareSessionMove(cmd *exec.Cmd) *sessionMove {
+	r, w, err := os.Pipe()
+	if err != nil {
+		warnf("not moving sessions: %v", err)
+		return nil
+	}
+	m := &sessionMove{meta: w, files: []*os.File{r}}
+	base := 3 + len(cmd.ExtraFiles)
+	cmd.ExtraFiles = append(cmd.ExtraFiles, r)
+	for _, s := range activeSessions() {
+		if !s.movable() {
+			continue
+		}
+		cf, err := s.client.(*net.TCPConn).File()
+		if err != nil {
+			continue
+		}
+		tf, err := s.target.(*net.TCPConn).File()
+		if err != nil {
+			cf.Close()
+			continue
+		}
+		m.list = append(m.list, sessionCandidate{s, cf, tf})
+		m.files = append(m.files, cf, tf)
+		cmd.ExtraFiles = append(cmd.ExtraFiles, cf, tf)
+	}
+	cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d,%d", upgradeSessionsEnv, base, len(m.list)))
+	return m
+}
+
+// closeFiles drops this process's copies of what was passed down.
+func (m *sessionMove) closeFiles() {
+	if m == nil {
+		return
+	}
+	for _, f := range m.files {
+		f.Close()
+	}
+}
+
+// abort is for when the new process didn't come up; nothing was paused.
+func (m *sessionMove) abort() {
+	if m != nil {
+		m.meta.Close()
+	}
+}
+
+// commit stops the candidates' copy loops, tells the new process about
+// the ones that stopped cleanly and lets the others carry on here. It
+// returns how many moved.
+func (m *sessionMove) commit() int {
+	if m == nil {
+		return 0
+	}
+	defer m.meta.Close()
+	handovers := make([]*sessionHandover, len(m.list))
+	now := time.Now()
+	for i, c := range m.list {
+		h := &sessionHandover{parked: make(chan struct{}, 2), done: make(chan struct{})}
+		handovers[i] = h
+		c.sess.mu.Lock()
+		c.sess.handover = h
+		c.sess.mu.Unlock()
+		c.sess.client.SetReadDeadline(now)
+		c.sess.target.SetReadDeadline(now)
+	}
+	deadline := now.Add(sessionParkTimeout)
+	moved := []movedSession{}
+	for i, c := range m.list {
+		s, h := c.sess, handovers[i]
+		if !h.waitParked(deadline) {
+			// ended meanwhile or stuck writing; carry on here. The deadlines
+			// go first, so a read that still trips one finds the handover
+			// and parks until done rather than failing the session.
+			s.client.SetReadDeadline(time.Time{})
+			s.target.SetReadDeadline(time.Time{})
+			s.mu.Lock()
+			s.handover = nil
+			s.mu.Unlock()
+			close(h.done)
+			continue
+		}
+		s.mu.Lock()
+		moved = append(moved, movedSession{
+			Index: i, ID: s.id, Tenant: s.tenant, IP: s.ip, Backend: s.backend, Route: s.route,
+			Start: s.start, BytesIn: s.bytesIn.Load(), BytesOut: s.bytesOut.Load(),
+			Tags: append([]string(nil), s.tags...),
+		})
+		s.mu.Unlock()
+	}
+	if err := json.NewEncoder(m.meta).Encode(moved); err != nil {
+		// the new process won't touch them, so they carry on here
+		errorf("failed to hand sessions to the new process: %v\n", err)
+		moved = nil
+	}
+	isMoved := make(map[int]bool, len(moved))
+	for _, ms := range moved {
+		isMoved[ms.Index] = true
+	}
+	for i, c := range m.list {
+		h := handovers[i]
+		select {
+		case <-h.done:
+			continue
+		default:
+		}
+		if isMoved[i] {
+			c.sess.moved.Store(true)
+			h.moved = true
+		} else {
+			c.sess.client.SetReadDeadline(time.Time{})
+			c.sess.target.SetReadDeadline(time.Time{})
+			c.sess.mu.Lock()
+			c.sess.handover = nil
+			c.sess.mu.Unlock()
+		}
+		close(h.done)
+	}
+	return len(moved)
+}
+
+// movedIn is the pipe the previous process describes moved sessions on,
+// and the sockets that may belong to them.
+var movedIn struct {
+	meta       *os.File
+	first, fds int
+}
+
+func inheritSessions() {
+	v := os.Getenv(upgradeSessionsEnv)
+	os.Unsetenv(upgradeSessionsEnv)
+	fd, n, ok := strings.Cut(v, ",")
+	if !ok {
+		return
+	}
+	metaFD, err1 := strconv.Atoi(fd)
+	count, err2 := strconv.Atoi(n)
+	if err1 != nil || err2 != nil {
+		return
+	}
+	movedIn.meta = os.NewFile(uintptr(metaFD), "upgrade-sessions")
+	movedIn.first, movedIn.fds = metaFD+1, 2*count
+}
+
+// adoptSessions runs once this process has said it's ready. The previous
+// process then stops the sessions and says which ones are ours; sockets it
+// doesn't mention are closed.
+func adoptSessions() {
+	if movedIn.meta == nil {
+		return
+	}
+	var list []movedSession
+	err := json.NewDecoder(movedIn.meta).Decode(&list)
+	movedIn.meta.Close()
+	if err != nil {
+		warnf("no sessions from the previous process: %v", err)
+	}
+	files := make([]*os.File, movedIn.fds)
+	for i := range files {
+		files[i] = os.NewFile(uintptr(movedIn.first+i), "upgrade-session")
+	}
+	adopted := 0
+	for _, ms := range list {
+		if ms.Index < 0 || 2*ms.Index+1 >= len(files) {
+			continue
+		}
+		if adoptSession(ms, files[2*ms.Index], files[2*ms.Index+1]) {
+			adopted++
+		}
+		files[2*ms.Index], files[2*ms.Index+1] = nil, nil
+	}
+	for _, f := range files {
+		if f != nil {
+			f.Close()
+		}
+	}
+	if len(list) > 0 {
+		infof("carrying on %d sessions from the previous process\n", adopted)
+	}
+}
+
+func adoptSession(ms movedSession, cf, tf *os.File) bool {
+	client, err := net.FileConn(cf)
+	cf.Close()
+	if err != nil {
+		tf.Close()
+		warnf("[%s] lost in the upgrade: %v", ms.ID, err)
+		return false
+	}
+	target, err := net.FileConn(tf)
+	tf.Close()
+	if err != nil {
+		client.Close()
+		warnf("[%s] lost in the upgrade: %v", ms.ID, err)
+		return false
+	}
+	s := &session{
+		id: ms.ID, tenant: ms.Tenant, client: client, target: target, ip: ms.IP,
+		backend: ms.Backend, route: ms.Route, start: ms.Start, tags: ms.Tags,
+	}
+	s.bytesIn.Store(ms.BytesIn)
+	s.bytesOut.Store(ms.BytesOut)
+	s.geo = lookupGeo(ms.IP)
+	s.hexdump = newHexdumper(ms.ID, ms.IP)
+	s.sigs = newSigScanner()
+	s.span = startSpan("session", spanKindServer, nil)
+	s.span.setAttr("sshproxy.conn_id", ms.ID)
+	s.span.setAttr("sshproxy.backend", ms.Backend)
+	// its quota slot was granted before the upgrade
+	t := tenants[ms.Tenant]
+	if t != nil {
+		t.active.Add(1)
+	}
+	sessionsMu.Lock()
+	sessions[s] = struct{}{}
+	n := len(sessions)
+	sessionsMu.Unlock()
+	checkCapacity(n)
+	debugf("[%s] carrying on the session from %s\n", ms.ID, anonIP(ms.IP))
+	go func() {
+		defer reportPanic()
+		defer client.Close()
+		defer s.span.end()
+		if t != nil {
+			defer t.release()
+		}
+		defer untrackSession(s)
+		defer target.Close()
+		pipeSession(s, client, target)
+	}()
+	return true
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Generic webhooks render each embed through an operator-supplied
+// text/template and POST the result, so feeding another chat system or an
+// automation tool is a config change rather than a new notifier.
+
+// defaultWebhookTemplate is used when a webhook has no template of its own.
+const defaultWebhookTemplate = `{"kind":{{json .Kind}},"category":{{json .Category}},"severity":{{json .Severity}},"title":{{json .Title}},"description":{{json .Description}},"color":{{.Color}},"timestamp":{{json .Timestamp}},"fields":{{json .Fields}}}`
+
+type webhookTemplateData struct {
+	Kind        string
+	Category    string
+	Severity    string
+	Title       string
+	Description string
+	Color       int
+	Timestamp   string
+	Fields      map[string]string
+}
+
+var (
+	webhookTemplatesMu sync.Mutex
+	webhookTemplates   = map[string]*template.Template{}
+)
+
+var webhookFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"upper":      strings.ToUpper,
+	"lower":      strings.ToLower,
+	"humanBytes": formatBytes,
+}
+
+func parseWebhookTemplate(c WebhookConfig) (*template.Template, error) {
+	text := c.Template
+	if text == "" {
+		text = defaultWebhookTemplate
+	}
+	return template.New(c.Name).Funcs(webhookFuncs).Option("missingkey=zero").Parse(text)
+}
+
+func webhookConfig(name string) (WebhookConfig, bool) {
+	for _, c := range conf().Notify.Webhooks {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return WebhookConfig{}, false
+}
+
+func webhookTemplate(c WebhookConfig) (*template.Template, error) {
+	webhookTemplatesMu.Lock()
+	defer webhookTemplatesMu.Unlock()
+	if t, ok := webhookTemplates[c.Name]; ok {
+		return t, nil
+	}
+	t, err := parseWebhookTemplate(c)
+	if err != nil {
+		return nil, err
+	}
+	webhookTemplates[c.Name] = t
+	return t, nil
+}
+
+// resetWebhookTemplates drops the cached templates, so a reloaded webhook
+// template is used for the next post.
+func resetWebhookTemplates() {
+	webhookTemplatesMu.Lock()
+	webhookTemplates = map[string]*template.Template{}
+	webhookTemplatesMu.Unlock()
+}
+
+// errBadWebhookBody marks a render failure; retrying won't fix the template.
+var errBadWebhookBody = &webhookStatusError{code: http.StatusBadRequest, status: "template did not render valid JSON"}
+
+func postWebhook(name, url string, embeds []DiscordEmbed) (time.Duration, error) {
+	c, ok := webhookConfig(name)
+	if !ok {
+		warnf("dropping notification for webhook %q, it is no longer configured", name)
+		return 0, nil
+	}
+	t, err := webhookTemplate(c)
+	if err != nil {
+		return 0, err
+	}
+	e := embeds[0]
+	kind := embedKind(strings.TrimSuffix(e.Title, " (summary)"))
+	data := webhookTemplateData{
+		Kind:        kind,
+		Category:    embedCategory(kind),
+		Severity:    embedSeverity(kind),
+		Title:       e.Title,
+		Description: e.Description,
+		Color:       e.Color,
+		Timestamp:   e.Timestamp,
+		Fields:      map[string]string{},
+	}
+	for _, f := range e.Fields {
+		data.Fields[f.Name] = f.Value
+	}
+	var body bytes.Buffer
+	if err := t.Execute(&body, data); err != nil {
+		warnf("webhook %s: failed to render template: %v", name, err)
+		return 0, errBadWebhookBody
+	}
+	if !json.Valid(body.Bytes()) {
+		warnf("webhook %s: template did not render valid JSON: %s", name, clip(body.String(), 200))
+		return 0, errBadWebhookBody
+	}
+	header := http.Header{}
+	for k, v := range c.Headers {
+		header.Set(k, v)
+	}
+	if c.Secret != "" {
+		signWebhook(header, c.Secret, body.Bytes())
+	}
+	return postJSON(url, body.Bytes(), header)
+}
+
+// signWebhook adds an HMAC-SHA256 signature over "<timestamp>.<body>", the
+// same scheme Stripe and Slack use. Receivers should recompute it, compare
+// in constant time and reject timestamps outside their replay window (a
+// few minutes). The timestamp is taken per attempt, so retries carry a
+// fresh one.
+func signWebhook(header http.Header, secret string, body []byte) {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	header.Set("X-Signature-Timestamp", ts)
+	header.Set("X-Signature", "sha256="+hex.EncodeToString(hmacSHA256([]byte(secret), ts+"."+string(body))))
+}
+
+// loadWebhooks reads template files into place and checks each webhook's
+// settings, so a bad template fails at startup rather than at the first
+// alert.
+func loadWebhooks(hooks []WebhookConfig) error {
+	seen := map[string]bool{}
+	for i := range hooks {
+		c := &hooks[i]
+		if c.Name == "" {
+			return fmt.Errorf("notify.webhooks[%d]: name is required", i)
+		}
+		if seen[c.Name] {
+			return fmt.Errorf("notify.webhooks: duplicate name %q", c.Name)
+		}
+		seen[c.Name] = true
+		if !strings.HasPrefix(c.URL, "http://") && !strings.HasPrefix(c.URL, "https://") {
+			return fmt.Errorf("notify.webhooks.%s: url must be an http(s) URL", c.Name)
+		}
+		if !validSeverity(c.MinSeverity) {
+			return fmt.Errorf("notify.webhooks.%s.min_severity must be debug, info, warning or critical, got %q", c.Name, c.MinSeverity)
+		}
+		if c.TemplateFile != "" {
+			data, err := os.ReadFile(c.TemplateFile)
+			if err != nil {
+				return fmt.Errorf("notify.webhooks.%s: %v", c.Name, err)
+			}
+			c.Template = string(data)
+		}
+		if _, err := parseWebhookTemplate(*c); err != nil {
+			return fmt.Errorf("notify.webhooks.%s: %v", c.Name, err)
+		}
+		for _, key := range c.Events {
+			if !knownEmbedKey(key) {
+				return fmt.Errorf("notify.webhooks.%s.events: unknown category or embed type %q", c.Name, key)
+			}
+		}
+	}
+	return nil
+}
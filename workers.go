@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// With workers.count above 1, the process started by hand (or by systemd)
+// becomes a supervisor. It binds workers.count SO_REUSEPORT sockets per
+// proxy address, so the kernel spreads connections over them, and starts
+// the executable once per worker with one socket of each. It holds on to
+// the sockets itself, so connections queued for a worker that crashed wait
+// for its replacement instead of being refused.
+//
+// Workers are numbered from 1. The first one also runs everything there
+// can only be one of: the admin API, control socket, bot, audit log and
+// the jobs that alert or report on totals. The others follow its bans
+// through the state file.
+
+const (
+	workerEnv = "SSHPROXY_WORKER"
+
+	workerBackoffMax = 30 * time.Second
+	// a worker that stayed up this long starts its backoff over
+	workerStableAfter = time.Minute
+)
+
+// workerIndex is this process's worker number, or 0 outside worker mode
+// and in the supervisor.
+var workerIndex int
+
+// setupWorker is called as soon as the config is loaded.
+func setupWorker() {
+	n, _ := strconv.Atoi(os.Getenv(workerEnv))
+	if n <= 0 {
+		return
+	}
+	workerIndex = n
+	log.SetPrefix(fmt.Sprintf("worker %d: ", n))
+	log.SetFlags(log.Flags() | log.Lmsgprefix)
+	workerOverrides(conf())
+}
+
+// workerOverrides turns off what a worker mustn't do. log.file belongs to
+// the supervisor, which writes what the workers print to it. History
+// pruning rewrites the file every worker appends to. Past the first
+// worker, anything that listens on a fixed address or alerts on its own
+// totals is left to the first.
+func workerOverrides(c *Config) {
+	if workerIndex == 0 {
+		return
+	}
+	c.Log.File = ""
+	c.Daemon.PIDFile = ""
+	c.History.Retention = Duration{}
+	if workerIndex == 1 {
+		return
+	}
+	c.Admin.Listen, c.Admin.GRPCListen = "", ""
+	c.DiscordBot.Listen = ""
+	c.Control.Socket = ""
+	c.Audit.File = ""
+	c.Heartbeat.Interval = Duration{}
+	c.Digest.Interval = Duration{}
+	c.Inactivity.AlertAfter = Duration{}
+	c.Anomaly.Factor, c.Anomaly.ZScore = 0, 0
+	c.TopTalkers.Schedule = ""
+	c.StatsD.Address = ""
+	c.OTLPMetrics.Endpoint = ""
+	c.Autoscale.Up, c.Autoscale.Down = ScaleHookConfig{}, ScaleHookConfig{}
+	c.Failover.Role = ""
+}
+
+// followBans replaces this worker's bans with the ones in the state file
+// every save_interval, so bans and unbans made on the first worker reach
+// the others, and closes the sessions of newly banned clients.
+func followBans(c StateConfig) {
+	tick := time.NewTicker(c.SaveInterval.Duration)
+	defer tick.Stop()
+	for range tick.C {
+		data, err := os.ReadFile(c.File)
+		if err != nil {
+			continue
+		}
+		var st savedState
+		if err := json.Unmarshal(data, &st); err != nil {
+			continue
+		}
+		if st.Bans == nil {
+			st.Bans = map[string]time.Time{}
+		}
+		added := map[string]bool{}
+		bansMu.Lock()
+		for ip := range st.Bans {
+			if _, ok := bans[ip]; !ok {
+				added[ip] = true
+			}
+		}
+		bans = st.Bans
+		bansMu.Unlock()
+		if len(added) == 0 {
+			continue
+		}
+		for _, s := range activeSessions() {
+			if added[s.ip] {
+				s.close("banned")
+			}
+		}
+	}
+}
+
+type worker struct {
+	n int
+	// sockets are what the worker is handed, by the key it asks for
+	sockets map[string]net.Listener
+	proc    *os.Process
+	started time.Time
+	backoff time.Duration
+}
+
+type workerExit struct {
+	w   *worker
+	err error
+}
+
+// start runs the worker and waits for it to say it's up. Its output goes
+// to the supervisor's log a line at a time.
+func (w *worker) start(exits chan<- workerExit) error {
+	out, outW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	go relayWorkerOutput(out)
+	cmd, exited, err := spawnWith(w.sockets, func(cmd *exec.Cmd) {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d", workerEnv, w.n), "NOTIFY_SOCKET=", "WATCHDOG_USEC=")
+		cmd.Stdout, cmd.Stderr = outW, outW
+	})
+	outW.Close()
+	if err != nil {
+		return err
+	}
+	w.proc, w.started = cmd.Process, time.Now()
+	go func() { exits <- workerExit{w, <-exited} }()
+	return nil
+}
+
+func relayWorkerOutput(r io.ReadCloser) {
+	defer r.Close()
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		log.Writer().Write(append(sc.Bytes(), '\n'))
+	}
+}
+
+// stopSupervisor cleans up once no worker is left running and exits.
+func stopSupervisor() {
+	infof("all workers stopped, exiting\n")
+	removePIDFile()
+	flushNotifications()
+	os.Exit(0)
+}
+
+// runSupervisor starts and minds the workers. It doesn't return.
+func runSupervisor(listenAddr string) {
+	n := conf().Workers.Count
+	if _, err := listenAcceptors(listenAddr); err != nil {
+		log.Fatalf("failed to listen on %s: %v", listenAddr, err)
+	}
+	proxyKeys := map[string]bool{"tcp:" + listenAddr: true}
+	for _, t := range conf().Tenants {
+		if _, err := listenAcceptors(t.Listen); err != nil {
+			warnf("tenant %s: %v", t.Name, err)
+			continue
+		}
+		proxyKeys["tcp:"+t.Listen] = true
+	}
+
+	workers := make([]*worker, n)
+	for i := range workers {
+		workers[i] = &worker{n: i + 1, sockets: map[string]net.Listener{}}
+	}
+	listenersMu.Lock()
+	// whatever daemon mode bound for the admin API and the like is the
+	// first worker's
+	for key, l := range inherited {
+		listeners[key] = l
+	}
+	inherited = map[string]net.Listener{}
+	for key, l := range listeners {
+		base, idx, _ := strings.Cut(key, "#")
+		if !proxyKeys[base] {
+			workers[0].sockets[key] = l
+			continue
+		}
+		i, _ := strconv.Atoi(idx)
+		workers[i].sockets[base] = l
+	}
+	listenersMu.Unlock()
+
+	exits := make(chan workerExit)
+	var running atomic.Int32
+	for _, w := range workers {
+		if err := w.start(exits); err != nil {
+			for _, w := range workers {
+				if w.proc != nil {
+					w.proc.Signal(syscall.SIGTERM)
+				}
+			}
+			log.Fatalf("worker %d didn't start: %v", w.n, err)
+		}
+		running.Add(1)
+	}
+	infof("supervising %d workers on %s\n", n, listenAddr)
+	listenersReady()
+	go runWatchdog(func(time.Duration) error {
+		if running.Load() == 0 {
+			return fmt.Errorf("no worker is running")
+		}
+		return nil
+	})
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt, syscall.SIGHUP)
+	usr2, _ := sigusr2()
+	for _, sig := range []func() (os.Signal, bool){sigusr1, sigusr2} {
+		if s, ok := sig(); ok {
+			signal.Notify(sigs, s)
+		}
+	}
+	restart := make(chan *worker)
+	stopping := false
+	for {
+		select {
+		case sig := <-sigs:
+			switch {
+			case sig == syscall.SIGTERM || sig == os.Interrupt:
+				if !stopping {
+					stopping = true
+					infof("received %v, stopping the workers\n", sig)
+					sdNotify("STOPPING=1")
+				}
+				if running.Load() == 0 {
+					// every worker is waiting out its restart backoff
+					stopSupervisor()
+				}
+				for _, w := range workers {
+					if w.proc != nil {
+						w.proc.Signal(syscall.SIGTERM)
+					}
+				}
+			case sig == usr2:
+				warnf("upgrades aren't supported with workers, restart the supervisor instead")
+			default:
+				infof("received %v, passing it on to the workers\n", sig)
+				for _, w := range workers {
+					if w.proc != nil {
+						w.proc.Signal(sig)
+					}
+				}
+			}
+		case e := <-exits:
+			w := e.w
+			pid := w.proc.Pid
+			w.proc = nil
+			running.Add(-1)
+			if stopping {
+				if running.Load() == 0 {
+					stopSupervisor()
+				}
+				continue
+			}
+			uptime := time.Since(w.started).Round(time.Second)
+			if uptime >= workerStableAfter {
+				w.backoff = 0
+			}
+			w.backoff = min(max(2*w.backoff, time.Second), workerBackoffMax)
+			reason := "exited"
+			if e.err != nil {
+				reason = e.err.Error()
+			}
+			errorf("worker %d (pid %d) stopped after %s: %s, restarting in %s\n", w.n, pid, uptime, reason, w.backoff)
+			if err := sendAlert(alertVars{"worker": w.n, "pid": pid, "reason": reason, "uptime": uptime}, "Worker Exited",
+				fmt.Sprintf("Worker %d (pid %d) stopped after %s: %s; restarting it in %s", w.n, pid, uptime, reason, w.backoff), 0xFF0000); err != nil {
+				warnf("Failed to send Discord embed: %v", err)
+			}
+			time.AfterFunc(w.backoff, func() { restart <- w })
+		case w := <-restart:
+			if stopping {
+				continue
+			}
+			if err := w.start(exits); err != nil {
+				w.backoff = min(2*w.backoff, workerBackoffMax)
+				errorf("worker %d didn't start: %v, trying again in %s\n", w.n, err, w.backoff)
+				time.AfterFunc(w.backoff, func() { restart <- w })
+				continue
+			}
+			running.Add(1)
+			infof("worker %d restarted as pid %d\n", w.n, w.proc.Pid)
+		}
+	}
+}